@@ -0,0 +1,79 @@
+// apcore is a server framework for implementing an ActivityPub application.
+// Copyright (C) 2019 Cory Slep
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package apcore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMEManager creates the manager obtaining and renewing the certificate of
+// the host from an ACME certificate authority, such as Let's Encrypt.
+//
+// Certificates are renewed in the background, and stored in the cache
+// directory so restarts do not request new ones.
+func newACMEManager(c *config) (m *autocert.Manager, err error) {
+	sc := c.ServerConfig
+	if len(sc.ACMECacheDirectory) == 0 {
+		err = fmt.Errorf("sr_acme_cache_directory is not set")
+		return
+	}
+	client := &acme.Client{
+		DirectoryURL: sc.ACMEDirectoryURL,
+	}
+	// Test certificate authorities such as Pebble serve their directory
+	// with a certificate signed by their own root.
+	if len(sc.ACMEDirectoryCAFile) > 0 {
+		var b []byte
+		if b, err = ioutil.ReadFile(sc.ACMEDirectoryCAFile); err != nil {
+			return
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			err = fmt.Errorf("no PEM certificates in sr_acme_directory_ca_file %q", sc.ACMEDirectoryCAFile)
+			return
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		}
+	}
+	m = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(sc.ACMECacheDirectory),
+		HostPolicy: autocert.HostWhitelist(sc.Host),
+		Client:     client,
+		Email:      sc.ACMEEmail,
+	}
+	return
+}
+
+// acmeTLSConfig serves the certificates of the manager, answering TLS-ALPN-01
+// challenges on the HTTPS server.
+func acmeTLSConfig(m *autocert.Manager) *tls.Config {
+	t := createTlsConfig()
+	t.GetCertificate = m.GetCertificate
+	t.NextProtos = []string{"http/1.1", acme.ALPNProto}
+	return t
+}
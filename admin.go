@@ -16,19 +16,25 @@
 
 package apcore
 
-func promptAdminUser() (username, email, password string, err error) {
+func promptAdminUser() (username, email, password string, mfaRequired bool, err error) {
 	username, err = promptStringWithDefault(
+		"admin_username",
 		"Enter the new admin account's username",
 		"")
 	if err != nil {
 		return
 	}
 	email, err = promptStringWithDefault(
+		"admin_email",
 		"Enter the new admin account's email address (will NOT be verified)",
 		"")
 	if err != nil {
 		return
 	}
-	password, err = promptPassword("Enter the new admin account's password")
+	password, err = promptPassword("admin_password", "Enter the new admin account's password")
+	if err != nil {
+		return
+	}
+	mfaRequired, err = promptYN("admin_mfa_required", "Require the new admin account to enroll in multi-factor authentication (TOTP) at its first login?")
 	return
 }
@@ -56,19 +56,95 @@ func (s *socialBehavior) AuthenticatePostOutbox(c context.Context, w http.Respon
 	if err != nil || !authenticated {
 		return
 	}
-	// Authenticated, but must determine if permitted by the granted scope.
-	authenticated, err = s.app.ScopePermitsPostOutbox(t.GetScope())
+	// Authenticated, but must determine if the token is the outbox owner's
+	// and permitted by the granted scope.
+	if authenticated, err = tokenOwnsBox(c, t); err != nil || !authenticated {
+		return
+	}
+	authenticated = scopeGrants(t.GetScope(), ScopeWriteOutbox)
 	return
 }
 
 func (s *socialBehavior) Callbacks(c context.Context) (wrapped pub.SocialWrappedCallbacks, other []interface{}, err error) {
-	wrapped = pub.SocialWrappedCallbacks{}
+	wrapped = pub.SocialWrappedCallbacks{
+		Block: s.onBlock,
+		Undo:  s.onUndo,
+	}
 	other = s.app.ApplySocialCallbacks(&wrapped)
 	return
 }
 
+// onBlock records the blocks of the user posting to their outbox.
+func (s *socialBehavior) onBlock(c context.Context, block vocab.ActivityStreamsBlock) error {
+	ctx := ctx{c}
+	userId, err := ctx.UserPathUUID()
+	if err != nil {
+		return err
+	}
+	activityIRI, err := pub.GetId(block)
+	if err != nil {
+		return err
+	}
+	op := block.GetActivityStreamsObject()
+	if op == nil || op.Len() == 0 {
+		return fmt.Errorf("block has no object")
+	}
+	for iter := op.Begin(); iter != op.End(); iter = iter.Next() {
+		id, err := pub.ToId(iter)
+		if err != nil {
+			return err
+		}
+		if err = s.db.Block(c, userId, id, activityIRI); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// onUndo removes the blocks undone by the user posting to their outbox.
+func (s *socialBehavior) onUndo(c context.Context, undo vocab.ActivityStreamsUndo) error {
+	ctx := ctx{c}
+	userId, err := ctx.UserPathUUID()
+	if err != nil {
+		return err
+	}
+	op := undo.GetActivityStreamsObject()
+	if op == nil {
+		return nil
+	}
+	for iter := op.Begin(); iter != op.End(); iter = iter.Next() {
+		// Only Blocks, or references to them, are handled here.
+		if t := iter.GetType(); t != nil && t.GetTypeName() != "Block" {
+			continue
+		}
+		id, err := pub.ToId(iter)
+		if err != nil {
+			return err
+		}
+		if err = s.db.UndoBlock(c, userId, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *socialBehavior) DefaultCallback(c context.Context, activity pub.Activity) error {
 	ctx := ctx{c}
+	if flag, ok := activity.(vocab.ActivityStreamsFlag); ok {
+		if ctx.reportRecorded() {
+			return nil
+		}
+		r, err := newReportFromFlag(flag)
+		if err != nil {
+			return err
+		}
+		if r.ReporterUserId, err = ctx.UserPathUUID(); err != nil {
+			return err
+		}
+		// Addressed Flags are delivered to the reported actor's instance.
+		r.Forward = flag.GetActivityStreamsTo() != nil || flag.GetActivityStreamsCc() != nil
+		return s.db.InsertReport(c, r)
+	}
 	t, err := ctx.ActivityType()
 	if err != nil {
 		return err
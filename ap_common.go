@@ -18,7 +18,6 @@ package apcore
 
 import (
 	"context"
-	"crypto/rsa"
 	"net/http"
 	"net/url"
 
@@ -67,16 +66,15 @@ func (a *commonBehavior) AuthenticateGetInbox(c context.Context, w http.Response
 	if !oAuthAuthenticated {
 		return
 	}
-	// Determine if private access permitted by the granted scope.
-	var ok bool
-	ok, err = a.app.ScopePermitsPrivateGetInbox(t.GetScope())
-	if err != nil {
+	// Private access is permitted only to the box owner, by the granted
+	// scope.
+	var owner bool
+	if owner, err = tokenOwnsBox(c, t); err != nil {
 		return
-	} else {
-		ctx := &ctx{c}
-		ctx.SetPrivateScope(ok)
-		newCtx = ctx.Context
 	}
+	ctx := &ctx{c}
+	ctx.SetPrivateScope(owner && scopeGrants(t.GetScope(), ScopeReadInbox))
+	newCtx = ctx.Context
 	return
 }
 
@@ -95,16 +93,27 @@ func (a *commonBehavior) AuthenticateGetOutbox(c context.Context, w http.Respons
 	if !oAuthAuthenticated {
 		return
 	}
-	// Determine if private access permitted by the granted scope.
-	var ok bool
-	ok, err = a.app.ScopePermitsPrivateGetOutbox(t.GetScope())
-	if err != nil {
+	// Private access is permitted only to the box owner, by the granted
+	// scope.
+	var owner bool
+	if owner, err = tokenOwnsBox(c, t); err != nil {
+		return
+	}
+	ctx := &ctx{c}
+	ctx.SetPrivateScope(owner && scopeGrants(t.GetScope(), ScopeReadOutbox))
+	newCtx = ctx.Context
+	return
+}
+
+// tokenOwnsBox determines whether the token was granted by the user whose box
+// is being accessed.
+func tokenOwnsBox(c context.Context, t oauth2.TokenInfo) (ok bool, err error) {
+	ctx := ctx{c}
+	var owner string
+	if owner, err = ctx.UserPathUUID(); err != nil {
 		return
-	} else {
-		ctx := &ctx{c}
-		ctx.SetPrivateScope(ok)
-		newCtx = ctx.Context
 	}
+	ok = len(t.GetUserID()) > 0 && t.GetUserID() == owner
 	return
 }
 
@@ -131,17 +140,5 @@ func (a *commonBehavior) NewTransport(c context.Context, actorBoxIRI *url.URL, g
 	if err != nil {
 		return
 	}
-	var privKey *rsa.PrivateKey
-	var kUUID string
-	kUUID, privKey, err = a.db.GetUserPKey(c, userUUID)
-	if err != nil {
-		return
-	}
-	var pubKeyURL *url.URL
-	pubKeyURL, err = a.p.PublicKeyPath(userUUID, kUUID)
-	if err != nil {
-		return
-	}
-	pubKeyId := pubKeyURL.String()
-	return a.tc.Get(privKey, pubKeyId)
+	return a.tc.ForUser(c, a.p, userUUID)
 }
@@ -50,13 +50,20 @@ func newFederatingBehavior(c *config, a Application, p *paths, db *database, tc
 func (f *federatingBehavior) PostInboxRequestBodyHook(c context.Context, r *http.Request, activity pub.Activity) (out context.Context, err error) {
 	ctx := &ctx{c}
 	ctx.withActivityStreamsValue(activity)
+	ctx.withActivity(activity)
 	out = ctx.Context
 	return
 }
 
 func (f *federatingBehavior) AuthenticatePostInbox(c context.Context, w http.ResponseWriter, r *http.Request) (out context.Context, authenticated bool, err error) {
-	authenticated, err = verifyHttpSignatures(c, r, f.p, f.db, f.tc)
 	out = c
+	var actorIRI *url.URL
+	if authenticated, actorIRI, err = verifyHttpSignatures(c, r, f.p, f.db, f.tc); err != nil || !authenticated {
+		return
+	}
+	ctx := &ctx{c}
+	ctx.withSignedActorIRI(actorIRI)
+	out = ctx.Context
 	return
 }
 
@@ -74,19 +81,40 @@ func (f *federatingBehavior) Blocked(c context.Context, actorIRIs []*url.URL) (b
 	if activityType, err = ctx.ActivityType(); err != nil {
 		return
 	}
-	// 1. Get Policies For Instance
+	// 1. Honor the blocks of the user, which are not recorded as
+	// resolutions.
+	for _, actorIRI := range actorIRIs {
+		if blocked, err = f.db.IsBlocking(c, targetUserId, actorIRI); err != nil || blocked {
+			return
+		}
+	}
+	// 2. Get Policies For Instance
 	var ip policies
 	if ip, err = f.db.InstancePolicies(c); err != nil {
 		return
 	}
-	// 2. Get This Actor's Policies
+	// 3. Get This Actor's Policies
 	var ap policies
 	if ap, err = f.db.UserPolicies(c, targetUserId); err != nil {
 		return
 	}
-	// 3. Apply policies -- instance first
+	// 4. Apply policies -- instance first
 	p := append(ip, ap...)
-	blocked, err = p.IsBlocked(c, f.db, targetUserId, actorIRIs, activityIRI, activityType)
+	var applied []action
+	blocked, applied, err = p.IsBlocked(c, f.db, targetUserId, actorIRIs, activityIRI, activityType)
+	if err != nil || blocked {
+		return
+	}
+	// 5. Apply moderation actions. Silenced activities are hidden from
+	// public collections by their recorded resolutions.
+	if containsAction(applied, rejectMedia) {
+		var activity pub.Activity
+		if activity, err = ctx.Activity(); err != nil {
+			return
+		}
+		InfoLogger.Infof("Rejecting media of federated Activity: %s", activityIRI)
+		stripAttachments(activity)
+	}
 	return
 }
 
@@ -113,6 +141,22 @@ func (f *federatingBehavior) DefaultCallback(c context.Context, activity pub.Act
 	if err != nil {
 		return err
 	}
+	if flag, ok := activity.(vocab.ActivityStreamsFlag); ok {
+		var r Report
+		if r, err = newReportFromFlag(flag); err != nil {
+			return err
+		}
+		// Only the signer can report as itself.
+		var signer *url.URL
+		if signer, err = ctx.SignedActorIRI(); err != nil {
+			return err
+		} else if signer.String() != r.ReporterIRI.String() {
+			InfoLogger.Infof("Ignoring federated Flag whose actor %s is not its signer %s: %s", r.ReporterIRI, signer, activityIRI)
+			return nil
+		}
+		InfoLogger.Infof("Adding report to moderation queue from federated Flag: %s", activityIRI)
+		return f.db.InsertReport(c, r)
+	}
 	InfoLogger.Infof("Nothing to do for federated Activity of type %q: %s", activityType, activityIRI)
 	return nil
 }
@@ -133,13 +177,18 @@ func (f *federatingBehavior) FilterForwarding(c context.Context, potentialRecipi
 		return
 	}
 	// Here we limit to only allow forwarding to the target user's
-	// followers.
+	// followers that the user is not blocking.
 	var fc vocab.ActivityStreamsCollection
 	fc, err = f.db.FollowersByUserUUID(c, userUUID)
 	if err != nil {
 		return
 	}
-	allowedRecipients := make(map[*url.URL]bool, 0)
+	var rs []Relationship
+	if rs, err = f.db.Relationships(c, userUUID); err != nil {
+		return
+	}
+	bs := newBlockSet(rs)
+	allowedRecipients := make(map[string]bool, 0)
 	items := fc.GetActivityStreamsItems()
 	if items != nil {
 		for iter := items.Begin(); iter != items.End(); iter = iter.Next() {
@@ -148,11 +197,11 @@ func (f *federatingBehavior) FilterForwarding(c context.Context, potentialRecipi
 			if err != nil {
 				return
 			}
-			allowedRecipients[id] = true
+			allowedRecipients[id.String()] = !bs.blocking(id)
 		}
 	}
 	for _, elem := range potentialRecipients {
-		if has, ok := allowedRecipients[elem]; ok && has {
+		if has, ok := allowedRecipients[elem.String()]; ok && has {
 			filteredRecipients = append(filteredRecipients, elem)
 		}
 	}
@@ -26,6 +26,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/go-fed/activity/pub"
 	"github.com/go-fed/activity/streams"
@@ -41,12 +42,26 @@ type publicKeyer interface {
 	GetW3IDSecurityV1PublicKey() vocab.W3IDSecurityV1PublicKeyProperty
 }
 
-func getPublicKeyFromResponse(c context.Context, b []byte, keyId *url.URL) (p crypto.PublicKey, err error) {
+func isActivityStreamsGet(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/activity+json") ||
+		strings.Contains(accept, "application/ld+json")
+}
+
+func getPublicKeyFromResponse(c context.Context, b []byte, keyId *url.URL) (p crypto.PublicKey, owner *url.URL, err error) {
 	m := make(map[string]interface{}, 0)
 	err = json.Unmarshal(b, &m)
 	if err != nil {
 		return
 	}
+	// Tombstones of deleted actors keep their publicKey until their Delete
+	// has been delivered, so are read as their former type.
+	if ft, ok := m["formerType"].(string); ok && m["type"] == "Tombstone" && m["publicKey"] != nil {
+		m["type"] = ft
+	}
 	var t vocab.Type
 	t, err = streams.ToType(c, m)
 	if err != nil {
@@ -83,6 +98,12 @@ func getPublicKeyFromResponse(c context.Context, b []byte, keyId *url.URL) (p cr
 		err = fmt.Errorf("cannot find publicKey with id: %s", keyId)
 		return
 	}
+	ownerProp := pkpFound.GetW3IDSecurityV1Owner()
+	if ownerProp == nil || !ownerProp.IsIRI() {
+		err = fmt.Errorf("owner property is not provided or it is not an IRI")
+		return
+	}
+	owner = ownerProp.GetIRI()
 	pkPemProp := pkpFound.GetW3IDSecurityV1PublicKeyPem()
 	if pkPemProp == nil || !pkPemProp.IsXMLSchemaString() {
 		err = fmt.Errorf("publicKeyPem property is not provided or it is not embedded as a value")
@@ -99,15 +120,30 @@ func getPublicKeyFromResponse(c context.Context, b []byte, keyId *url.URL) (p cr
 	return
 }
 
+// signedRequest copies the request with the Host header of this server, for
+// verifying HTTP Signatures that cover it. The server moves the header into
+// http.Request.Host, and a reverse proxy may have rewritten it.
+func signedRequest(r *http.Request, host string) *http.Request {
+	s := *r
+	s.Header = make(http.Header, len(r.Header)+1)
+	for k, v := range r.Header {
+		s.Header[k] = v
+	}
+	s.Header.Set("Host", host)
+	return &s
+}
+
+// verifyHttpSignatures verifies the HTTP Signature on a request to a local
+// user's inbox, returning the actor that owns the signing key.
 func verifyHttpSignatures(c context.Context,
 	r *http.Request,
 	p *paths,
 	db *database,
-	tc *transportController) (authenticated bool, err error) {
+	tc *transportController) (authenticated bool, actorIRI *url.URL, err error) {
 	// 1. Figure out what key we need to verify
 	ctx := ctx{c}
 	var v httpsig.Verifier
-	v, err = httpsig.NewVerifier(r)
+	v, err = httpsig.NewVerifier(signedRequest(r, p.host))
 	if err != nil {
 		return
 	}
@@ -145,12 +181,150 @@ func verifyHttpSignatures(c context.Context,
 	if err != nil {
 		return
 	}
-	pKey, err := getPublicKeyFromResponse(c, b, kIdIRI)
+	var pKey crypto.PublicKey
+	pKey, actorIRI, err = getPublicKeyFromResponse(c, b, kIdIRI)
+	if err != nil {
+		return
+	}
+	// 4. Confirm the actor claimed by the key also claims the key
+	if pKey, err = ownedPublicKey(c, tp.Dereference, kIdIRI, actorIRI, pKey); err != nil {
+		actorIRI = nil
+		return
+	}
+	// 5. Verify the other actor's key
+	algo := tc.GetFirstAlgorithm()
+	authenticated = nil == v.Verify(pKey, algo)
+	if !authenticated {
+		actorIRI = nil
+	}
+	return
+}
+
+// verifyHttpSignaturesForFetch verifies the HTTP Signature on a GET request for
+// local ActivityStreams data, returning the actor that owns the signing key.
+//
+// Unlike verifyHttpSignatures, no local user is on the receiving end of the
+// request, so the public key is fetched without signing the request. Peers in
+// secure mode serve actors and their keys without requiring a signature, just
+// as apcore does.
+func verifyHttpSignaturesForFetch(c context.Context,
+	r *http.Request,
+	host string,
+	tc *transportController) (authenticated bool, actorIRI *url.URL, err error) {
+	// 1. Figure out what key we need to verify
+	var v httpsig.Verifier
+	v, err = httpsig.NewVerifier(signedRequest(r, host))
+	if err != nil {
+		return
+	}
+	kId := v.KeyId()
+	var kIdIRI *url.URL
+	kIdIRI, err = url.Parse(kId)
+	if err != nil {
+		return
+	}
+	// 2. Fetch the public key of the other actor
+	var b []byte
+	b, err = tc.DereferenceUnsigned(c, kIdIRI)
+	if err != nil {
+		return
+	}
+	var pKey crypto.PublicKey
+	pKey, actorIRI, err = getPublicKeyFromResponse(c, b, kIdIRI)
 	if err != nil {
 		return
 	}
+	// 3. Confirm the actor claimed by the key also claims the key
+	if pKey, err = ownedPublicKey(c, tc.DereferenceUnsigned, kIdIRI, actorIRI, pKey); err != nil {
+		actorIRI = nil
+		return
+	}
 	// 4. Verify the other actor's key
 	algo := tc.GetFirstAlgorithm()
 	authenticated = nil == v.Verify(pKey, algo)
+	if !authenticated {
+		actorIRI = nil
+	}
+	return
+}
+
+// ownedPublicKey returns the public key as listed by the owner it claims. The
+// owner must be on the same host as the key and list the key as its own, so
+// that a key cannot claim an actor on another host to escape its policies.
+func ownedPublicKey(c context.Context,
+	deref func(context.Context, *url.URL) ([]byte, error),
+	keyId, owner *url.URL,
+	p crypto.PublicKey) (op crypto.PublicKey, err error) {
+	if owner.Host != keyId.Host {
+		err = fmt.Errorf("public key %s claims owner %s on another host", keyId, owner)
+		return
+	}
+	// Keys embedded in the owner were already listed by it.
+	doc := *keyId
+	doc.Fragment = ""
+	if doc.String() == owner.String() {
+		op = p
+		return
+	}
+	var b []byte
+	if b, err = deref(c, owner); err != nil {
+		return
+	}
+	var listedOwner *url.URL
+	if op, listedOwner, err = getPublicKeyFromResponse(c, b, keyId); err != nil {
+		err = fmt.Errorf("owner %s does not list public key %s: %s", owner, keyId, err)
+		return
+	} else if listedOwner.String() != owner.String() {
+		err = fmt.Errorf("owner %s lists public key %s as owned by %s", owner, keyId, listedOwner)
+	}
+	return
+}
+
+type attachmenter interface {
+	SetActivityStreamsAttachment(vocab.ActivityStreamsAttachmentProperty)
+}
+
+// stripAttachments removes the attachments of the activity and of any objects
+// embedded within it.
+func stripAttachments(activity pub.Activity) {
+	if a, ok := activity.(attachmenter); ok {
+		a.SetActivityStreamsAttachment(nil)
+	}
+	op := activity.GetActivityStreamsObject()
+	if op == nil {
+		return
+	}
+	for iter := op.Begin(); iter != op.End(); iter = iter.Next() {
+		if t := iter.GetType(); t != nil {
+			if a, ok := t.(attachmenter); ok {
+				a.SetActivityStreamsAttachment(nil)
+			}
+		}
+	}
+}
+
+// isPublicPayload determines whether a serialized activity is addressed to
+// the public collection.
+func isPublicPayload(b []byte) (public bool, err error) {
+	var m map[string]interface{}
+	if err = json.Unmarshal(b, &m); err != nil {
+		return
+	}
+	for _, k := range []string{"to", "cc", "bto", "bcc", "audience"} {
+		switch v := m[k].(type) {
+		case string:
+			public = pub.IsPublic(v)
+		case []interface{}:
+			for _, elem := range v {
+				if s, ok := elem.(string); ok && pub.IsPublic(s) {
+					public = true
+					break
+				}
+			}
+		}
+		if public {
+			return
+		}
+	}
 	return
 }
@@ -64,7 +64,8 @@ type Application interface {
 	//
 	// This configuration object is intended to be stable for the lifetime
 	// of a running application. When the command to "serve" is given, this
-	// function is only called once during application initialization.
+	// function is called during application initialization and whenever
+	// the configuration is reloaded.
 	//
 	// The command to "configure" will append these defaults to the guided
 	// flow. Admins will then be able to inspect the file and modify the
@@ -80,9 +81,23 @@ type Application interface {
 	//
 	// This configuration object is intended to be stable for the lifetime
 	// of a running application. When the command to serve, is given, this
-	// function is only called once during application initialization.
+	// function is only called once during application initialization. To
+	// accept changes when the configuration is reloaded, implement
+	// ConfigurationReloader.
 	SetConfiguration(interface{}) error
 
+	// Scopes returns the OAuth2 scopes the application defines in addition
+	// to the built-in ScopeReadInbox, ScopeReadOutbox, ScopeWriteOutbox,
+	// and ScopeAdmin. Their descriptions are shown to users when asked to
+	// consent to a client, and routes can require them with RequireScopes.
+	//
+	// Scope names must be unique and cannot contain spaces.
+	Scopes() []Scope
+
+	// Mailer returns the mailer used to send verification and password
+	// reset emails, or nil to use the one configured in the mail section.
+	Mailer() Mailer
+
 	// Whether this application supports ActivityPub's C2S protocol, or the
 	// Social API.
 	//
@@ -113,6 +128,9 @@ type Application interface {
 	BadRequestHandler() http.Handler
 
 	// Web handlers for the application server
+	//
+	// Every form these handlers render must include the CSRF token of the
+	// request, such as with CSRFField, or its POST is rejected.
 
 	// Web handler for a GET call to the login page.
 	//
@@ -120,15 +138,56 @@ type Application interface {
 	//
 	// If the URL contains a query parameter "login_error" with a value of
 	// "true", then it should convey to the user that the email or password
-	// previously entered was incorrect.
+	// previously entered was incorrect. If it contains "unverified" with a
+	// value of "true", then the user must first verify their email, and
+	// may request a new link by POSTing VerifyEmailFormEmailKey to the
+	// "/verify-email" endpoint. The query parameters "verified",
+	// "verify_error", "verification_sent", and "reset" with a value of
+	// "true" report the result of verifying an email, requesting a new
+	// link, and resetting a password.
 	GetLoginWebHandlerFunc() http.HandlerFunc
+	// Web handler for the second step of logging in, for users with
+	// multi-factor authentication.
+	//
+	// Unless the step contains recovery codes, it should render a page
+	// that POSTs a TOTP or recovery code to the "/login/mfa" endpoint. If
+	// the step contains an enrollment, the user must first add it to their
+	// authenticator app, and only a TOTP code is accepted.
+	//
+	// If the URL contains a query parameter "mfa_error" with a value of
+	// "true", then it should convey to the user that the code previously
+	// entered was incorrect.
+	GetLoginMFAWebHandlerFunc() func(w http.ResponseWriter, r *http.Request, step MFAStep)
+	// Web handler for a GET call to the registration page, which is only
+	// served when registration is not closed.
+	//
+	// It should render a form that POSTs the RegisterForm keys to the
+	// "/register" endpoint, including an invite code if the mode is
+	// RegistrationInviteOnly. It should convey these query parameters:
+	//   - "registered" of "true": the user must check their email.
+	//   - "register_error" of "invalid": the username, email, or password
+	//     of at least 8 characters is invalid.
+	//   - "register_error" of "taken": the username is taken.
+	//   - "register_error" of "invite": the invite code cannot be used.
+	GetRegistrationWebHandlerFunc() func(w http.ResponseWriter, r *http.Request, mode RegistrationMode)
+	// Web handler for a GET call to the password reset page.
+	//
+	// If the token is empty, it should render a form that POSTs the
+	// PasswordResetFormEmailKey to the "/reset-password" endpoint.
+	// Otherwise, it should render a form that POSTs the token and a new
+	// password. It should convey these query parameters:
+	//   - "sent" of "true": the user must check their email.
+	//   - "reset_error" of "invalid_password": the password is too short.
+	//   - "reset_error" of "invalid_token": the link is invalid or expired.
+	GetPasswordResetWebHandlerFunc() func(w http.ResponseWriter, r *http.Request, token string)
 	// Web handler for a GET call to the OAuth2 authorization page.
 	//
-	// It should render UX that informs the user that the other application
-	// is requesting to be authorized as that user to obtain certain scopes.
+	// It should render UX that informs the user that the client in the
+	// consent is requesting to be authorized as that user to obtain the
+	// listed scopes, and POST to the "/authorize" endpoint to approve.
 	//
 	// See the OAuth2 RFC 6749 for more information.
-	GetAuthWebHandlerFunc() http.HandlerFunc
+	GetAuthWebHandlerFunc() func(w http.ResponseWriter, r *http.Request, consent OAuth2Consent)
 
 	// Web handlers for ActivityPub related data
 
@@ -317,21 +376,6 @@ type Application interface {
 	// Only called if C2SEnabled returned true at startup time.
 	ApplySocialCallbacks(swc *pub.SocialWrappedCallbacks) (others []interface{})
 
-	// ScopePermitsPostOutbox determines if an OAuth token scope permits the
-	// bearer to post to an actor's outbox. It is only called if C2S is
-	// enabled.
-	ScopePermitsPostOutbox(scope string) (permitted bool, err error)
-	// ScopePermitsPrivateGetInbox determines if an OAuth token scope
-	// permits the bearer to view private (non-Public) messages in an
-	// actor's inbox. It is always called, regardless whether C2S or S2S is
-	// enabled.
-	ScopePermitsPrivateGetInbox(scope string) (permitted bool, err error)
-	// ScopePermitsPrivateGetOutbox determines if an OAuth token scope
-	// permits the bearer to view private (non-Public) messages in an
-	// actor's outbox. It is always called, regardless whether C2S or S2S is
-	// enabled.
-	ScopePermitsPrivateGetOutbox(scope string) (permitted bool, err error)
-
 	// CALLS MADE BOTH AT STARTUP AND SERVING TIME
 	//
 	// These calls are made at least once during server initialization, and
@@ -342,3 +386,28 @@ type Application interface {
 	// user agent information.
 	Software() Software
 }
+
+// ConfigurationValidator is optionally implemented by an Application to have
+// problems with its configuration reported together with those of apcore
+// whenever the configuration file is loaded, including by the check-config
+// command.
+type ConfigurationValidator interface {
+	// ValidateConfiguration checks a configuration of the type returned by
+	// NewConfiguration, returning an error for each problem found. Each
+	// error should name the offending key.
+	ValidateConfiguration(interface{}) []error
+}
+
+// ConfigurationReloader is optionally implemented by an Application to accept
+// changes to its configuration while serving, when the configuration file is
+// reloaded upon receiving SIGHUP.
+type ConfigurationReloader interface {
+	// ReloadConfiguration is given a new configuration of the type returned
+	// by NewConfiguration, loaded from the configuration file. Return an
+	// error to reject it, in which case none of the reloaded settings are
+	// applied and the current configuration remains in use.
+	//
+	// It is called while requests are being handled, so the application is
+	// responsible for switching to the new configuration safely.
+	ReloadConfiguration(interface{}) error
+}
@@ -17,6 +17,7 @@
 package apcore
 
 import (
+	"fmt"
 	"strings"
 )
 
@@ -51,6 +52,13 @@ func replace(input, replace string, offset int) string {
 			in[offset+len(repl):]...)...))
 }
 
+// printClarke prints what Clarke says, unless in quiet mode.
+func printClarke(moo string) {
+	if !*quietFlag {
+		fmt.Println(clarkeSays(moo))
+	}
+}
+
 func clarkeSays(moo string) string {
 	moo = strings.TrimSpace(strings.ReplaceAll(moo, "\n", " "))
 	words := strings.Split(moo, " ")
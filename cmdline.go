@@ -26,17 +26,44 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/google/logger"
 )
 
 var (
 	// Flags for apcore
-	debugFlag        = flag.Bool("debug", false, "Enable the development server on localhost & other developer quality of life features")
-	systemLogFlag    = flag.Bool("syslog", false, "Also logs to system (stdout and stderr) if logging to a file")
-	infoLogFileFlag  = flag.String("info_log_file", "", "Log file for info, defaults to stdout")
-	errorLogFileFlag = flag.String("error_log_file", "", "Log file for errors, defaults to stderr")
-	configFlag       = flag.String("config", "config.ini", "Path to the configuration file")
+	debugFlag          = flag.Bool("debug", false, "Enable the plain HTTP development server on localhost (see sr_debug_address) & other developer quality of life features")
+	systemLogFlag      = flag.Bool("syslog", false, "Also logs to system (stdout and stderr) if logging to a file")
+	infoLogFileFlag    = flag.String("info_log_file", "", "Log file for info, defaults to stdout")
+	errorLogFileFlag   = flag.String("error_log_file", "", "Log file for errors, defaults to stderr")
+	configFlag         = flag.String("config", "config.ini", "Path to the configuration file, whose keys can be overridden by APCORE_-prefixed environment variables such as APCORE_SR_HOST, or read from secret files named by keys or environment variables ending in _file such as pg_password_file")
+	nonInteractiveFlag = flag.Bool("non_interactive", false, "Fail instead of prompting for input, such as when running under systemd or in a container")
+	// Flags for scripting actions
+	answersFileFlag = flag.String("answers", "", "JSON or YAML (.yaml or .yml) file of answers to prompts, an object mapping prompt names such as sr_host or admin_username to answers; with non_interactive, a missing answer names its prompt")
+	answerFlag      = answerFlags{}
+	yesFlag         = flag.Bool("yes", false, "Accept the default of every unanswered prompt having one, answering no to yes-or-no questions; confirmations to continue with or overwrite an existing file must still be answered")
+	quietFlag       = flag.Bool("quiet", false, "Do not print Clarke the Cow's messages")
+	// Flags for moderating users
+	usernameFlag  = flag.String("username", "", "Username of the local user whose state is changed with the set-user-state action")
+	userStateFlag = flag.String("user_state", "", "New state of the user with set-user-state: active, silenced, suspended, or pending_deletion; setting active approves users pending approval")
+	// Flags for managing OAuth2 clients
+	clientIdFlag           = flag.String("client_id", "", "OAuth2 client to revoke with the revoke-client action")
+	clientNameFlag         = flag.String("client_name", "", "Name of the OAuth2 client created with the create-client action")
+	clientRedirectURIsFlag = flag.String("client_redirect_uris", "", "Comma-separated redirect URIs of the OAuth2 client created with the create-client action")
+	clientScopesFlag       = flag.String("client_scopes", "", "Space-separated scopes allowed for the OAuth2 client created with the create-client action")
+	clientGrantTypesFlag   = flag.String("client_grant_types", "", "Space-separated grant types allowed for the OAuth2 client created with the create-client action; defaults to authorization_code and refresh_token, plus client_credentials for confidential clients")
+	clientPublicFlag       = flag.Bool("client_public", false, "Whether the OAuth2 client created with the create-client action is public, such as a mobile or single-page app, and has no secret")
+	// Flags for creating invites
+	inviteMaxUsesFlag     = flag.Int("invite_max_uses", 1, "Number of times the invite created with the create-invite action can be used")
+	inviteExpiryHoursFlag = flag.Int("invite_expiry_hours", 168, "Hours until the invite created with the create-invite action expires; zero never expires")
+	// Flags for moderating reports
+	reportIdFlag       = flag.String("report_id", "", "Report to resolve with the resolve-report action")
+	reportStatusFlag   = flag.String("report_status", string(ReportOpen), "Status of reports to list with list-reports, or new status to set with resolve-report: open, resolved, or dismissed")
+	reportAssigneeFlag = flag.String("report_assignee", "", "Username of the moderator assigned to the report with resolve-report")
+	reportNotesFlag    = flag.String("report_notes", "", "Moderator notes to set on the report with resolve-report")
+	reportPolicyFlag   = flag.String("report_policy", "", "Kind of instance policy to create against the reported actor with resolve-report, such as instance_deny or actor_deny")
 )
 
 var (
@@ -56,7 +83,28 @@ var Usage func() = func() {}
 // with the correct executable name.
 var CmdLineName func() string = func() string { return "example" }
 
+// Exit codes of Run, so scripts can tell failures apart.
+const (
+	exitFailure       = 1
+	exitUsage         = 2
+	exitInvalidConfig = 3
+	exitMissingInput  = 4
+)
+
+// exitCode is the exit code for the error of an action.
+func exitCode(err error) int {
+	switch err.(type) {
+	case configProblems:
+		return exitInvalidConfig
+	case inputError:
+		return exitMissingInput
+	default:
+		return exitFailure
+	}
+}
+
 func init() {
+	flag.Var(answerFlag, "answer", "Answer to a prompt as name=value, such as sr_host=example.com; repeatable, and takes precedence over the answers file")
 	flag.Usage = func() {
 		Usage()
 		fmt.Fprintf(
@@ -90,6 +138,14 @@ func init() {
 			flag.CommandLine.Output(),
 			"Supported flags:\n")
 		flag.PrintDefaults()
+		fmt.Fprintf(
+			flag.CommandLine.Output(),
+			"\nExit codes are %d if the action failed, %d for invalid usage or answers,\n"+
+				"%d for an invalid configuration, and %d for a missing or invalid answer.\n",
+			exitFailure,
+			exitUsage,
+			exitInvalidConfig,
+			exitMissingInput)
 	}
 }
 
@@ -134,11 +190,51 @@ var (
 		Description: "Create or overwrite the server configuration in a guided flow.",
 		Action:      configureFn,
 	}
+	checkConfig cmdAction = cmdAction{
+		Name:        "check-config",
+		Description: "Validates the configuration, reporting every problem at once, and checks that the\nfiles, keys, timezone, and database connection it refers to are usable",
+		Action:      checkConfigFn,
+	}
 	version cmdAction = cmdAction{
 		Name:        "version",
 		Description: "List the current software and version.",
 		Action:      versionFn,
 	}
+	setUserState cmdAction = cmdAction{
+		Name:        "set-user-state",
+		Description: "Changes the state of the user given by the username flag to the user_state flag;\nusers pending deletion are deleted by the running server",
+		Action:      setUserStateFn,
+	}
+	createClient cmdAction = cmdAction{
+		Name:        "create-client",
+		Description: "Creates an OAuth2 client using the client_name, client_redirect_uris,\nclient_scopes, and client_public flags, printing its id and secret",
+		Action:      createClientFn,
+	}
+	listClients cmdAction = cmdAction{
+		Name:        "list-clients",
+		Description: "Lists the registered OAuth2 clients",
+		Action:      listClientsFn,
+	}
+	revokeClient cmdAction = cmdAction{
+		Name:        "revoke-client",
+		Description: "Revokes the OAuth2 client given by the client_id flag and removes its tokens",
+		Action:      revokeClientFn,
+	}
+	createInviteAction cmdAction = cmdAction{
+		Name:        "create-invite",
+		Description: "Creates an invite code for registering an account using the invite_max_uses\nand invite_expiry_hours flags",
+		Action:      createInviteFn,
+	}
+	listReports cmdAction = cmdAction{
+		Name:        "list-reports",
+		Description: "Lists the reports in the moderation queue having the status of the report_status flag",
+		Action:      listReportsFn,
+	}
+	resolveReport cmdAction = cmdAction{
+		Name:        "resolve-report",
+		Description: "Resolves the report given by the report_id flag, using the report_status,\nreport_assignee, report_notes, and report_policy flags",
+		Action:      resolveReportFn,
+	}
 	help cmdAction = cmdAction{
 		Name:        "help",
 		Description: "Print this help dialog",
@@ -154,6 +250,14 @@ func init() {
 		initDb,
 		initAdmin,
 		configure,
+		checkConfig,
+		setUserState,
+		createClient,
+		listClients,
+		revokeClient,
+		createInviteAction,
+		listReports,
+		resolveReport,
 		version,
 		help,
 	}
@@ -177,16 +281,42 @@ func serveFn(a Application) error {
 	interruptCh := make(chan os.Signal, 2)
 	signal.Notify(interruptCh, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		<-interruptCh
-		s.stop()
+		sig := <-interruptCh
+		InfoLogger.Infof("Received %s, shutting down gracefully; repeat to force quit", sig)
+		go s.stop()
+		sig = <-interruptCh
+		ErrorLogger.Errorf("Received %s again, forcing quit", sig)
+		os.Exit(1)
+	}()
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	go func() {
+		for range hupCh {
+			if err := s.reload(); err != nil {
+				ErrorLogger.Errorf("Error reloading configuration, keeping the current one: %s", err)
+			}
+		}
 	}()
 	return s.start()
 }
 
+// The 'check-config' command line action.
+func checkConfigFn(a Application) error {
+	c, err := loadConfigFile(*configFlag, a, *debugFlag)
+	if err != nil {
+		return err
+	}
+	if err = checkConfigEnvironment(c, a, *debugFlag); err != nil {
+		return err
+	}
+	printClarke("The configuration looks udderly fine!")
+	return nil
+}
+
 // The 'new' command line action.
 func guideNewFn(a Application) error {
 	sw := a.Software()
-	fmt.Println(clarkeSays(fmt.Sprintf(`
+	printClarke(fmt.Sprintf(`
 Hi, I'm Clarke the Cow! I am here to help you set up your ActivityPub
 software. It is called %q. This is version %d.%d.%d, but I don't know what
 that means. I'm a cow! First off, let's create a configuration file. Let's get
@@ -194,37 +324,37 @@ mooving!`,
 		sw.Name,
 		sw.MajorVersion,
 		sw.MinorVersion,
-		sw.PatchVersion)))
+		sw.PatchVersion))
 	err := configureFn(a)
 	if err != nil {
 		return err
 	}
-	fmt.Println(clarkeSays(`
+	printClarke(`
 Configuration wizardry complete! It is a good idea to check that configuration
 file for additional options before serving traffic. You can always re-run the
-wizard using the "configure" action. Now let's initialize the database!`))
+wizard using the "configure" action. Now let's initialize the database!`)
 	err = initDbFn(a)
 	if err != nil {
 		return err
 	}
-	fmt.Println(clarkeSays(`
+	printClarke(`
 Whew! That can manually be done using the "init-db" action in the future. Next,
-let's initialize your first administrator account in the database.`))
+let's initialize your first administrator account in the database.`)
 	err = initAdminFn(a)
 	if err != nil {
 		return err
 	}
-	fmt.Println(clarkeSays(`
+	printClarke(`
 Moo~! That was the "init-admin" action. We are done, but before you run the
-"serve" action, please do double check your configuration file! Bye bye!`))
+"serve" action, please do double check your configuration file! Bye bye!`)
 	return nil
 }
 
 // The 'init-db' command line action.
 func initDbFn(a Application) error {
-	fmt.Println(clarkeSays(`
+	printClarke(`
 We're connecting to the database using the specs in the config file, creating
-tables, and then closing all connections.`))
+tables, and then closing all connections.`)
 	c, err := loadConfigFile(*configFlag, a, *debugFlag)
 	if err != nil {
 		return err
@@ -237,7 +367,7 @@ tables, and then closing all connections.`))
 	if err != nil {
 		return err
 	}
-	fmt.Println(clarkeSays(`Database initialization udderly complete!`))
+	printClarke(`Database initialization udderly complete!`)
 	return nil
 }
 
@@ -247,7 +377,7 @@ func initAdminFn(a Application) error {
 	if *debugFlag {
 		msg += "\nWARNING: Creating a user in debug mode will NOT work in production and MUST ONLY be used for development"
 	}
-	fmt.Println(clarkeSays(msg))
+	printClarke(msg)
 	c, err := loadConfigFile(*configFlag, a, *debugFlag)
 	if err != nil {
 		return err
@@ -260,7 +390,7 @@ func initAdminFn(a Application) error {
 	if err != nil {
 		return err
 	}
-	username, email, password, err := promptAdminUser()
+	username, email, password, mfaRequired, err := promptAdminUser()
 	if err != nil {
 		return err
 	}
@@ -271,7 +401,8 @@ func initAdminFn(a Application) error {
 		username,
 		"",
 		email,
-		password)
+		password,
+		mfaRequired)
 	if err != nil {
 		return err
 	}
@@ -279,7 +410,7 @@ func initAdminFn(a Application) error {
 	if err != nil {
 		return err
 	}
-	fmt.Println(clarkeSays(`New admin account successfully created! Moo~`))
+	printClarke(`New admin account successfully created! Moo~`)
 	return nil
 }
 
@@ -291,7 +422,7 @@ func configureFn(a Application) error {
 	exists := false
 	if _, err := os.Stat(*configFlag); err == nil {
 		exists = true
-		cont, err := promptFileExistsContinue(*configFlag)
+		cont, err := promptFileExistsContinue("continue_existing_config", *configFlag)
 		if err != nil {
 			return err
 		}
@@ -308,7 +439,7 @@ func configureFn(a Application) error {
 	InfoLogger.Info("Calling application to get default config options")
 	acfg := a.NewConfiguration()
 	if exists {
-		cont, err := promptOverwriteExistingFile(*configFlag)
+		cont, err := promptOverwriteExistingFile("overwrite_existing_config", *configFlag)
 		if err != nil {
 			return err
 		}
@@ -325,6 +456,241 @@ func configureFn(a Application) error {
 	return nil
 }
 
+// The 'set-user-state' command line action.
+func setUserStateFn(a Application) error {
+	if len(*usernameFlag) == 0 {
+		return fmt.Errorf("username flag is not set")
+	}
+	state, err := toUserState(*userStateFlag)
+	if err != nil {
+		return err
+	} else if state == userDeleted {
+		return fmt.Errorf("users cannot be directly deleted, use %q instead", userPendingDeletion)
+	}
+	c, err := loadConfigFile(*configFlag, a, *debugFlag)
+	if err != nil {
+		return err
+	}
+	db, err := newDatabase(c, a, *debugFlag)
+	if err != nil {
+		return err
+	}
+	err = db.Open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ctx := context.Background()
+	userId, err := db.UserIdForUsername(ctx, *usernameFlag)
+	if err != nil {
+		return err
+	} else if len(userId) == 0 {
+		return fmt.Errorf("no user with username %q", *usernameFlag)
+	}
+	prev, err := db.UserState(ctx, userId)
+	if err != nil {
+		return err
+	} else if prev == userDeleted {
+		return fmt.Errorf("user %q is deleted", *usernameFlag)
+	}
+	if err = db.SetUserState(ctx, userId, state); err != nil {
+		return err
+	}
+	InfoLogger.Infof("Changed state of user %q from %s to %s", *usernameFlag, prev, state)
+	return nil
+}
+
+// The 'create-client' command line action.
+func createClientFn(a Application) error {
+	var redirectURIs []string
+	for _, r := range strings.Split(*clientRedirectURIsFlag, ",") {
+		if r = strings.TrimSpace(r); len(r) > 0 {
+			redirectURIs = append(redirectURIs, r)
+		}
+	}
+	sc, err := newScopes(a.Scopes())
+	if err != nil {
+		return err
+	}
+	cl, err := newOAuth2Client(sc, *clientNameFlag, redirectURIs, strings.Fields(*clientScopesFlag), strings.Fields(*clientGrantTypesFlag), *clientPublicFlag, "")
+	if err != nil {
+		return err
+	}
+	c, err := loadConfigFile(*configFlag, a, *debugFlag)
+	if err != nil {
+		return err
+	}
+	db, err := newDatabase(c, a, *debugFlag)
+	if err != nil {
+		return err
+	}
+	err = db.Open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if cl, err = db.InsertClient(context.Background(), cl); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "client_id: %s\n", cl.Id)
+	if !cl.Public {
+		fmt.Fprintf(os.Stdout, "client_secret: %s\n", cl.Secret)
+	}
+	InfoLogger.Infof("Created OAuth2 client %s (%q)", cl.Id, cl.Name)
+	return nil
+}
+
+// The 'create-invite' command line action.
+func createInviteFn(a Application) error {
+	c, err := loadConfigFile(*configFlag, a, *debugFlag)
+	if err != nil {
+		return err
+	}
+	db, err := newDatabase(c, a, *debugFlag)
+	if err != nil {
+		return err
+	}
+	err = db.Open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	code, err := createInvite(context.Background(), db, "", *inviteMaxUsesFlag, time.Duration(*inviteExpiryHoursFlag)*time.Hour)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "invite: %s\n", code)
+	return nil
+}
+
+// The 'list-clients' command line action.
+func listClientsFn(a Application) error {
+	c, err := loadConfigFile(*configFlag, a, *debugFlag)
+	if err != nil {
+		return err
+	}
+	db, err := newDatabase(c, a, *debugFlag)
+	if err != nil {
+		return err
+	}
+	err = db.Open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	cls, err := db.Clients(context.Background())
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tPUBLIC\tREVOKED\tSCOPES\tGRANT TYPES\tREDIRECT URIS")
+	for _, cl := range cls {
+		fmt.Fprintf(w, "%s\t%q\t%t\t%t\t%s\t%s\t%s\n",
+			cl.Id,
+			cl.Name,
+			cl.Public,
+			cl.Revoked,
+			strings.Join(cl.Scopes, " "),
+			strings.Join(cl.GrantTypes, " "),
+			strings.Join(cl.RedirectURIs, ","))
+	}
+	return w.Flush()
+}
+
+// The 'revoke-client' command line action.
+func revokeClientFn(a Application) error {
+	if len(*clientIdFlag) == 0 {
+		return fmt.Errorf("client_id flag is not set")
+	}
+	c, err := loadConfigFile(*configFlag, a, *debugFlag)
+	if err != nil {
+		return err
+	}
+	db, err := newDatabase(c, a, *debugFlag)
+	if err != nil {
+		return err
+	}
+	err = db.Open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err = db.RevokeClient(context.Background(), *clientIdFlag); err != nil {
+		return err
+	}
+	InfoLogger.Infof("Revoked OAuth2 client %s", *clientIdFlag)
+	return nil
+}
+
+// The 'list-reports' command line action.
+func listReportsFn(a Application) error {
+	c, err := loadConfigFile(*configFlag, a, *debugFlag)
+	if err != nil {
+		return err
+	}
+	db, err := newDatabase(c, a, *debugFlag)
+	if err != nil {
+		return err
+	}
+	err = db.Open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	rs, err := db.ReportsByStatus(context.Background(), ReportStatus(*reportStatusFlag))
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCREATED\tREPORTER\tREPORTED\tASSIGNEE\tCONTENT")
+	for _, r := range rs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%q\n",
+			r.Id,
+			r.CreateTime.Format(time.RFC3339),
+			r.ReporterIRI,
+			r.ReportedIRI,
+			r.AssigneeUserId,
+			r.Content)
+	}
+	return w.Flush()
+}
+
+// The 'resolve-report' command line action.
+func resolveReportFn(a Application) error {
+	if len(*reportIdFlag) == 0 {
+		return fmt.Errorf("report_id flag is not set")
+	}
+	c, err := loadConfigFile(*configFlag, a, *debugFlag)
+	if err != nil {
+		return err
+	}
+	db, err := newDatabase(c, a, *debugFlag)
+	if err != nil {
+		return err
+	}
+	err = db.Open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ctx := context.Background()
+	res := ReportResolution{
+		Status:     ReportStatus(*reportStatusFlag),
+		Notes:      *reportNotesFlag,
+		PolicyKind: *reportPolicyFlag,
+	}
+	if len(*reportAssigneeFlag) > 0 {
+		if res.AssigneeUserId, err = db.UserIdForUsername(ctx, *reportAssigneeFlag); err != nil {
+			return err
+		}
+	}
+	if err = applyReportResolution(ctx, db, *reportIdFlag, res); err != nil {
+		return err
+	}
+	InfoLogger.Infof("Resolved report %s as %s", *reportIdFlag, res.Status)
+	return nil
+}
+
 // The 'version' command line action.
 func versionFn(a Application) error {
 	fmt.Fprintf(os.Stdout, "%s; %s\n", a.Software(), apCoreSoftware())
@@ -344,7 +710,11 @@ func Run(a Application) {
 	}
 	if flag.NArg() != 1 {
 		flag.Usage()
-		os.Exit(1)
+		os.Exit(exitUsage)
+	}
+	if err := loadAnswers(*answersFileFlag, answerFlag); err != nil {
+		ErrorLogger.Errorf("cannot load answers: %s", err)
+		os.Exit(exitUsage)
 	}
 
 	// Check and prepare debug mode
@@ -405,10 +775,10 @@ func Run(a Application) {
 	if !found {
 		fmt.Fprintf(os.Stderr, "Unknown action: %s\n", flag.Arg(0))
 		fmt.Fprintf(os.Stderr, "Available actions:\n%s", allActionsUsage())
-		os.Exit(1)
+		os.Exit(exitUsage)
 	} else if err := action.Action(a); err != nil {
 		ErrorLogger.Errorf("error running %s: %s", flag.Arg(0), err)
-		os.Exit(1)
+		os.Exit(exitCode(err))
 	}
 }
 
@@ -18,21 +18,26 @@ package apcore
 
 import (
 	"fmt"
+	"net"
 
 	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/ini.v1"
 )
 
 const (
-	postgresDB = "postgres"
+	postgresDB                 = "postgres"
+	defaultDebugAddress        = "localhost:8080"
+	defaultReverseProxyAddress = "localhost:8080"
 )
 
 // Overall configuration file structure
 type config struct {
-	ServerConfig      serverConfig      `ini:"server" comment:"HTTP server configuration"`
-	OAuthConfig       oAuthConfig       `ini:"oauth" comment:"OAuth 2 configuration"`
-	DatabaseConfig    databaseConfig    `ini:"database" comment:"Database configuration"`
-	ActivityPubConfig activityPubConfig `ini:"activitypub" comment:"ActivityPub configuration"`
+	ServerConfig       serverConfig       `ini:"server" comment:"HTTP server configuration"`
+	OAuthConfig        oAuthConfig        `ini:"oauth" comment:"OAuth 2 configuration"`
+	DatabaseConfig     databaseConfig     `ini:"database" comment:"Database configuration"`
+	ActivityPubConfig  activityPubConfig  `ini:"activitypub" comment:"ActivityPub configuration"`
+	RegistrationConfig registrationConfig `ini:"registration" comment:"User registration configuration"`
+	MailConfig         mailConfig         `ini:"mail" comment:"Email configuration"`
 }
 
 func defaultConfig(dbkind string) (c *config, err error) {
@@ -42,61 +47,145 @@ func defaultConfig(dbkind string) (c *config, err error) {
 		return
 	}
 	c = &config{
-		ServerConfig:      defaultServerConfig(),
-		OAuthConfig:       defaultOAuthConfig(),
-		DatabaseConfig:    dbc,
-		ActivityPubConfig: defaultActivityPubConfig(),
+		ServerConfig:       defaultServerConfig(),
+		OAuthConfig:        defaultOAuthConfig(),
+		DatabaseConfig:     dbc,
+		ActivityPubConfig:  defaultActivityPubConfig(),
+		RegistrationConfig: defaultRegistrationConfig(),
+		MailConfig:         defaultMailConfig(),
 	}
 	return
 }
 
 // Configuration section specifically for the HTTP server.
 type serverConfig struct {
-	Host                        string `ini:"sr_host" comment:"(required) Host with TLD for this instance (basically, the fully qualified domain or subdomain); ignored in debug mode"`
-	CertFile                    string `init:"sr_cert_file" comment:"(required) Path to the certificate file used to establish TLS connections for HTTPS"`
-	KeyFile                     string `init:"sr_cert_file" comment:"(required) Path to the private key file used to establish TLS connections for HTTPS"`
-	CookieAuthKeyFile           string `ini:"sr_cookie_auth_key_file" comment:"(required) Path to private key file used for cookie authentication"`
-	CookieEncryptionKeyFile     string `ini:"sr_cookie_encryption_key_file" comment:"Path to private key file used for cookie encryption"`
-	CookieMaxAge                int    `ini:"sr_cookie_max_age" comment:"(default: 86400 seconds) Number of seconds a cookie is valid; 0 indicates no Max-Age (browser-dependent, usually session-only); negative value is invalid"`
-	CookieSessionName           string `ini:"sr_cookie_session_name" comment:"(required) Cookie session name to use for the application"`
-	HttpsReadTimeoutSeconds     int    `ini:"sr_https_read_timeout_seconds" comment:"Timeout in seconds for incoming HTTPS requests; a zero or unset value does not timeout"`
-	HttpsWriteTimeoutSeconds    int    `ini:"sr_https_write_timeout_seconds" comment:"Timeout in seconds for outgoing HTTPS responses; a zero or unset value does not timeout"`
-	RedirectReadTimeoutSeconds  int    `ini:"sr_redirect_read_timeout_seconds" comment:"Timeout in seconds for incoming HTTP requests, which will be redirected to HTTPS; a zero or unset value does not timeout"`
-	RedirectWriteTimeoutSeconds int    `ini:"sr_redirect_write_timeout_seconds" comment:"Timeout in seconds for outgoing HTTP redirect-to-HTTPS responses; a zero or unset value does not timeout"`
-	StaticRootDirectory         string `ini:"sr_static_root_directory" comment:"(required) Root directory for serving static content, such as ECMAScript, CSS, favicon; !!!Warning: Everything in this directory will be served and accessible!!!"`
-	SaltSize                    int    `ini:"sr_salt_size" comment:"(default: 32) The size of salts to use with passwords when hashing, anything smaller than 16 will be treated as 16"`
-	BCryptStrength              int    `ini:"sr_bcrypt_strength" comment:"(default: 10) The hashing cost to use with the bcrypt hashing algorithm, between 4 and 31; the higher the cost, the slower the hash comparisons for passwords will take for attackers and regular users alike"`
-	RSAKeySize                  int    `ini:"sr_rsa_private_key_size" comment:"(default: 1024) The size of the RSA private key for a user; values less than 1024 are forbidden"`
+	Host                          string `ini:"sr_host" comment:"(required) Host with TLD for this instance (basically, the fully qualified domain or subdomain); ignored in debug mode"`
+	ListenAddress                 string `ini:"sr_listen_address" comment:"(default: :https, or localhost:8080 in reverse proxy mode) Address on which the server listens, or the path of a Unix socket prefixed with \"unix:\"; ignored in debug mode"`
+	RedirectListenAddress         string `ini:"sr_redirect_listen_address" comment:"(default: :http) Address on which the HTTP server redirecting to HTTPS and answering ACME challenges listens, or the path of a Unix socket prefixed with \"unix:\"; unused in debug and reverse proxy modes"`
+	ReverseProxy                  bool   `ini:"sr_reverse_proxy" comment:"(default: false) Serve plain HTTP on sr_listen_address for a reverse proxy that terminates TLS for sr_host, such as nginx; IRIs still use https, and neither ACME nor the redirect server are used"`
+	TrustedProxies                string `ini:"sr_trusted_proxies" comment:"Comma-separated list of CIDRs of proxies trusted to set the X-Forwarded-For, X-Forwarded-Proto, and X-Forwarded-Host headers, such as \"127.0.0.1/32,::1/128\"; connections over a Unix socket are always trusted"`
+	DebugAddress                  string `ini:"sr_debug_address" comment:"(default: localhost:8080) Address on which plain HTTP is served in debug mode, whose port is used in the localhost IRIs; ignored outside debug mode"`
+	CertFile                      string `ini:"sr_cert_file" comment:"(required unless ACME is enabled) Path to the certificate file used to establish TLS connections for HTTPS; reloaded on SIGHUP"`
+	KeyFile                       string `ini:"sr_key_file" comment:"(required unless ACME is enabled) Path to the private key file used to establish TLS connections for HTTPS; reloaded on SIGHUP"`
+	ACMEEnabled                   bool   `ini:"sr_acme_enabled" comment:"(default: false) Obtain and renew the certificate for sr_host automatically from an ACME certificate authority, instead of using sr_cert_file and sr_key_file; enabling it agrees to the terms of service of the certificate authority, which must reach this server on ports 80 and 443"`
+	ACMEEmail                     string `ini:"sr_acme_email" comment:"Contact email given to the ACME certificate authority, for notices about the certificate"`
+	ACMECacheDirectory            string `ini:"sr_acme_cache_directory" comment:"(default: acme_cache) Directory in which ACME account keys and certificates are stored; keep it private"`
+	ACMEDirectoryURL              string `ini:"sr_acme_directory_url" comment:"Directory URL of the ACME certificate authority; if unset, Let's Encrypt is used; set it to the directory of a local test server such as Pebble during development"`
+	ACMEDirectoryCAFile           string `ini:"sr_acme_directory_ca_file" comment:"Path to a PEM file of root certificates to trust when connecting to the ACME directory, such as the root certificate of a Pebble test server"`
+	CookieAuthKeyFile             string `ini:"sr_cookie_auth_key_file" comment:"(required) Path to private key file used for cookie authentication"`
+	CookieEncryptionKeyFile       string `ini:"sr_cookie_encryption_key_file" comment:"Path to private key file used for cookie encryption"`
+	CookieMaxAge                  int    `ini:"sr_cookie_max_age" comment:"(default: 86400 seconds) Number of seconds a cookie is valid; 0 indicates no Max-Age (browser-dependent, usually session-only); negative value is invalid"`
+	CookieSessionName             string `ini:"sr_cookie_session_name" comment:"(required) Cookie session name to use for the application"`
+	CookieSameSite                string `ini:"sr_cookie_same_site" comment:"(default: lax) SameSite attribute of the session cookie, one of \"lax\", \"strict\", or \"none\"; with \"strict\", users following a link to authorize an application from another site must log in again"`
+	CookiePreviousKeyFiles        string `ini:"sr_cookie_previous_key_files" comment:"Comma-separated list of previously used cookie keys, each the path to an authentication key file optionally followed by a colon and the path to its encryption key file; cookies created with them are still accepted while new cookies use the current keys, allowing keys to be rotated without logging everyone out"`
+	SessionStore                  string `ini:"sr_session_store" comment:"(default: database) Where session data is kept, either \"database\" or \"memory\"; in-memory sessions are lost when the server restarts"`
+	SessionIdleTimeoutSeconds     int    `ini:"sr_session_idle_timeout_seconds" comment:"(default: 86400) Number of seconds after which an unused session is logged out; zero or negative values are invalid; reloaded on SIGHUP"`
+	SessionAbsoluteTimeoutSeconds int    `ini:"sr_session_absolute_timeout_seconds" comment:"(default: 604800) Number of seconds after which a session is logged out, regardless of use; zero or negative values are invalid; reloaded on SIGHUP"`
+	HttpsReadTimeoutSeconds       int    `ini:"sr_https_read_timeout_seconds" comment:"Timeout in seconds for incoming HTTPS requests; a zero or unset value does not timeout"`
+	HttpsWriteTimeoutSeconds      int    `ini:"sr_https_write_timeout_seconds" comment:"Timeout in seconds for outgoing HTTPS responses; a zero or unset value does not timeout"`
+	RedirectReadTimeoutSeconds    int    `ini:"sr_redirect_read_timeout_seconds" comment:"Timeout in seconds for incoming HTTP requests, which will be redirected to HTTPS; a zero or unset value does not timeout"`
+	RedirectWriteTimeoutSeconds   int    `ini:"sr_redirect_write_timeout_seconds" comment:"Timeout in seconds for outgoing HTTP redirect-to-HTTPS responses; a zero or unset value does not timeout"`
+	ShutdownDrainTimeoutSeconds   int    `ini:"sr_shutdown_drain_timeout_seconds" comment:"(default: 30) Number of seconds to wait on shutdown for in-flight requests and federated deliveries to finish; deliveries still running afterwards are cancelled and left pending in the database, to be retried on the next start; zero or negative values are invalid; reloaded on SIGHUP"`
+	StaticRootDirectory           string `ini:"sr_static_root_directory" comment:"(required) Root directory for serving static content, such as ECMAScript, CSS, favicon; !!!Warning: Everything in this directory will be served and accessible!!!"`
+	SaltSize                      int    `ini:"sr_salt_size" comment:"(default: 32) The size of salts to use with passwords when hashing, anything smaller than 16 will be treated as 16"`
+	BCryptStrength                int    `ini:"sr_bcrypt_strength" comment:"(default: 10) The hashing cost to use with the bcrypt hashing algorithm, between 4 and 31; the higher the cost, the slower the hash comparisons for passwords will take for attackers and regular users alike"`
+	PasswordHashAlgorithm         string `ini:"sr_password_hash_algorithm" comment:"(default: argon2id) Algorithm used to hash passwords, either \"argon2id\" or \"bcrypt\"; passwords hashed with another algorithm or different parameters are rehashed when their user next logs in"`
+	Argon2Time                    int    `ini:"sr_argon2_time" comment:"(default: 3) Number of passes over memory when hashing passwords with argon2id"`
+	Argon2MemoryKiB               int    `ini:"sr_argon2_memory_kib" comment:"(default: 65536) Memory in KiB used when hashing passwords with argon2id"`
+	Argon2Threads                 int    `ini:"sr_argon2_threads" comment:"(default: 2) Number of threads used when hashing passwords with argon2id, at most 255"`
+	RSAKeySize                    int    `ini:"sr_rsa_private_key_size" comment:"(default: 1024) The size of the RSA private key for a user; values less than 1024 are forbidden"`
+	LoginAttemptWindowSeconds     int    `ini:"sr_login_attempt_window_seconds" comment:"(default: 900) Duration in seconds over which failed logins are counted; zero or negative values are invalid"`
+	LoginDelayThreshold           int    `ini:"sr_login_delay_threshold" comment:"(default: 3) Number of failed logins of an account after which each further attempt must wait exponentially longer; zero or negative values are invalid"`
+	LoginMaxDelaySeconds          int    `ini:"sr_login_max_delay_seconds" comment:"(default: 60) Longest duration in seconds an account must wait between login attempts; zero or negative values are invalid"`
+	LoginLockoutThreshold         int    `ini:"sr_login_lockout_threshold" comment:"(default: 10) Number of failed logins of an account after which it is temporarily locked out; zero or negative values are invalid"`
+	LoginLockoutSeconds           int    `ini:"sr_login_lockout_seconds" comment:"(default: 900) Duration in seconds an account is locked out; zero or negative values are invalid"`
+	LoginIPThreshold              int    `ini:"sr_login_ip_threshold" comment:"(default: 50) Number of failed logins from an IP address, across all accounts, after which its logins are refused; zero or negative values are invalid"`
 }
 
 func defaultServerConfig() serverConfig {
 	return serverConfig{
-		CookieMaxAge:   86400,
-		SaltSize:       32,
-		BCryptStrength: bcrypt.DefaultCost,
-		RSAKeySize:     1024,
+		DebugAddress:                  defaultDebugAddress,
+		ACMECacheDirectory:            "acme_cache",
+		CookieMaxAge:                  86400,
+		CookieSameSite:                "lax",
+		SessionStore:                  sessionStoreDatabase,
+		SessionIdleTimeoutSeconds:     86400,
+		SessionAbsoluteTimeoutSeconds: 604800,
+		ShutdownDrainTimeoutSeconds:   30,
+		SaltSize:                      32,
+		BCryptStrength:                bcrypt.DefaultCost,
+		PasswordHashAlgorithm:         passwordArgon2id,
+		Argon2Time:                    3,
+		Argon2MemoryKiB:               64 * 1024,
+		Argon2Threads:                 2,
+		RSAKeySize:                    1024,
+		LoginAttemptWindowSeconds:     900,
+		LoginDelayThreshold:           3,
+		LoginMaxDelaySeconds:          60,
+		LoginLockoutThreshold:         10,
+		LoginLockoutSeconds:           900,
+		LoginIPThreshold:              50,
 	}
 }
 
 type oAuthConfig struct {
-	AccessTokenExpiry  int `ini:"oauth_access_token_expiry" comment:"(default: 3600 seconds) Duration in seconds until an access token expires; zero or negative values are invalid."`
-	RefreshTokenExpiry int `ini:"oauth_refresh_token_expiry" comment:"(default: 7200 seconds) Duration in seconds until a refresh token expires; zero or negative values are invalid."`
+	AccessTokenExpiry         int    `ini:"oauth_access_token_expiry" comment:"(default: 3600 seconds) Duration in seconds until an access token expires; zero or negative values are invalid."`
+	RefreshTokenExpiry        int    `ini:"oauth_refresh_token_expiry" comment:"(default: 7200 seconds) Duration in seconds until a refresh token expires; zero or negative values are invalid."`
+	DynamicClientRegistration bool   `ini:"oauth_dynamic_client_registration" comment:"(default: false) Whether to allow clients, such as C2S applications, to register themselves at the /oauth/register endpoint per RFC 7591"`
+	TokenHashKeyFile          string `ini:"oauth_token_hash_key_file" comment:"(required) Path to private key file used to hash OAuth2 codes and tokens stored in the database"`
+	TokenPurgePeriodSeconds   int    `ini:"oauth_token_purge_period_seconds" comment:"(default: 3600) Period in seconds between removing expired authorization codes and tokens; zero or negative values are invalid"`
+	OIDCSigningKeyFile        string `ini:"oauth_oidc_signing_key_file" comment:"(default: disabled) Path to the PEM encoded PKCS8 RSA private key used to sign OpenID Connect ID tokens; OpenID Connect is disabled if unset"`
 }
 
 func defaultOAuthConfig() oAuthConfig {
 	return oAuthConfig{
-		AccessTokenExpiry:  3600,
-		RefreshTokenExpiry: 7200,
+		AccessTokenExpiry:       3600,
+		RefreshTokenExpiry:      7200,
+		TokenPurgePeriodSeconds: 3600,
+	}
+}
+
+// Configuration section specifically for registering users and their
+// accounts.
+type registrationConfig struct {
+	Mode                           string `ini:"reg_mode" comment:"(default: closed) Who may register accounts: \"closed\" allows no one, \"invite_only\" requires an invite code, \"approval_required\" requires an administrator to approve accounts without an invite code, and \"open\" allows anyone"`
+	VerificationTokenExpirySeconds int    `ini:"reg_verification_token_expiry_seconds" comment:"(default: 86400) Duration in seconds until an email verification link expires; zero or negative values are invalid"`
+	ResetTokenExpirySeconds        int    `ini:"reg_reset_token_expiry_seconds" comment:"(default: 3600) Duration in seconds until a password reset link expires; zero or negative values are invalid"`
+}
+
+func defaultRegistrationConfig() registrationConfig {
+	return registrationConfig{
+		Mode:                           string(RegistrationClosed),
+		VerificationTokenExpirySeconds: 86400,
+		ResetTokenExpirySeconds:        3600,
+	}
+}
+
+// Configuration section specifically for sending email.
+type mailConfig struct {
+	Mailer        string `ini:"mail_mailer" comment:"(default: log) How to send email: \"smtp\" uses an SMTP server, while \"log\" and \"file\" write emails to the info log or a directory for development; ignored if the application provides its own Mailer"`
+	From          string `ini:"mail_from" comment:"(required for smtp) Address emails are sent from"`
+	SMTPHost      string `ini:"mail_smtp_host" comment:"(required for smtp) Host of the SMTP server"`
+	SMTPPort      int    `ini:"mail_smtp_port" comment:"(default: 587) Port of the SMTP server"`
+	SMTPUsername  string `ini:"mail_smtp_username" comment:"Username to authenticate with the SMTP server; no authentication is used if unset"`
+	SMTPPassword  string `ini:"mail_smtp_password" comment:"Password to authenticate with the SMTP server"`
+	FileDirectory string `ini:"mail_file_directory" comment:"(required for file) Directory that emails are written to"`
+}
+
+func defaultMailConfig() mailConfig {
+	return mailConfig{
+		Mailer:   mailerLog,
+		SMTPPort: 587,
 	}
 }
 
 // Configuration section specifically for the database.
 type databaseConfig struct {
 	DatabaseKind              string         `ini:"db_database_kind" comment:"(required) Only \"postgres\" supported"`
-	ConnMaxLifetimeSeconds    int            `ini:"db_conn_max_lifetime_seconds" comment:"(default: indefinite) Maximum lifetime of a connection in seconds; a value of zero or unset value means indefinite"`
-	MaxOpenConns              int            `ini:"db_max_open_conns" comment:"(default: infinite) Maximum number of open connections to the database; a value of zero or unset value means infinite"`
-	MaxIdleConns              int            `ini:"db_max_idle_conns" comment:"(default: 2) Maximum number of idle connections in the connection pool to the database; a value of zero maintains no idle connections; a value greater than max_open_conns is reduced to be equal to max_open_conns"`
-	DefaultCollectionPageSize int            `ini:"db_default_collection_page_size" comment:"(default: 10) The default collection page size when fetching a page of an ActivityStreams collection"`
+	ConnMaxLifetimeSeconds    int            `ini:"db_conn_max_lifetime_seconds" comment:"(default: indefinite) Maximum lifetime of a connection in seconds; a value of zero or unset value means indefinite; reloaded on SIGHUP"`
+	MaxOpenConns              int            `ini:"db_max_open_conns" comment:"(default: infinite) Maximum number of open connections to the database; a value of zero or unset value means infinite; reloaded on SIGHUP"`
+	MaxIdleConns              int            `ini:"db_max_idle_conns" comment:"(default: 2) Maximum number of idle connections in the connection pool to the database; a value of zero maintains no idle connections; a value greater than max_open_conns is reduced to be equal to max_open_conns; reloaded on SIGHUP"`
+	DefaultCollectionPageSize int            `ini:"db_default_collection_page_size" comment:"(default: 10) The default collection page size when fetching a page of an ActivityStreams collection; reloaded on SIGHUP"`
 	PostgresConfig            postgresConfig `ini:"db_postgres,omitempty" comment:"Only needed if database_kind is postgres, and values are based on the github.com/lib/pq driver"`
 }
 
@@ -120,11 +209,13 @@ func defaultDatabaseConfig(dbkind string) (d databaseConfig, err error) {
 // Configuration section specifically for ActivityPub.
 type activityPubConfig struct {
 	ClockTimezone                    string               `ini:"ap_clock_timezone" comment:"(default: UTC) Timezone for ActivityPub related operations: unset and \"UTC\" are UTC, \"Local\" is local server time, otherwise use IANA Time Zone database values"`
-	OutboundRateLimitQPS             float64              `ini:"ap_outbound_rate_limit_qps" comment:"(default: 10) Global outbound rate limit for delivery of federated messages under steady state conditions; a negative value or value of zero is invalid"`
-	OutboundRateLimitBurst           int                  `ini:"ap_outbound_rate_limit_burst" comment:"(default: 50) Global outbound burst tolerance for delivery of federated messages; a negative value or value of zero is invalid"`
+	OutboundRateLimitQPS             float64              `ini:"ap_outbound_rate_limit_qps" comment:"(default: 10) Global outbound rate limit for delivery of federated messages under steady state conditions; a negative value or value of zero is invalid; reloaded on SIGHUP"`
+	OutboundRateLimitBurst           int                  `ini:"ap_outbound_rate_limit_burst" comment:"(default: 50) Global outbound burst tolerance for delivery of federated messages; a negative value or value of zero is invalid; reloaded on SIGHUP"`
 	HttpSignaturesConfig             httpSignaturesConfig `ini:"ap_http_signatures" comment:"HTTP Signatures configuration"`
 	MaxInboxForwardingRecursionDepth int                  `ini:"ap_max_inbox_forwarding_recursion_depth" comment:"(default: 50) The maximum recursion depth to use when determining whether to do inbox forwarding, which if triggered ensures older thread participants are able to receive messages; zero means no limit (only used if the application has S2S enabled)"`
 	MaxDeliveryRecursionDepth        int                  `ini:"ap_max_delivery_recursion_depth" comment:"(default: 50) The maximum depth to search for peers to deliver due to inbox forwarding, which ensures messages received by this server are propagated to them and no \"ghost reply\" problems occur; zero means no limit (only used if the application has S2S enabled)"`
+	UserDeletionPeriodSeconds        int                  `ini:"ap_user_deletion_period_seconds" comment:"(default: 60) Period in seconds between federating the Delete of users pending deletion and replacing their actors with Tombstones; zero or negative values are invalid"`
+	AuthorizedFetch                  bool                 `ini:"ap_authorized_fetch" comment:"(default: false) Secure mode: require a valid HTTP Signature on ActivityStreams GET requests for local objects and collections, and apply instance and user policies to the signer; actors remain fetchable so peers can obtain public keys (only used if the application has S2S enabled)"`
 }
 
 func defaultActivityPubConfig() activityPubConfig {
@@ -135,6 +226,7 @@ func defaultActivityPubConfig() activityPubConfig {
 		HttpSignaturesConfig:             defaultHttpSignaturesConfig(),
 		MaxInboxForwardingRecursionDepth: 50,
 		MaxDeliveryRecursionDepth:        50,
+		UserDeletionPeriodSeconds:        60,
 	}
 }
 
@@ -158,7 +250,8 @@ func defaultHttpSignaturesConfig() httpSignaturesConfig {
 // Configuration section specifically for Postgres databases.
 type postgresConfig struct {
 	DatabaseName            string `ini:"pg_db_name" comment:"(required) Database name"`
-	UserName                string `ini:"pg_user" comment:"(required) User to connect as (any password will be prompted)"`
+	UserName                string `ini:"pg_user" comment:"(required) User to connect as"`
+	Password                string `ini:"pg_password" comment:"Password of the user; rather than storing it in this file, prefer setting pg_password_file to a file containing it or the APCORE_PG_PASSWORD environment variable; if unset, whether there is a password is prompted, unless -non_interactive is given, in which case none is used"`
 	Host                    string `ini:"pg_host" comment:"(default: localhost) The Postgres host to connect to"`
 	Port                    int    `ini:"pg_port" comment:"(default: 5432) The port to connect to"`
 	SSLMode                 string `ini:"pg_ssl_mode" comment:"(default: require) SSL mode to use when connecting (options are: \"disable\", \"require\", \"verify-ca\", \"verify-full\")"`
@@ -175,28 +268,77 @@ func defaultPostgresConfig() postgresConfig {
 }
 
 func loadConfigFile(filename string, a Application, debug bool) (c *config, err error) {
+	var appCfg interface{}
+	c, appCfg, err = parseConfigFile(filename, a, debug)
+	if err != nil {
+		return
+	}
+	err = a.SetConfiguration(appCfg)
+	return
+}
+
+// parseConfigFile reads the apcore and application configurations from the
+// file, without giving the latter to the application. Keys missing from the
+// file keep their defaults, and every problem with the configuration is
+// reported at once.
+func parseConfigFile(filename string, a Application, debug bool) (c *config, appCfg interface{}, err error) {
 	InfoLogger.Infof("Loading config file: %s", filename)
 	var cfg *ini.File
 	cfg, err = ini.Load(filename)
 	if err != nil {
 		return
 	}
-	c = &config{}
-	err = cfg.MapTo(c)
+	// Only postgres is supported, and a different kind in the file is
+	// reported by validation.
+	c, err = defaultConfig(postgresDB)
 	if err != nil {
 		return
 	}
-	appCfg := a.NewConfiguration()
-	err = cfg.MapTo(appCfg)
+	appCfg = a.NewConfiguration()
+	err = renameLegacyConfigKeys(cfg)
 	if err != nil {
 		return
 	}
-	err = a.SetConfiguration(appCfg)
+	err = applyConfigOverrides(cfg, c, appCfg)
+	if err != nil {
+		return
+	}
+	err = cfg.MapTo(c)
+	if err != nil {
+		return
+	}
+	err = cfg.MapTo(appCfg)
 	if err != nil {
 		return
 	}
 	if debug {
-		c.ServerConfig.Host = "localhost"
+		if len(c.ServerConfig.DebugAddress) == 0 {
+			c.ServerConfig.DebugAddress = defaultDebugAddress
+		}
+		// An invalid address is reported by validateConfig.
+		c.ServerConfig.Host, _ = debugHost(c.ServerConfig.DebugAddress)
+	}
+	p := validateConfig(c, debug)
+	p = append(p, unknownConfigKeys(cfg, c, appCfg)...)
+	if v, ok := a.(ConfigurationValidator); ok {
+		for _, verr := range v.ValidateConfiguration(appCfg) {
+			p.addErr("application", verr)
+		}
+	}
+	err = p.err()
+	return
+}
+
+// debugHost is the host used in IRIs when serving plain HTTP on the address in
+// debug mode.
+func debugHost(addr string) (host string, err error) {
+	var port string
+	if _, port, err = net.SplitHostPort(addr); err != nil {
+		return
+	}
+	host = "localhost"
+	if port != "80" && port != "http" {
+		host = net.JoinHostPort(host, port)
 	}
 	return
 }
@@ -218,7 +360,7 @@ func saveConfigFile(filename string, c *config, others ...interface{}) error {
 }
 
 func promptNewConfig(file string) (c *config, err error) {
-	fmt.Println(clarkeSays(fmt.Sprintf(`
+	printClarke(fmt.Sprintf(`
 Welcome to the configuration guided flow!
 
 Here we will visit common configuration choices. While not every option is asked
@@ -227,10 +369,11 @@ change options. You can also change your answers to this flow. Note that in
 order to take advantage of changed configuration values, the application will
 need to be restarted.
 
-Let's go!`)))
+Let's go!`))
 
 	var s string
 	s, err = promptSelection(
+		"db_database_kind",
 		"Please choose the database you are using",
 		postgresDB)
 	if err != nil {
@@ -243,32 +386,72 @@ Let's go!`)))
 
 	// Prompt for ServerConfig
 	c.ServerConfig.Host, err = promptStringWithDefault(
+		"sr_host",
 		"Enter the host for this server (ignored in debug mode)",
 		"example.com")
 	if err != nil {
 		return
 	}
-	c.ServerConfig.CertFile, err = promptString(
-		"Enter the path to the file containing the certificate used in HTTPS connections")
-	if err != nil {
+	if c.ServerConfig.ReverseProxy, err = promptYN("sr_reverse_proxy", "Will this server run behind a reverse proxy that terminates TLS, such as nginx?"); err != nil {
 		return
-	}
-	c.ServerConfig.KeyFile, err = promptString(
-		"Enter the path to the file containing the private key for the certificate used in HTTPS connections")
-	if err != nil {
+	} else if c.ServerConfig.ReverseProxy {
+		c.ServerConfig.ListenAddress, err = promptStringWithDefault(
+			"sr_listen_address",
+			"Enter the address to serve plain HTTP on for the reverse proxy, or a Unix socket path prefixed with \"unix:\"",
+			defaultReverseProxyAddress)
+		if err != nil {
+			return
+		}
+		c.ServerConfig.TrustedProxies, err = promptStringWithDefault(
+			"sr_trusted_proxies",
+			"Enter the comma-separated CIDRs of the reverse proxy, whose X-Forwarded headers will be trusted",
+			"127.0.0.1/32,::1/128")
+		if err != nil {
+			return
+		}
+	} else if c.ServerConfig.ACMEEnabled, err = promptYN("sr_acme_enabled", "Do you want to automatically obtain and renew the HTTPS certificate from Let's Encrypt, agreeing to its terms of service?"); err != nil {
 		return
+	} else if c.ServerConfig.ACMEEnabled {
+		c.ServerConfig.ACMEEmail, err = promptString(
+			"sr_acme_email",
+			"Enter the email Let's Encrypt may contact about the certificate")
+		if err != nil {
+			return
+		}
+		c.ServerConfig.ACMECacheDirectory, err = promptStringWithDefault(
+			"sr_acme_cache_directory",
+			"Enter the directory in which to store certificates",
+			c.ServerConfig.ACMECacheDirectory)
+		if err != nil {
+			return
+		}
+	} else {
+		c.ServerConfig.CertFile, err = promptString(
+			"sr_cert_file",
+			"Enter the path to the file containing the certificate used in HTTPS connections")
+		if err != nil {
+			return
+		}
+		c.ServerConfig.KeyFile, err = promptString(
+			"sr_key_file",
+			"Enter the path to the file containing the private key for the certificate used in HTTPS connections")
+		if err != nil {
+			return
+		}
 	}
 	c.ServerConfig.StaticRootDirectory, err = promptStringWithDefault(
+		"sr_static_root_directory",
 		"Enter the directory for serving static content (WARNING: Everything in it will be served)?",
 		"static")
 	if err != nil {
 		return
 	}
 	var have bool
-	if have, err = promptYN("Do you already have a file containing a cookie authentication private key?"); err != nil {
+	if have, err = promptYN("have_cookie_auth_key_file", "Do you already have a file containing a cookie authentication private key?"); err != nil {
 		return
 	} else if have {
 		c.ServerConfig.CookieAuthKeyFile, err = promptStringWithDefault(
+			"sr_cookie_auth_key_file",
 			"Enter the existing file name for the cookie authentication private key",
 			"cookie_authn.key")
 		if err != nil {
@@ -276,47 +459,135 @@ Let's go!`)))
 		}
 	} else {
 		c.ServerConfig.CookieAuthKeyFile, err = promptStringWithDefault(
+			"sr_cookie_auth_key_file",
 			"Enter the new file name for the cookie authentication private key",
 			"cookie_authn.key")
 		if err != nil {
 			return
 		}
-		err = createKeyFile(c.ServerConfig.CookieAuthKeyFile)
+		err = createKeyFile(c.ServerConfig.CookieAuthKeyFile, cookieAuthKeySize)
 		if err != nil {
 			return
 		}
 	}
 	var want bool
-	if have, err = promptYN("Do you already have a file containing a cookie encryption private key?"); err != nil {
+	if have, err = promptYN("have_cookie_encryption_key_file", "Do you already have a file containing a cookie encryption private key?"); err != nil {
 		return
 	} else if have {
 		c.ServerConfig.CookieEncryptionKeyFile, err = promptStringWithDefault(
+			"sr_cookie_encryption_key_file",
 			"Enter the existing file name for the cookie encryption private key",
 			"cookie_enc.key")
 		if err != nil {
 			return
 		}
-	} else if want, err = promptYN("Do you want to use a cookie encryption private key?"); err != nil {
+	} else if want, err = promptYN("use_cookie_encryption_key", "Do you want to use a cookie encryption private key?"); err != nil {
 		return
 	} else if want {
 		c.ServerConfig.CookieEncryptionKeyFile, err = promptStringWithDefault(
+			"sr_cookie_encryption_key_file",
 			"Enter the new file name for the cookie encryption private key",
 			"cookie_enc.key")
 		if err != nil {
 			return
 		}
-		err = createKeyFile(c.ServerConfig.CookieEncryptionKeyFile)
+		err = createKeyFile(c.ServerConfig.CookieEncryptionKeyFile, cookieEncryptionKeySize)
 		if err != nil {
 			return
 		}
 	}
 	c.ServerConfig.CookieSessionName, err = promptStringWithDefault(
+		"sr_cookie_session_name",
 		"Session name used to find cookies",
 		"my_apcore_session_name")
 	if err != nil {
 		return
 	}
+	if have, err = promptYN("have_oauth_token_hash_key_file", "Do you already have a file containing an OAuth2 token hashing private key?"); err != nil {
+		return
+	} else if have {
+		c.OAuthConfig.TokenHashKeyFile, err = promptStringWithDefault(
+			"oauth_token_hash_key_file",
+			"Enter the existing file name for the OAuth2 token hashing private key",
+			"oauth_token.key")
+		if err != nil {
+			return
+		}
+	} else {
+		c.OAuthConfig.TokenHashKeyFile, err = promptStringWithDefault(
+			"oauth_token_hash_key_file",
+			"Enter the new file name for the OAuth2 token hashing private key",
+			"oauth_token.key")
+		if err != nil {
+			return
+		}
+		err = createKeyFile(c.OAuthConfig.TokenHashKeyFile, tokenHashKeySize)
+		if err != nil {
+			return
+		}
+	}
+	if have, err = promptYN("use_oidc", "Do you want to act as an OpenID Connect provider?"); err != nil {
+		return
+	} else if have {
+		c.OAuthConfig.OIDCSigningKeyFile, err = promptStringWithDefault(
+			"oauth_oidc_signing_key_file",
+			"Enter the file name for the OpenID Connect signing private key; it is created if it does not exist",
+			"oidc_signing.pem")
+		if err != nil {
+			return
+		}
+		err = createPEMKeyFile(c.OAuthConfig.OIDCSigningKeyFile, oidcSigningKeySize)
+		if err != nil {
+			return
+		}
+	}
+	c.RegistrationConfig.Mode, err = promptSelection(
+		"reg_mode",
+		"Who may register accounts?",
+		string(RegistrationClosed),
+		string(RegistrationInviteOnly),
+		string(RegistrationApprovalRequired),
+		string(RegistrationOpen))
+	if err != nil {
+		return
+	}
+	if c.RegistrationConfig.Mode != string(RegistrationClosed) {
+		c.MailConfig.Mailer, err = promptSelection(
+			"mail_mailer",
+			"How should verification and password reset emails be sent?",
+			mailerSMTP,
+			mailerFile,
+			mailerLog)
+		if err != nil {
+			return
+		}
+		switch c.MailConfig.Mailer {
+		case mailerSMTP:
+			if c.MailConfig.From, err = promptString("mail_from", "Enter the address emails are sent from"); err != nil {
+				return
+			}
+			if c.MailConfig.SMTPHost, err = promptString("mail_smtp_host", "Enter the SMTP server host"); err != nil {
+				return
+			}
+			if c.MailConfig.SMTPPort, err = promptIntWithDefault("mail_smtp_port", "Enter the SMTP server port", 587); err != nil {
+				return
+			}
+			if c.MailConfig.SMTPUsername, err = promptString("mail_smtp_username", "Enter the SMTP username, or leave empty for no authentication"); err != nil {
+				return
+			}
+			if len(c.MailConfig.SMTPUsername) > 0 {
+				if c.MailConfig.SMTPPassword, err = promptPassword("mail_smtp_password", "Enter the SMTP password"); err != nil {
+					return
+				}
+			}
+		case mailerFile:
+			if c.MailConfig.FileDirectory, err = promptStringWithDefault("mail_file_directory", "Enter the directory to write emails to", "mail"); err != nil {
+				return
+			}
+		}
+	}
 	c.ServerConfig.HttpsReadTimeoutSeconds, err = promptIntWithDefault(
+		"sr_https_read_timeout_seconds",
 		"Enter the deadline (in seconds) for reading & writing HTTP & HTTPS requests. A value of zero means connections do not timeout",
 		60)
 	if err != nil {
@@ -328,18 +599,21 @@ Let's go!`)))
 
 	// Prompt for ActivityPubConfig
 	c.ActivityPubConfig.ClockTimezone, err = promptStringWithDefault(
+		"ap_clock_timezone",
 		"Please enter an IANA Time Zone for the server, \"UTC\", or \"Local\"",
 		"UTC")
 	if err != nil {
 		return
 	}
 	c.ActivityPubConfig.OutboundRateLimitQPS, err = promptFloat64WithDefault(
+		"ap_outbound_rate_limit_qps",
 		"Please enter the steady-state rate limit for outbound ActivityPub QPS",
 		10)
 	if err != nil {
 		return
 	}
 	c.ActivityPubConfig.OutboundRateLimitBurst, err = promptIntWithDefault(
+		"ap_outbound_rate_limit_burst",
 		"Please enter the burst limit for outbound ActivityPub QPS",
 		50)
 	if err != nil {
@@ -348,12 +622,14 @@ Let's go!`)))
 
 	// Prompt for DatabaseConfig
 	c.DatabaseConfig.ConnMaxLifetimeSeconds, err = promptIntWithDefault(
+		"db_conn_max_lifetime_seconds",
 		"Enter the maximum lifetime (in seconds) for database connections. A value of zero means connections do not timeout",
 		60)
 	if err != nil {
 		return
 	}
 	c.DatabaseConfig.MaxOpenConns, err = promptIntWithDefault(
+		"db_max_open_conns",
 		"Enter the maximum number of database connections allowed. A value of zero means infinite are permitted.",
 		0)
 
@@ -369,30 +645,35 @@ Let's go!`)))
 func promptPostgresConfig(c *config) (err error) {
 	fmt.Println("Prompting for Postgres database configuration options...")
 	c.DatabaseConfig.PostgresConfig.DatabaseName, err = promptStringWithDefault(
+		"pg_db_name",
 		"Enter the postgres database name",
 		"pgdb")
 	if err != nil {
 		return
 	}
 	c.DatabaseConfig.PostgresConfig.UserName, err = promptStringWithDefault(
+		"pg_user",
 		"Enter the postgres user name",
 		"pguser")
 	if err != nil {
 		return
 	}
 	c.DatabaseConfig.PostgresConfig.Host, err = promptStringWithDefault(
+		"pg_host",
 		"Enter the postgres database host name",
 		"localhost")
 	if err != nil {
 		return
 	}
 	c.DatabaseConfig.PostgresConfig.Port, err = promptIntWithDefault(
+		"pg_port",
 		"Enter the postgres database port",
 		5432)
 	if err != nil {
 		return
 	}
 	c.DatabaseConfig.PostgresConfig.SSLMode, err = promptSelection(
+		"pg_ssl_mode",
 		"Please choose a SSL mode (see https://www.postgresql.org/docs/current/libpq-ssl.html)",
 		"disable",
 		"require",
@@ -402,14 +683,14 @@ func promptPostgresConfig(c *config) (err error) {
 		return
 	}
 	if mode := c.DatabaseConfig.PostgresConfig.SSLMode; mode == "require" || mode == "verify-ca" || mode == "verify-full" {
-		fmt.Println(clarkeSays(fmt.Sprintf(`
+		printClarke(fmt.Sprintf(`
 Hey, Clarke the Cow here, I noticed you chose %q! Be sure to check your
 configuration file for the %q, %q, and/or %q options to get SSL set up properly!
 Toodlemoo~`,
 			mode,
 			"pg_ssl_cert",
 			"pg_ssl_key",
-			"pg_ssl_root_cert")))
+			"pg_ssl_root_cert"))
 	}
 	return
 }
@@ -0,0 +1,122 @@
+// apcore is a server framework for implementing an ActivityPub application.
+// Copyright (C) 2019 Cory Slep
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package apcore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+const (
+	configEnvPrefix        = "APCORE_"
+	configSecretFileSuffix = "_file"
+)
+
+// legacyConfigKeys maps keys written by earlier versions of the configure
+// action to their current names, by section.
+var legacyConfigKeys = map[string]map[string]string{
+	"server": {
+		"CertFile": "sr_cert_file",
+		"KeyFile":  "sr_key_file",
+	},
+}
+
+// renameLegacyConfigKeys gives keys written by earlier versions their current
+// names, warning that the old names are deprecated.
+func renameLegacyConfigKeys(cfg *ini.File) (err error) {
+	for secName, keys := range legacyConfigKeys {
+		sec, serr := cfg.GetSection(secName)
+		if serr != nil {
+			continue
+		}
+		for old, name := range keys {
+			if !sec.HasKey(old) {
+				continue
+			}
+			v := sec.Key(old).String()
+			sec.DeleteKey(old)
+			if sec.HasKey(name) {
+				InfoLogger.Warningf("Ignoring deprecated key %s in section [%s], as %s is also set", old, secName, name)
+				continue
+			}
+			if _, err = sec.NewKey(name, v); err != nil {
+				return
+			}
+			InfoLogger.Warningf("Key %s in section [%s] is deprecated, rename it to %s", old, secName, name)
+		}
+	}
+	return
+}
+
+// applyConfigOverrides replaces values loaded from the configuration file with
+// those given by environment variables and secret files, for every key of the
+// configuration structs.
+//
+// A key such as pg_password is set by the APCORE_PG_PASSWORD environment
+// variable. Its value can instead be read from a file, such as a mounted
+// secret, named by the pg_password_file key or the APCORE_PG_PASSWORD_FILE
+// environment variable. Environment variables take precedence over the
+// configuration file.
+func applyConfigOverrides(cfg *ini.File, structs ...interface{}) (err error) {
+	for _, st := range structs {
+		tmpl := ini.Empty()
+		if err = ini.ReflectFrom(tmpl, st); err != nil {
+			return
+		}
+		for _, sec := range tmpl.Sections() {
+			for _, name := range sec.KeyStrings() {
+				if err = overrideConfigKey(cfg.Section(sec.Name()), name); err != nil {
+					return
+				}
+			}
+		}
+	}
+	return
+}
+
+func overrideConfigKey(sec *ini.Section, name string) (err error) {
+	env := configEnvPrefix + strings.ToUpper(name)
+	fileEnv := env + strings.ToUpper(configSecretFileSuffix)
+	v, hasEnv := os.LookupEnv(env)
+	file, hasFileEnv := os.LookupEnv(fileEnv)
+	if hasEnv && hasFileEnv {
+		err = fmt.Errorf("both %s and %s are set", env, fileEnv)
+		return
+	} else if hasEnv {
+		InfoLogger.Infof("Setting %s from %s", name, env)
+		sec.Key(name).SetValue(v)
+		return
+	} else if hasFileEnv {
+		InfoLogger.Infof("Setting %s from the file named by %s", name, fileEnv)
+	} else if fileKey := name + configSecretFileSuffix; sec.HasKey(fileKey) && len(sec.Key(fileKey).String()) > 0 {
+		file = sec.Key(fileKey).String()
+		InfoLogger.Infof("Setting %s from the file named by %s", name, fileKey)
+	} else {
+		return
+	}
+	var b []byte
+	if b, err = ioutil.ReadFile(file); err != nil {
+		err = fmt.Errorf("failed to read %s from file: %s", name, err)
+		return
+	}
+	sec.Key(name).SetValue(strings.TrimRight(string(b), "\r\n"))
+	return
+}
@@ -0,0 +1,306 @@
+// apcore is a server framework for implementing an ActivityPub application.
+// Copyright (C) 2019 Cory Slep
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package apcore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/go-fed/httpsig"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/ini.v1"
+)
+
+const (
+	minCookieAuthKeySize = 32
+	minTokenHashKeySize  = 32
+)
+
+// configProblems collects every problem found in a configuration, so that they
+// are reported at once instead of one per attempt to start the server.
+type configProblems []string
+
+func (p configProblems) Error() string {
+	return fmt.Sprintf("found %d problems with the configuration:\n  %s", len(p), strings.Join(p, "\n  "))
+}
+
+func (p *configProblems) add(key, format string, args ...interface{}) {
+	*p = append(*p, fmt.Sprintf("%s: %s", key, fmt.Sprintf(format, args...)))
+}
+
+func (p *configProblems) addErr(key string, err error) {
+	if err != nil {
+		p.add(key, "%s", err)
+	}
+}
+
+func (p configProblems) err() error {
+	if len(p) == 0 {
+		return nil
+	}
+	return p
+}
+
+// validateConfig checks the values of the configuration, without reading any
+// of the files it refers to.
+func validateConfig(c *config, debug bool) (p configProblems) {
+	sc := c.ServerConfig
+	if debug {
+		_, err := debugHost(sc.DebugAddress)
+		p.addErr("sr_debug_address", err)
+	} else if len(sc.Host) == 0 {
+		p.add("sr_host", "is required")
+	}
+	if !debug && !sc.ReverseProxy && !sc.ACMEEnabled {
+		if len(sc.CertFile) == 0 {
+			p.add("sr_cert_file", "is required unless ACME is enabled")
+		}
+		if len(sc.KeyFile) == 0 {
+			p.add("sr_key_file", "is required unless ACME is enabled")
+		}
+	}
+	if sc.ACMEEnabled {
+		if sc.ReverseProxy {
+			p.add("sr_acme_enabled", "cannot be enabled behind a reverse proxy, which must terminate TLS")
+		}
+		if len(sc.ACMECacheDirectory) == 0 {
+			p.add("sr_acme_cache_directory", "is required when ACME is enabled")
+		}
+	}
+	_, err := newForwardedHeaders(c, debug)
+	p.addErr("sr_trusted_proxies", err)
+	if len(sc.CookieAuthKeyFile) == 0 {
+		p.add("sr_cookie_auth_key_file", "is required")
+	}
+	if len(sc.CookieSessionName) == 0 {
+		p.add("sr_cookie_session_name", "is required")
+	}
+	if sc.CookieMaxAge < 0 {
+		p.add("sr_cookie_max_age", "is negative")
+	}
+	_, err = toSameSite(sc.CookieSameSite)
+	p.addErr("sr_cookie_same_site", err)
+	if sc.SessionStore != sessionStoreDatabase && sc.SessionStore != sessionStoreMemory {
+		p.add("sr_session_store", "is %q instead of %q or %q", sc.SessionStore, sessionStoreDatabase, sessionStoreMemory)
+	}
+	positive(&p, "sr_session_idle_timeout_seconds", sc.SessionIdleTimeoutSeconds)
+	positive(&p, "sr_session_absolute_timeout_seconds", sc.SessionAbsoluteTimeoutSeconds)
+	positive(&p, "sr_shutdown_drain_timeout_seconds", sc.ShutdownDrainTimeoutSeconds)
+	if len(sc.StaticRootDirectory) == 0 {
+		p.add("sr_static_root_directory", "is required")
+	}
+	_, err = newPasswordHasher(c)
+	p.addErr("sr_password_hash_algorithm", err)
+	if sc.BCryptStrength > bcrypt.MaxCost {
+		p.add("sr_bcrypt_strength", "is greater than %d", bcrypt.MaxCost)
+	}
+	if sc.RSAKeySize < minKeySize {
+		p.add("sr_rsa_private_key_size", "is less than %d", minKeySize)
+	}
+	positive(&p, "sr_login_attempt_window_seconds", sc.LoginAttemptWindowSeconds)
+	positive(&p, "sr_login_delay_threshold", sc.LoginDelayThreshold)
+	positive(&p, "sr_login_max_delay_seconds", sc.LoginMaxDelaySeconds)
+	positive(&p, "sr_login_lockout_threshold", sc.LoginLockoutThreshold)
+	positive(&p, "sr_login_lockout_seconds", sc.LoginLockoutSeconds)
+	positive(&p, "sr_login_ip_threshold", sc.LoginIPThreshold)
+
+	oc := c.OAuthConfig
+	positive(&p, "oauth_access_token_expiry", oc.AccessTokenExpiry)
+	positive(&p, "oauth_refresh_token_expiry", oc.RefreshTokenExpiry)
+	positive(&p, "oauth_token_purge_period_seconds", oc.TokenPurgePeriodSeconds)
+	if len(oc.TokenHashKeyFile) == 0 {
+		p.add("oauth_token_hash_key_file", "is required")
+	}
+
+	dc := c.DatabaseConfig
+	if dc.DatabaseKind != postgresDB {
+		p.add("db_database_kind", "is %q instead of %q", dc.DatabaseKind, postgresDB)
+	} else {
+		pg := dc.PostgresConfig
+		if len(pg.DatabaseName) == 0 {
+			p.add("pg_db_name", "is required")
+		}
+		if len(pg.UserName) == 0 {
+			p.add("pg_user", "is required")
+		}
+		switch pg.SSLMode {
+		case "", "disable", "require", "verify-ca", "verify-full":
+		default:
+			p.add("pg_ssl_mode", "is %q, which is not supported", pg.SSLMode)
+		}
+	}
+	if dc.DefaultCollectionPageSize < 0 {
+		p.add("db_default_collection_page_size", "is negative")
+	}
+
+	ac := c.ActivityPubConfig
+	_, err = newClock(ac.ClockTimezone)
+	p.addErr("ap_clock_timezone", err)
+	if ac.OutboundRateLimitQPS <= 0 {
+		p.add("ap_outbound_rate_limit_qps", "is not positive")
+	}
+	positive(&p, "ap_outbound_rate_limit_burst", ac.OutboundRateLimitBurst)
+	positive(&p, "ap_user_deletion_period_seconds", ac.UserDeletionPeriodSeconds)
+	hc := ac.HttpSignaturesConfig
+	if len(hc.Algorithms) == 0 {
+		p.add("http_sig_algorithms", "is required")
+	}
+	for _, algo := range hc.Algorithms {
+		if !httpsig.IsSupportedHttpSigAlgorithm(algo) {
+			p.add("http_sig_algorithms", "%q is not supported", algo)
+		}
+	}
+	if !httpsig.IsSupportedDigestAlgorithm(hc.DigestAlgorithm) {
+		p.add("http_sig_digest_algorithm", "%q is not supported", hc.DigestAlgorithm)
+	}
+	p.addErr("http_sig_get_headers", containsRequiredHttpHeaders(http.MethodGet, hc.GetHeaders))
+	p.addErr("http_sig_post_headers", containsRequiredHttpHeaders(http.MethodPost, hc.PostHeaders))
+
+	rc := c.RegistrationConfig
+	_, err = toRegistrationMode(rc.Mode)
+	p.addErr("reg_mode", err)
+	positive(&p, "reg_verification_token_expiry_seconds", rc.VerificationTokenExpirySeconds)
+	positive(&p, "reg_reset_token_expiry_seconds", rc.ResetTokenExpirySeconds)
+
+	mc := c.MailConfig
+	switch mc.Mailer {
+	case mailerLog, "":
+	case mailerFile:
+		if len(mc.FileDirectory) == 0 {
+			p.add("mail_file_directory", "is required by the file mailer")
+		}
+	case mailerSMTP:
+		if len(mc.SMTPHost) == 0 {
+			p.add("mail_smtp_host", "is required by the smtp mailer")
+		}
+		if len(mc.From) == 0 {
+			p.add("mail_from", "is required by the smtp mailer")
+		}
+	default:
+		p.add("mail_mailer", "is %q instead of %q, %q, or %q", mc.Mailer, mailerLog, mailerFile, mailerSMTP)
+	}
+	return
+}
+
+func positive(p *configProblems, key string, v int) {
+	if v <= 0 {
+		p.add(key, "is not positive")
+	}
+}
+
+// unknownConfigKeys reports keys in the configuration file that do not belong
+// to any of the configuration structs, such as misspelled keys that would
+// otherwise be silently ignored. Keys naming secret files are allowed for
+// every known key.
+func unknownConfigKeys(cfg *ini.File, structs ...interface{}) (p configProblems) {
+	known := make(map[string]bool)
+	for _, st := range structs {
+		tmpl := ini.Empty()
+		if err := ini.ReflectFrom(tmpl, st); err != nil {
+			p.addErr("configuration", err)
+			return
+		}
+		for _, sec := range tmpl.Sections() {
+			for _, name := range sec.KeyStrings() {
+				known[sec.Name()+"."+name] = true
+				known[sec.Name()+"."+name+configSecretFileSuffix] = true
+			}
+		}
+	}
+	for _, sec := range cfg.Sections() {
+		for _, name := range sec.KeyStrings() {
+			if !known[sec.Name()+"."+name] {
+				p.add(name, "is not a known key in section [%s]", sec.Name())
+			}
+		}
+	}
+	return
+}
+
+// checkConfigEnvironment checks that the files, keys, and database named by a
+// valid configuration can be used.
+func checkConfigEnvironment(c *config, a Application, debug bool) error {
+	var p configProblems
+	sc := c.ServerConfig
+	if !debug && !sc.ReverseProxy && !sc.ACMEEnabled {
+		_, err := loadCertificate(c)
+		p.addErr("sr_cert_file", err)
+	}
+	if sc.ACMEEnabled && !debug {
+		_, err := newACMEManager(c)
+		p.addErr("sr_acme_directory_ca_file", err)
+	}
+	checkDirectory(&p, "sr_static_root_directory", sc.StaticRootDirectory)
+	checkCookieKeys(&p, "sr_cookie_auth_key_file", sc.CookieAuthKeyFile, sc.CookieEncryptionKeyFile)
+	for _, pair := range strings.Split(sc.CookiePreviousKeyFiles, ",") {
+		if pair = strings.TrimSpace(pair); len(pair) == 0 {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		var encFile string
+		if len(parts) == 2 {
+			encFile = parts[1]
+		}
+		checkCookieKeys(&p, "sr_cookie_previous_key_files", parts[0], encFile)
+	}
+	if b, err := ioutil.ReadFile(c.OAuthConfig.TokenHashKeyFile); err != nil {
+		p.addErr("oauth_token_hash_key_file", err)
+	} else if len(b) < minTokenHashKeySize {
+		p.add("oauth_token_hash_key_file", "key is %d bytes, shorter than %d", len(b), minTokenHashKeySize)
+	}
+	if len(c.OAuthConfig.OIDCSigningKeyFile) > 0 {
+		if o, err := newOIDCProvider(c, "https", nil); err != nil {
+			p.addErr("oauth_oidc_signing_key_file", err)
+		} else if n := o.key.N.BitLen(); n < oidcSigningKeySize {
+			p.add("oauth_oidc_signing_key_file", "RSA key is %d bits, smaller than %d", n, oidcSigningKeySize)
+		}
+	}
+	if c.MailConfig.Mailer == mailerFile && a.Mailer() == nil {
+		checkDirectory(&p, "mail_file_directory", c.MailConfig.FileDirectory)
+	}
+	if db, err := newDatabase(c, a, debug); err != nil {
+		p.addErr("database", err)
+	} else if err = db.Ping(); err != nil {
+		p.add("database", "cannot connect: %s", err)
+	}
+	return p.err()
+}
+
+func checkDirectory(p *configProblems, key, dir string) {
+	if fi, err := os.Stat(dir); err != nil {
+		p.addErr(key, err)
+	} else if !fi.IsDir() {
+		p.add(key, "%q is not a directory", dir)
+	}
+}
+
+func checkCookieKeys(p *configProblems, key, authFile, encFile string) {
+	keys, err := readCookieKeys(authFile, encFile)
+	if err != nil {
+		p.addErr(key, err)
+		return
+	}
+	if n := len(keys[0]); n < minCookieAuthKeySize {
+		p.add(key, "authentication key %q is %d bytes, shorter than %d", authFile, n, minCookieAuthKeySize)
+	}
+	if n := len(keys[1]); n > 0 && n != 16 && n != 24 && n != 32 {
+		p.add(key, "encryption key %q is %d bytes instead of 16, 24, or 32", encFile, n)
+	}
+}
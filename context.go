@@ -35,6 +35,9 @@ const (
 	activityTypeContextKey       = "activityType"
 	completeRequestURLContextKey = "completeRequestURL"
 	privateScopeContextKey       = "privateScope"
+	signedActorIRIContextKey     = "signedActorIRI"
+	activityContextKey           = "activity"
+	reportRecordedContextKey     = "reportRecorded"
 )
 
 type Context interface {
@@ -45,6 +48,7 @@ type Context interface {
 	ActivityIRI() (u *url.URL, err error)
 	ActivityType() (s string, err error)
 	CompleteRequestURL() (u *url.URL, err error)
+	SignedActorIRI() (u *url.URL, err error)
 }
 
 var _ Context = &ctx{}
@@ -129,6 +133,8 @@ func (c *ctx) withActivityType(s string) {
 	c.Context = context.WithValue(c.Context, activityTypeContextKey, s)
 }
 
+// withCompleteRequestURL uses the scheme and host of this server rather than
+// those of the request, which a reverse proxy may have rewritten.
 func (c *ctx) withCompleteRequestURL(r *http.Request, scheme, host string) {
 	u := *r.URL // Copy
 	u.Host = host
@@ -136,6 +142,20 @@ func (c *ctx) withCompleteRequestURL(r *http.Request, scheme, host string) {
 	c.Context = context.WithValue(c.Context, completeRequestURLContextKey, &u)
 }
 
+func (c *ctx) withActivity(a pub.Activity) {
+	c.Context = context.WithValue(c.Context, activityContextKey, a)
+}
+
+func (c *ctx) withSignedActorIRI(u *url.URL) {
+	c.Context = context.WithValue(c.Context, signedActorIRIContextKey, u)
+}
+
+// withReportRecorded marks that the Flag being sent is recorded as a report by
+// the sender, rather than by the side effects of posting it to the outbox.
+func (c *ctx) withReportRecorded() {
+	c.Context = context.WithValue(c.Context, reportRecordedContextKey, true)
+}
+
 func (c *ctx) SetPrivateScope(b bool) {
 	c.Context = context.WithValue(c.Context, privateScopeContextKey, b)
 }
@@ -206,6 +226,35 @@ func (c ctx) CompleteRequestURL() (u *url.URL, err error) {
 	return
 }
 
+// SignedActorIRI is the actor whose HTTP Signature was verified on an
+// ActivityStreams GET request. It is only set when authorized fetch is enabled.
+func (c ctx) SignedActorIRI() (u *url.URL, err error) {
+	v := c.Value(signedActorIRIContextKey)
+	var ok bool
+	if v == nil {
+		err = fmt.Errorf("no signed actor IRI in context")
+	} else if u, ok = v.(*url.URL); !ok {
+		err = fmt.Errorf("signed actor IRI in context is not a *url.URL")
+	}
+	return
+}
+
+func (c ctx) Activity() (a pub.Activity, err error) {
+	v := c.Value(activityContextKey)
+	var ok bool
+	if v == nil {
+		err = fmt.Errorf("no activity in context")
+	} else if a, ok = v.(pub.Activity); !ok {
+		err = fmt.Errorf("activity in context is not a pub.Activity")
+	}
+	return
+}
+
+func (c ctx) reportRecorded() bool {
+	b, _ := c.Value(reportRecordedContextKey).(bool)
+	return b
+}
+
 func (c *ctx) HasPrivateScope() bool {
 	v := c.Value(privateScopeContextKey)
 	var b, ok bool
@@ -0,0 +1,118 @@
+// apcore is a server framework for implementing an ActivityPub application.
+// Copyright (C) 2019 Cory Slep
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package apcore
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"net/http"
+)
+
+const (
+	// CSRFFormKey is the form field in which web forms must post the CSRF
+	// token.
+	CSRFFormKey = "csrf_token"
+	// CSRFHeader is the header in which scripts may send the CSRF token
+	// instead.
+	CSRFHeader = "X-CSRF-Token"
+
+	csrfTokenSize = 32
+)
+
+type csrfContextKey struct{}
+
+// CSRFToken returns the CSRF token of the request's session, which forms must
+// post in the CSRFFormKey field. It is only available to handlers registered
+// with WebOnlyHandle, WebOnlyHandleFunc, WebOnlyHandler, or WebOnlyHandlerFunc,
+// and to the login, registration, password reset, and authorization web
+// handlers of the Application.
+func CSRFToken(r *http.Request) string {
+	t, _ := r.Context().Value(csrfContextKey{}).(string)
+	return t
+}
+
+// CSRFField returns a hidden form input holding the CSRF token, to embed in
+// forms rendered with html/template.
+func CSRFField(r *http.Request) template.HTML {
+	return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`,
+		CSRFFormKey,
+		template.HTMLEscapeString(CSRFToken(r))))
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	default:
+		return false
+	}
+}
+
+// csrfProtect requires state-changing requests to carry the CSRF token of the
+// session, which is created on the first safe request. Visitors without a
+// stored session instead get a token in a signed cookie, so that their visits
+// do not create sessions. Requests with an Authorization header are not
+// checked, as browsers never attach one by themselves.
+func csrfProtect(sl *sessions, internalErrorHandler, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.Header.Get("Authorization")) > 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		s, err := sl.Get(r)
+		if err != nil {
+			ErrorLogger.Errorf("error getting session for CSRF protection: %s", err)
+			internalErrorHandler.ServeHTTP(w, r)
+			return
+		}
+		token, ok := s.CSRFToken()
+		if !ok && !s.stored() {
+			token, ok = sl.csrfCookieToken(r)
+		}
+		if !isSafeMethod(r.Method) {
+			sent := r.Header.Get(CSRFHeader)
+			if len(sent) == 0 {
+				sent = r.PostFormValue(CSRFFormKey)
+			}
+			if !ok || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+		} else if !ok && s.stored() {
+			// Stored sessions keep their own token.
+			if token, err = s.NewCSRFToken(); err != nil {
+				ErrorLogger.Errorf("error creating CSRF token: %s", err)
+				internalErrorHandler.ServeHTTP(w, r)
+				return
+			} else if err = s.Save(r, w); err != nil {
+				ErrorLogger.Errorf("error saving session for CSRF protection: %s", err)
+				internalErrorHandler.ServeHTTP(w, r)
+				return
+			}
+		} else if !ok {
+			if token, err = sl.setCSRFCookie(w); err != nil {
+				ErrorLogger.Errorf("error creating CSRF token: %s", err)
+				internalErrorHandler.ServeHTTP(w, r)
+				return
+			}
+		}
+		*r = *r.WithContext(context.WithValue(r.Context(), csrfContextKey{}, token))
+		next.ServeHTTP(w, r)
+	})
+}
@@ -23,7 +23,10 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/url"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-fed/activity/pub"
@@ -33,7 +36,26 @@ import (
 	"gopkg.in/oauth2.v3"
 )
 
-type Database interface{}
+type Database interface {
+	// Relationships lists the current blocks, mutes, and domain blocks of
+	// the user. Expired mutes are not included.
+	Relationships(c context.Context, userId string) ([]Relationship, error)
+	// IsBlocking determines whether the user blocks the actor, either
+	// directly or by blocking its domain.
+	IsBlocking(c context.Context, userId string, actor *url.URL) (bool, error)
+	// IsMuting determines whether the user has an unexpired mute of the
+	// actor.
+	IsMuting(c context.Context, userId string, actor *url.URL) (bool, error)
+	// Mute hides the actor's content from the user while still accepting
+	// its activities. A zero expires time never expires.
+	Mute(c context.Context, userId string, actor *url.URL, expires time.Time) error
+	// Unmute removes a mute of the actor.
+	Unmute(c context.Context, userId string, actor *url.URL) error
+	// BlockDomain blocks all actors on the host for the user.
+	BlockDomain(c context.Context, userId string, host string) error
+	// UnblockDomain removes a domain block of the host.
+	UnblockDomain(c context.Context, userId string, host string) error
+}
 
 var _ Database = &database{}
 
@@ -44,20 +66,44 @@ type database struct {
 	// url.URL.Host name for this server
 	hostname string
 	// default size of fetching pages of inbox, outboxes, etc
-	defaultCollectionSize int
-	// size of salt
-	saltSize int
-	// default strength of bcrypt
+	defaultCollectionSize int32
+	// hashes and verifies user passwords
+	hasher passwordHasher
+	// default strength of bcrypt, for client secrets
 	bcryptStrength int
 	// size of RSA private keys
 	rsaKeySize int
+	// key for hashing OAuth2 codes and tokens
+	tokenKey []byte
 
 	// Prepared statements for apcore
 	hashPassForUserID    *sql.Stmt
+	rehashUserPassword   *sql.Stmt
 	userIdForEmail       *sql.Stmt
 	userIdForBoxPath     *sql.Stmt
 	userIdForUsername    *sql.Stmt
 	userPreferences      *sql.Stmt
+	userState            *sql.Stmt
+	userIsAdmin          *sql.Stmt
+	userProfile          *sql.Stmt
+	userMFA              *sql.Stmt
+	setTOTPSecret        *sql.Stmt
+	totpSecret           *sql.Stmt
+	pendingTOTPSecret    *sql.Stmt
+	setTOTPStep          *sql.Stmt
+	useRecoveryCode      *sql.Stmt
+	insertLoginAttempt   *sql.Stmt
+	userAccount          *sql.Stmt
+	setEmailVerified     *sql.Stmt
+	setUserPassword      *sql.Stmt
+	insertInvite         *sql.Stmt
+	accountLoginFailures *sql.Stmt
+	ipLoginFailures      *sql.Stmt
+	setUserLockedUntil   *sql.Stmt
+	userLockedUntil      *sql.Stmt
+	setUserState         *sql.Stmt
+	usersInState         *sql.Stmt
+	usersPendingKeyPurge *sql.Stmt
 	insertUserPolicy     *sql.Stmt
 	insertInstancePolicy *sql.Stmt
 	updateUserPolicy     *sql.Stmt
@@ -68,10 +114,22 @@ type database struct {
 	insertUserPKey       *sql.Stmt
 	getUserPKey          *sql.Stmt
 	followersByUserUUID  *sql.Stmt
+	// Prepared statements for user relationships
+	insertRelationship           *sql.Stmt
+	deleteRelationship           *sql.Stmt
+	deleteRelationshipByActivity *sql.Stmt
+	userRelationships            *sql.Stmt
+	hasRelationship              *sql.Stmt
+	// Prepared statements for reports
+	insertReport    *sql.Stmt
+	reportsByStatus *sql.Stmt
+	reportById      *sql.Stmt
+	updateReport    *sql.Stmt
 	// Prepared statements for persistent delivery
 	insertAttempt           *sql.Stmt
 	markSuccessfulAttempt   *sql.Stmt
 	markRetryFailureAttempt *sql.Stmt
+	pendingAttempts         *sql.Stmt
 	// Prepared statements for oauth
 	createTokenInfo      *sql.Stmt
 	removeTokenByCode    *sql.Stmt
@@ -80,7 +138,25 @@ type database struct {
 	getTokenByCode       *sql.Stmt
 	getTokenByAccess     *sql.Stmt
 	getTokenByRefresh    *sql.Stmt
+	setCodeParameters    *sql.Stmt
+	codeParameters       *sql.Stmt
 	getClientById        *sql.Stmt
+	insertClient         *sql.Stmt
+	clients              *sql.Stmt
+	userGrants           *sql.Stmt
+	removeUserGrant      *sql.Stmt
+	removeClientGrants   *sql.Stmt
+	purgeExpiredTokens   *sql.Stmt
+	// Prepared statements for sessions
+	getSession           *sql.Stmt
+	insertSession        *sql.Stmt
+	updateSession        *sql.Stmt
+	touchSession         *sql.Stmt
+	deleteSession        *sql.Stmt
+	userSessions         *sql.Stmt
+	deleteUserSession    *sql.Stmt
+	deleteUserSessions   *sql.Stmt
+	purgeExpiredSessions *sql.Stmt
 	// Prepared statements for the database required by go-fed
 	inboxContains   *sql.Stmt
 	getInbox        *sql.Stmt
@@ -141,16 +217,49 @@ func newDatabase(c *config, a Application, debug bool) (db *database, err error)
 	InfoLogger.Infof("Database connections configured successfully")
 	InfoLogger.Infof("NOTE: No underlying database connections may have happened yet!")
 
+	var hasher passwordHasher
+	if hasher, err = newPasswordHasher(c); err != nil {
+		return
+	}
 	db = &database{
 		db:                    sqldb,
 		app:                   a,
 		sqlgen:                sqlgen,
 		hostname:              c.ServerConfig.Host,
-		defaultCollectionSize: c.DatabaseConfig.DefaultCollectionPageSize,
-		saltSize:              c.ServerConfig.SaltSize,
+		defaultCollectionSize: int32(c.DatabaseConfig.DefaultCollectionPageSize),
+		hasher:                hasher,
 		bcryptStrength:        c.ServerConfig.BCryptStrength,
 		rsaKeySize:            c.ServerConfig.RSAKeySize,
 	}
+	if len(c.OAuthConfig.TokenHashKeyFile) > 0 {
+		db.tokenKey, err = ioutil.ReadFile(c.OAuthConfig.TokenHashKeyFile)
+	}
+	return
+}
+
+// collectionPageSize is the default number of items in a page of an
+// ActivityStreams collection.
+func (d *database) collectionPageSize() int {
+	return int(atomic.LoadInt32(&d.defaultCollectionSize))
+}
+
+// prepareReload validates the database settings of a reloaded configuration
+// that apply to an open connection pool, returning a function that applies
+// them.
+func (d *database) prepareReload(c *config) (apply func(), err error) {
+	dc := c.DatabaseConfig
+	if dc.DefaultCollectionPageSize < 0 {
+		err = fmt.Errorf("db_default_collection_page_size is < 0")
+		return
+	}
+	apply = func() {
+		atomic.StoreInt32(&d.defaultCollectionSize, int32(dc.DefaultCollectionPageSize))
+		d.db.SetConnMaxLifetime(time.Duration(dc.ConnMaxLifetimeSeconds) * time.Second)
+		d.db.SetMaxOpenConns(dc.MaxOpenConns)
+		if dc.MaxIdleConns >= 0 {
+			d.db.SetMaxIdleConns(dc.MaxIdleConns)
+		}
+	}
 	return
 }
 
@@ -171,7 +280,7 @@ func (d *database) OpenCreateTablesClose() (err error) {
 		return
 	}
 	defer tx.Rollback()
-	err = d.sqlgen.CreateTables(tx)
+	err = d.sqlgen.UpgradeTables(tx)
 	if err != nil {
 		return
 	}
@@ -193,6 +302,23 @@ func (d *database) Open() (err error) {
 	end := time.Now()
 	InfoLogger.Infof("Successfully pinged database with latency: %s", end.Sub(start))
 
+	// Statements are prepared against the current schema, so tables
+	// created by earlier versions are upgraded first.
+	var tx *sql.Tx
+	tx, err = d.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	err = d.sqlgen.UpgradeTables(tx)
+	if err != nil {
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		return
+	}
+
 	InfoLogger.Infof("Beginning creating prepared statements")
 	start = time.Now()
 	// apcore statement preparations
@@ -200,6 +326,10 @@ func (d *database) Open() (err error) {
 	if err != nil {
 		return
 	}
+	d.rehashUserPassword, err = d.db.Prepare(d.sqlgen.RehashUserPassword())
+	if err != nil {
+		return
+	}
 	d.userIdForEmail, err = d.db.Prepare(d.sqlgen.UserIdForEmail())
 	if err != nil {
 		return
@@ -216,6 +346,90 @@ func (d *database) Open() (err error) {
 	if err != nil {
 		return
 	}
+	d.userState, err = d.db.Prepare(d.sqlgen.UserState())
+	if err != nil {
+		return
+	}
+	d.userIsAdmin, err = d.db.Prepare(d.sqlgen.UserIsAdmin())
+	if err != nil {
+		return
+	}
+	d.userProfile, err = d.db.Prepare(d.sqlgen.UserProfile())
+	if err != nil {
+		return
+	}
+	d.userMFA, err = d.db.Prepare(d.sqlgen.UserMFA())
+	if err != nil {
+		return
+	}
+	d.setTOTPSecret, err = d.db.Prepare(d.sqlgen.SetTOTPSecret())
+	if err != nil {
+		return
+	}
+	d.totpSecret, err = d.db.Prepare(d.sqlgen.TOTPSecret())
+	if err != nil {
+		return
+	}
+	d.pendingTOTPSecret, err = d.db.Prepare(d.sqlgen.PendingTOTPSecret())
+	if err != nil {
+		return
+	}
+	d.setTOTPStep, err = d.db.Prepare(d.sqlgen.SetTOTPStep())
+	if err != nil {
+		return
+	}
+	d.useRecoveryCode, err = d.db.Prepare(d.sqlgen.UseRecoveryCode())
+	if err != nil {
+		return
+	}
+	d.insertLoginAttempt, err = d.db.Prepare(d.sqlgen.InsertLoginAttempt())
+	if err != nil {
+		return
+	}
+	d.userAccount, err = d.db.Prepare(d.sqlgen.UserAccount())
+	if err != nil {
+		return
+	}
+	d.setEmailVerified, err = d.db.Prepare(d.sqlgen.SetEmailVerified())
+	if err != nil {
+		return
+	}
+	d.setUserPassword, err = d.db.Prepare(d.sqlgen.SetUserPassword())
+	if err != nil {
+		return
+	}
+	d.insertInvite, err = d.db.Prepare(d.sqlgen.InsertInvite())
+	if err != nil {
+		return
+	}
+	d.accountLoginFailures, err = d.db.Prepare(d.sqlgen.AccountLoginFailures())
+	if err != nil {
+		return
+	}
+	d.ipLoginFailures, err = d.db.Prepare(d.sqlgen.IPLoginFailures())
+	if err != nil {
+		return
+	}
+	d.setUserLockedUntil, err = d.db.Prepare(d.sqlgen.SetUserLockedUntil())
+	if err != nil {
+		return
+	}
+	d.userLockedUntil, err = d.db.Prepare(d.sqlgen.UserLockedUntil())
+	if err != nil {
+		return
+	}
+	d.setUserState, err = d.db.Prepare(d.sqlgen.SetUserState())
+	if err != nil {
+		return
+	}
+	d.usersInState, err = d.db.Prepare(d.sqlgen.UsersInState())
+	if err != nil {
+		return
+	}
+	d.usersPendingKeyPurge, err = d.db.Prepare(d.sqlgen.UsersPendingKeyPurge())
+	if err != nil {
+		return
+	}
 	d.updateUserPolicy, err = d.db.Prepare(d.sqlgen.UpdateUserPolicy())
 	if err != nil {
 		return
@@ -257,6 +471,46 @@ func (d *database) Open() (err error) {
 		return
 	}
 
+	// prepared statements for user relationships
+	d.insertRelationship, err = d.db.Prepare(d.sqlgen.InsertRelationship())
+	if err != nil {
+		return
+	}
+	d.deleteRelationship, err = d.db.Prepare(d.sqlgen.DeleteRelationship())
+	if err != nil {
+		return
+	}
+	d.deleteRelationshipByActivity, err = d.db.Prepare(d.sqlgen.DeleteRelationshipByActivity())
+	if err != nil {
+		return
+	}
+	d.userRelationships, err = d.db.Prepare(d.sqlgen.UserRelationships())
+	if err != nil {
+		return
+	}
+	d.hasRelationship, err = d.db.Prepare(d.sqlgen.HasRelationship())
+	if err != nil {
+		return
+	}
+
+	// prepared statements for reports
+	d.insertReport, err = d.db.Prepare(d.sqlgen.InsertReport())
+	if err != nil {
+		return
+	}
+	d.reportsByStatus, err = d.db.Prepare(d.sqlgen.ReportsByStatus())
+	if err != nil {
+		return
+	}
+	d.reportById, err = d.db.Prepare(d.sqlgen.ReportById())
+	if err != nil {
+		return
+	}
+	d.updateReport, err = d.db.Prepare(d.sqlgen.UpdateReport())
+	if err != nil {
+		return
+	}
+
 	// prepared statements for persistent delivery
 	d.insertAttempt, err = d.db.Prepare(d.sqlgen.InsertAttempt())
 	if err != nil {
@@ -270,6 +524,10 @@ func (d *database) Open() (err error) {
 	if err != nil {
 		return
 	}
+	d.pendingAttempts, err = d.db.Prepare(d.sqlgen.PendingAttempts())
+	if err != nil {
+		return
+	}
 
 	// prepared statements for oauth
 	d.createTokenInfo, err = d.db.Prepare(d.sqlgen.CreateTokenInfo())
@@ -300,10 +558,78 @@ func (d *database) Open() (err error) {
 	if err != nil {
 		return
 	}
+	d.setCodeParameters, err = d.db.Prepare(d.sqlgen.SetTokenCodeParameters())
+	if err != nil {
+		return
+	}
+	d.codeParameters, err = d.db.Prepare(d.sqlgen.TokenCodeParameters())
+	if err != nil {
+		return
+	}
 	d.getClientById, err = d.db.Prepare(d.sqlgen.GetClientById())
 	if err != nil {
 		return
 	}
+	d.insertClient, err = d.db.Prepare(d.sqlgen.InsertClient())
+	if err != nil {
+		return
+	}
+	d.clients, err = d.db.Prepare(d.sqlgen.Clients())
+	if err != nil {
+		return
+	}
+	d.userGrants, err = d.db.Prepare(d.sqlgen.UserGrants())
+	if err != nil {
+		return
+	}
+	d.removeUserGrant, err = d.db.Prepare(d.sqlgen.RemoveUserGrant())
+	if err != nil {
+		return
+	}
+	d.removeClientGrants, err = d.db.Prepare(d.sqlgen.RemoveUserClientGrants())
+	if err != nil {
+		return
+	}
+	d.purgeExpiredTokens, err = d.db.Prepare(d.sqlgen.PurgeExpiredTokens())
+	if err != nil {
+		return
+	}
+	d.getSession, err = d.db.Prepare(d.sqlgen.GetSession())
+	if err != nil {
+		return
+	}
+	d.insertSession, err = d.db.Prepare(d.sqlgen.InsertSession())
+	if err != nil {
+		return
+	}
+	d.updateSession, err = d.db.Prepare(d.sqlgen.UpdateSession())
+	if err != nil {
+		return
+	}
+	d.touchSession, err = d.db.Prepare(d.sqlgen.TouchSession())
+	if err != nil {
+		return
+	}
+	d.deleteSession, err = d.db.Prepare(d.sqlgen.DeleteSession())
+	if err != nil {
+		return
+	}
+	d.userSessions, err = d.db.Prepare(d.sqlgen.UserSessions())
+	if err != nil {
+		return
+	}
+	d.deleteUserSession, err = d.db.Prepare(d.sqlgen.DeleteUserSession())
+	if err != nil {
+		return
+	}
+	d.deleteUserSessions, err = d.db.Prepare(d.sqlgen.DeleteUserSessions())
+	if err != nil {
+		return
+	}
+	d.purgeExpiredSessions, err = d.db.Prepare(d.sqlgen.PurgeExpiredSessions())
+	if err != nil {
+		return
+	}
 
 	// go-fed statement preparations
 	d.inboxContains, err = d.db.Prepare(d.sqlgen.InboxContains())
@@ -397,26 +723,35 @@ func postgresConn(pg postgresConfig) (s string, err error) {
 		return
 	}
 	s = fmt.Sprintf("dbname=%s user=%s", pg.DatabaseName, pg.UserName)
-	var hasPw bool
-	hasPw, err = promptDoesXHavePassword(
-		fmt.Sprintf(
-			"user=%q in db_name=%q",
-			pg.UserName,
-			pg.DatabaseName))
-	if err != nil {
-		return
-	}
-	if hasPw {
-		var pw string
-		pw, err = promptPassword(
+	pw := pg.Password
+	_, answered := answers["pg_has_password"]
+	if len(pw) == 0 && (answered || !*nonInteractiveFlag) {
+		var hasPw bool
+		hasPw, err = promptDoesXHavePassword(
+			"pg_has_password",
 			fmt.Sprintf(
-				"Please enter the password for db_name=%q and user=%q:",
-				pg.DatabaseName,
-				pg.UserName))
+				"user=%q in db_name=%q",
+				pg.UserName,
+				pg.DatabaseName))
 		if err != nil {
 			return
 		}
-		s = fmt.Sprintf("%s password=%s", s, pw)
+		if hasPw {
+			pw, err = promptPassword(
+				"pg_password",
+				fmt.Sprintf(
+					"Please enter the password for db_name=%q and user=%q:",
+					pg.DatabaseName,
+					pg.UserName))
+			if err != nil {
+				return
+			}
+		}
+	}
+	if len(pw) > 0 {
+		// Quoted, as passwords may contain spaces.
+		pw = strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(pw)
+		s = fmt.Sprintf("%s password='%s'", s, pw)
 	}
 	if len(pg.Host) > 0 {
 		s = fmt.Sprintf("%s host=%s", s, pg.Host)
@@ -448,10 +783,32 @@ func postgresConn(pg postgresConfig) (s string, err error) {
 func (d *database) Close() error {
 	// apcore
 	d.hashPassForUserID.Close()
+	d.rehashUserPassword.Close()
 	d.userIdForEmail.Close()
 	d.userIdForBoxPath.Close()
 	d.userIdForUsername.Close()
 	d.userPreferences.Close()
+	d.userState.Close()
+	d.userIsAdmin.Close()
+	d.userProfile.Close()
+	d.userMFA.Close()
+	d.setTOTPSecret.Close()
+	d.totpSecret.Close()
+	d.pendingTOTPSecret.Close()
+	d.setTOTPStep.Close()
+	d.useRecoveryCode.Close()
+	d.insertLoginAttempt.Close()
+	d.userAccount.Close()
+	d.setEmailVerified.Close()
+	d.setUserPassword.Close()
+	d.insertInvite.Close()
+	d.accountLoginFailures.Close()
+	d.ipLoginFailures.Close()
+	d.setUserLockedUntil.Close()
+	d.userLockedUntil.Close()
+	d.setUserState.Close()
+	d.usersInState.Close()
+	d.usersPendingKeyPurge.Close()
 	d.insertUserPolicy.Close()
 	d.insertInstancePolicy.Close()
 	d.updateUserPolicy.Close()
@@ -462,10 +819,22 @@ func (d *database) Close() error {
 	d.insertUserPKey.Close()
 	d.getUserPKey.Close()
 	d.followersByUserUUID.Close()
+	// user relationships
+	d.insertRelationship.Close()
+	d.deleteRelationship.Close()
+	d.deleteRelationshipByActivity.Close()
+	d.userRelationships.Close()
+	d.hasRelationship.Close()
+	// reports
+	d.insertReport.Close()
+	d.reportsByStatus.Close()
+	d.reportById.Close()
+	d.updateReport.Close()
 	// transport retries
 	d.insertAttempt.Close()
 	d.markSuccessfulAttempt.Close()
 	d.markRetryFailureAttempt.Close()
+	d.pendingAttempts.Close()
 	// oauth
 	d.createTokenInfo.Close()
 	d.removeTokenByCode.Close()
@@ -474,7 +843,24 @@ func (d *database) Close() error {
 	d.getTokenByCode.Close()
 	d.getTokenByAccess.Close()
 	d.getTokenByRefresh.Close()
+	d.setCodeParameters.Close()
+	d.codeParameters.Close()
 	d.getClientById.Close()
+	d.insertClient.Close()
+	d.clients.Close()
+	d.userGrants.Close()
+	d.removeUserGrant.Close()
+	d.removeClientGrants.Close()
+	d.purgeExpiredTokens.Close()
+	d.getSession.Close()
+	d.insertSession.Close()
+	d.updateSession.Close()
+	d.touchSession.Close()
+	d.deleteSession.Close()
+	d.userSessions.Close()
+	d.deleteUserSession.Close()
+	d.deleteUserSessions.Close()
+	d.purgeExpiredSessions.Close()
 	// go-fed
 	d.inboxContains.Close()
 	d.getInbox.Close()
@@ -525,32 +911,91 @@ func (d *database) Valid(c context.Context, userId, pass string) (valid bool, er
 	if err = r.Err(); err != nil {
 		return
 	}
-	valid = passEquals(pass, salt, hash)
+	var rehash bool
+	if valid, rehash = d.hasher.Verify(pass, hash, salt); !valid || !rehash {
+		return
+	}
+	// Upgrade the hash to the current algorithm and parameters. The old
+	// hash is compared so a concurrent password change is not clobbered.
+	var newHash []byte
+	if newHash, err = d.hasher.Hash(pass); err != nil {
+		return
+	}
+	_, err = d.rehashUserPassword.ExecContext(c, userId, newHash, []byte{}, hash)
 	return
 }
 
 func (d *database) CreateUser(c context.Context,
 	scheme, host, username, preferredUsername, summary, email, pass string) (userId string, err error) {
-	return d.createUser(c, scheme, host, username, preferredUsername, summary, email, pass, false, pub.OnFollowAutomaticallyAccept)
+	return d.createUser(c, scheme, host, username, preferredUsername, summary, email, pass, false, false, pub.OnFollowAutomaticallyAccept)
+}
+
+// RegisterUser creates a user who signed up, with an unverified email. A
+// non-empty invite code is consumed, failing with errInvalidInvite if it cannot
+// be used.
+func (d *database) RegisterUser(c context.Context,
+	scheme, host, username, email, pass, inviteCode string, state userState) (userId string, err error) {
+	var tx *sql.Tx
+	tx, err = d.db.BeginTx(c, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	if len(inviteCode) > 0 {
+		var res sql.Result
+		if res, err = tx.ExecContext(c, d.sqlgen.UseInvite(), hashToken(d.tokenKey, inviteCode)); err != nil {
+			return
+		}
+		var n int64
+		if n, err = res.RowsAffected(); err != nil {
+			return
+		} else if n != 1 {
+			err = errInvalidInvite
+			return
+		}
+	}
+	if userId, err = d.createUserTx(c, tx, scheme, host, username, username, "", email, pass, false, false, state, false, pub.OnFollowAutomaticallyAccept); err != nil {
+		return
+	}
+	err = tx.Commit()
+	return
 }
 
+// CreateAdminUser creates an administrator, who must enroll in multi-factor
+// authentication at their next login if mfaRequired is true.
 func (d *database) CreateAdminUser(c context.Context,
-	scheme, host, username, preferredUsername, summary, email, pass string) (userId string, err error) {
-	return d.createUser(c, scheme, host, username, preferredUsername, summary, email, pass, true, pub.OnFollowAutomaticallyAccept)
+	scheme, host, username, preferredUsername, summary, email, pass string, mfaRequired bool) (userId string, err error) {
+	return d.createUser(c, scheme, host, username, preferredUsername, summary, email, pass, true, mfaRequired, pub.OnFollowAutomaticallyAccept)
 }
 
 func (d *database) createUser(c context.Context,
 	scheme, host, username, preferredUsername, summary, email, pass string,
-	admin bool,
+	admin, mfaRequired bool,
 	onFollow pub.OnFollowBehavior) (userId string, err error) {
-	// Prepare Salt & Hash Password
-	var salt []byte
-	salt, err = newSalt(d.saltSize)
+	var tx *sql.Tx
+	tx, err = d.db.BeginTx(c, nil)
 	if err != nil {
 		return
 	}
+	defer tx.Rollback()
+	// Users created by administrators have trusted emails.
+	if userId, err = d.createUserTx(c, tx, scheme, host, username, preferredUsername, summary, email, pass, admin, mfaRequired, userActive, true, onFollow); err != nil {
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+func (d *database) createUserTx(c context.Context, tx *sql.Tx,
+	scheme, host, username, preferredUsername, summary, email, pass string,
+	admin, mfaRequired bool,
+	state userState,
+	emailVerified bool,
+	onFollow pub.OnFollowBehavior) (userId string, err error) {
+	// Hash Password; the salt is part of the versioned hash
+	salt := []byte{}
 	var hashpass []byte
-	hashpass, err = hashPasswordWithSalt(pass, salt, d.bcryptStrength)
+	hashpass, err = d.hasher.Hash(pass)
 	if err != nil {
 		return
 	}
@@ -568,12 +1013,6 @@ func (d *database) createUser(c context.Context,
 	// Prepare preferences
 	onFol := toOnFollow(onFollow)
 
-	var tx *sql.Tx
-	tx, err = d.db.BeginTx(c, nil)
-	if err != nil {
-		return
-	}
-	defer tx.Rollback()
 	// Create ActivityStreams `actor`
 	var actor vocab.ActivityStreamsPerson
 	actor, err = toPersonActor(d.app, scheme, host, username, preferredUsername, summary, k.PublicKey)
@@ -609,7 +1048,7 @@ func (d *database) createUser(c context.Context,
 	r.Close()
 
 	// Insert into user_privileges table
-	_, err = tx.ExecContext(c, d.sqlgen.InsertUserPrivileges(), userId, admin)
+	_, err = tx.ExecContext(c, d.sqlgen.InsertUserPrivileges(), userId, admin, mfaRequired, state, emailVerified)
 	if err != nil {
 		return
 	}
@@ -620,11 +1059,6 @@ func (d *database) createUser(c context.Context,
 	}
 	// Insert into private_keys table
 	_, err = tx.ExecContext(c, d.sqlgen.InsertUserPKey(), userId, pkb)
-	if err != nil {
-		return
-	}
-
-	err = tx.Commit()
 	return
 }
 
@@ -682,7 +1116,7 @@ func (d *database) UserIdForBoxPath(c context.Context, boxPath string) (userId s
 
 func (d *database) UserIdForUsername(c context.Context, preferredUsername string) (userId string, err error) {
 	var r *sql.Rows
-	r, err = d.userIdForBoxPath.QueryContext(c, preferredUsername)
+	r, err = d.userIdForUsername.QueryContext(c, preferredUsername)
 	if err != nil {
 		return
 	}
@@ -729,40 +1163,508 @@ func (d *database) UserPreferences(c context.Context, userId string) (u userPref
 	return
 }
 
-func (d *database) InsertPolicy(c context.Context, p policy) (err error) {
-	if p.IsInstancePolicy {
-		_, err = d.insertInstancePolicy.ExecContext(c,
-			p.Order,
-			p.Description,
-			p.Subject,
-			p.Kind)
-	} else {
-		_, err = d.insertUserPolicy.ExecContext(c,
-			p.Order,
-			p.UserId,
-			p.Description,
-			p.Subject,
-			p.Kind)
+// UserProfile fetches the claims of a user's actor for OpenID Connect.
+func (d *database) UserProfile(c context.Context, userId string) (p oidcProfile, err error) {
+	var id *string
+	err = d.userProfile.QueryRowContext(c, userId).Scan(
+		&id,
+		&p.PreferredUsername,
+		&p.Name,
+		&p.Picture)
+	if err == sql.ErrNoRows {
+		err = fmt.Errorf("no user %q", userId)
+	} else if id != nil {
+		p.Profile = *id
 	}
 	return
 }
 
-func (d *database) UpdatePolicy(c context.Context, p policy) (err error) {
-	if p.IsInstancePolicy {
-		_, err = d.updateInstancePolicy.ExecContext(c,
-			p.Id,
-			p.Order,
-			p.Description,
-			p.Subject,
-			p.Kind)
-	} else {
-		_, err = d.updateUserPolicy.ExecContext(c,
-			p.Id,
-			p.Order,
-			p.UserId,
-			p.Description,
-			p.Subject,
-			p.Kind)
+// mfaStatus is whether a user has enrolled in, or must enroll in, multi-factor
+// authentication.
+type mfaStatus struct {
+	enabled  bool
+	required bool
+}
+
+// UserMFA fetches the multi-factor authentication status of a user.
+func (d *database) UserMFA(c context.Context, userId string) (s mfaStatus, err error) {
+	err = d.userMFA.QueryRowContext(c, userId).Scan(&s.enabled, &s.required)
+	if err == sql.ErrNoRows {
+		err = fmt.Errorf("no user privileges for user %q", userId)
+	}
+	return
+}
+
+// SetTOTPSecret begins TOTP enrollment of a user, replacing any secret of an
+// enrollment that was not completed. It fails if the user has already enrolled.
+func (d *database) SetTOTPSecret(c context.Context, userId string, secret []byte) (err error) {
+	var sealed []byte
+	if sealed, err = sealTOTPSecret(d.tokenKey, secret); err != nil {
+		return
+	}
+	var res sql.Result
+	if res, err = d.setTOTPSecret.ExecContext(c, userId, sealed); err != nil {
+		return
+	}
+	var n int64
+	if n, err = res.RowsAffected(); err != nil {
+		return
+	} else if n == 0 {
+		err = fmt.Errorf("user %q has already enrolled in multi-factor authentication", userId)
+	}
+	return
+}
+
+// TOTPSecret fetches the TOTP secret of a user, and whether enrollment is
+// complete.
+func (d *database) TOTPSecret(c context.Context, userId string) (secret []byte, enabled bool, err error) {
+	var sealed []byte
+	err = d.totpSecret.QueryRowContext(c, userId).Scan(&sealed, &enabled)
+	if err == sql.ErrNoRows {
+		err = fmt.Errorf("user %q has not begun TOTP enrollment", userId)
+		return
+	} else if err != nil {
+		return
+	}
+	secret, err = openTOTPSecret(d.tokenKey, sealed)
+	return
+}
+
+// PendingTOTPSecret fetches the TOTP secret of a user whose enrollment is not
+// complete, if it was created after the given time. Otherwise, the secret is
+// nil.
+func (d *database) PendingTOTPSecret(c context.Context, userId string, after time.Time) (secret []byte, err error) {
+	var sealed []byte
+	err = d.pendingTOTPSecret.QueryRowContext(c, userId, after).Scan(&sealed)
+	if err == sql.ErrNoRows {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+	secret, err = openTOTPSecret(d.tokenKey, sealed)
+	return
+}
+
+// AcceptTOTPStep records the time step of a verified TOTP code, returning false
+// if it or a later code was already used.
+func (d *database) AcceptTOTPStep(c context.Context, userId string, step int64) (ok bool, err error) {
+	var res sql.Result
+	if res, err = d.setTOTPStep.ExecContext(c, userId, step); err != nil {
+		return
+	}
+	var n int64
+	n, err = res.RowsAffected()
+	ok = n == 1
+	return
+}
+
+// EnableMFA completes enrollment of a user, storing the hashes of the given
+// recovery codes.
+func (d *database) EnableMFA(c context.Context, userId string, codes []string) (err error) {
+	var tx *sql.Tx
+	tx, err = d.db.BeginTx(c, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	if _, err = tx.ExecContext(c, d.sqlgen.EnableMFA(), userId); err != nil {
+		return
+	}
+	if err = d.replaceRecoveryCodes(c, tx, userId, codes); err != nil {
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+// ReplaceRecoveryCodes invalidates the recovery codes of a user in favor of the
+// given ones.
+func (d *database) ReplaceRecoveryCodes(c context.Context, userId string, codes []string) (err error) {
+	var tx *sql.Tx
+	tx, err = d.db.BeginTx(c, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	if err = d.replaceRecoveryCodes(c, tx, userId, codes); err != nil {
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+func (d *database) replaceRecoveryCodes(c context.Context, tx *sql.Tx, userId string, codes []string) (err error) {
+	if _, err = tx.ExecContext(c, d.sqlgen.DeleteRecoveryCodes(), userId); err != nil {
+		return
+	}
+	for _, code := range codes {
+		if _, err = tx.ExecContext(c, d.sqlgen.InsertRecoveryCode(), userId, hashToken(d.tokenKey, normalizeRecoveryCode(code))); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// UseRecoveryCode consumes an unused recovery code of a user, returning false
+// if there is none matching.
+func (d *database) UseRecoveryCode(c context.Context, userId, code string) (ok bool, err error) {
+	code = normalizeRecoveryCode(code)
+	if len(code) == 0 {
+		return
+	}
+	var res sql.Result
+	if res, err = d.useRecoveryCode.ExecContext(c, userId, hashToken(d.tokenKey, code)); err != nil {
+		return
+	}
+	var n int64
+	n, err = res.RowsAffected()
+	ok = n == 1
+	return
+}
+
+// DisableMFA removes the TOTP secret and recovery codes of a user.
+func (d *database) DisableMFA(c context.Context, userId string) (err error) {
+	var tx *sql.Tx
+	tx, err = d.db.BeginTx(c, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	if _, err = tx.ExecContext(c, d.sqlgen.DeleteMFA(), userId); err != nil {
+		return
+	}
+	if _, err = tx.ExecContext(c, d.sqlgen.DeleteRecoveryCodes(), userId); err != nil {
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+// userAccount is the account information of a user used for email
+// verification and password resets.
+type userAccount struct {
+	email    string
+	hashpass []byte
+	verified bool
+	state    userState
+}
+
+func (d *database) UserAccount(c context.Context, userId string) (a userAccount, err error) {
+	var state string
+	err = d.userAccount.QueryRowContext(c, userId).Scan(&a.email, &a.hashpass, &a.verified, &state)
+	if err == sql.ErrNoRows {
+		err = fmt.Errorf("no user %q", userId)
+		return
+	} else if err != nil {
+		return
+	}
+	a.state, err = toUserState(state)
+	return
+}
+
+func (d *database) SetEmailVerified(c context.Context, userId string) error {
+	_, err := d.setEmailVerified.ExecContext(c, userId)
+	return err
+}
+
+// SetPassword hashes and replaces the password of a user.
+func (d *database) SetPassword(c context.Context, userId, pass string) (err error) {
+	var hashpass []byte
+	if hashpass, err = d.hasher.Hash(pass); err != nil {
+		return
+	}
+	_, err = d.setUserPassword.ExecContext(c, userId, hashpass, []byte{})
+	return
+}
+
+// InsertInvite stores the hash of an invite code, which expires at the given
+// time unless it is zero.
+func (d *database) InsertInvite(c context.Context, code, createdBy string, expires time.Time, maxUses int) error {
+	var by sql.NullString
+	if len(createdBy) > 0 {
+		by = sql.NullString{String: createdBy, Valid: true}
+	}
+	var exp *time.Time
+	if !expires.IsZero() {
+		exp = &expires
+	}
+	_, err := d.insertInvite.ExecContext(c, hashToken(d.tokenKey, code), by, exp, maxUses)
+	return err
+}
+
+// loginAttempt is an entry in the audit log of logins.
+type loginAttempt struct {
+	// account is the user id, or the email if no such user exists.
+	account string
+	userId  string
+	email   string
+	ip      string
+	success bool
+	reason  string
+}
+
+func (d *database) InsertLoginAttempt(c context.Context, a loginAttempt) error {
+	var userId sql.NullString
+	if len(a.userId) > 0 {
+		userId = sql.NullString{String: a.userId, Valid: true}
+	}
+	_, err := d.insertLoginAttempt.ExecContext(c,
+		a.account,
+		userId,
+		a.email,
+		a.ip,
+		a.success,
+		a.reason)
+	return err
+}
+
+// AccountLoginFailures counts the failed logins of an account since the given
+// time and its last successful login.
+func (d *database) AccountLoginFailures(c context.Context, account string, since time.Time) (n int, last time.Time, err error) {
+	var t *time.Time
+	if err = d.accountLoginFailures.QueryRowContext(c, account, since).Scan(&n, &t); err != nil {
+		return
+	} else if t != nil {
+		last = *t
+	}
+	return
+}
+
+// IPLoginFailures counts the failed logins from an IP address since the given
+// time.
+func (d *database) IPLoginFailures(c context.Context, ip string, since time.Time) (n int, last time.Time, err error) {
+	var t *time.Time
+	if err = d.ipLoginFailures.QueryRowContext(c, ip, since).Scan(&n, &t); err != nil {
+		return
+	} else if t != nil {
+		last = *t
+	}
+	return
+}
+
+func (d *database) SetUserLockedUntil(c context.Context, userId string, t time.Time) error {
+	_, err := d.setUserLockedUntil.ExecContext(c, userId, t)
+	return err
+}
+
+// UserLockedUntil fetches the time until which a user is locked out, which is
+// zero if they never were.
+func (d *database) UserLockedUntil(c context.Context, userId string) (t time.Time, err error) {
+	var lu *time.Time
+	err = d.userLockedUntil.QueryRowContext(c, userId).Scan(&lu)
+	if err == sql.ErrNoRows {
+		err = fmt.Errorf("no user privileges for user %q", userId)
+	} else if lu != nil {
+		t = *lu
+	}
+	return
+}
+
+func (d *database) UserIsAdmin(c context.Context, userId string) (admin bool, err error) {
+	err = d.userIsAdmin.QueryRowContext(c, userId).Scan(&admin)
+	if err == sql.ErrNoRows {
+		err = fmt.Errorf("no user privileges for user %q", userId)
+	}
+	return
+}
+
+func (d *database) UserState(c context.Context, userId string) (u userState, err error) {
+	var r *sql.Rows
+	r, err = d.userState.QueryContext(c, userId)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	var n int
+	var s string
+	for r.Next() {
+		if n > 0 {
+			err = fmt.Errorf("multiple rows when obtaining user state")
+			return
+		}
+		if err = r.Scan(&s); err != nil {
+			return
+		}
+		n++
+	}
+	if err = r.Err(); err != nil {
+		return
+	}
+	if n == 0 {
+		err = fmt.Errorf("no user state for user %q", userId)
+		return
+	}
+	u, err = toUserState(s)
+	return
+}
+
+func (d *database) SetUserState(c context.Context, userId string, u userState) (err error) {
+	_, err = d.setUserState.ExecContext(c, userId, u)
+	return
+}
+
+// userToDelete is a local user pending deletion.
+type userToDelete struct {
+	UserId       string
+	ActorIRI     *url.URL
+	OutboxIRI    *url.URL
+	FollowersIRI *url.URL
+}
+
+func (u *userToDelete) Load(row scanner) (err error) {
+	var actor, outbox, followers string
+	if err = row.Scan(&u.UserId, &actor, &outbox, &followers); err != nil {
+		return
+	}
+	if u.ActorIRI, err = url.Parse(actor); err != nil {
+		return
+	}
+	if u.OutboxIRI, err = url.Parse(outbox); err != nil {
+		return
+	}
+	u.FollowersIRI, err = url.Parse(followers)
+	return
+}
+
+func (d *database) UsersPendingDeletion(c context.Context) (us []userToDelete, err error) {
+	var r *sql.Rows
+	r, err = d.usersInState.QueryContext(c, userPendingDeletion)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	for r.Next() {
+		var u userToDelete
+		if err = u.Load(r); err != nil {
+			return
+		}
+		us = append(us, u)
+	}
+	if err = r.Err(); err != nil {
+		return
+	}
+	return
+}
+
+// TombstoneUser replaces the user's actor with the Tombstone, removes their
+// private data, and marks them as deleted. The actor's keys are kept, and its
+// publicKey is kept on the Tombstone, so that the Delete can still be signed
+// and verified until PurgeUserKeys.
+func (d *database) TombstoneUser(c context.Context, userId string, tombstone vocab.ActivityStreamsTombstone, actor vocab.Type) (err error) {
+	var m, am map[string]interface{}
+	if m, err = streams.Serialize(tombstone); err != nil {
+		return
+	} else if am, err = streams.Serialize(actor); err != nil {
+		return
+	}
+	if pk, ok := am["publicKey"]; ok {
+		m["@context"] = am["@context"]
+		m["publicKey"] = pk
+	}
+	var b []byte
+	if b, err = json.Marshal(m); err != nil {
+		return
+	}
+	var tx *sql.Tx
+	tx, err = d.db.BeginTx(c, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(c, d.sqlgen.TombstoneUser(), userId, b); err != nil {
+		return
+	}
+	if _, err = tx.ExecContext(c, d.sqlgen.DeleteUserInbox(), userId); err != nil {
+		return
+	}
+	if _, err = tx.ExecContext(c, d.sqlgen.DeleteUserTokens(), userId); err != nil {
+		return
+	}
+	if _, err = tx.ExecContext(c, d.sqlgen.SetUserState(), userId, userDeleted); err != nil {
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+// UsersPendingKeyPurge lists the deleted users that still have keys, but no
+// pending deliveries that need them.
+func (d *database) UsersPendingKeyPurge(c context.Context) (userIds []string, err error) {
+	var r *sql.Rows
+	r, err = d.usersPendingKeyPurge.QueryContext(c, userDeleted)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	for r.Next() {
+		var id string
+		if err = r.Scan(&id); err != nil {
+			return
+		}
+		userIds = append(userIds, id)
+	}
+	if err = r.Err(); err != nil {
+		return
+	}
+	return
+}
+
+// PurgeUserKeys removes the keys of a deleted user, and the publicKey from
+// their Tombstone.
+func (d *database) PurgeUserKeys(c context.Context, userId string) (err error) {
+	var tx *sql.Tx
+	tx, err = d.db.BeginTx(c, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(c, d.sqlgen.DeleteUserPKeys(), userId); err != nil {
+		return
+	}
+	if _, err = tx.ExecContext(c, d.sqlgen.RemoveActorPublicKey(), userId); err != nil {
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+func (d *database) InsertPolicy(c context.Context, p policy) (err error) {
+	if p.IsInstancePolicy {
+		_, err = d.insertInstancePolicy.ExecContext(c,
+			p.Order,
+			p.Description,
+			p.Subject,
+			p.Kind)
+	} else {
+		_, err = d.insertUserPolicy.ExecContext(c,
+			p.Order,
+			p.UserId,
+			p.Description,
+			p.Subject,
+			p.Kind)
+	}
+	return
+}
+
+func (d *database) UpdatePolicy(c context.Context, p policy) (err error) {
+	if p.IsInstancePolicy {
+		_, err = d.updateInstancePolicy.ExecContext(c,
+			p.Id,
+			p.Order,
+			p.Description,
+			p.Subject,
+			p.Kind)
+	} else {
+		_, err = d.updateUserPolicy.ExecContext(c,
+			p.Id,
+			p.Order,
+			p.UserId,
+			p.Description,
+			p.Subject,
+			p.Kind)
 	}
 	return
 }
@@ -820,9 +1722,12 @@ func (d *database) InsertResolutions(c context.Context, r []resolution) (err err
 			d.sqlgen.InsertResolutions(),
 			res.TargetUserId,
 			res.Permit,
+			res.Action,
 			res.ActivityId.String(),
 			res.Public,
-			res.Reason)
+			res.Reason,
+			res.Order,
+			res.PolicyId)
 		if err != nil {
 			return
 		}
@@ -851,51 +1756,235 @@ func (d *database) UserResolutions(c context.Context, userId string) (r []resolu
 	return
 }
 
-func (d *database) InsertUserPKey(c context.Context, userUUID string, k *rsa.PrivateKey) (id int64, err error) {
-	var pKeyB []byte
-	pKeyB, err = serializeRSAPrivateKey(k)
+func (d *database) InsertUserPKey(c context.Context, userUUID string, k *rsa.PrivateKey) (id int64, err error) {
+	var pKeyB []byte
+	pKeyB, err = serializeRSAPrivateKey(k)
+	if err != nil {
+		return
+	}
+	var res sql.Result
+	res, err = d.insertUserPKey.ExecContext(c, userUUID, pKeyB)
+	if err != nil {
+		return
+	}
+	id, err = res.LastInsertId()
+	return
+}
+
+func (d *database) GetUserPKey(c context.Context, userUUID string) (kUUID string, k *rsa.PrivateKey, err error) {
+	var rw *sql.Rows
+	rw, err = d.getUserPKey.QueryContext(c, userUUID)
+	if err != nil {
+		return
+	}
+	defer rw.Close()
+	var pKeyB []byte
+	var n int
+	for rw.Next() {
+		if n > 0 {
+			err = fmt.Errorf("multiple rows when getting user private key: %s", userUUID)
+			return
+		}
+		if err = rw.Scan(&kUUID, &pKeyB); err != nil {
+			return
+		}
+		n++
+	}
+	if err = rw.Err(); err != nil {
+		return
+	}
+	var pk crypto.PrivateKey
+	pk, err = deserializeRSAPrivateKey(pKeyB)
+	var ok bool
+	k, ok = pk.(*rsa.PrivateKey)
+	if !ok {
+		err = fmt.Errorf("private key is not of type *rsa.PrivateKey")
+		return
+	}
+	return
+}
+
+func (d *database) insertRelationshipImpl(c context.Context, userId string, kind RelationshipKind, subject string, expires time.Time, activityIRI *url.URL) (err error) {
+	var exp *time.Time
+	if !expires.IsZero() {
+		exp = &expires
+	}
+	var act sql.NullString
+	if activityIRI != nil {
+		act = sql.NullString{String: activityIRI.String(), Valid: true}
+	}
+	_, err = d.insertRelationship.ExecContext(c,
+		userId,
+		kind,
+		subject,
+		exp,
+		act)
+	return
+}
+
+func (d *database) hasRelationshipImpl(c context.Context, userId string, kind RelationshipKind, subject string) (has bool, err error) {
+	var r *sql.Rows
+	r, err = d.hasRelationship.QueryContext(c, userId, kind, subject)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	var n int
+	for r.Next() {
+		if n > 0 {
+			err = fmt.Errorf("multiple rows when checking user relationship")
+			return
+		}
+		if err = r.Scan(&has); err != nil {
+			return
+		}
+		n++
+	}
+	if err = r.Err(); err != nil {
+		return
+	}
+	return
+}
+
+func (d *database) Relationships(c context.Context, userId string) (rs []Relationship, err error) {
+	var r *sql.Rows
+	r, err = d.userRelationships.QueryContext(c, userId)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	for r.Next() {
+		var rel Relationship
+		if err = rel.Load(r); err != nil {
+			return
+		}
+		rs = append(rs, rel)
+	}
+	if err = r.Err(); err != nil {
+		return
+	}
+	return
+}
+
+func (d *database) IsBlocking(c context.Context, userId string, actor *url.URL) (blocking bool, err error) {
+	if blocking, err = d.hasRelationshipImpl(c, userId, RelationshipBlock, actor.String()); err != nil || blocking {
+		return
+	}
+	blocking, err = d.hasRelationshipImpl(c, userId, RelationshipDomainBlock, actor.Hostname())
+	return
+}
+
+func (d *database) IsMuting(c context.Context, userId string, actor *url.URL) (muting bool, err error) {
+	return d.hasRelationshipImpl(c, userId, RelationshipMute, actor.String())
+}
+
+func (d *database) Block(c context.Context, userId string, actor *url.URL, activityIRI *url.URL) (err error) {
+	return d.insertRelationshipImpl(c, userId, RelationshipBlock, actor.String(), time.Time{}, activityIRI)
+}
+
+func (d *database) UndoBlock(c context.Context, userId string, activityIRI *url.URL) (err error) {
+	_, err = d.deleteRelationshipByActivity.ExecContext(c, userId, activityIRI.String())
+	return
+}
+
+func (d *database) Mute(c context.Context, userId string, actor *url.URL, expires time.Time) (err error) {
+	return d.insertRelationshipImpl(c, userId, RelationshipMute, actor.String(), expires, nil)
+}
+
+func (d *database) Unmute(c context.Context, userId string, actor *url.URL) (err error) {
+	_, err = d.deleteRelationship.ExecContext(c, userId, RelationshipMute, actor.String())
+	return
+}
+
+func (d *database) BlockDomain(c context.Context, userId string, host string) (err error) {
+	return d.insertRelationshipImpl(c, userId, RelationshipDomainBlock, host, time.Time{}, nil)
+}
+
+func (d *database) UnblockDomain(c context.Context, userId string, host string) (err error) {
+	_, err = d.deleteRelationship.ExecContext(c, userId, RelationshipDomainBlock, host)
+	return
+}
+
+func (d *database) InsertReport(c context.Context, r Report) (err error) {
+	var objects []byte
+	if objects, err = r.objectsJSON(); err != nil {
+		return
+	}
+	var flagIRI, reporterUserId sql.NullString
+	if r.FlagIRI != nil {
+		flagIRI = sql.NullString{String: r.FlagIRI.String(), Valid: true}
+	}
+	if len(r.ReporterUserId) > 0 {
+		reporterUserId = sql.NullString{String: r.ReporterUserId, Valid: true}
+	}
+	_, err = d.insertReport.ExecContext(c,
+		flagIRI,
+		r.ReporterIRI.String(),
+		reporterUserId,
+		r.ReportedIRI.String(),
+		objects,
+		r.Content,
+		r.Forward)
+	return
+}
+
+func (d *database) ReportsByStatus(c context.Context, status ReportStatus) (rs []Report, err error) {
+	var r *sql.Rows
+	r, err = d.reportsByStatus.QueryContext(c, status)
 	if err != nil {
 		return
 	}
-	var res sql.Result
-	res, err = d.insertUserPKey.ExecContext(c, userUUID, pKeyB)
-	if err != nil {
+	defer r.Close()
+	for r.Next() {
+		var rep Report
+		if err = rep.Load(r); err != nil {
+			return
+		}
+		rs = append(rs, rep)
+	}
+	if err = r.Err(); err != nil {
 		return
 	}
-	id, err = res.LastInsertId()
 	return
 }
 
-func (d *database) GetUserPKey(c context.Context, userUUID string) (kUUID string, k *rsa.PrivateKey, err error) {
-	var rw *sql.Rows
-	rw, err = d.getUserPKey.QueryContext(c, userUUID)
+func (d *database) ReportById(c context.Context, id string) (rep Report, err error) {
+	var r *sql.Rows
+	r, err = d.reportById.QueryContext(c, id)
 	if err != nil {
 		return
 	}
-	defer rw.Close()
-	var pKeyB []byte
+	defer r.Close()
 	var n int
-	for rw.Next() {
+	for r.Next() {
 		if n > 0 {
-			err = fmt.Errorf("multiple rows when getting user private key: %s", userUUID)
+			err = fmt.Errorf("multiple rows when obtaining report by id")
 			return
 		}
-		if err = rw.Scan(&kUUID, &pKeyB); err != nil {
+		if err = rep.Load(r); err != nil {
 			return
 		}
 		n++
 	}
-	if err = rw.Err(); err != nil {
+	if err = r.Err(); err != nil {
 		return
 	}
-	var pk crypto.PrivateKey
-	pk, err = deserializeRSAPrivateKey(pKeyB)
-	var ok bool
-	k, ok = pk.(*rsa.PrivateKey)
-	if !ok {
-		err = fmt.Errorf("private key is not of type *rsa.PrivateKey")
-		return
+	if n == 0 {
+		err = fmt.Errorf("no report with id %q", id)
+	}
+	return
+}
+
+func (d *database) UpdateReport(c context.Context, id string, status ReportStatus, assigneeUserId, notes string) (err error) {
+	var assignee sql.NullString
+	if len(assigneeUserId) > 0 {
+		assignee = sql.NullString{String: assigneeUserId, Valid: true}
 	}
+	_, err = d.updateReport.ExecContext(c,
+		id,
+		status,
+		assignee,
+		notes)
 	return
 }
 
@@ -939,27 +2028,61 @@ func (d *database) FollowersByUserUUID(c context.Context, userUUID string) (foll
 
 // apcore attempt functions
 
-func (d *database) InsertAttempt(c context.Context, payload []byte, to *url.URL, fromUUID string) (id int64, err error) {
-	var res sql.Result
-	res, err = d.insertAttempt.ExecContext(c, fromUUID, to, payload)
-	if err != nil {
-		return
-	}
-	id, err = res.LastInsertId()
+func (d *database) InsertAttempt(c context.Context, payload []byte, to *url.URL, fromUUID string) (id string, err error) {
+	err = d.insertAttempt.QueryRowContext(c, fromUUID, to.String(), payload).Scan(&id)
 	return
 }
 
-func (d *database) MarkSuccessfulAttempt(c context.Context, id int64) (err error) {
+func (d *database) MarkSuccessfulAttempt(c context.Context, id string) (err error) {
 	_, err = d.markSuccessfulAttempt.ExecContext(c, id)
 	return
 
 }
 
-func (d *database) MarkRetryFailureAttempt(c context.Context, id int64) (err error) {
+func (d *database) MarkRetryFailureAttempt(c context.Context, id string) (err error) {
 	_, err = d.markRetryFailureAttempt.ExecContext(c, id)
 	return
 }
 
+// pendingAttempt is a delivery that was never attempted, or whose attempt was
+// cancelled by shutdown.
+type pendingAttempt struct {
+	Id       string
+	FromUUID string
+	To       *url.URL
+	Payload  []byte
+}
+
+func (p *pendingAttempt) Load(row scanner) (err error) {
+	var to string
+	if err = row.Scan(&p.Id, &p.FromUUID, &to, &p.Payload); err != nil {
+		return
+	}
+	p.To, err = url.Parse(to)
+	return
+}
+
+// PendingAttempts lists the pending deliveries, oldest first.
+func (d *database) PendingAttempts(c context.Context) (as []pendingAttempt, err error) {
+	var r *sql.Rows
+	r, err = d.pendingAttempts.QueryContext(c)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	for r.Next() {
+		var a pendingAttempt
+		if err = a.Load(r); err != nil {
+			return
+		}
+		as = append(as, a)
+	}
+	if err = r.Err(); err != nil {
+		return
+	}
+	return
+}
+
 // apcore oauth functions
 
 func (d *database) CreateTokenInfo(c context.Context, info oauth2.TokenInfo) error {
@@ -969,13 +2092,13 @@ func (d *database) CreateTokenInfo(c context.Context, info oauth2.TokenInfo) err
 		info.GetUserID(),
 		info.GetRedirectURI(),
 		info.GetScope(),
-		info.GetCode(),
+		hashToken(d.tokenKey, info.GetCode()),
 		info.GetCodeCreateAt(),
 		info.GetCodeExpiresIn(),
-		info.GetAccess(),
+		hashToken(d.tokenKey, info.GetAccess()),
 		info.GetAccessCreateAt(),
 		info.GetAccessExpiresIn(),
-		info.GetRefresh(),
+		hashToken(d.tokenKey, info.GetRefresh()),
 		info.GetRefreshCreateAt(),
 		info.GetRefreshExpiresIn())
 	return err
@@ -984,21 +2107,21 @@ func (d *database) CreateTokenInfo(c context.Context, info oauth2.TokenInfo) err
 func (d *database) RemoveTokenByCode(c context.Context, code string) error {
 	_, err := d.removeTokenByCode.ExecContext(
 		c,
-		code)
+		hashToken(d.tokenKey, code))
 	return err
 }
 
 func (d *database) RemoveTokenByAccess(c context.Context, access string) error {
 	_, err := d.removeTokenByAccess.ExecContext(
 		c,
-		access)
+		hashToken(d.tokenKey, access))
 	return err
 }
 
 func (d *database) RemoveTokenByRefresh(c context.Context, refresh string) error {
 	_, err := d.removeTokenByRefresh.ExecContext(
 		c,
-		refresh)
+		hashToken(d.tokenKey, refresh))
 	return err
 }
 
@@ -1035,12 +2158,18 @@ func (d *database) GetTokenByCode(c context.Context, code string) (oti oauth2.To
 	ti := &tokenInfo{}
 	oti = ti
 	var r *sql.Rows
-	r, err = d.getTokenByCode.QueryContext(c, code)
+	r, err = d.getTokenByCode.QueryContext(c, hashToken(d.tokenKey, code))
 	if err != nil {
 		return
 	}
 	defer r.Close()
-	err = d.mustScanRowsForOneToken(r, ti)
+	if err = d.mustScanRowsForOneToken(r, ti); err != nil {
+		return
+	}
+	// Only the hash is stored, so restore the value that was looked up.
+	if len(ti.code) > 0 {
+		ti.code = code
+	}
 	return
 }
 
@@ -1048,12 +2177,18 @@ func (d *database) GetTokenByAccess(c context.Context, access string) (oti oauth
 	ti := &tokenInfo{}
 	oti = ti
 	var r *sql.Rows
-	r, err = d.getTokenByAccess.QueryContext(c, access)
+	r, err = d.getTokenByAccess.QueryContext(c, hashToken(d.tokenKey, access))
 	if err != nil {
 		return
 	}
 	defer r.Close()
-	err = d.mustScanRowsForOneToken(r, ti)
+	if err = d.mustScanRowsForOneToken(r, ti); err != nil {
+		return
+	}
+	// Only the hash is stored, so restore the value that was looked up.
+	if len(ti.access) > 0 {
+		ti.access = access
+	}
 	return
 }
 
@@ -1061,12 +2196,51 @@ func (d *database) GetTokenByRefresh(c context.Context, refresh string) (oti oau
 	ti := &tokenInfo{}
 	oti = ti
 	var r *sql.Rows
-	r, err = d.getTokenByRefresh.QueryContext(c, refresh)
+	r, err = d.getTokenByRefresh.QueryContext(c, hashToken(d.tokenKey, refresh))
 	if err != nil {
 		return
 	}
 	defer r.Close()
-	err = d.mustScanRowsForOneToken(r, ti)
+	if err = d.mustScanRowsForOneToken(r, ti); err != nil {
+		return
+	}
+	// Only the hash is stored, so restore the value that was looked up.
+	if len(ti.refresh) > 0 {
+		ti.refresh = refresh
+	}
+	return
+}
+
+// codeParameters are the parts of an authorization request needed again when
+// its code is exchanged for a token.
+type codeParameters struct {
+	challenge string
+	method    string
+	nonce     string
+}
+
+// SetCodeParameters attaches the PKCE code challenge and OpenID Connect nonce
+// to an authorization code.
+func (d *database) SetCodeParameters(c context.Context, code string, p codeParameters) error {
+	_, err := d.setCodeParameters.ExecContext(
+		c,
+		hashToken(d.tokenKey, code),
+		p.challenge,
+		p.method,
+		p.nonce)
+	return err
+}
+
+// CodeParameters fetches the parameters of an authorization code, which are
+// empty if the code was issued without them.
+func (d *database) CodeParameters(c context.Context, code string) (p codeParameters, err error) {
+	err = d.codeParameters.QueryRowContext(c, hashToken(d.tokenKey, code)).Scan(
+		&p.challenge,
+		&p.method,
+		&p.nonce)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
 	return
 }
 
@@ -1085,16 +2259,347 @@ func (d *database) GetClientById(c context.Context, id string) (oci oauth2.Clien
 			err = fmt.Errorf("multiple rows when obtaining OAuth2 client")
 			return
 		}
+		var userId *string
+		var redirectURIs []byte
+		var scopes, grantTypes string
 		if err = r.Scan(
 			&ci.id,
 			&ci.secret,
 			&ci.domain,
-			&ci.userId); err != nil {
+			&userId,
+			&ci.name,
+			&redirectURIs,
+			&scopes,
+			&grantTypes,
+			&ci.public,
+			&ci.revoked); err != nil {
+			return
+		}
+		if userId != nil {
+			ci.userId = *userId
+		}
+		ci.scopes = strings.Fields(scopes)
+		ci.grantTypes = strings.Fields(grantTypes)
+		if err = json.Unmarshal(redirectURIs, &ci.redirectURIs); err != nil {
 			return
 		}
 		n++
 	}
-	err = r.Err()
+	if err = r.Err(); err != nil {
+		return
+	}
+	if n == 0 {
+		err = fmt.Errorf("no OAuth2 client with id %q", id)
+	}
+	return
+}
+
+// InsertClient registers the OAuth2 client, setting its creation time.
+func (d *database) InsertClient(c context.Context, cl OAuth2Client) (out OAuth2Client, err error) {
+	var redirectURIs []byte
+	if redirectURIs, err = json.Marshal(cl.RedirectURIs); err != nil {
+		return
+	}
+	var userId *string
+	if len(cl.UserId) > 0 {
+		userId = &cl.UserId
+	}
+	var secret string
+	if len(cl.Secret) > 0 {
+		if secret, err = hashClientSecret(cl.Secret, d.bcryptStrength); err != nil {
+			return
+		}
+	}
+	// The domain is retained for the oauth2 library, which validates
+	// redirects against it.
+	if err = d.insertClient.QueryRowContext(c,
+		cl.Id,
+		secret,
+		cl.RedirectURIs[0],
+		userId,
+		cl.Name,
+		redirectURIs,
+		strings.Join(cl.Scopes, " "),
+		strings.Join(cl.GrantTypes, " "),
+		cl.Public).Scan(&cl.CreateTime); err != nil {
+		return
+	}
+	out = cl
+	return
+}
+
+func (d *database) Clients(c context.Context) (cls []OAuth2Client, err error) {
+	var r *sql.Rows
+	r, err = d.clients.QueryContext(c)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	for r.Next() {
+		var cl OAuth2Client
+		if err = cl.Load(r); err != nil {
+			return
+		}
+		cls = append(cls, cl)
+	}
+	if err = r.Err(); err != nil {
+		return
+	}
+	return
+}
+
+func (d *database) UserGrants(c context.Context, userId string) (gs []OAuth2Grant, err error) {
+	var r *sql.Rows
+	r, err = d.userGrants.QueryContext(c, userId)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	for r.Next() {
+		var g OAuth2Grant
+		if err = g.Load(r); err != nil {
+			return
+		}
+		gs = append(gs, g)
+	}
+	if err = r.Err(); err != nil {
+		return
+	}
+	return
+}
+
+func (d *database) RevokeUserGrant(c context.Context, userId, id string) error {
+	_, err := d.removeUserGrant.ExecContext(c, id, userId)
+	return err
+}
+
+func (d *database) RevokeUserClientGrants(c context.Context, userId, clientId string) error {
+	_, err := d.removeClientGrants.ExecContext(c, clientId, userId)
+	return err
+}
+
+// PurgeExpiredTokens removes expired authorization codes and tokens,
+// returning how many were removed.
+func (d *database) PurgeExpiredTokens(c context.Context) (n int64, err error) {
+	var res sql.Result
+	if res, err = d.purgeExpiredTokens.ExecContext(c); err != nil {
+		return
+	}
+	n, err = res.RowsAffected()
+	return
+}
+
+func (d *database) GetSession(c context.Context, id string) (s sessionRecord, ok bool, err error) {
+	var userId sql.NullString
+	err = d.getSession.QueryRowContext(c, id).Scan(
+		&userId,
+		&s.data,
+		&s.created,
+		&s.lastSeen,
+		&s.userAgent,
+		&s.ip)
+	if err == sql.ErrNoRows {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+	s.id = id
+	s.userId = userId.String
+	ok = true
+	return
+}
+
+func (d *database) InsertSession(c context.Context, s sessionRecord) error {
+	var userId sql.NullString
+	if len(s.userId) > 0 {
+		userId = sql.NullString{String: s.userId, Valid: true}
+	}
+	_, err := d.insertSession.ExecContext(c,
+		s.id,
+		userId,
+		s.data,
+		s.lastSeen,
+		s.userAgent,
+		s.ip)
+	return err
+}
+
+func (d *database) UpdateSession(c context.Context, s sessionRecord) (ok bool, err error) {
+	var userId sql.NullString
+	if len(s.userId) > 0 {
+		userId = sql.NullString{String: s.userId, Valid: true}
+	}
+	var res sql.Result
+	if res, err = d.updateSession.ExecContext(c,
+		s.id,
+		userId,
+		s.data,
+		s.lastSeen,
+		s.userAgent,
+		s.ip); err != nil {
+		return
+	}
+	var n int64
+	n, err = res.RowsAffected()
+	ok = n == 1
+	return
+}
+
+func (d *database) TouchSession(c context.Context, id string, t time.Time) error {
+	_, err := d.touchSession.ExecContext(c, id, t)
+	return err
+}
+
+func (d *database) DeleteSession(c context.Context, id string) error {
+	_, err := d.deleteSession.ExecContext(c, id)
+	return err
+}
+
+func (d *database) UserSessions(c context.Context, userId string) (us []UserSession, err error) {
+	var r *sql.Rows
+	r, err = d.userSessions.QueryContext(c, userId)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	for r.Next() {
+		var u UserSession
+		if err = u.Load(r); err != nil {
+			return
+		}
+		us = append(us, u)
+	}
+	if err = r.Err(); err != nil {
+		return
+	}
+	return
+}
+
+func (d *database) DeleteUserSession(c context.Context, userId, id string) error {
+	_, err := d.deleteUserSession.ExecContext(c, id, userId)
+	return err
+}
+
+func (d *database) DeleteUserSessions(c context.Context, userId string) error {
+	_, err := d.deleteUserSessions.ExecContext(c, userId)
+	return err
+}
+
+// PurgeExpiredSessions removes sessions last seen before idleBefore or created
+// before createdBefore, returning how many were removed.
+func (d *database) PurgeExpiredSessions(c context.Context, idleBefore, createdBefore time.Time) (n int64, err error) {
+	var res sql.Result
+	if res, err = d.purgeExpiredSessions.ExecContext(c, idleBefore, createdBefore); err != nil {
+		return
+	}
+	n, err = res.RowsAffected()
+	return
+}
+
+// MigrateOAuth2Secrets hashes the OAuth2 codes, tokens, and client secrets
+// stored in plaintext by earlier versions. It is safe to run repeatedly.
+func (d *database) MigrateOAuth2Secrets(c context.Context) (nTokens, nClients int, err error) {
+	if len(d.tokenKey) == 0 {
+		err = fmt.Errorf("no OAuth2 token hashing key is configured")
+		return
+	}
+	var tx *sql.Tx
+	tx, err = d.db.BeginTx(c, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	type tokenRow struct {
+		id, code, access, refresh string
+	}
+	var tokens []tokenRow
+	var r *sql.Rows
+	if r, err = tx.QueryContext(c, d.sqlgen.PlaintextTokens()); err != nil {
+		return
+	}
+	for r.Next() {
+		var t tokenRow
+		if err = r.Scan(&t.id, &t.code, &t.access, &t.refresh); err != nil {
+			r.Close()
+			return
+		}
+		tokens = append(tokens, t)
+	}
+	r.Close()
+	if err = r.Err(); err != nil {
+		return
+	}
+	for _, t := range tokens {
+		if _, err = tx.ExecContext(c, d.sqlgen.SetTokenHashes(),
+			t.id,
+			hashPlaintextToken(d.tokenKey, t.code),
+			hashPlaintextToken(d.tokenKey, t.access),
+			hashPlaintextToken(d.tokenKey, t.refresh)); err != nil {
+			return
+		}
+	}
+
+	secrets := make(map[string]string)
+	if r, err = tx.QueryContext(c, d.sqlgen.ClientSecrets()); err != nil {
+		return
+	}
+	for r.Next() {
+		var id, secret string
+		if err = r.Scan(&id, &secret); err != nil {
+			r.Close()
+			return
+		}
+		if !isHashedClientSecret(secret) {
+			secrets[id] = secret
+		}
+	}
+	r.Close()
+	if err = r.Err(); err != nil {
+		return
+	}
+	for id, secret := range secrets {
+		var hash string
+		if hash, err = hashClientSecret(secret, d.bcryptStrength); err != nil {
+			return
+		}
+		if _, err = tx.ExecContext(c, d.sqlgen.SetClientSecret(), id, hash); err != nil {
+			return
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	nTokens, nClients = len(tokens), len(secrets)
+	return
+}
+
+// RevokeClient prevents the OAuth2 client from obtaining tokens, and removes
+// its existing tokens.
+func (d *database) RevokeClient(c context.Context, id string) (err error) {
+	var tx *sql.Tx
+	tx, err = d.db.BeginTx(c, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	var res sql.Result
+	if res, err = tx.ExecContext(c, d.sqlgen.RevokeClient(), id); err != nil {
+		return
+	}
+	var n int64
+	if n, err = res.RowsAffected(); err != nil {
+		return
+	} else if n == 0 {
+		err = fmt.Errorf("no OAuth2 client with id %q", id)
+		return
+	}
+	if _, err = tx.ExecContext(c, d.sqlgen.RemoveTokensByClient(), id); err != nil {
+		return
+	}
+	err = tx.Commit()
 	return
 }
 
@@ -1126,7 +2631,7 @@ func (d *database) InboxContains(c context.Context, inbox, id *url.URL) (contain
 
 func (d *database) getInboxImpl(c context.Context, inboxIRI *url.URL, private bool) (inbox vocab.ActivityStreamsOrderedCollectionPage, err error) {
 	start := collectionPageStartIndex(inboxIRI)
-	length := collectionPageLength(inboxIRI, d.defaultCollectionSize)
+	length := collectionPageLength(inboxIRI, d.collectionPageSize())
 	baseInboxIRI := normalize(inboxIRI)
 	var r *sql.Rows
 	if private {
@@ -1154,7 +2659,7 @@ func (d *database) getInboxImpl(c context.Context, inboxIRI *url.URL, private bo
 		return
 	}
 	var id *url.URL
-	id, err = collectionPageId(baseInboxIRI, start, length, d.defaultCollectionSize)
+	id, err = collectionPageId(baseInboxIRI, start, length, d.collectionPageSize())
 	if err != nil {
 		return
 	}
@@ -1179,7 +2684,7 @@ func (d *database) SetInbox(c context.Context, inbox vocab.ActivityStreamsOrdere
 		return err
 	}
 	start := collectionPageStartIndex(iri)
-	length := collectionPageLength(iri, d.defaultCollectionSize)
+	length := collectionPageLength(iri, d.collectionPageSize())
 	baseInboxIRI := normalize(iri)
 	tx, err := d.db.BeginTx(c, nil)
 	if err != nil {
@@ -1467,7 +2972,7 @@ func (d *database) Delete(c context.Context, id *url.URL) (err error) {
 
 func (d *database) getOutboxImpl(c context.Context, outboxIRI *url.URL, private bool) (outbox vocab.ActivityStreamsOrderedCollectionPage, err error) {
 	start := collectionPageStartIndex(outboxIRI)
-	length := collectionPageLength(outboxIRI, d.defaultCollectionSize)
+	length := collectionPageLength(outboxIRI, d.collectionPageSize())
 	baseOutboxIRI := normalize(outboxIRI)
 	var r *sql.Rows
 	if private {
@@ -1495,7 +3000,7 @@ func (d *database) getOutboxImpl(c context.Context, outboxIRI *url.URL, private
 		return
 	}
 	var id *url.URL
-	id, err = collectionPageId(baseOutboxIRI, start, length, d.defaultCollectionSize)
+	id, err = collectionPageId(baseOutboxIRI, start, length, d.collectionPageSize())
 	if err != nil {
 		return
 	}
@@ -1520,7 +3025,7 @@ func (d *database) SetOutbox(c context.Context, outbox vocab.ActivityStreamsOrde
 		return err
 	}
 	start := collectionPageStartIndex(iri)
-	length := collectionPageLength(iri, d.defaultCollectionSize)
+	length := collectionPageLength(iri, d.collectionPageSize())
 	baseOutboxIRI := normalize(iri)
 	tx, err := d.db.BeginTx(c, nil)
 	if err != nil {
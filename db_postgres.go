@@ -18,7 +18,6 @@ package apcore
 
 import (
 	"database/sql"
-	"fmt"
 )
 
 var _ sqlGenerator = &pgV0{}
@@ -72,6 +71,26 @@ func (p *pgV0) CreateTables(t *sql.Tx) (err error) {
 	if err != nil {
 		return
 	}
+	err = p.maybeLogExecute(t, p.userMFATable())
+	if err != nil {
+		return
+	}
+	err = p.maybeLogExecute(t, p.userRecoveryCodeTable())
+	if err != nil {
+		return
+	}
+	err = p.maybeLogExecute(t, p.loginAttemptTable())
+	if err != nil {
+		return
+	}
+	err = p.maybeLogExecute(t, p.inviteTable())
+	if err != nil {
+		return
+	}
+	err = p.maybeLogExecute(t, p.sessionTable())
+	if err != nil {
+		return
+	}
 	err = p.maybeLogExecute(t, p.instancePolicyTable())
 	if err != nil {
 		return
@@ -100,6 +119,14 @@ func (p *pgV0) CreateTables(t *sql.Tx) (err error) {
 	if err != nil {
 		return
 	}
+	err = p.maybeLogExecute(t, p.relationshipTable())
+	if err != nil {
+		return
+	}
+	err = p.maybeLogExecute(t, p.reportTable())
+	if err != nil {
+		return
+	}
 	// OAuth information
 	err = p.maybeLogExecute(t, p.tokenTable())
 	if err != nil {
@@ -135,15 +162,66 @@ func (p *pgV0) CreateTables(t *sql.Tx) (err error) {
 	if err != nil {
 		return
 	}
+	err = p.maybeLogExecute(t, p.indexLoginAttemptAccount())
+	if err != nil {
+		return
+	}
+	err = p.maybeLogExecute(t, p.indexLoginAttemptIP())
+	if err != nil {
+		return
+	}
+	err = p.maybeLogExecute(t, p.indexSessionUser())
+	if err != nil {
+		return
+	}
 
 	return
 }
 
+// UpgradeTables brings tables created by earlier revisions of v0 up to date,
+// creating missing tables and indexes and adding missing columns. It is safe
+// to run repeatedly.
 func (p *pgV0) UpgradeTables(t *sql.Tx) (err error) {
-	err = fmt.Errorf("cannot upgrade Postgres tables to first version v0")
+	InfoLogger.Info("Running Postgres upgrade tables v0")
+	err = p.CreateTables(t)
+	if err != nil {
+		return
+	}
+	for _, s := range p.upgradeColumns() {
+		err = p.maybeLogExecute(t, s)
+		if err != nil {
+			return
+		}
+	}
 	return
 }
 
+// upgradeColumns adds the columns introduced after tables were first created.
+// Existing users keep their access, so they are active and have verified
+// emails, while new users must still verify theirs.
+func (p *pgV0) upgradeColumns() []string {
+	return []string{
+		`ALTER TABLE ` + p.schema + `user_privileges ADD COLUMN IF NOT EXISTS state text NOT NULL DEFAULT 'active';`,
+		`ALTER TABLE ` + p.schema + `user_privileges ADD COLUMN IF NOT EXISTS mfa_required boolean NOT NULL DEFAULT false;`,
+		`ALTER TABLE ` + p.schema + `user_privileges ADD COLUMN IF NOT EXISTS locked_until timestamp with time zone;`,
+		`ALTER TABLE ` + p.schema + `user_privileges ADD COLUMN IF NOT EXISTS email_verified boolean NOT NULL DEFAULT true;`,
+		`ALTER TABLE ` + p.schema + `user_privileges ALTER COLUMN email_verified SET DEFAULT false;`,
+		`ALTER TABLE ` + p.schema + `resolutions ADD COLUMN IF NOT EXISTS action text NOT NULL DEFAULT 'none';`,
+		`ALTER TABLE ` + p.schema + `oauth_tokens ADD COLUMN IF NOT EXISTS id uuid PRIMARY KEY DEFAULT gen_random_uuid();`,
+		`ALTER TABLE ` + p.schema + `oauth_tokens ADD COLUMN IF NOT EXISTS code_challenge text NOT NULL DEFAULT '';`,
+		`ALTER TABLE ` + p.schema + `oauth_tokens ADD COLUMN IF NOT EXISTS code_challenge_method text NOT NULL DEFAULT '';`,
+		`ALTER TABLE ` + p.schema + `oauth_tokens ADD COLUMN IF NOT EXISTS nonce text NOT NULL DEFAULT '';`,
+		`ALTER TABLE ` + p.schema + `oauth_clients ADD COLUMN IF NOT EXISTS create_time timestamp with time zone NOT NULL DEFAULT current_timestamp;`,
+		`ALTER TABLE ` + p.schema + `oauth_clients ADD COLUMN IF NOT EXISTS name text NOT NULL DEFAULT '';`,
+		`ALTER TABLE ` + p.schema + `oauth_clients ADD COLUMN IF NOT EXISTS redirect_uris jsonb NOT NULL DEFAULT '[]';`,
+		`ALTER TABLE ` + p.schema + `oauth_clients ADD COLUMN IF NOT EXISTS scopes text NOT NULL DEFAULT '';`,
+		`ALTER TABLE ` + p.schema + `oauth_clients ADD COLUMN IF NOT EXISTS public boolean NOT NULL DEFAULT false;`,
+		`ALTER TABLE ` + p.schema + `oauth_clients ADD COLUMN IF NOT EXISTS revoked boolean NOT NULL DEFAULT false;`,
+		`ALTER TABLE ` + p.schema + `oauth_clients ADD COLUMN IF NOT EXISTS grant_types text NOT NULL DEFAULT '';`,
+		`ALTER TABLE ` + p.schema + `oauth_clients ALTER COLUMN user_id DROP NOT NULL;`,
+	}
+}
+
 func (p *pgV0) maybeLogExecute(t *sql.Tx, s string) (err error) {
 	if p.log {
 		InfoLogger.Infof("SQL exec: %s", s)
@@ -203,7 +281,7 @@ func (p *pgV0) usersInboxTable() string {
 CREATE TABLE IF NOT EXISTS ` + p.schema + `users_inbox
 (
   id bigserial PRIMARY KEY,
-  user_id uuid REFERENCES ` + p.schema + `users (id) NOT NULL ON DELETE RESTRICT,
+  user_id uuid REFERENCES ` + p.schema + `users (id) NOT NULL ON DELETE CASCADE,
   federated_id uuid REFERENCES ` + p.schema + `fed_data (id) NOT NULL ON DELETE CASCADE,
 );`
 }
@@ -213,7 +291,7 @@ func (p *pgV0) usersOutboxTable() string {
 CREATE TABLE IF NOT EXISTS ` + p.schema + `users_inbox
 (
   id bigserial PRIMARY KEY,
-  user_id uuid REFERENCES ` + p.schema + `users (id) NOT NULL ON DELETE RESTRICT,
+  user_id uuid REFERENCES ` + p.schema + `users (id) NOT NULL ON DELETE CASCADE,
   local_id uuid REFERENCES ` + p.schema + `local_data (id) NOT NULL ON DELETE CASCADE,
 );`
 }
@@ -224,7 +302,89 @@ CREATE TABLE IF NOT EXISTS ` + p.schema + `user_privileges
 (
   id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
   user_id uuid REFERENCES ` + p.schema + `users (id) NOT NULL ON DELETE CASCADE,
-  admin boolean NOT NULL
+  admin boolean NOT NULL,
+  state text NOT NULL DEFAULT 'active',
+  mfa_required boolean NOT NULL DEFAULT false,
+  locked_until timestamp with time zone,
+  email_verified boolean NOT NULL DEFAULT false
+);`
+}
+
+func (p *pgV0) inviteTable() string {
+	return `
+CREATE TABLE IF NOT EXISTS ` + p.schema + `invites
+(
+  id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+  create_time timestamp with time zone NOT NULL DEFAULT current_timestamp,
+  code_hash text UNIQUE NOT NULL,
+  created_by uuid REFERENCES ` + p.schema + `users (id) ON DELETE SET NULL,
+  expire_time timestamp with time zone,
+  max_uses integer NOT NULL,
+  uses integer NOT NULL DEFAULT 0
+);`
+}
+
+func (p *pgV0) userMFATable() string {
+	return `
+CREATE TABLE IF NOT EXISTS ` + p.schema + `user_mfa
+(
+  user_id uuid PRIMARY KEY REFERENCES ` + p.schema + `users (id) ON DELETE CASCADE,
+  create_time timestamp with time zone NOT NULL DEFAULT current_timestamp,
+  totp_secret bytea NOT NULL,
+  enabled boolean NOT NULL DEFAULT false,
+  last_step bigint NOT NULL DEFAULT 0
+);`
+}
+
+func (p *pgV0) loginAttemptTable() string {
+	return `
+CREATE TABLE IF NOT EXISTS ` + p.schema + `login_attempts
+(
+  id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+  create_time timestamp with time zone NOT NULL DEFAULT current_timestamp,
+  account text NOT NULL,
+  user_id uuid REFERENCES ` + p.schema + `users (id) ON DELETE SET NULL,
+  email text NOT NULL,
+  ip text NOT NULL,
+  success boolean NOT NULL,
+  reason text NOT NULL
+);`
+}
+
+func (p *pgV0) indexLoginAttemptAccount() string {
+	return `CREATE INDEX IF NOT EXISTS login_attempts_account_index ON ` + p.schema + `login_attempts (account, create_time);`
+}
+
+func (p *pgV0) indexLoginAttemptIP() string {
+	return `CREATE INDEX IF NOT EXISTS login_attempts_ip_index ON ` + p.schema + `login_attempts (ip, create_time);`
+}
+
+func (p *pgV0) sessionTable() string {
+	return `
+CREATE TABLE IF NOT EXISTS ` + p.schema + `sessions
+(
+  id text PRIMARY KEY,
+  user_id uuid REFERENCES ` + p.schema + `users (id) ON DELETE CASCADE,
+  create_time timestamp with time zone NOT NULL DEFAULT current_timestamp,
+  last_seen timestamp with time zone NOT NULL DEFAULT current_timestamp,
+  data bytea NOT NULL,
+  user_agent text NOT NULL,
+  ip text NOT NULL
+);`
+}
+
+func (p *pgV0) indexSessionUser() string {
+	return `CREATE INDEX IF NOT EXISTS sessions_user_id_index ON ` + p.schema + `sessions (user_id);`
+}
+
+func (p *pgV0) userRecoveryCodeTable() string {
+	return `
+CREATE TABLE IF NOT EXISTS ` + p.schema + `user_recovery_codes
+(
+  id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+  user_id uuid REFERENCES ` + p.schema + `users (id) ON DELETE CASCADE NOT NULL,
+  code_hash text NOT NULL,
+  used_time timestamp with time zone
 );`
 }
 
@@ -244,7 +404,7 @@ CREATE TABLE IF NOT EXISTS ` + p.schema + `instance_policies
 (
   id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
   create_time timestamp with time zone DEFAULT current_timestamp,
-  order integer NOT NULL CONSTRAINT unique_order UNIQUE DEFERRABLE INITIALLY DEFERRED,
+  "order" integer NOT NULL CONSTRAINT unique_order UNIQUE DEFERRABLE INITIALLY DEFERRED,
   description text NOT NULL,
   subject text NOT NULL,
   kind text NOT NULL
@@ -257,12 +417,12 @@ CREATE TABLE IF NOT EXISTS ` + p.schema + `user_policies
 (
   id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
   create_time timestamp with time zone DEFAULT current_timestamp,
-  user_id uuid REFERENCES ` + p.schema + `users (id) NOT NULL ON DELETE CASCADE,
-  order integer NOT NULL,
+  user_id uuid NOT NULL REFERENCES ` + p.schema + `users (id) ON DELETE CASCADE,
+  "order" integer NOT NULL,
   description text NOT NULL,
   subject text NOT NULL,
   kind text NOT NULL,
-  CONSTRAINT user_unique_order UNIQUE (user_id, order) DEFERRABLE INITIALLY DEFERRED
+  CONSTRAINT user_unique_order UNIQUE (user_id, "order") DEFERRABLE INITIALLY DEFERRED
 );`
 }
 
@@ -272,13 +432,14 @@ CREATE TABLE IF NOT EXISTS ` + p.schema + `resolutions
 (
   id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
   create_time timestamp with time zone DEFAULT current_timestamp,
-  order integer NOT NULL,
-  user_id uuid REFERENCES ` + p.schema + `users (id) NOT NULL ON DELETE CASCADE,
-  permitted string NOT NULL,
+  "order" integer NOT NULL,
+  user_id uuid NOT NULL REFERENCES ` + p.schema + `users (id) ON DELETE CASCADE,
+  permitted integer NOT NULL,
+  action text NOT NULL DEFAULT 'none',
   activity_iri text NOT NULL,
   is_public boolean NOT NULL,
-  reason text NOT NULL
-  CONSTRAINT activity_unique_order UNIQUE (activity_iri, order) DEFERRABLE INITIALLY DEFERRED
+  reason text NOT NULL,
+  CONSTRAINT activity_unique_order UNIQUE (user_id, activity_iri, "order")
 );`
 }
 
@@ -286,8 +447,8 @@ func (p *pgV0) resolutionInstancePolicyJoinTable() string {
 	return `
 CREATE TABLE IF NOT EXISTS ` + p.schema + `resolutions_instance_policies
 (
-  resolution_id uuid REFERENCES ` + p.schema + `resolutions (id) NOT NULL ON DELETE CASCADE,
-  instance_policy_id uuid REFERENCES ` + p.schema + `instance_policies (id) NOT NULL ON DELETE CASCADE
+  resolution_id uuid NOT NULL REFERENCES ` + p.schema + `resolutions (id) ON DELETE CASCADE,
+  instance_policy_id uuid NOT NULL REFERENCES ` + p.schema + `instance_policies (id) ON DELETE CASCADE
 );`
 }
 
@@ -295,8 +456,8 @@ func (p *pgV0) resolutionUserPolicyJoinTable() string {
 	return `
 CREATE TABLE IF NOT EXISTS ` + p.schema + `resolutions_user_policies
 (
-  resolution_id uuid REFERENCES ` + p.schema + `resolutions (id) NOT NULL ON DELETE CASCADE,
-  user_policy_id uuid REFERENCES ` + p.schema + `user_policies (id) NOT NULL ON DELETE CASCADE
+  resolution_id uuid NOT NULL REFERENCES ` + p.schema + `resolutions (id) ON DELETE CASCADE,
+  user_policy_id uuid NOT NULL REFERENCES ` + p.schema + `user_policies (id) ON DELETE CASCADE
 );`
 }
 
@@ -324,10 +485,44 @@ CREATE TABLE IF NOT EXISTS ` + p.schema + `private_keys
 );`
 }
 
+func (p *pgV0) relationshipTable() string {
+	return `
+CREATE TABLE IF NOT EXISTS ` + p.schema + `user_relationships
+(
+  id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+  create_time timestamp with time zone NOT NULL DEFAULT current_timestamp,
+  user_id uuid NOT NULL REFERENCES ` + p.schema + `users (id) ON DELETE CASCADE,
+  kind text NOT NULL,
+  subject text NOT NULL,
+  expires_at timestamp with time zone,
+  activity_iri text
+);`
+}
+
+func (p *pgV0) reportTable() string {
+	return `
+CREATE TABLE IF NOT EXISTS ` + p.schema + `reports
+(
+  id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+  create_time timestamp with time zone NOT NULL DEFAULT current_timestamp,
+  flag_iri text,
+  reporter_iri text NOT NULL,
+  reporter_user_id uuid REFERENCES ` + p.schema + `users (id) ON DELETE SET NULL,
+  reported_iri text NOT NULL,
+  objects jsonb NOT NULL,
+  content text NOT NULL,
+  forward boolean NOT NULL,
+  status text NOT NULL DEFAULT 'open',
+  assignee_id uuid REFERENCES ` + p.schema + `users (id) ON DELETE SET NULL,
+  notes text NOT NULL DEFAULT ''
+);`
+}
+
 func (p *pgV0) tokenTable() string {
 	return `
 CREATE TABLE IF NOT EXISTS ` + p.schema + `oauth_tokens
 (
+  id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
   client_id text NOT NULL,
   user_id text NOT NULL,
   redirect_uri text NOT NULL,
@@ -340,7 +535,10 @@ CREATE TABLE IF NOT EXISTS ` + p.schema + `oauth_tokens
   access_expires_in bigint NOT NULL,
   refresh text NOT NULL,
   refresh_create_at timestamp with time zone NOT NULL,
-  refresh_expires_in bigint NOT NULL
+  refresh_expires_in bigint NOT NULL,
+  code_challenge text NOT NULL DEFAULT '',
+  code_challenge_method text NOT NULL DEFAULT '',
+  nonce text NOT NULL DEFAULT ''
 );`
 }
 
@@ -361,9 +559,16 @@ func (p *pgV0) clientTable() string {
 CREATE TABLE IF NOT EXISTS ` + p.schema + `oauth_clients
 (
   id text PRIMARY KEY,
+  create_time timestamp with time zone NOT NULL DEFAULT current_timestamp,
   secret text NOT NULL,
   domain text NOT NULL,
-  user_id uuid REFERENCES ` + p.schema + `users(id) NOT NULL ON DELETE CASCADE
+  user_id uuid REFERENCES ` + p.schema + `users(id) ON DELETE CASCADE,
+  name text NOT NULL DEFAULT '',
+  redirect_uris jsonb NOT NULL DEFAULT '[]',
+  scopes text NOT NULL DEFAULT '',
+  grant_types text NOT NULL DEFAULT '',
+  public boolean NOT NULL DEFAULT false,
+  revoked boolean NOT NULL DEFAULT false
 );`
 }
 
@@ -371,6 +576,10 @@ func (p *pgV0) HashPassForUserID() string {
 	return "SELECT hashpass, salt FROM " + p.schema + "users WHERE id = $1"
 }
 
+func (p *pgV0) RehashUserPassword() string {
+	return "UPDATE " + p.schema + "users SET (hashpass, salt) = ($2, $3) WHERE id = $1 AND hashpass = $4"
+}
+
 func (p *pgV0) UserIdForEmail() string {
 	return "SELECT id FROM " + p.schema + "users WHERE email = $1"
 }
@@ -387,44 +596,215 @@ func (p *pgV0) UserPreferences() string {
 	return "SELECT on_follow FROM " + p.schema + "user_preferences WHERE user_id = $1"
 }
 
+func (p *pgV0) UserState() string {
+	return "SELECT state FROM " + p.schema + "user_privileges WHERE user_id = $1"
+}
+
+func (p *pgV0) UserProfile() string {
+	return `SELECT
+  actor->>'id',
+  COALESCE(actor->>'preferredUsername', ''),
+  COALESCE(actor->>'name', ''),
+  COALESCE(actor->'icon'->>'url', actor->'icon'->0->>'url', '')
+FROM ` + p.schema + `users WHERE id = $1`
+}
+
+func (p *pgV0) UserIsAdmin() string {
+	return "SELECT admin FROM " + p.schema + "user_privileges WHERE user_id = $1"
+}
+
+func (p *pgV0) UserMFA() string {
+	return `SELECT COALESCE(m.enabled, false), up.mfa_required
+FROM ` + p.schema + `user_privileges AS up
+LEFT JOIN ` + p.schema + `user_mfa AS m
+ON up.user_id = m.user_id
+WHERE up.user_id = $1`
+}
+
+func (p *pgV0) SetTOTPSecret() string {
+	return `INSERT INTO ` + p.schema + `user_mfa (user_id, totp_secret) VALUES ($1, $2)
+ON CONFLICT (user_id) DO UPDATE SET (totp_secret, last_step, create_time) = ($2, 0, current_timestamp)
+WHERE ` + p.schema + `user_mfa.enabled = false`
+}
+
+func (p *pgV0) TOTPSecret() string {
+	return "SELECT totp_secret, enabled FROM " + p.schema + "user_mfa WHERE user_id = $1"
+}
+
+func (p *pgV0) PendingTOTPSecret() string {
+	return "SELECT totp_secret FROM " + p.schema + "user_mfa WHERE user_id = $1 AND enabled = false AND create_time > $2"
+}
+
+func (p *pgV0) SetTOTPStep() string {
+	return "UPDATE " + p.schema + "user_mfa SET (last_step) = ($2) WHERE user_id = $1 AND last_step < $2"
+}
+
+func (p *pgV0) EnableMFA() string {
+	return "UPDATE " + p.schema + "user_mfa SET (enabled) = (true) WHERE user_id = $1"
+}
+
+func (p *pgV0) DeleteMFA() string {
+	return "DELETE FROM " + p.schema + "user_mfa WHERE user_id = $1"
+}
+
+func (p *pgV0) InsertRecoveryCode() string {
+	return "INSERT INTO " + p.schema + "user_recovery_codes (user_id, code_hash) VALUES ($1, $2)"
+}
+
+func (p *pgV0) DeleteRecoveryCodes() string {
+	return "DELETE FROM " + p.schema + "user_recovery_codes WHERE user_id = $1"
+}
+
+func (p *pgV0) UseRecoveryCode() string {
+	return "UPDATE " + p.schema + "user_recovery_codes SET (used_time) = (current_timestamp) WHERE user_id = $1 AND code_hash = $2 AND used_time IS NULL"
+}
+
+func (p *pgV0) UserAccount() string {
+	return `SELECT u.email, u.hashpass, up.email_verified, up.state
+FROM ` + p.schema + `users AS u
+INNER JOIN ` + p.schema + `user_privileges AS up
+ON u.id = up.user_id
+WHERE u.id = $1`
+}
+
+func (p *pgV0) SetEmailVerified() string {
+	return "UPDATE " + p.schema + "user_privileges SET (email_verified) = (true) WHERE user_id = $1"
+}
+
+func (p *pgV0) SetUserPassword() string {
+	return "UPDATE " + p.schema + "users SET (hashpass, salt) = ($2, $3) WHERE id = $1"
+}
+
+func (p *pgV0) InsertInvite() string {
+	return "INSERT INTO " + p.schema + "invites (code_hash, created_by, expire_time, max_uses) VALUES ($1, $2, $3, $4)"
+}
+
+func (p *pgV0) UseInvite() string {
+	return `UPDATE ` + p.schema + `invites SET (uses) = (uses + 1)
+WHERE code_hash = $1 AND uses < max_uses AND (expire_time IS NULL OR expire_time > current_timestamp)`
+}
+
+func (p *pgV0) InsertLoginAttempt() string {
+	return "INSERT INTO " + p.schema + "login_attempts (account, user_id, email, ip, success, reason) VALUES ($1, $2, $3, $4, $5, $6)"
+}
+
+func (p *pgV0) AccountLoginFailures() string {
+	return `SELECT count(*), max(create_time) FROM ` + p.schema + `login_attempts
+WHERE account = $1 AND NOT success AND create_time > $2
+AND create_time > COALESCE(
+  (SELECT max(create_time) FROM ` + p.schema + `login_attempts WHERE account = $1 AND success),
+  '-infinity')`
+}
+
+func (p *pgV0) IPLoginFailures() string {
+	return "SELECT count(*), max(create_time) FROM " + p.schema + "login_attempts WHERE ip = $1 AND NOT success AND create_time > $2"
+}
+
+func (p *pgV0) SetUserLockedUntil() string {
+	return "UPDATE " + p.schema + "user_privileges SET (locked_until) = ($2) WHERE user_id = $1"
+}
+
+func (p *pgV0) UserLockedUntil() string {
+	return "SELECT locked_until FROM " + p.schema + "user_privileges WHERE user_id = $1"
+}
+
+func (p *pgV0) SetUserState() string {
+	return "UPDATE " + p.schema + "user_privileges SET (state) = ($2) WHERE user_id = $1"
+}
+
+func (p *pgV0) UsersInState() string {
+	return `SELECT u.id, u.actor->>'id', u.actor->>'outbox', u.actor->>'followers'
+FROM ` + p.schema + `users AS u
+INNER JOIN ` + p.schema + `user_privileges AS up
+ON u.id = up.user_id
+WHERE up.state = $1`
+}
+
+func (p *pgV0) UsersPendingKeyPurge() string {
+	return `SELECT up.user_id
+FROM ` + p.schema + `user_privileges AS up
+WHERE up.state = $1
+AND EXISTS (
+  SELECT 1 FROM ` + p.schema + `private_keys AS k WHERE k.user_id = up.user_id
+)
+AND NOT EXISTS (
+  SELECT 1 FROM ` + p.schema + `delivery_attempts AS a WHERE a.from_id = up.user_id AND a.state = 'new'
+)`
+}
+
+func (p *pgV0) RemoveActorPublicKey() string {
+	return "UPDATE " + p.schema + "users SET (actor) = (actor - 'publicKey') WHERE id = $1"
+}
+
+func (p *pgV0) TombstoneUser() string {
+	return "UPDATE " + p.schema + "users SET (email, actor) = ('', $2) WHERE id = $1"
+}
+
+func (p *pgV0) DeleteUserInbox() string {
+	return "DELETE FROM " + p.schema + "users_inbox WHERE user_id = $1"
+}
+
+func (p *pgV0) DeleteUserPKeys() string {
+	return "DELETE FROM " + p.schema + "private_keys WHERE user_id = $1"
+}
+
+func (p *pgV0) DeleteUserTokens() string {
+	return "DELETE FROM " + p.schema + "oauth_tokens WHERE user_id = $1"
+}
+
 func (p *pgV0) UpdateUserPolicy() string {
-	// TODO
-	return ""
+	return `UPDATE ` + p.schema + `user_policies
+SET "order" = $2, description = $4, subject = $5, kind = $6
+WHERE id = $1 AND user_id = $3`
 }
 
 func (p *pgV0) UpdateInstancePolicy() string {
-	// TODO
-	return ""
+	return `UPDATE ` + p.schema + `instance_policies
+SET "order" = $2, description = $3, subject = $4, kind = $5
+WHERE id = $1`
 }
 
 func (p *pgV0) InsertUserPolicy() string {
-	// TODO
-	return ""
+	return `INSERT INTO ` + p.schema + `user_policies ("order", user_id, description, subject, kind) VALUES ($1, $2, $3, $4, $5)`
 }
 
 func (p *pgV0) InsertInstancePolicy() string {
-	// TODO
-	return ""
+	return `INSERT INTO ` + p.schema + `instance_policies ("order", description, subject, kind) VALUES ($1, $2, $3, $4)`
 }
 
 func (p *pgV0) InstancePolicies() string {
-	// TODO
-	return ""
+	return `SELECT id, "order", description, subject, kind FROM ` + p.schema + `instance_policies ORDER BY "order"`
 }
 
 func (p *pgV0) UserPolicies() string {
-	// TODO
-	return ""
+	return `SELECT id, user_id, description, subject, kind FROM ` + p.schema + `user_policies WHERE user_id = $1 ORDER BY "order"`
 }
 
+// InsertResolutions records the resolution along with the instance or user
+// policy that made it. Resolutions of redelivered activities are kept as
+// first recorded.
 func (p *pgV0) InsertResolutions() string {
-	// TODO
-	return ""
+	return `WITH r AS (
+  INSERT INTO ` + p.schema + `resolutions (user_id, permitted, action, activity_iri, is_public, reason, "order")
+  VALUES ($1, $2, $3, $4, $5, $6, $7)
+  ON CONFLICT DO NOTHING
+  RETURNING id
+), ip AS (
+  INSERT INTO ` + p.schema + `resolutions_instance_policies (resolution_id, instance_policy_id)
+  SELECT id, $8 FROM r WHERE $5
+)
+INSERT INTO ` + p.schema + `resolutions_user_policies (resolution_id, user_policy_id)
+SELECT id, $8 FROM r WHERE NOT $5`
 }
 
 func (p *pgV0) UserResolutions() string {
-	// TODO
-	return ""
+	return `SELECT r.id, r.user_id, r.permitted, r.action, r.activity_iri, r."order", r.is_public, r.reason,
+  COALESCE(ri.instance_policy_id::text, ru.user_policy_id::text, '')
+FROM ` + p.schema + `resolutions AS r
+LEFT JOIN ` + p.schema + `resolutions_instance_policies AS ri ON ri.resolution_id = r.id
+LEFT JOIN ` + p.schema + `resolutions_user_policies AS ru ON ru.resolution_id = r.id
+WHERE r.user_id = $1
+ORDER BY r.create_time DESC, r.activity_iri, r."order"`
 }
 
 func (p *pgV0) InsertUserPKey() string {
@@ -442,8 +822,58 @@ ON users.actor->>'followers' = local_data.payload->>'id'
 WHERE users.id = $1`
 }
 
+func (p *pgV0) InsertRelationship() string {
+	return "INSERT INTO " + p.schema + "user_relationships (user_id, kind, subject, expires_at, activity_iri) VALUES ($1, $2, $3, $4, $5)"
+}
+
+func (p *pgV0) DeleteRelationship() string {
+	return "DELETE FROM " + p.schema + "user_relationships WHERE user_id = $1 AND kind = $2 AND subject = $3"
+}
+
+func (p *pgV0) DeleteRelationshipByActivity() string {
+	return "DELETE FROM " + p.schema + "user_relationships WHERE user_id = $1 AND activity_iri = $2"
+}
+
+func (p *pgV0) UserRelationships() string {
+	return `SELECT id, create_time, user_id, kind, subject, expires_at, activity_iri
+FROM ` + p.schema + `user_relationships
+WHERE user_id = $1 AND (expires_at IS NULL OR expires_at > current_timestamp)
+ORDER BY create_time DESC`
+}
+
+func (p *pgV0) HasRelationship() string {
+	return `SELECT EXISTS (
+  SELECT 1 FROM ` + p.schema + `user_relationships
+  WHERE user_id = $1 AND kind = $2 AND subject = $3
+  AND (expires_at IS NULL OR expires_at > current_timestamp)
+)`
+}
+
+func (p *pgV0) InsertReport() string {
+	return `INSERT INTO ` + p.schema + `reports
+(flag_iri, reporter_iri, reporter_user_id, reported_iri, objects, content, forward)
+VALUES ($1, $2, $3, $4, $5, $6, $7)`
+}
+
+func (p *pgV0) ReportsByStatus() string {
+	return `SELECT id, create_time, flag_iri, reporter_iri, reporter_user_id, reported_iri, objects, content, forward, status, assignee_id, notes
+FROM ` + p.schema + `reports
+WHERE status = $1
+ORDER BY create_time ASC`
+}
+
+func (p *pgV0) ReportById() string {
+	return `SELECT id, create_time, flag_iri, reporter_iri, reporter_user_id, reported_iri, objects, content, forward, status, assignee_id, notes
+FROM ` + p.schema + `reports
+WHERE id = $1`
+}
+
+func (p *pgV0) UpdateReport() string {
+	return "UPDATE " + p.schema + "reports SET (status, assignee_id, notes) = ($2, $3, $4) WHERE id = $1"
+}
+
 func (p *pgV0) InsertAttempt() string {
-	return "INSERT INTO " + p.schema + "delivery_attempts (from_id, to, payload, state) VALUES ($1, $2, $3, 'new')"
+	return "INSERT INTO " + p.schema + "delivery_attempts (from_id, to, payload, state) VALUES ($1, $2, $3, 'new') RETURNING id"
 }
 
 func (p *pgV0) MarkSuccessfulAttempt() string {
@@ -454,6 +884,10 @@ func (p *pgV0) MarkRetryFailureAttempt() string {
 	return "UPDATE " + p.schema + "delivery_attempts SET (state) = ('fail') WHERE id = $1"
 }
 
+func (p *pgV0) PendingAttempts() string {
+	return "SELECT id, from_id, to, payload FROM " + p.schema + "delivery_attempts WHERE state = 'new' ORDER BY create_time ASC"
+}
+
 func (p *pgV0) CreateTokenInfo() string {
 	return "INSERT INTO " + p.schema + `oauth_tokens
 (
@@ -502,7 +936,6 @@ func (p *pgV0) RemoveTokenByRefresh() string {
 
 func (p *pgV0) GetTokenByCode() string {
 	return `SELECT
-(
   client_id,
   user_id,
   redirect_uri,
@@ -516,13 +949,11 @@ func (p *pgV0) GetTokenByCode() string {
   refresh,
   refresh_create_at,
   refresh_expires_in
-) 
 FROM ` + p.schema + "oauth_tokens WHERE code = $1"
 }
 
 func (p *pgV0) GetTokenByAccess() string {
 	return `SELECT
-(
   client_id,
   user_id,
   redirect_uri,
@@ -536,13 +967,11 @@ func (p *pgV0) GetTokenByAccess() string {
   refresh,
   refresh_create_at,
   refresh_expires_in
-) 
 FROM ` + p.schema + "oauth_tokens WHERE access = $1"
 }
 
 func (p *pgV0) GetTokenByRefresh() string {
 	return `SELECT
-(
   client_id,
   user_id,
   redirect_uri,
@@ -556,12 +985,122 @@ func (p *pgV0) GetTokenByRefresh() string {
   refresh,
   refresh_create_at,
   refresh_expires_in
-) 
 FROM ` + p.schema + "oauth_tokens WHERE refresh = $1"
 }
 
 func (p *pgV0) GetClientById() string {
-	return "SELECT (id, secret, domain, user_id) FROM " + p.schema + "oauth_clients WHERE id = $1"
+	return `SELECT id, secret, domain, user_id, name, redirect_uris, scopes, grant_types, public, revoked
+FROM ` + p.schema + `oauth_clients WHERE id = $1`
+}
+
+func (p *pgV0) InsertClient() string {
+	return `INSERT INTO ` + p.schema + `oauth_clients
+(id, secret, domain, user_id, name, redirect_uris, scopes, grant_types, public)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+RETURNING create_time`
+}
+
+func (p *pgV0) Clients() string {
+	return `SELECT id, name, redirect_uris, scopes, grant_types, public, revoked, user_id, create_time
+FROM ` + p.schema + `oauth_clients
+ORDER BY create_time ASC`
+}
+
+func (p *pgV0) RevokeClient() string {
+	return "UPDATE " + p.schema + "oauth_clients SET (revoked) = (true) WHERE id = $1"
+}
+
+func (p *pgV0) SetTokenCodeParameters() string {
+	return "UPDATE " + p.schema + "oauth_tokens SET (code_challenge, code_challenge_method, nonce) = ($2, $3, $4) WHERE code = $1"
+}
+
+func (p *pgV0) TokenCodeParameters() string {
+	return "SELECT code_challenge, code_challenge_method, nonce FROM " + p.schema + "oauth_tokens WHERE code = $1"
+}
+
+func (p *pgV0) UserGrants() string {
+	return `SELECT t.id, t.client_id, c.name, t.scope, t.access_create_at, t.access_expires_in, t.refresh, t.refresh_create_at, t.refresh_expires_in
+FROM ` + p.schema + `oauth_tokens AS t
+INNER JOIN ` + p.schema + `oauth_clients AS c
+ON t.client_id = c.id
+WHERE t.user_id = $1 AND t.access <> ''
+ORDER BY t.access_create_at DESC`
+}
+
+func (p *pgV0) RemoveUserGrant() string {
+	return "DELETE FROM " + p.schema + "oauth_tokens WHERE id = $1 AND user_id = $2"
+}
+
+func (p *pgV0) RemoveUserClientGrants() string {
+	return "DELETE FROM " + p.schema + "oauth_tokens WHERE client_id = $1 AND user_id = $2"
+}
+
+func (p *pgV0) PurgeExpiredTokens() string {
+	// Expiry durations are stored in nanoseconds. Tokens that can be
+	// refreshed live as long as their refresh token.
+	return `DELETE FROM ` + p.schema + `oauth_tokens
+WHERE (access = '' AND code_create_at + make_interval(secs => code_expires_in / 1e9) < current_timestamp)
+OR (access <> '' AND refresh = '' AND access_expires_in > 0 AND access_create_at + make_interval(secs => access_expires_in / 1e9) < current_timestamp)
+OR (refresh <> '' AND refresh_expires_in > 0 AND refresh_create_at + make_interval(secs => refresh_expires_in / 1e9) < current_timestamp)`
+}
+
+func (p *pgV0) GetSession() string {
+	return "SELECT user_id, data, create_time, last_seen, user_agent, ip FROM " + p.schema + "sessions WHERE id = $1"
+}
+
+func (p *pgV0) InsertSession() string {
+	return "INSERT INTO " + p.schema + "sessions (id, user_id, data, last_seen, user_agent, ip) VALUES ($1, $2, $3, $4, $5, $6)"
+}
+
+func (p *pgV0) UpdateSession() string {
+	return "UPDATE " + p.schema + "sessions SET (user_id, data, last_seen, user_agent, ip) = ($2, $3, $4, $5, $6) WHERE id = $1"
+}
+
+func (p *pgV0) TouchSession() string {
+	return "UPDATE " + p.schema + "sessions SET last_seen = $2 WHERE id = $1"
+}
+
+func (p *pgV0) DeleteSession() string {
+	return "DELETE FROM " + p.schema + "sessions WHERE id = $1"
+}
+
+func (p *pgV0) UserSessions() string {
+	return "SELECT id, create_time, last_seen, user_agent, ip FROM " + p.schema + "sessions WHERE user_id = $1 ORDER BY last_seen DESC"
+}
+
+func (p *pgV0) DeleteUserSession() string {
+	return "DELETE FROM " + p.schema + "sessions WHERE id = $1 AND user_id = $2"
+}
+
+func (p *pgV0) DeleteUserSessions() string {
+	return "DELETE FROM " + p.schema + "sessions WHERE user_id = $1"
+}
+
+func (p *pgV0) PurgeExpiredSessions() string {
+	return "DELETE FROM " + p.schema + "sessions WHERE last_seen < $1 OR create_time < $2"
+}
+
+func (p *pgV0) PlaintextTokens() string {
+	return `SELECT id, code, access, refresh FROM ` + p.schema + `oauth_tokens
+WHERE (code <> '' AND code NOT LIKE 'hmac-sha256:%')
+OR (access <> '' AND access NOT LIKE 'hmac-sha256:%')
+OR (refresh <> '' AND refresh NOT LIKE 'hmac-sha256:%')`
+}
+
+func (p *pgV0) SetTokenHashes() string {
+	return "UPDATE " + p.schema + "oauth_tokens SET (code, access, refresh) = ($2, $3, $4) WHERE id = $1"
+}
+
+func (p *pgV0) ClientSecrets() string {
+	return "SELECT id, secret FROM " + p.schema + "oauth_clients WHERE secret <> ''"
+}
+
+func (p *pgV0) SetClientSecret() string {
+	return "UPDATE " + p.schema + "oauth_clients SET (secret) = ($2) WHERE id = $1"
+}
+
+func (p *pgV0) RemoveTokensByClient() string {
+	return "DELETE FROM " + p.schema + "oauth_tokens WHERE client_id = $1"
 }
 
 func (p *pgV0) InboxContains() string {
@@ -584,6 +1123,17 @@ ON u.id = ui.user_id
 INNER JOIN ` + p.schema + `fed_data AS f
 ON ui.federated_id = f.id
 WHERE u.actor->>'inbox' = $1
+AND NOT EXISTS
+(
+  SELECT 1 FROM ` + p.schema + `user_relationships AS rel
+  WHERE rel.user_id = u.id
+  AND (rel.expires_at IS NULL OR rel.expires_at > current_timestamp)
+  AND
+  (
+    (rel.kind IN ('block', 'mute') AND rel.subject = f.payload->>'actor')
+    OR (rel.kind = 'domain_block' AND rel.subject = substring(f.payload->>'actor' from '^[a-z]+://([^/:]+)'))
+  )
+)
 ORDER BY f.create_time DESC
 LIMIT $3 OFFSET $2`
 }
@@ -599,6 +1149,21 @@ WHERE u.actor->>'inbox' = $1 AND
 (
   f.payload->'to' ? 'https://www.w3.org/ns/activitystreams#Public'
   OR f.payload->'cc' ? 'https://www.w3.org/ns/activitystreams#Public'
+) AND NOT EXISTS
+(
+  SELECT 1 FROM ` + p.schema + `resolutions AS r
+  WHERE r.activity_iri = f.payload->>'id' AND r.action = 'silence'
+)
+AND NOT EXISTS
+(
+  SELECT 1 FROM ` + p.schema + `user_relationships AS rel
+  WHERE rel.user_id = u.id
+  AND (rel.expires_at IS NULL OR rel.expires_at > current_timestamp)
+  AND
+  (
+    (rel.kind IN ('block', 'mute') AND rel.subject = f.payload->>'actor')
+    OR (rel.kind = 'domain_block' AND rel.subject = substring(f.payload->>'actor' from '^[a-z]+://([^/:]+)'))
+  )
 )
 ORDER BY f.create_time DESC
 LIMIT $3 OFFSET $2`
@@ -701,6 +1266,10 @@ WHERE u.actor->>'outbox' = $1 AND
 (
   l.payload->'to' ? 'https://www.w3.org/ns/activitystreams#Public'
   OR l.payload->'cc' ? 'https://www.w3.org/ns/activitystreams#Public'
+) AND NOT EXISTS
+(
+  SELECT 1 FROM ` + p.schema + `user_privileges AS up
+  WHERE up.user_id = u.id AND up.state = 'silenced'
 )
 ORDER BY l.create_time DESC
 LIMIT $3 OFFSET $2`
@@ -748,16 +1317,13 @@ WHERE users.actor->>'id' = $1`
 }
 
 func (p *pgV0) InsertUser() string {
-	// TODO
-	return ""
+	return "INSERT INTO " + p.schema + "users (email, hashpass, salt, actor) VALUES ($1, $2, $3, $4)"
 }
 
 func (p *pgV0) InsertUserPrivileges() string {
-	// TODO
-	return ""
+	return "INSERT INTO " + p.schema + "user_privileges (user_id, admin, mfa_required, state, email_verified) VALUES ($1, $2, $3, $4, $5)"
 }
 
 func (p *pgV0) InsertUserPreferences() string {
-	// TODO
-	return ""
+	return "INSERT INTO " + p.schema + "user_preferences (user_id, on_follow) VALUES ($1, $2)"
 }
@@ -152,15 +152,50 @@ func (a *App) BadRequestHandler() http.Handler {
 // message.
 func (a *App) GetLoginWebHandlerFunc() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		a.templates.ExecuteTemplate(w, "login.html", a.getTemplateData())
+		a.templates.ExecuteTemplate(w, "login.html", a.getTemplateData(r))
+	}
+}
+
+// GetLoginMFAWebHandlerFunc returns a handler that renders the second step of
+// logging in, where the user enters a TOTP or recovery code, enrolls in TOTP,
+// or is shown their new recovery codes.
+func (a *App) GetLoginMFAWebHandlerFunc() func(w http.ResponseWriter, r *http.Request, step apcore.MFAStep) {
+	return func(w http.ResponseWriter, r *http.Request, step apcore.MFAStep) {
+		d := a.getTemplateData(r)
+		d["Step"] = step
+		a.templates.ExecuteTemplate(w, "login_mfa.html", d)
+	}
+}
+
+// GetRegistrationWebHandlerFunc returns a handler that renders the sign up page,
+// asking for an invite code when registration is invite-only.
+func (a *App) GetRegistrationWebHandlerFunc() func(w http.ResponseWriter, r *http.Request, mode apcore.RegistrationMode) {
+	return func(w http.ResponseWriter, r *http.Request, mode apcore.RegistrationMode) {
+		d := a.getTemplateData(r)
+		d["InviteOnly"] = mode == apcore.RegistrationInviteOnly
+		a.templates.ExecuteTemplate(w, "register.html", d)
+	}
+}
+
+// GetPasswordResetWebHandlerFunc returns a handler that renders the page to
+// request a password reset email, or to choose a new password using the token
+// from that email.
+func (a *App) GetPasswordResetWebHandlerFunc() func(w http.ResponseWriter, r *http.Request, token string) {
+	return func(w http.ResponseWriter, r *http.Request, token string) {
+		d := a.getTemplateData(r)
+		d["Token"] = token
+		a.templates.ExecuteTemplate(w, "reset_password.html", d)
 	}
 }
 
 // GetAuthWebHandlerFunc returns a handler that renders the authorization page
 // for the user to approve in the OAuth2 flow.
-func (a *App) GetAuthWebHandlerFunc() http.HandlerFunc {
-	// TODO
-	return nil
+func (a *App) GetAuthWebHandlerFunc() func(w http.ResponseWriter, r *http.Request, consent apcore.OAuth2Consent) {
+	return func(w http.ResponseWriter, r *http.Request, consent apcore.OAuth2Consent) {
+		d := a.getTemplateData(r)
+		d["Consent"] = consent
+		a.templates.ExecuteTemplate(w, "authorize.html", d)
+	}
 }
 
 // GetInboxWebHandlerFunc returns a function rendering the outbox. The framework
@@ -222,7 +257,7 @@ func (a *App) BuildRoutes(r *apcore.Router, db apcore.Database, f apcore.Framewo
 	// endpoints:
 	//
 	//     /login (GET & POST)
-	//     /logout (GET)
+	//     /logout (POST)
 	//     /authorize (GET & POST)
 	//     /token (GET)
 	//
@@ -243,11 +278,11 @@ func (a *App) BuildRoutes(r *apcore.Router, db apcore.Database, f apcore.Framewo
 	//
 	// It is sugar for Path(...).HandlerFunc(...)
 	r.WebOnlyHandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		a.templates.ExecuteTemplate(w, "home.html", a.getTemplateData())
+		a.templates.ExecuteTemplate(w, "home.html", a.getTemplateData(r))
 	})
 	r.WebOnlyHandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {
 		// TODO: List users
-		d := a.getTemplateData()
+		d := a.getTemplateData(r)
 		a.templates.ExecuteTemplate(w, "users.html", d)
 	})
 	// ActivityPubHandleFunc is a convenience function for endpoints with
@@ -278,7 +313,10 @@ func (a *App) BuildRoutes(r *apcore.Router, db apcore.Database, f apcore.Framewo
 	})
 	// Next, a webpage to handle creating, updating, and deleting notes.
 	// This is NOT via C2S, but is done natively in our application.
-	r.NewRoute().Path("/notes/create").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	//
+	// Registering it with WebOnlyHandlerFunc protects its form against
+	// cross-site request forgery.
+	r.NewRoute().Methods("GET").WebOnlyHandlerFunc("/notes/create", func(w http.ResponseWriter, r *http.Request) {
 		// Ensure the user is logged in.
 		_, authd, err := f.ValidateOAuth2AccessToken(w, r)
 		if err != nil {
@@ -291,10 +329,10 @@ func (a *App) BuildRoutes(r *apcore.Router, db apcore.Database, f apcore.Framewo
 			return
 		}
 		// Render the webpage.
-		d := a.getTemplateData()
+		d := a.getTemplateData(r)
 		a.templates.ExecuteTemplate(w, "create_note.html", d)
 	})
-	r.NewRoute().Path("/notes/create").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	r.NewRoute().Methods("POST").WebOnlyHandlerFunc("/notes/create", func(w http.ResponseWriter, r *http.Request) {
 		// Ensure the user is logged in.
 		_, authd, err := f.ValidateOAuth2AccessToken(w, r)
 		if err != nil {
@@ -357,25 +395,21 @@ func (a *App) ApplySocialCallbacks(swc *pub.SocialWrappedCallbacks) (others []in
 	return
 }
 
-// ScopePermitsPostOutbox ensures the OAuth2 token scope is "loggedin", which
-// is the only permission. Other applications can have more granular
-// authorization systems.
-func (a *App) ScopePermitsPostOutbox(scope string) (permitted bool, err error) {
-	return scope == "loggedin", nil
-}
-
-// ScopePermitsPrivateGetInbox ensures the OAuth2 token scope is "loggedin",
-// which is the only permission. Other applications can have more granular
-// authorization systems.
-func (a *App) ScopePermitsPrivateGetInbox(scope string) (permitted bool, err error) {
-	return scope == "loggedin", nil
+// Scopes adds a scope for creating notes natively in this application, in
+// addition to apcore's built-in scopes.
+func (a *App) Scopes() []apcore.Scope {
+	return []apcore.Scope{
+		{
+			Name:        "write:notes",
+			Description: "Create notes on your behalf",
+		},
+	}
 }
 
-// ScopePermitsPrivateGetOutbox ensures the OAuth2 token scope is "loggedin",
-// which is the only permission. Other applications can have more granular
-// authorization systems.
-func (a *App) ScopePermitsPrivateGetOutbox(scope string) (permitted bool, err error) {
-	return scope == "loggedin", nil
+// Mailer returns nil to send emails with the mailer configured in the mail
+// section of the configuration file.
+func (a *App) Mailer() apcore.Mailer {
+	return nil
 }
 
 // Software describes the current running software, based on the code. This
@@ -394,9 +428,10 @@ func (a *App) Software() apcore.Software {
 }
 
 // This is a helper function to generate common data needed in the web
-// templates.
-func (a *App) getTemplateData() map[string]interface{} {
+// templates. Every form must include the CSRFField, or apcore rejects it.
+func (a *App) getTemplateData(r *http.Request) map[string]interface{} {
 	return map[string]interface{}{
+		"CSRFField": apcore.CSRFField(r),
 		"Nav": []struct {
 			Href string
 			Name string
@@ -409,10 +444,6 @@ func (a *App) getTemplateData() map[string]interface{} {
 				Href: "/login",
 				Name: "login",
 			},
-			{
-				Href: "/logout",
-				Name: "logout",
-			},
 			{
 				Href: "/users",
 				Name: "users",
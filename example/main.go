@@ -42,6 +42,10 @@ func main() {
 			"templates/header.html",
 			"templates/home.html",
 			"templates/login.html",
+			"templates/login_mfa.html",
+			"templates/register.html",
+			"templates/reset_password.html",
+			"templates/authorize.html",
 			"templates/users.html",
 		},
 	)
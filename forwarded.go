@@ -0,0 +1,161 @@
+// apcore is a server framework for implementing an ActivityPub application.
+// Copyright (C) 2019 Cory Slep
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package apcore
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const unixSocketPrefix = "unix:"
+
+type clientIPContextKey struct{}
+
+// forwardedHeaders determines the scheme, host, and client IP of requests,
+// honouring the X-Forwarded-For, X-Forwarded-Proto, and X-Forwarded-Host
+// headers only when sent by a trusted proxy.
+type forwardedHeaders struct {
+	trusted []*net.IPNet
+	// scheme of requests not stating one, which is https behind a reverse
+	// proxy terminating TLS.
+	scheme string
+}
+
+func newForwardedHeaders(c *config, debug bool) (f *forwardedHeaders, err error) {
+	f = &forwardedHeaders{
+		scheme: "http",
+	}
+	if c.ServerConfig.ReverseProxy && !debug {
+		f.scheme = "https"
+	}
+	for _, s := range strings.Split(c.ServerConfig.TrustedProxies, ",") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		var n *net.IPNet
+		if _, n, err = net.ParseCIDR(s); err != nil {
+			err = fmt.Errorf("invalid sr_trusted_proxies CIDR %q: %s", s, err)
+			return
+		}
+		f.trusted = append(f.trusted, n)
+	}
+	return
+}
+
+// isTrusted determines whether the remote address is a trusted proxy.
+// Connections over a Unix socket can only come from this machine, so are
+// trusted.
+func (f *forwardedHeaders) isTrusted(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return len(remoteAddr) == 0 || remoteAddr == "@"
+	}
+	return f.isTrustedIP(net.ParseIP(host))
+}
+
+func (f *forwardedHeaders) isTrustedIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range f.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP finds the client in X-Forwarded-For, which is the nearest address
+// not of a trusted proxy, as earlier addresses can be forged by the client.
+func (f *forwardedHeaders) clientIP(r *http.Request) string {
+	var hops []string
+	for _, v := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			return ""
+		} else if !f.isTrustedIP(ip) || i == 0 {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+func (f *forwardedHeaders) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme := f.scheme
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		if f.isTrusted(r.RemoteAddr) {
+			if ip := f.clientIP(r); len(ip) > 0 {
+				*r = *r.WithContext(context.WithValue(r.Context(), clientIPContextKey{}, ip))
+			}
+			if p := strings.ToLower(r.Header.Get("X-Forwarded-Proto")); p == "http" || p == "https" {
+				scheme = p
+			}
+			if h := r.Header.Get("X-Forwarded-Host"); len(h) > 0 {
+				r.Host = h
+			}
+		}
+		// Routes match on the scheme, which servers leave empty.
+		if len(r.URL.Scheme) == 0 {
+			r.URL.Scheme = scheme
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listen on the address, which is a Unix socket if prefixed with "unix:".
+func listen(addr string) (l net.Listener, err error) {
+	if !strings.HasPrefix(addr, unixSocketPrefix) {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, unixSocketPrefix)
+	// A socket left behind by an earlier run prevents listening.
+	if fi, serr := os.Stat(path); serr == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err = os.Remove(path); err != nil {
+			return
+		}
+	}
+	if l, err = net.Listen("unix", path); err != nil {
+		return
+	}
+	// Let a reverse proxy in the same group connect.
+	err = os.Chmod(path, 0660)
+	return
+}
+
+// listenAndServe serves on the address of the server, with TLS if useTLS is
+// set.
+func listenAndServe(s *http.Server, useTLS bool) error {
+	l, err := listen(s.Addr)
+	if err != nil {
+		return err
+	}
+	if useTLS {
+		return s.ServeTLS(l, "", "")
+	}
+	return s.Serve(l)
+}
@@ -21,8 +21,10 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/go-fed/activity/pub"
+	"github.com/go-fed/activity/streams"
 	"github.com/go-fed/activity/streams/vocab"
 	"gopkg.in/oauth2.v3"
 )
@@ -49,6 +51,101 @@ type Framework interface {
 	// Note that a new ID is not needed on the activity and/or objects that
 	// are being sent; they will be generated as needed.
 	Send(c context.Context, outbox *url.URL, toSend vocab.Type) error
+
+	// Report files a moderation report on behalf of the user represented
+	// by the outbox IRI, about the reported actor and any of its objects.
+	//
+	// If forward is true and the reported actor is on another instance,
+	// a Flag activity is also sent to the reported actor.
+	Report(c context.Context, outbox *url.URL, reported *url.URL, objects []*url.URL, content string, forward bool) error
+
+	// Reports lists the reports in the moderation queue with the given
+	// status, oldest first.
+	//
+	// The application is responsible for ensuring only administrators
+	// can access reports.
+	Reports(c context.Context, status ReportStatus) ([]Report, error)
+
+	// ResolveReport updates the status, assignee, and notes of a report,
+	// optionally creating an instance policy against the reported actor.
+	//
+	// The application is responsible for ensuring only administrators
+	// can resolve reports.
+	ResolveReport(c context.Context, id string, res ReportResolution) error
+
+	// CreateOAuth2Client registers an OAuth2 client, such as one for the
+	// application's own frontend. The returned client contains the only
+	// copy of its secret, which is empty for public clients.
+	CreateOAuth2Client(c context.Context, name string, redirectURIs, scopes []string, public bool) (OAuth2Client, error)
+
+	// OAuth2Clients lists all registered OAuth2 clients, without secrets.
+	OAuth2Clients(c context.Context) ([]OAuth2Client, error)
+
+	// RevokeOAuth2Client prevents the OAuth2 client from obtaining new
+	// tokens and removes its existing tokens.
+	RevokeOAuth2Client(c context.Context, id string) error
+
+	// OAuth2Grants lists the apps and devices a user has authorized,
+	// newest first.
+	//
+	// The application is responsible for ensuring users can only see
+	// their own grants.
+	OAuth2Grants(c context.Context, userId string) ([]OAuth2Grant, error)
+
+	// RevokeOAuth2Grant revokes a single grant of the user, such as the
+	// tokens of a lost device.
+	RevokeOAuth2Grant(c context.Context, userId, grantId string) error
+
+	// RevokeOAuth2ClientGrants revokes every grant the user has given to
+	// the client.
+	RevokeOAuth2ClientGrants(c context.Context, userId, clientId string) error
+
+	// EnrollMFA begins enrolling the user in TOTP multi-factor
+	// authentication, returning the secret to add to their authenticator
+	// app. It has no effect until confirmed with ConfirmMFA.
+	//
+	// The application is responsible for ensuring users can only enroll
+	// themselves.
+	EnrollMFA(c context.Context, userId string) (MFAEnrollment, error)
+
+	// ConfirmMFA completes enrollment if the TOTP code is valid, returning
+	// recovery codes that must be shown to the user once.
+	ConfirmMFA(c context.Context, userId, code string) (recoveryCodes []string, ok bool, err error)
+
+	// RegenerateRecoveryCodes replaces the recovery codes of an enrolled
+	// user, such as when they have used or lost them.
+	RegenerateRecoveryCodes(c context.Context, userId string) ([]string, error)
+
+	// DisableMFA removes multi-factor authentication from the user. Users
+	// required to use it must enroll again at their next login.
+	//
+	// The application is responsible for ensuring the user has recently
+	// verified their password or a code.
+	DisableMFA(c context.Context, userId string) error
+
+	// CreateInvite creates an invite code that lets up to maxUses people
+	// register, even when registration is invite-only or requires
+	// approval. It never expires if expiry is zero. The createdBy user may
+	// be empty.
+	CreateInvite(c context.Context, createdBy string, maxUses int, expiry time.Duration) (code string, err error)
+
+	// ApproveRegistration makes a user registered while approval was
+	// required active, so they can log in.
+	//
+	// The application is responsible for ensuring only administrators
+	// can approve registrations.
+	ApproveRegistration(c context.Context, userId string) error
+
+	// UserSessions lists the browser sessions in which the user is logged
+	// in, most recently used first.
+	UserSessions(c context.Context, userId string) ([]UserSession, error)
+
+	// RevokeSession logs out one of the user's sessions.
+	RevokeSession(c context.Context, userId, sessionId string) error
+
+	// RevokeAllSessions logs the user out of every session. Changing a
+	// password through a reset does so automatically.
+	RevokeAllSessions(c context.Context, userId string) error
 }
 
 var _ Framework = &framework{}
@@ -58,16 +155,18 @@ type framework struct {
 	host              string
 	o                 *oAuth2Server
 	db                *apdb
+	sl                *sessions
 	actor             pub.Actor
 	federationEnabled bool
 }
 
-func newFramework(scheme string, host string, o *oAuth2Server, db *apdb, actor pub.Actor, federationEnabled bool) *framework {
+func newFramework(scheme string, host string, o *oAuth2Server, db *apdb, sl *sessions, actor pub.Actor, federationEnabled bool) *framework {
 	return &framework{
 		scheme:            scheme,
 		host:              host,
 		o:                 o,
 		db:                db,
+		sl:                sl,
 		actor:             actor,
 		federationEnabled: federationEnabled,
 	}
@@ -87,3 +186,140 @@ func (f *framework) Send(c context.Context, outbox *url.URL, t vocab.Type) error
 		return err
 	}
 }
+
+func (f *framework) Report(c context.Context, outbox *url.URL, reported *url.URL, objects []*url.URL, content string, forward bool) (err error) {
+	r := Report{
+		ReportedIRI: reported,
+		Objects:     append([]*url.URL{reported}, objects...),
+		Content:     content,
+		Forward:     forward && reported.Host != f.host,
+		Status:      ReportOpen,
+	}
+	if r.ReporterUserId, err = f.db.UserIdForBoxPath(c, outbox.String()); err != nil {
+		return
+	}
+	if r.ReporterIRI, err = f.db.ActorForOutbox(c, outbox); err != nil {
+		return
+	}
+	if r.Forward {
+		flag := streams.NewActivityStreamsFlag()
+		actor := streams.NewActivityStreamsActorProperty()
+		actor.AppendIRI(r.ReporterIRI)
+		flag.SetActivityStreamsActor(actor)
+		obj := streams.NewActivityStreamsObjectProperty()
+		for _, o := range r.Objects {
+			obj.AppendIRI(o)
+		}
+		flag.SetActivityStreamsObject(obj)
+		to := streams.NewActivityStreamsToProperty()
+		to.AppendIRI(reported)
+		flag.SetActivityStreamsTo(to)
+		if len(content) > 0 {
+			cp := streams.NewActivityStreamsContentProperty()
+			cp.AppendXMLSchemaString(content)
+			flag.SetActivityStreamsContent(cp)
+		}
+		// The report is recorded below, instead of by the outbox.
+		sc := &ctx{c}
+		sc.withReportRecorded()
+		if err = f.Send(sc.Context, outbox, flag); err != nil {
+			return
+		}
+		if id, err := pub.GetId(flag); err == nil {
+			r.FlagIRI = id
+		}
+	}
+	err = f.db.InsertReport(c, r)
+	return
+}
+
+func (f *framework) Reports(c context.Context, status ReportStatus) ([]Report, error) {
+	return f.db.ReportsByStatus(c, status)
+}
+
+func (f *framework) ResolveReport(c context.Context, id string, res ReportResolution) error {
+	return applyReportResolution(c, f.db.database, id, res)
+}
+
+func (f *framework) CreateOAuth2Client(c context.Context, name string, redirectURIs, scopes []string, public bool) (cl OAuth2Client, err error) {
+	if cl, err = newOAuth2Client(f.o.scopes, name, redirectURIs, scopes, nil, public, ""); err != nil {
+		return
+	}
+	cl, err = f.db.InsertClient(c, cl)
+	return
+}
+
+func (f *framework) OAuth2Clients(c context.Context) ([]OAuth2Client, error) {
+	return f.db.Clients(c)
+}
+
+func (f *framework) RevokeOAuth2Client(c context.Context, id string) error {
+	return f.db.RevokeClient(c, id)
+}
+
+func (f *framework) OAuth2Grants(c context.Context, userId string) ([]OAuth2Grant, error) {
+	return f.db.UserGrants(c, userId)
+}
+
+func (f *framework) RevokeOAuth2Grant(c context.Context, userId, grantId string) error {
+	return f.db.RevokeUserGrant(c, userId, grantId)
+}
+
+func (f *framework) RevokeOAuth2ClientGrants(c context.Context, userId, clientId string) error {
+	return f.db.RevokeUserClientGrants(c, userId, clientId)
+}
+
+func (f *framework) EnrollMFA(c context.Context, userId string) (MFAEnrollment, error) {
+	return beginTOTPEnrollment(c, f.db.database, f.host, userId)
+}
+
+func (f *framework) ConfirmMFA(c context.Context, userId, code string) (recoveryCodes []string, ok bool, err error) {
+	return completeTOTPEnrollment(c, f.db.database, userId, code)
+}
+
+func (f *framework) RegenerateRecoveryCodes(c context.Context, userId string) (codes []string, err error) {
+	var s mfaStatus
+	if s, err = f.db.UserMFA(c, userId); err != nil {
+		return
+	} else if !s.enabled {
+		err = fmt.Errorf("user %q has not enrolled in multi-factor authentication", userId)
+		return
+	}
+	if codes, err = newRecoveryCodes(); err != nil {
+		return
+	}
+	err = f.db.ReplaceRecoveryCodes(c, userId, codes)
+	return
+}
+
+func (f *framework) DisableMFA(c context.Context, userId string) error {
+	return f.db.DisableMFA(c, userId)
+}
+
+func (f *framework) CreateInvite(c context.Context, createdBy string, maxUses int, expiry time.Duration) (string, error) {
+	return createInvite(c, f.db.database, createdBy, maxUses, expiry)
+}
+
+func (f *framework) ApproveRegistration(c context.Context, userId string) (err error) {
+	var state userState
+	if state, err = f.db.UserState(c, userId); err != nil {
+		return
+	} else if state != userPendingApproval {
+		err = fmt.Errorf("user %q is not pending approval: %q", userId, state)
+		return
+	}
+	err = f.db.SetUserState(c, userId, userActive)
+	return
+}
+
+func (f *framework) UserSessions(c context.Context, userId string) ([]UserSession, error) {
+	return f.sl.UserSessions(c, userId)
+}
+
+func (f *framework) RevokeSession(c context.Context, userId, sessionId string) error {
+	return f.sl.Revoke(c, userId, sessionId)
+}
+
+func (f *framework) RevokeAllSessions(c context.Context, userId string) error {
+	return f.sl.RevokeUser(c, userId)
+}
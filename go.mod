@@ -7,6 +7,7 @@ require (
 	github.com/go-fed/httpsig v0.1.1-0.20190924171022-f4c36041199d
 	github.com/google/logger v1.0.1
 	github.com/gorilla/mux v1.7.3
+	github.com/gorilla/securecookie v1.1.1
 	github.com/gorilla/sessions v1.2.0
 	github.com/lib/pq v1.2.0
 	github.com/manifoldco/promptui v0.3.2
@@ -14,4 +15,5 @@ require (
 	golang.org/x/time v0.0.0-20180412165947-fbb02b2291d2
 	gopkg.in/ini.v1 v1.44.0
 	gopkg.in/oauth2.v3 v3.10.0
+	gopkg.in/yaml.v2 v2.2.8
 )
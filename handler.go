@@ -31,13 +31,16 @@ import (
 const (
 	LoginFormEmailKey    = "username"
 	LoginFormPasswordKey = "password"
+	// LoginFormMFACodeKey is the form key of the TOTP or recovery code
+	// POSTed to "/login/mfa".
+	LoginFormMFACodeKey = "code"
 )
 
 type handler struct {
 	router *Router
 }
 
-func newHandler(scheme string, c *config, a Application, actor pub.Actor, db *apdb, oauth *oAuth2Server, sl *sessions, clock pub.Clock, debug bool) (h *handler, err error) {
+func newHandler(scheme string, c *config, a Application, actor pub.Actor, db *apdb, oauth *oAuth2Server, sl *sessions, lg *loginGuard, ac *accounts, clock pub.Clock, tc *transportController, debug bool) (h *handler, err error) {
 	mr := mux.NewRouter()
 	mr.NotFoundHandler = a.NotFoundHandler()
 	mr.MethodNotAllowedHandler = a.MethodNotAllowedHandler()
@@ -45,6 +48,7 @@ func newHandler(scheme string, c *config, a Application, actor pub.Actor, db *ap
 	badRequestHandler := a.BadRequestHandler()
 	getAuthWebHandler := a.GetAuthWebHandlerFunc()
 	getLoginWebHandler := a.GetLoginWebHandlerFunc()
+	mfaWebHandler := a.GetLoginMFAWebHandlerFunc()
 
 	// Static assets
 	if sd := c.ServerConfig.StaticRootDirectory; len(sd) == 0 {
@@ -61,18 +65,21 @@ func newHandler(scheme string, c *config, a Application, actor pub.Actor, db *ap
 		mr,
 		db,
 		oauth,
+		sl,
 		actor,
 		clock,
 		c.ServerConfig.Host,
 		scheme,
 		internalErrorHandler,
-		badRequestHandler)
+		badRequestHandler,
+		tc,
+		c.ActivityPubConfig.AuthorizedFetch && a.S2SEnabled())
 
 	// Host-meta
-	r.WebOnlyHandleFunc("/.well-known/host-meta", hostMetaHandler(scheme, c.ServerConfig.Host))
+	r.NewRoute().withoutCSRF().WebOnlyHandlerFunc("/.well-known/host-meta", hostMetaHandler(scheme, c.ServerConfig.Host))
 
 	// Webfinger
-	r.WebOnlyHandleFunc("/.well-known/webfinger", webfingerHandler(scheme, c.ServerConfig.Host, badRequestHandler, internalErrorHandler))
+	r.NewRoute().withoutCSRF().WebOnlyHandlerFunc("/.well-known/webfinger", webfingerHandler(scheme, c.ServerConfig.Host, badRequestHandler, internalErrorHandler))
 
 	// TODO: Node-info
 	// TODO: Actor routes (public key id)
@@ -93,23 +100,42 @@ func newHandler(scheme string, c *config, a Application, actor pub.Actor, db *ap
 	if a.C2SEnabled() {
 		r.actorPostOutbox(knownUserPaths[outboxPathKey], scheme)
 	}
-	maybeAddWebFn := func(path string, f func() (http.HandlerFunc, AuthorizeFunc)) {
+	maybeAddWebFn := func(path string, f func() (http.HandlerFunc, AuthorizeFunc), authorizedFetch bool) {
 		web, authFn := f()
+		authFn = userStateAuthorizeFunc(db, authFn)
+		route := r.NewRoute()
+		if !authorizedFetch {
+			route = route.withoutAuthorizedFetch()
+		}
 		if web == nil {
-			r.ActivityPubOnlyHandleFunc(path, authFn)
+			route.ActivityPubOnlyHandleFunc(path, authFn)
 		} else {
-			r.ActivityPubAndWebHandleFunc(path, authFn, web)
+			route.ActivityPubAndWebHandleFunc(path, authFn, web)
 		}
 	}
-	maybeAddWebFn(knownUserPaths[followersPathKey], a.GetFollowersWebHandlerFunc)
-	maybeAddWebFn(knownUserPaths[followingPathKey], a.GetFollowingWebHandlerFunc)
-	maybeAddWebFn(knownUserPaths[likedPathKey], a.GetLikedWebHandlerFunc)
-	maybeAddWebFn(knownUserPaths[userPathKey], a.GetUserWebHandlerFunc)
+	maybeAddWebFn(knownUserPaths[followersPathKey], a.GetFollowersWebHandlerFunc, true)
+	maybeAddWebFn(knownUserPaths[followingPathKey], a.GetFollowingWebHandlerFunc, true)
+	maybeAddWebFn(knownUserPaths[likedPathKey], a.GetLikedWebHandlerFunc, true)
+	// Actors must remain fetchable for peers to verify HTTP Signatures.
+	maybeAddWebFn(knownUserPaths[userPathKey], a.GetUserWebHandlerFunc, false)
+
+	// Login and logout routes. Web routes require the CSRF token of the
+	// session on POST, so logging out is a POST.
+	r.NewRoute().Methods("POST").WebOnlyHandlerFunc("/login", postLoginFn(sl, db.database, lg, c.ServerConfig.Host, badRequestHandler, internalErrorHandler))
+	r.NewRoute().Methods("GET").WebOnlyHandlerFunc("/login", getLoginWebHandler)
+	r.NewRoute().Methods("GET").WebOnlyHandlerFunc("/login/mfa", getMFAFn(sl, db.database, c.ServerConfig.Host, internalErrorHandler, mfaWebHandler))
+	r.NewRoute().Methods("POST").WebOnlyHandlerFunc("/login/mfa", postMFAFn(sl, db.database, lg, badRequestHandler, internalErrorHandler, mfaWebHandler))
 
-	// POST Login and GET logout routes
-	r.NewRoute().Path("/login").Methods("POST").HandlerFunc(postLoginFn(sl, db.database, badRequestHandler, internalErrorHandler))
-	r.NewRoute().Path("/login").Methods("GET").HandlerFunc(getLoginWebHandler)
-	r.NewRoute().Path("/logout").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	// Registration, email verification, and password reset routes
+	if ac.mode != RegistrationClosed {
+		r.NewRoute().Methods("GET").WebOnlyHandlerFunc("/register", getRegisterFn(ac.mode, a.GetRegistrationWebHandlerFunc()))
+		r.NewRoute().Methods("POST").WebOnlyHandlerFunc("/register", postRegisterFn(ac, badRequestHandler, internalErrorHandler))
+	}
+	r.NewRoute().Methods("GET").WebOnlyHandlerFunc("/verify-email", getVerifyEmailFn(ac, internalErrorHandler))
+	r.NewRoute().Methods("POST").WebOnlyHandlerFunc("/verify-email", postVerifyEmailFn(ac, badRequestHandler, internalErrorHandler))
+	r.NewRoute().Methods("GET").WebOnlyHandlerFunc("/reset-password", getResetPasswordFn(a.GetPasswordResetWebHandlerFunc()))
+	r.NewRoute().Methods("POST").WebOnlyHandlerFunc("/reset-password", postResetPasswordFn(ac, badRequestHandler, internalErrorHandler))
+	r.NewRoute().Methods("POST").WebOnlyHandlerFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
 		t, authd, err := oauth.ValidateOAuth2AccessToken(w, r)
 		if err != nil {
 			internalErrorHandler.ServeHTTP(w, r)
@@ -121,16 +147,37 @@ func newHandler(scheme string, c *config, a Application, actor pub.Actor, db *ap
 				return
 			}
 		}
+		s, err := sl.Get(r)
+		if err != nil {
+			ErrorLogger.Errorf("error getting session for POST logout: %s", err)
+			internalErrorHandler.ServeHTTP(w, r)
+			return
+		}
+		if err = s.Destroy(r, w); err != nil {
+			ErrorLogger.Errorf("error destroying session for POST logout: %s", err)
+			internalErrorHandler.ServeHTTP(w, r)
+			return
+		}
 		http.Redirect(w, r, "/login", http.StatusFound)
 	})
-	r.NewRoute().Path("/authorize").Methods("GET").HandlerFunc(getAuthFn(sl, internalErrorHandler, getAuthWebHandler))
-	r.NewRoute().Path("/authorize").Methods("POST").HandlerFunc(postAuthFn(sl, oauth, internalErrorHandler))
-	r.NewRoute().Path("/token").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	r.NewRoute().Methods("GET").WebOnlyHandlerFunc("/authorize", getAuthFn(sl, oauth, badRequestHandler, internalErrorHandler, getAuthWebHandler))
+	r.NewRoute().Methods("POST").WebOnlyHandlerFunc("/authorize", postAuthFn(sl, oauth, badRequestHandler, internalErrorHandler))
+	r.NewRoute().Path("/token").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		oauth.HandleAccessTokenRequest(w, r)
 	})
+	r.NewRoute().Path("/oauth/revoke").Methods("POST").HandlerFunc(oauth.HandleRevocationRequest)
+	r.NewRoute().Path("/oauth/introspect").Methods("POST").HandlerFunc(oauth.HandleIntrospectionRequest)
+	if c.OAuthConfig.DynamicClientRegistration {
+		r.NewRoute().Path("/oauth/register").Methods("POST").HandlerFunc(clientRegistrationHandler(db.database, oauth.scopes))
+	}
+	if oauth.oidc != nil {
+		r.NewRoute().Path(oidcDiscoveryPath).Methods("GET").HandlerFunc(oauth.oidc.discoveryHandler(oauth.scopes))
+		r.NewRoute().Path(oidcJWKSPath).Methods("GET").HandlerFunc(oauth.oidc.jwksHandler)
+		r.NewRoute().Path(oidcUserInfoPath).Methods("GET", "POST").HandlerFunc(oauth.oidc.userInfoHandler(oauth))
+	}
 
 	// Application-specific routes
-	err = a.BuildRoutes(r, db, newFramework(scheme, c.ServerConfig.Host, oauth, db, actor, a.S2SEnabled()))
+	err = a.BuildRoutes(r, db, newFramework(scheme, c.ServerConfig.Host, oauth, db, sl, actor, a.S2SEnabled()))
 	if err != nil {
 		return
 	}
@@ -225,7 +272,33 @@ func webfingerHandler(scheme, host string, badRequestHandler, internalErrorHandl
 	}
 }
 
-func postLoginFn(sl *sessions, db *database, badRequestHandler, internalErrorHandler http.Handler) func(w http.ResponseWriter, r *http.Request) {
+// userStateAuthorizeFunc denies requests for the data of users whose state
+// does not permit serving their actor, before applying the authFn.
+func userStateAuthorizeFunc(db *apdb, authFn AuthorizeFunc) AuthorizeFunc {
+	return func(c Context, w http.ResponseWriter, r *http.Request, d Database) (permit bool, err error) {
+		var userId string
+		if userId, err = db.UserIdForUsername(r.Context(), Vars(r)["user"]); err != nil {
+			return
+		}
+		// Deleted actors no longer have a username, and their Tombstones
+		// are served.
+		if len(userId) > 0 {
+			var state userState
+			if state, err = db.UserState(r.Context(), userId); err != nil {
+				return
+			} else if !state.ServesActor() {
+				return
+			}
+		}
+		permit = true
+		if authFn != nil {
+			permit, err = authFn(c, w, r, d)
+		}
+		return
+	}
+}
+
+func postLoginFn(sl *sessions, db *database, lg *loginGuard, host string, badRequestHandler, internalErrorHandler http.Handler) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		s, err := sl.Get(r)
 		if err != nil {
@@ -252,21 +325,63 @@ func postLoginFn(sl *sessions, db *database, badRequestHandler, internalErrorHan
 			return
 		}
 		pass := passV[0]
-		u, err := db.UserIDFromEmail(r.Context(), email)
+		ip := remoteIP(r)
+		u, valid, err := lg.CheckPassword(r.Context(), email, pass, ip)
 		if err != nil {
-			ErrorLogger.Errorf("error getting userID for email in POST login: %s", err)
+			ErrorLogger.Errorf("error determining password validity in POST login: %s", err)
 			internalErrorHandler.ServeHTTP(w, r)
 			return
+		} else if !valid {
+			http.Redirect(w, r, "/login?login_error=true", http.StatusFound)
+			return
 		}
-		valid, err := db.Valid(r.Context(), u, pass)
+		state, err := db.UserState(r.Context(), u)
 		if err != nil {
-			ErrorLogger.Errorf("error determining password validity in POST login: %s", err)
+			ErrorLogger.Errorf("error determining user state in POST login: %s", err)
 			internalErrorHandler.ServeHTTP(w, r)
 			return
-		} else if !valid {
+		} else if !state.CanLogin() {
 			http.Redirect(w, r, "/login?login_error=true", http.StatusFound)
 			return
 		}
+		account, err := db.UserAccount(r.Context(), u)
+		if err != nil {
+			ErrorLogger.Errorf("error fetching account in POST login: %s", err)
+			internalErrorHandler.ServeHTTP(w, r)
+			return
+		} else if !account.verified {
+			http.Redirect(w, r, "/login?unverified=true", http.StatusFound)
+			return
+		}
+		mfa, err := db.UserMFA(r.Context(), u)
+		if err != nil {
+			ErrorLogger.Errorf("error determining MFA status in POST login: %s", err)
+			internalErrorHandler.ServeHTTP(w, r)
+			return
+		}
+		if mfa.enabled || mfa.required {
+			if !mfa.enabled {
+				if _, err = beginTOTPEnrollment(r.Context(), db, host, u); err != nil {
+					ErrorLogger.Errorf("error beginning TOTP enrollment in POST login: %s", err)
+					internalErrorHandler.ServeHTTP(w, r)
+					return
+				}
+			}
+			s.SetMFAPending(u)
+			err = s.Save(r, w)
+			if err != nil {
+				ErrorLogger.Errorf("error saving session in POST login: %s", err)
+				internalErrorHandler.ServeHTTP(w, r)
+				return
+			}
+			http.Redirect(w, r, "/login/mfa", http.StatusFound)
+			return
+		}
+		if err = lg.Succeeded(r.Context(), u, email, ip); err != nil {
+			ErrorLogger.Errorf("error recording login in POST login: %s", err)
+			internalErrorHandler.ServeHTTP(w, r)
+			return
+		}
 		s.SetUserID(u)
 		err = s.Save(r, w)
 		if err != nil {
@@ -278,7 +393,7 @@ func postLoginFn(sl *sessions, db *database, badRequestHandler, internalErrorHan
 	}
 }
 
-func getAuthFn(sl *sessions, internalErrorHandler http.Handler, authWebHandler http.HandlerFunc) func(w http.ResponseWriter, r *http.Request) {
+func getAuthFn(sl *sessions, oa *oAuth2Server, badRequestHandler, internalErrorHandler http.Handler, authWebHandler func(http.ResponseWriter, *http.Request, OAuth2Consent)) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		s, err := sl.Get(r)
 		if err != nil {
@@ -286,16 +401,54 @@ func getAuthFn(sl *sessions, internalErrorHandler http.Handler, authWebHandler h
 			internalErrorHandler.ServeHTTP(w, r)
 			return
 		}
+		// Keep only the validated request while the user logs in and
+		// consents.
+		q := r.URL.Query()
+		fromQuery := len(q.Get("client_id")) > 0
+		var ar authorizeRequest
+		var ok bool
+		if fromQuery {
+			ar, ok = newAuthorizeRequest(q), true
+		} else {
+			ar, ok = s.AuthorizeRequest()
+		}
+		if !ok {
+			badRequestHandler.ServeHTTP(w, r)
+			return
+		}
+		ci, err := ar.validate(r.Context(), oa.d, oa.scopes)
+		if err != nil {
+			badRequestHandler.ServeHTTP(w, r)
+			return
+		}
+		if fromQuery {
+			s.SetAuthorizeRequest(ar)
+			err = s.Save(r, w)
+			if err != nil {
+				ErrorLogger.Errorf("error saving session in GET authorize: %s", err)
+				internalErrorHandler.ServeHTTP(w, r)
+				return
+			}
+		}
 		_, err = s.UserID()
 		if err != nil {
 			http.Redirect(w, r, "/login", http.StatusFound)
 			return
 		}
-		authWebHandler(w, r)
+		scopes, err := oa.scopes.Parse(ar.Scope)
+		if err != nil {
+			badRequestHandler.ServeHTTP(w, r)
+			return
+		}
+		authWebHandler(w, r, OAuth2Consent{
+			ClientId:   ci.id,
+			ClientName: ci.name,
+			Scopes:     scopes,
+		})
 	}
 }
 
-func postAuthFn(sl *sessions, oa *oAuth2Server, internalErrorHandler http.Handler) func(w http.ResponseWriter, r *http.Request) {
+func postAuthFn(sl *sessions, oa *oAuth2Server, badRequestHandler, internalErrorHandler http.Handler) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		s, err := sl.Get(r)
 		if err != nil {
@@ -303,16 +456,33 @@ func postAuthFn(sl *sessions, oa *oAuth2Server, internalErrorHandler http.Handle
 			internalErrorHandler.ServeHTTP(w, r)
 			return
 		}
-		if v, ok := s.OAuthRedirectFormValues(); ok {
-			r.Form = v
-			s.DeleteOAuthRedirectFormValues()
+		if err = r.ParseForm(); err != nil {
+			badRequestHandler.ServeHTTP(w, r)
+			return
+		}
+		var ar authorizeRequest
+		if len(r.Form.Get("client_id")) > 0 {
+			ar = newAuthorizeRequest(r.Form)
+		} else if v, ok := s.AuthorizeRequest(); ok {
+			ar = v
+			s.DeleteAuthorizeRequest()
 			err = s.Save(r, w)
 			if err != nil {
 				ErrorLogger.Errorf("error saving session in POST authorize: %s", err)
 				internalErrorHandler.ServeHTTP(w, r)
 				return
 			}
+		} else {
+			badRequestHandler.ServeHTTP(w, r)
+			return
+		}
+		// Never redirect to an unvalidated URI, so errors are not
+		// reported to the client.
+		if _, err = ar.validate(r.Context(), oa.d, oa.scopes); err != nil {
+			badRequestHandler.ServeHTTP(w, r)
+			return
 		}
+		r.Form = ar.values()
 		oa.HandleAuthorizationRequest(w, r)
 	}
 }
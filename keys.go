@@ -18,17 +18,30 @@ package apcore
 
 import (
 	"crypto"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 )
 
 const (
 	minKeySize = 1024
+	// Sizes in bytes of created key files. Cookies are encrypted with
+	// AES-256, which needs a 32 byte key.
+	cookieAuthKeySize       = 64
+	cookieEncryptionKeySize = 32
+	tokenHashKeySize        = 64
+	// Prefixes the stored hashes of OAuth2 codes and tokens, distinguishing
+	// them from plaintext values stored by earlier versions.
+	hashedTokenPrefix = "hmac-sha256:"
 )
 
 func createRSAPrivateKey(n int) (k *rsa.PrivateKey, err error) {
@@ -60,8 +73,7 @@ func deserializeRSAPrivateKey(b []byte) (crypto.PrivateKey, error) {
 	return x509.ParsePKCS8PrivateKey(b)
 }
 
-func createKeyFile(file string) (err error) {
-	c := 64
+func createKeyFile(file string, c int) (err error) {
 	k := make([]byte, c)
 	var n int
 	n, err = rand.Read(k)
@@ -74,3 +86,71 @@ func createKeyFile(file string) (err error) {
 	err = ioutil.WriteFile(file, k, os.FileMode(0660))
 	return
 }
+
+// deriveKey derives a key for a distinct purpose, given by the label, from a
+// private key.
+func deriveKey(key []byte, label string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(label))
+	return m.Sum(nil)
+}
+
+// createPEMKeyFile creates a PEM encoded PKCS8 RSA private key file, unless the
+// file already exists.
+func createPEMKeyFile(file string, n int) (err error) {
+	if _, err = os.Stat(file); err == nil {
+		return
+	} else if !os.IsNotExist(err) {
+		return
+	}
+	var k *rsa.PrivateKey
+	if k, err = createRSAPrivateKey(n); err != nil {
+		return
+	}
+	var b []byte
+	if b, err = serializeRSAPrivateKey(k); err != nil {
+		return
+	}
+	err = ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: b,
+	}), os.FileMode(0660))
+	return
+}
+
+// randomToken creates a URL-safe random string from the given number of random
+// bytes.
+func randomToken(size int) (s string, err error) {
+	b := make([]byte, size)
+	var n int
+	n, err = rand.Read(b)
+	if err != nil {
+		return
+	} else if n != size {
+		err = fmt.Errorf("crypto/rand read %d of %d bytes", n, size)
+		return
+	}
+	s = base64.RawURLEncoding.EncodeToString(b)
+	return
+}
+
+// hashToken computes the keyed hash under which an OAuth2 code or token is
+// stored, so that a database leak does not reveal usable credentials. Empty
+// values are left empty.
+func hashToken(key []byte, t string) string {
+	if len(t) == 0 {
+		return t
+	}
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(t))
+	return hashedTokenPrefix + hex.EncodeToString(m.Sum(nil))
+}
+
+// hashPlaintextToken hashes a stored value only if it has not already been,
+// for migrating rows from earlier versions.
+func hashPlaintextToken(key []byte, t string) string {
+	if strings.HasPrefix(t, hashedTokenPrefix) {
+		return t
+	}
+	return hashToken(key, t)
+}
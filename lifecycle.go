@@ -0,0 +1,198 @@
+// apcore is a server framework for implementing an ActivityPub application.
+// Copyright (C) 2019 Cory Slep
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package apcore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// lifecycleComponent is a running part of the server that is stopped on
+// shutdown.
+type lifecycleComponent struct {
+	name string
+	stop func(c context.Context) error
+}
+
+// lifecycle tracks the running components and background goroutines of the
+// server, so that shutdown stops them in a defined order within the drain
+// timeout.
+//
+// Components are stopped in the reverse order they were registered, so the
+// HTTP servers that are started last stop accepting requests first, and the
+// database that is opened first is closed last.
+type lifecycle struct {
+	drain      time.Duration
+	ctx        context.Context
+	cancel     context.CancelFunc
+	mu         *sync.Mutex
+	components []lifecycleComponent
+	closing    bool
+	inflight   int
+	wg         *sync.WaitGroup
+	once       *sync.Once
+}
+
+func newLifecycle(c *config) (l *lifecycle, err error) {
+	if c.ServerConfig.ShutdownDrainTimeoutSeconds <= 0 {
+		err = fmt.Errorf("shutdown drain timeout is <= 0")
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	l = &lifecycle{
+		drain:  time.Duration(c.ServerConfig.ShutdownDrainTimeoutSeconds) * time.Second,
+		ctx:    ctx,
+		cancel: cancel,
+		mu:     &sync.Mutex{},
+		wg:     &sync.WaitGroup{},
+		once:   &sync.Once{},
+	}
+	return
+}
+
+// prepareReload validates the drain timeout of a reloaded configuration,
+// returning a function that applies it.
+func (l *lifecycle) prepareReload(c *config) (apply func(), err error) {
+	if c.ServerConfig.ShutdownDrainTimeoutSeconds <= 0 {
+		err = fmt.Errorf("shutdown drain timeout is <= 0")
+		return
+	}
+	apply = func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.drain = time.Duration(c.ServerConfig.ShutdownDrainTimeoutSeconds) * time.Second
+	}
+	return
+}
+
+// register adds a component to stop on shutdown. The context passed to stop
+// is done once the drain timeout elapses.
+func (l *lifecycle) register(name string, stop func(c context.Context) error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.components = append(l.components, lifecycleComponent{name: name, stop: stop})
+}
+
+// spawn runs f in a goroutine that shutdown waits on. It returns false without
+// running f once shutdown has begun.
+func (l *lifecycle) spawn(f func()) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closing {
+		return false
+	}
+	l.inflight++
+	l.wg.Add(1)
+	go func() {
+		defer func() {
+			l.mu.Lock()
+			l.inflight--
+			l.mu.Unlock()
+			l.wg.Done()
+		}()
+		f()
+	}()
+	return true
+}
+
+// draining determines whether shutdown has begun.
+func (l *lifecycle) draining() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closing
+}
+
+// bind derives a context from c that is also cancelled when the drain timeout
+// elapses during shutdown.
+func (l *lifecycle) bind(c context.Context) (context.Context, context.CancelFunc) {
+	bc, cancel := context.WithCancel(c)
+	go func() {
+		select {
+		case <-l.ctx.Done():
+			cancel()
+		case <-bc.Done():
+		}
+	}()
+	return bc, cancel
+}
+
+// wait blocks until the goroutines started with spawn finish. Once c is done,
+// their bound contexts are cancelled and wait returns after they unwind.
+func (l *lifecycle) wait(c context.Context) error {
+	l.mu.Lock()
+	n := l.inflight
+	l.mu.Unlock()
+	if n == 0 {
+		return nil
+	}
+	InfoLogger.Infof("Waiting for %d in-flight background tasks", n)
+	doneCh := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+		return nil
+	case <-c.Done():
+	}
+	l.mu.Lock()
+	n = l.inflight
+	l.mu.Unlock()
+	InfoLogger.Infof("Drain timeout elapsed, cancelling %d in-flight background tasks", n)
+	l.cancel()
+	<-doneCh
+	return fmt.Errorf("cancelled %d background tasks after the drain timeout", n)
+}
+
+// shutdown stops the registered components. Only the first call has an effect,
+// and every call returns once it completes.
+func (l *lifecycle) shutdown() {
+	l.once.Do(func() {
+		start := time.Now()
+		l.mu.Lock()
+		l.closing = true
+		cs := l.components
+		drain := l.drain
+		l.mu.Unlock()
+		InfoLogger.Infof("Shutting down, draining for up to %s", drain)
+		c, cancel := context.WithTimeout(context.Background(), drain)
+		defer cancel()
+		go func() {
+			<-c.Done()
+			l.cancel()
+		}()
+		nErr := 0
+		for i := len(cs) - 1; i >= 0; i-- {
+			InfoLogger.Infof("Stopping %s", cs[i].name)
+			t := time.Now()
+			if err := cs[i].stop(c); err != nil {
+				nErr++
+				ErrorLogger.Errorf("Error stopping %s: %s", cs[i].name, err)
+				continue
+			}
+			InfoLogger.Infof("Stopped %s in %s", cs[i].name, time.Since(t))
+		}
+		if nErr > 0 {
+			ErrorLogger.Errorf("Shutdown finished in %s with %d errors", time.Since(start), nErr)
+		} else {
+			InfoLogger.Infof("Shutdown complete in %s", time.Since(start))
+		}
+	})
+}
@@ -0,0 +1,253 @@
+// apcore is a server framework for implementing an ActivityPub application.
+// Copyright (C) 2019 Cory Slep
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package apcore
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	loginReasonInvalid   = "invalid_credentials"
+	loginReasonMFA       = "invalid_mfa_code"
+	loginReasonThrottled = "throttled"
+	loginReasonLocked    = "locked"
+	loginReasonIP        = "ip_throttled"
+	loginReasonSuccess   = "success"
+)
+
+// loginGuard throttles and audits logins. Failed logins of an account require
+// exponentially longer delays between attempts before locking the account
+// out, and failed logins from an IP address across all accounts are limited.
+//
+// Unknown emails are treated like accounts, and have their password hashed, so
+// that responses do not reveal whether an email is registered.
+type loginGuard struct {
+	d                *database
+	window           time.Duration
+	maxDelay         time.Duration
+	lockout          time.Duration
+	delayThreshold   int
+	lockoutThreshold int
+	ipThreshold      int
+	dummyHash        []byte
+}
+
+func newLoginGuard(c *config, d *database) (g *loginGuard, err error) {
+	sc := c.ServerConfig
+	if sc.LoginAttemptWindowSeconds <= 0 {
+		err = fmt.Errorf("sr_login_attempt_window_seconds is <= 0")
+		return
+	} else if sc.LoginDelayThreshold <= 0 {
+		err = fmt.Errorf("sr_login_delay_threshold is <= 0")
+		return
+	} else if sc.LoginMaxDelaySeconds <= 0 {
+		err = fmt.Errorf("sr_login_max_delay_seconds is <= 0")
+		return
+	} else if sc.LoginLockoutThreshold <= 0 {
+		err = fmt.Errorf("sr_login_lockout_threshold is <= 0")
+		return
+	} else if sc.LoginLockoutSeconds <= 0 {
+		err = fmt.Errorf("sr_login_lockout_seconds is <= 0")
+		return
+	} else if sc.LoginIPThreshold <= 0 {
+		err = fmt.Errorf("sr_login_ip_threshold is <= 0")
+		return
+	}
+	g = &loginGuard{
+		d:                d,
+		window:           time.Duration(sc.LoginAttemptWindowSeconds) * time.Second,
+		maxDelay:         time.Duration(sc.LoginMaxDelaySeconds) * time.Second,
+		lockout:          time.Duration(sc.LoginLockoutSeconds) * time.Second,
+		delayThreshold:   sc.LoginDelayThreshold,
+		lockoutThreshold: sc.LoginLockoutThreshold,
+		ipThreshold:      sc.LoginIPThreshold,
+	}
+	// Hash a random password, to compare against for unknown emails.
+	var pass []byte
+	if pass, err = newSalt(16); err != nil {
+		return
+	}
+	g.dummyHash, err = d.hasher.Hash(string(pass))
+	return
+}
+
+// delay is the duration an account must wait after its latest failed login.
+func (g *loginGuard) delay(failures int) time.Duration {
+	if failures < g.delayThreshold {
+		return 0
+	}
+	n := uint(failures - g.delayThreshold)
+	if n > 16 {
+		return g.maxDelay
+	}
+	d := time.Second << n
+	if d > g.maxDelay {
+		d = g.maxDelay
+	}
+	return d
+}
+
+// refused determines whether a login attempt may not proceed, and why.
+func (g *loginGuard) refused(c context.Context, account, userId, ip string) (reason string, err error) {
+	now := time.Now()
+	if len(ip) > 0 {
+		var n int
+		if n, _, err = g.d.IPLoginFailures(c, ip, now.Add(-g.window)); err != nil {
+			return
+		} else if n >= g.ipThreshold {
+			reason = loginReasonIP
+			return
+		}
+	}
+	if len(userId) > 0 {
+		var until time.Time
+		if until, err = g.d.UserLockedUntil(c, userId); err != nil {
+			return
+		} else if now.Before(until) {
+			reason = loginReasonLocked
+			return
+		}
+	}
+	var n int
+	var last time.Time
+	if n, last, err = g.d.AccountLoginFailures(c, account, now.Add(-g.window)); err != nil {
+		return
+	} else if n >= g.lockoutThreshold && now.Before(last.Add(g.lockout)) {
+		// Unknown emails are locked out like accounts are.
+		reason = loginReasonLocked
+	} else if now.Before(last.Add(g.delay(n))) {
+		reason = loginReasonThrottled
+	}
+	return
+}
+
+// failed records a failed login, locking the account out if it has failed too
+// many times.
+func (g *loginGuard) failed(c context.Context, a loginAttempt) (err error) {
+	InfoLogger.Infof("Failed login for account %q (email %q) from %q: %s", a.account, a.email, a.ip, a.reason)
+	a.success = false
+	if a.reason == loginReasonIP || a.reason == loginReasonThrottled || a.reason == loginReasonLocked {
+		// Refused attempts are only logged, so that they cannot be used
+		// to flood the audit table.
+		return
+	}
+	if err = g.d.InsertLoginAttempt(c, a); err != nil {
+		return
+	}
+	if len(a.userId) == 0 {
+		return
+	}
+	now := time.Now()
+	var n int
+	if n, _, err = g.d.AccountLoginFailures(c, a.account, now.Add(-g.window)); err != nil {
+		return
+	} else if n >= g.lockoutThreshold {
+		InfoLogger.Infof("Locking out user %s for %s after %d failed logins", a.userId, g.lockout, n)
+		err = g.d.SetUserLockedUntil(c, a.userId, now.Add(g.lockout))
+	}
+	return
+}
+
+// CheckPassword verifies the password of the account with the email, unless it
+// is throttled. An empty ip skips the per-IP limits.
+func (g *loginGuard) CheckPassword(c context.Context, email, pass, ip string) (userId string, ok bool, err error) {
+	if userId, err = g.d.UserIDFromEmail(c, email); err != nil {
+		return
+	}
+	a := loginAttempt{
+		account: userId,
+		userId:  userId,
+		email:   email,
+		ip:      ip,
+		reason:  loginReasonInvalid,
+	}
+	if len(userId) == 0 {
+		a.account = strings.ToLower(email)
+	}
+	var reason string
+	if reason, err = g.refused(c, a.account, userId, ip); err != nil {
+		return
+	} else if len(reason) > 0 {
+		a.reason = reason
+		err = g.failed(c, a)
+		return
+	}
+	if len(userId) == 0 {
+		g.d.hasher.Verify(pass, g.dummyHash, nil)
+	} else if ok, err = g.d.Valid(c, userId, pass); err != nil {
+		return
+	}
+	if !ok {
+		err = g.failed(c, a)
+	}
+	return
+}
+
+// CheckMFACode verifies the second factor of a user with the verify function,
+// unless it is throttled. Failures count towards the same limits as passwords.
+func (g *loginGuard) CheckMFACode(c context.Context, userId, ip string, verify func() (bool, error)) (ok bool, err error) {
+	a := loginAttempt{
+		account: userId,
+		userId:  userId,
+		ip:      ip,
+		reason:  loginReasonMFA,
+	}
+	var reason string
+	if reason, err = g.refused(c, a.account, userId, ip); err != nil {
+		return
+	} else if len(reason) > 0 {
+		a.reason = reason
+		err = g.failed(c, a)
+		return
+	}
+	if ok, err = verify(); err != nil {
+		return
+	} else if !ok {
+		err = g.failed(c, a)
+	}
+	return
+}
+
+// Succeeded records a completed login, which resets the delays of the account.
+func (g *loginGuard) Succeeded(c context.Context, userId, email, ip string) error {
+	return g.d.InsertLoginAttempt(c, loginAttempt{
+		account: userId,
+		userId:  userId,
+		email:   email,
+		ip:      ip,
+		success: true,
+		reason:  loginReasonSuccess,
+	})
+}
+
+// remoteIP is the IP address of the client making the request, which is
+// forwarded by a trusted proxy or is the remote address of the connection.
+func remoteIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPContextKey{}).(string); ok {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,153 @@
+// apcore is a server framework for implementing an ActivityPub application.
+// Copyright (C) 2019 Cory Slep
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package apcore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	mailerLog  = "log"
+	mailerFile = "file"
+	mailerSMTP = "smtp"
+)
+
+// Mail is a plain text email sent to a user, such as to verify their email
+// address or reset their password.
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails to users.
+type Mailer interface {
+	SendMail(c context.Context, m Mail) error
+}
+
+// newMailer creates the mailer configured in the mail section, unless the
+// application provides its own.
+func newMailer(c *config, a Application) (m Mailer, err error) {
+	if m = a.Mailer(); m != nil {
+		return
+	}
+	mc := c.MailConfig
+	switch mc.Mailer {
+	case mailerLog, "":
+		m = logMailer{}
+	case mailerFile:
+		if len(mc.FileDirectory) == 0 {
+			err = fmt.Errorf("mail_file_directory is empty")
+			return
+		}
+		m = fileMailer{from: mc.From, dir: mc.FileDirectory}
+	case mailerSMTP:
+		if len(mc.SMTPHost) == 0 {
+			err = fmt.Errorf("mail_smtp_host is empty")
+			return
+		} else if len(mc.From) == 0 {
+			err = fmt.Errorf("mail_from is empty")
+			return
+		}
+		sm := smtpMailer{
+			from: mc.From,
+			addr: net.JoinHostPort(mc.SMTPHost, strconv.Itoa(mc.SMTPPort)),
+		}
+		if len(mc.SMTPUsername) > 0 {
+			sm.auth = smtp.PlainAuth("", mc.SMTPUsername, mc.SMTPPassword, mc.SMTPHost)
+		}
+		m = sm
+	default:
+		err = fmt.Errorf("unknown mail_mailer: %q", mc.Mailer)
+	}
+	return
+}
+
+// formatMail renders the message in RFC 5322 format.
+func formatMail(from string, m Mail) (msg []byte, err error) {
+	if strings.ContainsAny(m.To, "\r\n") || strings.ContainsAny(from, "\r\n") {
+		err = fmt.Errorf("mail address contains a line break")
+		return
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(m.Body)
+	msg = b.Bytes()
+	return
+}
+
+// logMailer writes emails to the info log, for development.
+type logMailer struct{}
+
+func (logMailer) SendMail(c context.Context, m Mail) error {
+	InfoLogger.Infof("Mail to %q with subject %q:\n%s", m.To, m.Subject, m.Body)
+	return nil
+}
+
+// fileMailer writes each email to its own file in a directory, for
+// development.
+type fileMailer struct {
+	from string
+	dir  string
+}
+
+func (f fileMailer) SendMail(c context.Context, m Mail) error {
+	s, err := randomToken(8)
+	if err != nil {
+		return err
+	}
+	msg, err := formatMail(f.from, m)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), s)
+	return ioutil.WriteFile(filepath.Join(f.dir, name), msg, os.FileMode(0660))
+}
+
+// smtpMailer sends emails through an SMTP server, using STARTTLS when the
+// server supports it.
+type smtpMailer struct {
+	from string
+	addr string
+	auth smtp.Auth
+}
+
+func (s smtpMailer) SendMail(c context.Context, m Mail) error {
+	msg, err := formatMail(s.from, m)
+	if err != nil {
+		return err
+	}
+	// TODO: net/smtp does not support request contexts.
+	return smtp.SendMail(s.addr, s.auth, s.from, []string{m.To}, msg)
+}
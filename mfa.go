@@ -0,0 +1,375 @@
+// apcore is a server framework for implementing an ActivityPub application.
+// Copyright (C) 2019 Cory Slep
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package apcore
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpDigits     = 6
+	totpPeriod     = 30
+	totpSkew       = 1
+	totpSecretSize = 20
+	// Number of recovery codes created at enrollment, each of which can be
+	// used once in place of a TOTP code.
+	recoveryCodeCount = 10
+	recoveryCodeSize  = 10
+	// Duration a user has to complete the second step of logging in after
+	// entering their password.
+	mfaPendingTimeout = 5 * time.Minute
+	// Duration a pending TOTP secret is reused when enrollment begins
+	// again, before a new secret replaces it.
+	totpEnrollmentTimeout = 24 * time.Hour
+)
+
+var mfaEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// MFAEnrollment is the TOTP secret a user adds to their authenticator app.
+type MFAEnrollment struct {
+	// Secret is the base32 encoded secret, for entering manually.
+	Secret string
+	// URI is the otpauth URI of the secret, usually rendered as a QR code.
+	URI string
+}
+
+// MFAStep is the second step of logging in, when a user enters a TOTP or
+// recovery code.
+type MFAStep struct {
+	// Enrollment is set when the user is required to use multi-factor
+	// authentication but has not enrolled. They must add it to their
+	// authenticator app and enter a TOTP code to finish logging in.
+	Enrollment *MFAEnrollment
+	// RecoveryCodes is set once enrollment is complete and the user has
+	// logged in. They must be shown to the user, who should then continue
+	// to "/authorize".
+	RecoveryCodes []string
+}
+
+// totpCode computes the RFC 6238 code for the time step.
+func totpCode(secret []byte, step int64) string {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(step))
+	m := hmac.New(sha1.New, secret)
+	m.Write(b[:])
+	h := m.Sum(nil)
+	o := h[len(h)-1] & 0x0f
+	v := binary.BigEndian.Uint32(h[o:o+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, v%1000000)
+}
+
+// totpStep finds the time step, within the allowed clock skew, whose code
+// matches.
+func totpStep(secret []byte, code string, now time.Time) (step int64, ok bool) {
+	if len(code) != totpDigits {
+		return
+	}
+	cur := now.Unix() / totpPeriod
+	for s := cur - totpSkew; s <= cur+totpSkew; s++ {
+		if hmac.Equal([]byte(totpCode(secret, s)), []byte(code)) {
+			return s, true
+		}
+	}
+	return
+}
+
+func newTOTPSecret() (b []byte, err error) {
+	b = make([]byte, totpSecretSize)
+	_, err = rand.Read(b)
+	return
+}
+
+func totpEnrollment(issuer, account string, secret []byte) MFAEnrollment {
+	s := mfaEncoding.EncodeToString(secret)
+	q := url.Values{}
+	q.Set("secret", s)
+	q.Set("issuer", issuer)
+	q.Set("digits", fmt.Sprintf("%d", totpDigits))
+	q.Set("period", fmt.Sprintf("%d", totpPeriod))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: q.Encode(),
+	}
+	return MFAEnrollment{
+		Secret: s,
+		URI:    u.String(),
+	}
+}
+
+// totpSecretKey derives the key encrypting TOTP secrets at rest from the OAuth2
+// token hashing key.
+func totpSecretKey(key []byte) []byte {
+	return deriveKey(key, "apcore totp secret")
+}
+
+func sealTOTPSecret(key, secret []byte) (b []byte, err error) {
+	var block cipher.Block
+	if block, err = aes.NewCipher(totpSecretKey(key)); err != nil {
+		return
+	}
+	var gcm cipher.AEAD
+	if gcm, err = cipher.NewGCM(block); err != nil {
+		return
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+	b = gcm.Seal(nonce, nonce, secret, nil)
+	return
+}
+
+func openTOTPSecret(key, sealed []byte) (secret []byte, err error) {
+	var block cipher.Block
+	if block, err = aes.NewCipher(totpSecretKey(key)); err != nil {
+		return
+	}
+	var gcm cipher.AEAD
+	if gcm, err = cipher.NewGCM(block); err != nil {
+		return
+	}
+	if len(sealed) < gcm.NonceSize() {
+		err = fmt.Errorf("sealed TOTP secret is too short")
+		return
+	}
+	secret, err = gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	return
+}
+
+func newRecoveryCodes() (codes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, recoveryCodeSize)
+		if _, err = rand.Read(b); err != nil {
+			return
+		}
+		s := strings.ToLower(mfaEncoding.EncodeToString(b))
+		codes = append(codes, s[:4]+"-"+s[4:8]+"-"+s[8:12]+"-"+s[12:])
+	}
+	return
+}
+
+// normalizeRecoveryCode ignores case and separators, which users may mistype.
+func normalizeRecoveryCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(strings.TrimSpace(code)))
+}
+
+// beginTOTPEnrollment creates a new TOTP secret for the user, which only takes
+// effect once a code is verified by completeTOTPEnrollment. A pending secret
+// is reused until it expires, so that beginning again does not invalidate a
+// secret already added to an authenticator app.
+func beginTOTPEnrollment(c context.Context, d *database, host, userId string) (e MFAEnrollment, err error) {
+	var p oidcProfile
+	if p, err = d.UserProfile(c, userId); err != nil {
+		return
+	}
+	var secret []byte
+	if secret, err = d.PendingTOTPSecret(c, userId, time.Now().Add(-totpEnrollmentTimeout)); err != nil {
+		return
+	} else if secret == nil {
+		if secret, err = newTOTPSecret(); err != nil {
+			return
+		}
+		if err = d.SetTOTPSecret(c, userId, secret); err != nil {
+			return
+		}
+	}
+	e = totpEnrollment(host, p.PreferredUsername+"@"+host, secret)
+	return
+}
+
+// pendingTOTPEnrollment fetches an enrollment that has not been completed.
+func pendingTOTPEnrollment(c context.Context, d *database, host, userId string) (e MFAEnrollment, err error) {
+	var p oidcProfile
+	if p, err = d.UserProfile(c, userId); err != nil {
+		return
+	}
+	var secret []byte
+	var enabled bool
+	if secret, enabled, err = d.TOTPSecret(c, userId); err != nil {
+		return
+	} else if enabled {
+		err = fmt.Errorf("user %q has already enrolled in multi-factor authentication", userId)
+		return
+	}
+	e = totpEnrollment(host, p.PreferredUsername+"@"+host, secret)
+	return
+}
+
+// completeTOTPEnrollment enables multi-factor authentication if the code is
+// valid for the pending secret, returning the new recovery codes.
+func completeTOTPEnrollment(c context.Context, d *database, userId, code string) (codes []string, ok bool, err error) {
+	var secret []byte
+	var enabled bool
+	if secret, enabled, err = d.TOTPSecret(c, userId); err != nil {
+		return
+	} else if enabled {
+		err = fmt.Errorf("user %q has already enrolled in multi-factor authentication", userId)
+		return
+	}
+	step, match := totpStep(secret, strings.TrimSpace(code), time.Now())
+	if !match {
+		return
+	}
+	if ok, err = d.AcceptTOTPStep(c, userId, step); err != nil || !ok {
+		return
+	}
+	if codes, err = newRecoveryCodes(); err != nil {
+		return
+	}
+	err = d.EnableMFA(c, userId, codes)
+	return
+}
+
+// verifyMFACode checks a TOTP code, or consumes a recovery code, of a user who
+// has enrolled. A TOTP code cannot be used twice.
+func verifyMFACode(c context.Context, d *database, userId, code string) (ok bool, err error) {
+	code = strings.TrimSpace(code)
+	if len(code) == totpDigits {
+		var secret []byte
+		var enabled bool
+		if secret, enabled, err = d.TOTPSecret(c, userId); err != nil {
+			return
+		} else if !enabled {
+			return
+		}
+		step, match := totpStep(secret, code, time.Now())
+		if !match {
+			return
+		}
+		return d.AcceptTOTPStep(c, userId, step)
+	}
+	return d.UseRecoveryCode(c, userId, code)
+}
+
+func getMFAFn(sl *sessions, db *database, host string, internalErrorHandler http.Handler, mfaWebHandler func(http.ResponseWriter, *http.Request, MFAStep)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, err := sl.Get(r)
+		if err != nil {
+			ErrorLogger.Errorf("error getting session for GET login MFA: %s", err)
+			internalErrorHandler.ServeHTTP(w, r)
+			return
+		}
+		u, ok := s.MFAPending()
+		if !ok {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		status, err := db.UserMFA(r.Context(), u)
+		if err != nil {
+			ErrorLogger.Errorf("error getting MFA status for GET login MFA: %s", err)
+			internalErrorHandler.ServeHTTP(w, r)
+			return
+		}
+		var step MFAStep
+		if !status.enabled {
+			e, err := pendingTOTPEnrollment(r.Context(), db, host, u)
+			if err != nil {
+				ErrorLogger.Errorf("error getting TOTP enrollment for GET login MFA: %s", err)
+				internalErrorHandler.ServeHTTP(w, r)
+				return
+			}
+			step.Enrollment = &e
+		}
+		mfaWebHandler(w, r, step)
+	}
+}
+
+func postMFAFn(sl *sessions, db *database, lg *loginGuard, badRequestHandler, internalErrorHandler http.Handler, mfaWebHandler func(http.ResponseWriter, *http.Request, MFAStep)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, err := sl.Get(r)
+		if err != nil {
+			ErrorLogger.Errorf("error getting session for POST login MFA: %s", err)
+			internalErrorHandler.ServeHTTP(w, r)
+			return
+		}
+		u, ok := s.MFAPending()
+		if !ok {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		if err = r.ParseForm(); err != nil {
+			badRequestHandler.ServeHTTP(w, r)
+			return
+		}
+		codeV, ok := r.Form[LoginFormMFACodeKey]
+		if !ok || len(codeV) != 1 {
+			badRequestHandler.ServeHTTP(w, r)
+			return
+		}
+		status, err := db.UserMFA(r.Context(), u)
+		if err != nil {
+			ErrorLogger.Errorf("error getting MFA status for POST login MFA: %s", err)
+			internalErrorHandler.ServeHTTP(w, r)
+			return
+		}
+		ip := remoteIP(r)
+		var codes []string
+		ok, err = lg.CheckMFACode(r.Context(), u, ip, func() (ok bool, err error) {
+			if status.enabled {
+				ok, err = verifyMFACode(r.Context(), db, u, codeV[0])
+			} else {
+				codes, ok, err = completeTOTPEnrollment(r.Context(), db, u, codeV[0])
+			}
+			return
+		})
+		if err != nil {
+			ErrorLogger.Errorf("error verifying code in POST login MFA: %s", err)
+			internalErrorHandler.ServeHTTP(w, r)
+			return
+		} else if !ok {
+			http.Redirect(w, r, "/login/mfa?mfa_error=true", http.StatusFound)
+			return
+		}
+		if err = lg.Succeeded(r.Context(), u, "", ip); err != nil {
+			ErrorLogger.Errorf("error recording login in POST login MFA: %s", err)
+			internalErrorHandler.ServeHTTP(w, r)
+			return
+		}
+		s.DeleteMFAPending()
+		s.SetUserID(u)
+		err = s.Save(r, w)
+		if err != nil {
+			ErrorLogger.Errorf("error saving session in POST login MFA: %s", err)
+			internalErrorHandler.ServeHTTP(w, r)
+			return
+		}
+		if len(codes) > 0 {
+			mfaWebHandler(w, r, MFAStep{RecoveryCodes: codes})
+			return
+		}
+		http.Redirect(w, r, "/authorize", http.StatusFound)
+	}
+}
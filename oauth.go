@@ -20,6 +20,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"gopkg.in/oauth2.v3"
@@ -30,14 +31,24 @@ import (
 )
 
 type oAuth2Server struct {
-	d *database
-	k *sessions
-	m *manage.Manager
-	s *oaserver.Server
+	d      *database
+	k      *sessions
+	m      *oAuth2Manager
+	s      *oaserver.Server
+	scopes *scopes
+	oidc   *oidcProvider
 }
 
-func newOAuth2Server(c *config, a Application, d *database, k *sessions) (s *oAuth2Server, err error) {
-	m := manage.NewDefaultManager()
+func newOAuth2Server(c *config, scheme string, a Application, d *database, k *sessions, lg *loginGuard) (s *oAuth2Server, err error) {
+	var sc *scopes
+	if sc, err = newScopes(a.Scopes()); err != nil {
+		return
+	}
+	m := &oAuth2Manager{
+		Manager: manage.NewDefaultManager(),
+		d:       d,
+		scopes:  sc,
+	}
 	// Configure Access token and Refresh token refresh.
 	if c.OAuthConfig.AccessTokenExpiry <= 0 {
 		err = fmt.Errorf("oauth2 access token expiration duration is <= 0")
@@ -71,6 +82,11 @@ func newOAuth2Server(c *config, a Application, d *database, k *sessions) (s *oAu
 		return
 	}
 	m.MapClientStorage(cs)
+	// Redirect URIs are instead matched exactly against every registered
+	// URI by the oAuth2Manager.
+	m.SetValidateURIHandler(func(baseURI, redirectURI string) error {
+		return nil
+	})
 	// OAuth2 server
 	srv := oaserver.NewServer(&oaserver.Config{
 		TokenType: "Bearer",
@@ -79,7 +95,7 @@ func newOAuth2Server(c *config, a Application, d *database, k *sessions) (s *oAu
 		// Support only the non-implicit flow.
 		AllowedResponseTypes: []oauth2.ResponseType{oauth2.Code},
 		// Allow:
-		// - Authorization Code (for third parties)
+		// - Authorization Code (for third parties, with PKCE)
 		// - Refreshing Tokens
 		// - Client secrets
 		//
@@ -91,13 +107,36 @@ func newOAuth2Server(c *config, a Application, d *database, k *sessions) (s *oAu
 			oauth2.ClientCredentials,
 		},
 	}, m)
-	// Parse tokens in POST body.
-	srv.SetClientInfoHandler(oaserver.ClientFormHandler)
+	// Clients may only obtain registered scopes, and cannot broaden them
+	// when refreshing.
+	srv.SetClientScopeHandler(func(clientID, scope string) (allowed bool, err error) {
+		var ci *clientInfo
+		if ci, err = m.client(clientID); err != nil {
+			return
+		}
+		allowed = ci.allowsScope(sc, scope)
+		return
+	})
+	// Clients may only use the grant types they registered.
+	srv.SetClientAuthorizedHandler(func(clientID string, grant oauth2.GrantType) (allowed bool, err error) {
+		var ci *clientInfo
+		if ci, err = m.client(clientID); err != nil {
+			return
+		}
+		allowed = ci.allowsGrant(grant)
+		return
+	})
+	srv.SetRefreshingScopeHandler(func(newScope, oldScope string) (allowed bool, err error) {
+		allowed = scopeGrants(oldScope, strings.Fields(newScope)...)
+		return
+	})
+	// Parse client credentials in the Authorization header or POST body,
+	// permitting public clients to omit the secret.
+	srv.SetClientInfoHandler(clientInfoHandler)
 	// Determines the user to use when granting an authorization token. If
 	// no user is present, then they have not yet logged in and need to do
 	// so. Note that an empty string userID plus no error will magically
 	// cause the library to stop processing.
-	badRequestHandler := a.BadRequestHandler()
 	internalErrorHandler := a.InternalServerErrorHandler()
 	srv.SetUserAuthorizationHandler(func(w http.ResponseWriter, r *http.Request) (userID string, err error) {
 		var s *session
@@ -107,14 +146,8 @@ func newOAuth2Server(c *config, a Application, d *database, k *sessions) (s *oAu
 			return
 		}
 		if userID, err = s.UserID(); err != nil {
-			if r.Form == nil {
-				err = r.ParseForm()
-				if err != nil {
-					badRequestHandler.ServeHTTP(w, r)
-					return
-				}
-			}
-			s.SetOAuthRedirectFormValues(r.Form)
+			// The form has already been validated by postAuthFn.
+			s.SetAuthorizeRequest(newAuthorizeRequest(r.Form))
 			err = s.Save(r, w)
 			if err != nil {
 				ErrorLogger.Errorf("error saving session in OAuth2 SetUserAuthorizationHandler: %s", err)
@@ -124,7 +157,24 @@ func newOAuth2Server(c *config, a Application, d *database, k *sessions) (s *oAu
 			http.Redirect(w, r, "/login", http.StatusFound)
 			return
 		}
-		// User is already logged in
+		// User is already logged in, but may since have been suspended.
+		var state userState
+		if state, err = d.UserState(r.Context(), userID); err != nil {
+			return
+		} else if !state.CanLogin() {
+			err = fmt.Errorf("user %s cannot log in with state %q", userID, state)
+			return
+		}
+		// Only administrators may grant the admin scope.
+		if scopeGrants(r.Form.Get("scope"), ScopeAdmin) {
+			var admin bool
+			if admin, err = d.UserIsAdmin(r.Context(), userID); err != nil {
+				return
+			} else if !admin {
+				err = errors.ErrAccessDenied
+				return
+			}
+		}
 		return
 	})
 	// Called when requesting a token through the password credential grant
@@ -133,19 +183,39 @@ func newOAuth2Server(c *config, a Application, d *database, k *sessions) (s *oAu
 	// NOTE: This grant type is currently not supported, but the handler is
 	// here if it were to be enabled.
 	srv.SetPasswordAuthorizationHandler(func(email, password string) (userID string, err error) {
-		// TODO: Fix oauth2 to support request contexts.
-		userID, err = d.UserIDFromEmail(context.Background(), email)
-		if err != nil {
-			return
-		}
+		// TODO: Fix oauth2 to support request contexts, and the client
+		// IP address.
 		var valid bool
-		valid, err = d.Valid(context.Background(), userID, password)
+		userID, valid, err = lg.CheckPassword(context.Background(), email, password, "")
 		if err != nil {
 			return
 		} else if !valid {
 			err = fmt.Errorf("username and/or password is invalid")
 			return
 		}
+		var state userState
+		if state, err = d.UserState(context.Background(), userID); err != nil {
+			return
+		} else if !state.CanLogin() {
+			err = fmt.Errorf("username and/or password is invalid")
+			return
+		}
+		var account userAccount
+		if account, err = d.UserAccount(context.Background(), userID); err != nil {
+			return
+		} else if !account.verified {
+			err = errors.ErrAccessDenied
+			return
+		}
+		// The password alone is insufficient for multi-factor accounts.
+		var mfa mfaStatus
+		if mfa, err = d.UserMFA(context.Background(), userID); err != nil {
+			return
+		} else if mfa.enabled || mfa.required {
+			err = errors.ErrAccessDenied
+			return
+		}
+		err = lg.Succeeded(context.Background(), userID, email, "")
 		return
 	})
 	srv.SetInternalErrorHandler(func(err error) (re *errors.Response) {
@@ -160,17 +230,39 @@ func newOAuth2Server(c *config, a Application, d *database, k *sessions) (s *oAu
 	srv.SetResponseErrorHandler(func(re *errors.Response) {
 		ErrorLogger.Errorf("oauth2 response error: %s", re.Error.Error())
 	})
+	// OpenID Connect is only supported when a signing key is configured.
+	var op *oidcProvider
+	if len(c.OAuthConfig.OIDCSigningKeyFile) > 0 {
+		if op, err = newOIDCProvider(c, scheme, d); err != nil {
+			return
+		}
+		srv.SetExtensionFieldsHandler(func(ti oauth2.TokenInfo) (fieldsValue map[string]interface{}) {
+			if len(ti.GetUserID()) == 0 || !scopeGrants(ti.GetScope(), ScopeOpenID) {
+				return
+			}
+			// TODO: Fix oauth2 to support request contexts.
+			idt, err := op.IDToken(context.Background(), ti)
+			if err != nil {
+				ErrorLogger.Errorf("error creating OpenID Connect ID token: %s", err)
+				return
+			}
+			fieldsValue = map[string]interface{}{
+				"id_token": idt,
+			}
+			return
+		})
+	}
 	s = &oAuth2Server{
-		d: d,
-		k: k,
-		m: m,
-		s: srv,
+		d:      d,
+		k:      k,
+		m:      m,
+		s:      srv,
+		scopes: sc,
+		oidc:   op,
 	}
 	return
 }
 
-// TODO: Scopes
-
 func (o *oAuth2Server) HandleAuthorizationRequest(w http.ResponseWriter, r *http.Request) {
 	if err := o.s.HandleAuthorizeRequest(w, r); err != nil {
 		// oauth2 library would already have written headers by now.
@@ -192,6 +284,18 @@ func (o *oAuth2Server) ValidateOAuth2AccessToken(w http.ResponseWriter, r *http.
 		authenticated = false
 		err = nil
 	}
+	// Tokens without a user cannot carry scopes acting for one, and tokens
+	// of users that can no longer log in are not honored.
+	if authenticated && len(token.GetUserID()) == 0 {
+		authenticated = !o.scopes.UserBound(token.GetScope())
+	} else if authenticated {
+		var state userState
+		if state, err = o.d.UserState(r.Context(), token.GetUserID()); err != nil {
+			authenticated = false
+			return
+		}
+		authenticated = state.CanLogin()
+	}
 	return
 }
 
@@ -0,0 +1,324 @@
+// apcore is a server framework for implementing an ActivityPub application.
+// Copyright (C) 2019 Cory Slep
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package apcore
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/gob"
+	"net/http"
+	"net/url"
+
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/errors"
+	"gopkg.in/oauth2.v3/manage"
+)
+
+const (
+	pkceMethodS256  = "S256"
+	pkceMethodPlain = "plain"
+	// RFC 7636 Section 4.1 bounds the verifier, and therefore a plain
+	// challenge, to between 43 and 128 characters.
+	minPKCELength  = 43
+	maxPKCELength  = 128
+	maxStateLength = 1024
+)
+
+func init() {
+	// Pending authorization requests are kept in the cookie session.
+	gob.Register(authorizeRequest{})
+}
+
+// OAuth2Consent describes an authorization request that the user is asked to
+// approve.
+type OAuth2Consent struct {
+	ClientId   string
+	ClientName string
+	Scopes     []Scope
+}
+
+// authorizeRequest is the validated subset of an OAuth2 authorization request,
+// kept in the session while the user logs in and consents.
+type authorizeRequest struct {
+	ClientID            string
+	RedirectURI         string
+	ResponseType        string
+	Scope               string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Nonce               string
+}
+
+func newAuthorizeRequest(f url.Values) authorizeRequest {
+	return authorizeRequest{
+		ClientID:            f.Get("client_id"),
+		RedirectURI:         f.Get("redirect_uri"),
+		ResponseType:        f.Get("response_type"),
+		Scope:               f.Get("scope"),
+		State:               f.Get("state"),
+		CodeChallenge:       f.Get("code_challenge"),
+		CodeChallengeMethod: f.Get("code_challenge_method"),
+		Nonce:               f.Get("nonce"),
+	}
+}
+
+// validate checks the request against the registered client and scopes,
+// filling in the redirect URI and challenge method defaults.
+func (a *authorizeRequest) validate(c context.Context, d *database, sc *scopes) (ci *clientInfo, err error) {
+	if len(a.ClientID) == 0 {
+		err = errors.ErrInvalidRequest
+		return
+	} else if oauth2.ResponseType(a.ResponseType) != oauth2.Code {
+		err = errors.ErrUnsupportedResponseType
+		return
+	} else if !isValidState(a.State) {
+		err = errors.ErrInvalidRequest
+		return
+	} else if len(a.Nonce) > 0 && !isValidState(a.Nonce) {
+		// The OpenID Connect nonce has the same constraints.
+		err = errors.ErrInvalidRequest
+		return
+	}
+	var oci oauth2.ClientInfo
+	if oci, err = d.GetClientById(c, a.ClientID); err != nil {
+		err = errors.ErrInvalidClient
+		return
+	}
+	ci = oci.(*clientInfo)
+	if ci.revoked {
+		err = errors.ErrInvalidClient
+		return
+	} else if !ci.allowsScope(sc, a.Scope) {
+		err = errors.ErrInvalidScope
+		return
+	}
+	if len(a.RedirectURI) == 0 {
+		if uris := ci.registeredRedirectURIs(); len(uris) == 1 {
+			a.RedirectURI = uris[0]
+		}
+	}
+	if !ci.allowsRedirectURI(a.RedirectURI) {
+		err = errors.ErrInvalidRedirectURI
+		return
+	}
+	if len(a.CodeChallenge) == 0 {
+		if ci.public || len(a.CodeChallengeMethod) > 0 {
+			err = errors.ErrInvalidRequest
+		}
+		return
+	}
+	if len(a.CodeChallengeMethod) == 0 {
+		a.CodeChallengeMethod = pkceMethodPlain
+	}
+	if a.CodeChallengeMethod != pkceMethodS256 && a.CodeChallengeMethod != pkceMethodPlain {
+		err = errors.ErrInvalidRequest
+	} else if !isValidPKCEString(a.CodeChallenge) {
+		err = errors.ErrInvalidRequest
+	}
+	return
+}
+
+func (a authorizeRequest) values() url.Values {
+	v := url.Values{}
+	v.Set("client_id", a.ClientID)
+	v.Set("redirect_uri", a.RedirectURI)
+	v.Set("response_type", a.ResponseType)
+	v.Set("scope", a.Scope)
+	v.Set("state", a.State)
+	if len(a.CodeChallenge) > 0 {
+		v.Set("code_challenge", a.CodeChallenge)
+		v.Set("code_challenge_method", a.CodeChallengeMethod)
+	}
+	if len(a.Nonce) > 0 {
+		v.Set("nonce", a.Nonce)
+	}
+	return v
+}
+
+// isValidState requires a non-empty state of printable ASCII, per RFC 6749
+// Appendix A.5, so that clients are protected against CSRF.
+func isValidState(s string) bool {
+	if len(s) == 0 || len(s) > maxStateLength {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// isValidPKCEString checks a code verifier or plain challenge against the
+// unreserved characters of RFC 7636 Section 4.1.
+func isValidPKCEString(s string) bool {
+	if len(s) < minPKCELength || len(s) > maxPKCELength {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; {
+		case ch >= 'A' && ch <= 'Z', ch >= 'a' && ch <= 'z', ch >= '0' && ch <= '9':
+		case ch == '-', ch == '.', ch == '_', ch == '~':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func verifyCodeVerifier(challenge, method, verifier string) bool {
+	if !isValidPKCEString(verifier) {
+		return false
+	}
+	switch method {
+	case pkceMethodS256:
+		h := sha256.Sum256([]byte(verifier))
+		verifier = base64.RawURLEncoding.EncodeToString(h[:])
+	case pkceMethodPlain:
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(challenge), []byte(verifier)) == 1
+}
+
+// clientInfoHandler reads client credentials from HTTP Basic authentication
+// or the POST body. Unlike the oauth2 library handlers, the secret may be
+// omitted by public clients.
+func clientInfoHandler(r *http.Request) (clientID, clientSecret string, err error) {
+	var ok bool
+	if clientID, clientSecret, ok = r.BasicAuth(); !ok {
+		clientID = r.PostFormValue("client_id")
+		clientSecret = r.PostFormValue("client_secret")
+	}
+	if len(clientID) == 0 {
+		err = errors.ErrInvalidClient
+	}
+	return
+}
+
+var _ oauth2.Manager = &oAuth2Manager{}
+
+// oAuth2Manager enforces exact redirect URI matching, PKCE, hashed client
+// secrets, and user-bound scopes on top of the oauth2 library's manager.
+type oAuth2Manager struct {
+	*manage.Manager
+	d      *database
+	scopes *scopes
+}
+
+func (m *oAuth2Manager) client(clientID string) (ci *clientInfo, err error) {
+	var oci oauth2.ClientInfo
+	if oci, err = m.Manager.GetClient(clientID); err != nil {
+		return
+	}
+	ci = oci.(*clientInfo)
+	return
+}
+
+func (m *oAuth2Manager) GenerateAuthToken(rt oauth2.ResponseType, tgr *oauth2.TokenGenerateRequest) (ti oauth2.TokenInfo, err error) {
+	var ci *clientInfo
+	if ci, err = m.client(tgr.ClientID); err != nil {
+		return
+	} else if !ci.allowsRedirectURI(tgr.RedirectURI) {
+		err = errors.ErrInvalidRequest
+		return
+	}
+	if ti, err = m.Manager.GenerateAuthToken(rt, tgr); err != nil {
+		return
+	}
+	// The request form was replaced with the validated authorizeRequest.
+	p := codeParameters{
+		challenge: tgr.Request.Form.Get("code_challenge"),
+		method:    tgr.Request.Form.Get("code_challenge_method"),
+		nonce:     tgr.Request.Form.Get("nonce"),
+	}
+	if len(p.challenge) > 0 || len(p.nonce) > 0 {
+		err = m.d.SetCodeParameters(tgr.Request.Context(), ti.GetCode(), p)
+	}
+	return
+}
+
+// authenticate verifies the client secret against its stored hash. The
+// library then compares the request's secret to the stored one, so the hash is
+// substituted once verified.
+func (m *oAuth2Manager) authenticate(tgr *oauth2.TokenGenerateRequest) (ci *clientInfo, err error) {
+	if ci, err = m.client(tgr.ClientID); err != nil {
+		return
+	} else if !clientSecretEquals(ci.secret, tgr.ClientSecret) {
+		err = errors.ErrInvalidClient
+		return
+	}
+	tgr.ClientSecret = ci.secret
+	return
+}
+
+func (m *oAuth2Manager) GenerateAccessToken(gt oauth2.GrantType, tgr *oauth2.TokenGenerateRequest) (ti oauth2.TokenInfo, err error) {
+	var ci *clientInfo
+	if ci, err = m.authenticate(tgr); err != nil {
+		return
+	}
+	var p codeParameters
+	switch gt {
+	case oauth2.ClientCredentials:
+		// Public clients have no secret to authenticate with.
+		if ci.public {
+			err = errors.ErrUnauthorizedClient
+			return
+		}
+		// Without a user, scopes acting for one cannot be granted.
+		if m.scopes.UserBound(tgr.Scope) {
+			err = errors.ErrInvalidScope
+			return
+		}
+	case oauth2.AuthorizationCode:
+		if !ci.allowsRedirectURI(tgr.RedirectURI) {
+			err = errors.ErrInvalidGrant
+			return
+		}
+		if p, err = m.d.CodeParameters(tgr.Request.Context(), tgr.Code); err != nil {
+			return
+		}
+		verifier := tgr.Request.PostFormValue("code_verifier")
+		if len(p.challenge) == 0 {
+			if ci.public || len(verifier) > 0 {
+				err = errors.ErrInvalidGrant
+				return
+			}
+		} else if !verifyCodeVerifier(p.challenge, p.method, verifier) {
+			err = errors.ErrInvalidGrant
+			return
+		}
+	}
+	if ti, err = m.Manager.GenerateAccessToken(gt, tgr); err != nil {
+		return
+	}
+	if len(p.nonce) > 0 {
+		ti = &nonceTokenInfo{TokenInfo: ti, nonce: p.nonce}
+	}
+	return
+}
+
+func (m *oAuth2Manager) RefreshAccessToken(tgr *oauth2.TokenGenerateRequest) (ti oauth2.TokenInfo, err error) {
+	if _, err = m.authenticate(tgr); err != nil {
+		return
+	}
+	ti, err = m.Manager.RefreshAccessToken(tgr)
+	return
+}
@@ -0,0 +1,297 @@
+// apcore is a server framework for implementing an ActivityPub application.
+// Copyright (C) 2019 Cory Slep
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package apcore
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	clientIdSize     = 16
+	clientSecretSize = 32
+)
+
+// OAuth2Client is a third-party application registered to obtain OAuth2
+// tokens on behalf of local users.
+type OAuth2Client struct {
+	Id string
+	// Secret is only populated when the client is created, and is empty
+	// for public clients.
+	Secret       string
+	Name         string
+	RedirectURIs []string
+	// Scopes are the only scopes the client can obtain, so a client
+	// registered without scopes can obtain none.
+	Scopes []string
+	// GrantTypes are the only grant types the client can use.
+	GrantTypes []string
+	// Public clients, such as mobile and single-page applications, cannot
+	// keep a secret.
+	Public     bool
+	Revoked    bool
+	UserId     string
+	CreateTime time.Time
+}
+
+func (o *OAuth2Client) Load(row scanner) (err error) {
+	var userId *string
+	var redirectURIs []byte
+	var scopes, grantTypes string
+	if err = row.Scan(
+		&o.Id,
+		&o.Name,
+		&redirectURIs,
+		&scopes,
+		&grantTypes,
+		&o.Public,
+		&o.Revoked,
+		&userId,
+		&o.CreateTime); err != nil {
+		return
+	}
+	if userId != nil {
+		o.UserId = *userId
+	}
+	o.Scopes = strings.Fields(scopes)
+	if o.GrantTypes = strings.Fields(grantTypes); len(o.GrantTypes) == 0 {
+		o.GrantTypes = defaultGrantTypes(o.Public)
+	}
+	err = json.Unmarshal(redirectURIs, &o.RedirectURIs)
+	return
+}
+
+// validateRedirectURI ensures a redirect URI is absolute and has no fragment,
+// per RFC 6749 Section 3.1.2. Custom schemes are allowed for native
+// applications.
+func validateRedirectURI(s string) (err error) {
+	var u *url.URL
+	if u, err = url.Parse(s); err != nil {
+		return
+	} else if !u.IsAbs() {
+		err = fmt.Errorf("redirect uri is not absolute: %s", s)
+	} else if len(u.Fragment) > 0 {
+		err = fmt.Errorf("redirect uri has a fragment: %s", s)
+	} else if u.Scheme == "http" && u.Hostname() != "localhost" && u.Hostname() != "127.0.0.1" {
+		err = fmt.Errorf("redirect uri must use https unless on localhost: %s", s)
+	}
+	return
+}
+
+// redirectURIError is returned by newOAuth2Client when the redirect URIs are
+// invalid, as opposed to the rest of the client metadata.
+type redirectURIError struct {
+	error
+}
+
+// defaultGrantTypes are used by clients registered without grant types.
+func defaultGrantTypes(public bool) []string {
+	if public {
+		return []string{"authorization_code", "refresh_token"}
+	}
+	return []string{"authorization_code", "refresh_token", "client_credentials"}
+}
+
+// validateGrantTypes ensures the grant types are supported. Public clients
+// cannot authenticate, so cannot use client credentials.
+func validateGrantTypes(grantTypes []string, public bool) (err error) {
+	for _, g := range grantTypes {
+		switch g {
+		case "authorization_code", "refresh_token":
+		case "client_credentials":
+			if public {
+				err = fmt.Errorf("public clients cannot use grant_type: %s", g)
+				return
+			}
+		default:
+			err = fmt.Errorf("unsupported grant_type: %s", g)
+			return
+		}
+	}
+	return
+}
+
+// newOAuth2Client prepares a client for registration, generating its id and,
+// for confidential clients, its secret. Clients registered without grant
+// types use the defaults.
+func newOAuth2Client(sc *scopes, name string, redirectURIs, scopes, grantTypes []string, public bool, userId string) (o OAuth2Client, err error) {
+	if err = sc.Validate(scopes); err != nil {
+		return
+	} else if err = validateGrantTypes(grantTypes, public); err != nil {
+		return
+	} else if len(redirectURIs) == 0 {
+		err = redirectURIError{fmt.Errorf("at least one redirect uri is required")}
+		return
+	}
+	for _, r := range redirectURIs {
+		if err = validateRedirectURI(r); err != nil {
+			err = redirectURIError{err}
+			return
+		}
+	}
+	if len(grantTypes) == 0 {
+		grantTypes = defaultGrantTypes(public)
+	}
+	o = OAuth2Client{
+		Name:         name,
+		RedirectURIs: redirectURIs,
+		Scopes:       scopes,
+		GrantTypes:   grantTypes,
+		Public:       public,
+		UserId:       userId,
+	}
+	if o.Id, err = randomToken(clientIdSize); err != nil {
+		return
+	}
+	if !public {
+		if o.Secret, err = randomToken(clientSecretSize); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// clientRegistrationRequest is the client metadata of RFC 7591 that is
+// supported.
+type clientRegistrationRequest struct {
+	RedirectURIs            []string `json:"redirect_uris"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method,omitempty"`
+	GrantTypes              []string `json:"grant_types,omitempty"`
+	ResponseTypes           []string `json:"response_types,omitempty"`
+	ClientName              string   `json:"client_name,omitempty"`
+	Scope                   string   `json:"scope,omitempty"`
+}
+
+type clientRegistrationResponse struct {
+	ClientId                string   `json:"client_id"`
+	ClientSecret            string   `json:"client_secret,omitempty"`
+	ClientIdIssuedAt        int64    `json:"client_id_issued_at"`
+	ClientSecretExpiresAt   int64    `json:"client_secret_expires_at"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+	GrantTypes              []string `json:"grant_types"`
+	ResponseTypes           []string `json:"response_types"`
+	ClientName              string   `json:"client_name,omitempty"`
+	Scope                   string   `json:"scope,omitempty"`
+}
+
+type clientRegistrationError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+func writeOAuth2JSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		ErrorLogger.Errorf("error marshalling OAuth2 JSON response: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if _, err = w.Write(b); err != nil {
+		ErrorLogger.Errorf("error writing client registration response: %s", err)
+	}
+}
+
+// clientRegistrationHandler implements RFC 7591 dynamic client registration
+// for clients such as C2S applications.
+func clientRegistrationHandler(db *database, sc *scopes) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req clientRegistrationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeOAuth2JSON(w, http.StatusBadRequest, clientRegistrationError{
+				Error:            "invalid_client_metadata",
+				ErrorDescription: "request body is not valid JSON client metadata",
+			})
+			return
+		}
+		public := false
+		switch req.TokenEndpointAuthMethod {
+		case "none":
+			public = true
+		case "", "client_secret_post":
+			req.TokenEndpointAuthMethod = "client_secret_post"
+		default:
+			writeOAuth2JSON(w, http.StatusBadRequest, clientRegistrationError{
+				Error:            "invalid_client_metadata",
+				ErrorDescription: fmt.Sprintf("unsupported token_endpoint_auth_method: %s", req.TokenEndpointAuthMethod),
+			})
+			return
+		}
+		if len(req.GrantTypes) == 0 {
+			req.GrantTypes = []string{"authorization_code"}
+		}
+		for _, g := range req.GrantTypes {
+			if g != "authorization_code" && g != "refresh_token" {
+				writeOAuth2JSON(w, http.StatusBadRequest, clientRegistrationError{
+					Error:            "invalid_client_metadata",
+					ErrorDescription: fmt.Sprintf("unsupported grant_type: %s", g),
+				})
+				return
+			}
+		}
+		if len(req.ResponseTypes) == 0 {
+			req.ResponseTypes = []string{"code"}
+		}
+		for _, rt := range req.ResponseTypes {
+			if rt != "code" {
+				writeOAuth2JSON(w, http.StatusBadRequest, clientRegistrationError{
+					Error:            "invalid_client_metadata",
+					ErrorDescription: fmt.Sprintf("unsupported response_type: %s", rt),
+				})
+				return
+			}
+		}
+		cl, err := newOAuth2Client(sc, req.ClientName, req.RedirectURIs, strings.Fields(req.Scope), req.GrantTypes, public, "")
+		if err != nil {
+			code := "invalid_client_metadata"
+			if _, ok := err.(redirectURIError); ok {
+				code = "invalid_redirect_uri"
+			}
+			writeOAuth2JSON(w, http.StatusBadRequest, clientRegistrationError{
+				Error:            code,
+				ErrorDescription: err.Error(),
+			})
+			return
+		}
+		if cl, err = db.InsertClient(r.Context(), cl); err != nil {
+			ErrorLogger.Errorf("error inserting dynamically registered client: %s", err)
+			writeOAuth2JSON(w, http.StatusInternalServerError, clientRegistrationError{
+				Error: "server_error",
+			})
+			return
+		}
+		InfoLogger.Infof("Dynamically registered OAuth2 client %s (%q)", cl.Id, cl.Name)
+		writeOAuth2JSON(w, http.StatusCreated, clientRegistrationResponse{
+			ClientId:                cl.Id,
+			ClientSecret:            cl.Secret,
+			ClientIdIssuedAt:        cl.CreateTime.Unix(),
+			RedirectURIs:            cl.RedirectURIs,
+			TokenEndpointAuthMethod: req.TokenEndpointAuthMethod,
+			GrantTypes:              cl.GrantTypes,
+			ResponseTypes:           req.ResponseTypes,
+			ClientName:              cl.Name,
+			Scope:                   strings.Join(cl.Scopes, " "),
+		})
+	}
+}
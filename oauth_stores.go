@@ -18,9 +18,11 @@ package apcore
 
 import (
 	"context"
+	"strings"
 	"time"
 
 	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/errors"
 )
 
 var _ oauth2.TokenInfo = &tokenInfo{}
@@ -202,10 +204,16 @@ var _ oauth2.ClientInfo = &clientInfo{}
 
 // TODO: Postgres table
 type clientInfo struct {
-	id     string
-	secret string
-	domain string
-	userId string
+	id           string
+	secret       string
+	domain       string
+	userId       string
+	name         string
+	redirectURIs []string
+	scopes       []string
+	grantTypes   []string
+	public       bool
+	revoked      bool
 }
 
 func (c *clientInfo) GetID() string {
@@ -224,6 +232,49 @@ func (c *clientInfo) GetUserID() string {
 	return c.userId
 }
 
+// registeredRedirectURIs falls back to the domain for clients created before
+// redirect URIs were registered.
+func (c *clientInfo) registeredRedirectURIs() []string {
+	if len(c.redirectURIs) == 0 && len(c.domain) > 0 {
+		return []string{c.domain}
+	}
+	return c.redirectURIs
+}
+
+// allowsRedirectURI requires an exact match against a registered redirect URI.
+func (c *clientInfo) allowsRedirectURI(s string) bool {
+	for _, r := range c.registeredRedirectURIs() {
+		if r == s {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsScope requires the scope to be registered and among the client's
+// scopes. Clients that registered no scopes can obtain none.
+func (c *clientInfo) allowsScope(sc *scopes, scope string) bool {
+	if _, err := sc.Parse(scope); err != nil {
+		return false
+	}
+	return scopeGrants(strings.Join(c.scopes, " "), strings.Fields(scope)...)
+}
+
+// allowsGrant requires the grant type to be one the client registered.
+// Clients registered before grant types were recorded use the defaults.
+func (c *clientInfo) allowsGrant(gt oauth2.GrantType) bool {
+	grantTypes := c.grantTypes
+	if len(grantTypes) == 0 {
+		grantTypes = defaultGrantTypes(c.public)
+	}
+	for _, g := range grantTypes {
+		if g == string(gt) {
+			return true
+		}
+	}
+	return false
+}
+
 var _ oauth2.ClientStore = &clientStore{}
 
 type clientStore struct {
@@ -239,5 +290,11 @@ func newClientStore(d *database) (t *clientStore, err error) {
 
 // According to the ID for the client information
 func (c *clientStore) GetByID(id string) (oauth2.ClientInfo, error) {
-	return c.d.GetClientById(context.Background(), id)
+	ci, err := c.d.GetClientById(context.Background(), id)
+	if err != nil {
+		return nil, err
+	} else if ci.(*clientInfo).revoked {
+		return nil, errors.ErrInvalidClient
+	}
+	return ci, nil
 }
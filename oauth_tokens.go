@@ -0,0 +1,284 @@
+// apcore is a server framework for implementing an ActivityPub application.
+// Copyright (C) 2019 Cory Slep
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package apcore
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/errors"
+)
+
+// OAuth2Grant is a token a user has granted to a client, such as an app on one
+// of their devices.
+type OAuth2Grant struct {
+	Id         string
+	ClientId   string
+	ClientName string
+	Scopes     []string
+	CreateTime time.Time
+	// ExpireTime is when the grant can no longer be used or refreshed.
+	ExpireTime time.Time
+}
+
+func (o *OAuth2Grant) Load(row scanner) (err error) {
+	var scope, refresh string
+	var accessExpires, refreshExpires time.Duration
+	var refreshCreated time.Time
+	if err = row.Scan(
+		&o.Id,
+		&o.ClientId,
+		&o.ClientName,
+		&scope,
+		&o.CreateTime,
+		&accessExpires,
+		&refresh,
+		&refreshCreated,
+		&refreshExpires); err != nil {
+		return
+	}
+	o.Scopes = strings.Fields(scope)
+	if len(refresh) > 0 {
+		o.ExpireTime = refreshCreated.Add(refreshExpires)
+	} else {
+		o.ExpireTime = o.CreateTime.Add(accessExpires)
+	}
+	return
+}
+
+// tokenPurger periodically removes expired authorization codes, tokens, and
+// sessions.
+type tokenPurger struct {
+	db     *database
+	sl     *sessions
+	period time.Duration
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+func newTokenPurger(c *config, db *database, sl *sessions) (t *tokenPurger, err error) {
+	if c.OAuthConfig.TokenPurgePeriodSeconds <= 0 {
+		err = fmt.Errorf("oauth2 token purge period is <= 0")
+		return
+	}
+	t = &tokenPurger{
+		db:     db,
+		sl:     sl,
+		period: time.Duration(c.OAuthConfig.TokenPurgePeriodSeconds) * time.Second,
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+	return
+}
+
+func (t *tokenPurger) start() {
+	go func() {
+		defer close(t.doneCh)
+		tk := time.NewTicker(t.period)
+		defer tk.Stop()
+		for {
+			select {
+			case <-tk.C:
+				n, err := t.db.PurgeExpiredTokens(context.Background())
+				if err != nil {
+					ErrorLogger.Errorf("Error purging expired OAuth2 tokens: %s", err)
+				} else if n > 0 {
+					InfoLogger.Infof("Purged %d expired OAuth2 tokens", n)
+				}
+				n, err = t.sl.PurgeExpired(context.Background())
+				if err != nil {
+					ErrorLogger.Errorf("Error purging expired sessions: %s", err)
+				} else if n > 0 {
+					InfoLogger.Infof("Purged %d expired sessions", n)
+				}
+			case <-t.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (t *tokenPurger) stop() {
+	close(t.stopCh)
+	<-t.doneCh
+}
+
+// authenticateClient verifies the client credentials of a request to the
+// revocation or introspection endpoints.
+func (o *oAuth2Server) authenticateClient(r *http.Request) (ci *clientInfo, err error) {
+	var id, secret string
+	if id, secret, err = clientInfoHandler(r); err != nil {
+		return
+	}
+	if ci, err = o.m.client(id); err != nil {
+		err = errors.ErrInvalidClient
+		return
+	} else if !clientSecretEquals(ci.secret, secret) {
+		err = errors.ErrInvalidClient
+	}
+	return
+}
+
+// lookupToken finds an access or refresh token, trying the hinted type first.
+// It returns nil if no such token exists.
+func (o *oAuth2Server) lookupToken(c context.Context, token, hint string) (ti oauth2.TokenInfo, err error) {
+	lookups := []func(context.Context, string) (oauth2.TokenInfo, error){
+		o.d.GetTokenByAccess,
+		o.d.GetTokenByRefresh,
+	}
+	if hint == "refresh_token" {
+		lookups[0], lookups[1] = lookups[1], lookups[0]
+	}
+	for _, fn := range lookups {
+		if ti, err = fn(c, token); err != nil {
+			return
+		} else if ti.GetAccess() == token || ti.GetRefresh() == token {
+			return
+		}
+	}
+	ti = nil
+	return
+}
+
+func (o *oAuth2Server) writeClientError(w http.ResponseWriter, err error) {
+	w.Header().Set("WWW-Authenticate", "Basic")
+	writeOAuth2JSON(w, http.StatusUnauthorized, map[string]string{
+		"error": err.Error(),
+	})
+}
+
+// HandleRevocationRequest revokes an access or refresh token per RFC 7009,
+// along with the rest of the grant it belongs to.
+func (o *oAuth2Server) HandleRevocationRequest(w http.ResponseWriter, r *http.Request) {
+	ci, err := o.authenticateClient(r)
+	if err != nil {
+		o.writeClientError(w, err)
+		return
+	}
+	token := r.PostFormValue("token")
+	if len(token) == 0 {
+		writeOAuth2JSON(w, http.StatusBadRequest, map[string]string{
+			"error": errors.ErrInvalidRequest.Error(),
+		})
+		return
+	}
+	ti, err := o.lookupToken(r.Context(), token, r.PostFormValue("token_type_hint"))
+	if err != nil {
+		ErrorLogger.Errorf("error looking up token to revoke: %s", err)
+		writeOAuth2JSON(w, http.StatusInternalServerError, map[string]string{
+			"error": errors.ErrServerError.Error(),
+		})
+		return
+	}
+	// Unknown tokens and tokens of other clients are not revoked, but
+	// are indistinguishable to the client.
+	if ti != nil && ti.GetClientID() == ci.id {
+		if ti.GetAccess() == token {
+			err = o.d.RemoveTokenByAccess(r.Context(), token)
+		} else {
+			err = o.d.RemoveTokenByRefresh(r.Context(), token)
+		}
+		if err != nil {
+			ErrorLogger.Errorf("error revoking token: %s", err)
+			writeOAuth2JSON(w, http.StatusInternalServerError, map[string]string{
+				"error": errors.ErrServerError.Error(),
+			})
+			return
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+type introspectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientId  string `json:"client_id,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+}
+
+// HandleIntrospectionRequest describes an access or refresh token per RFC
+// 7662. Only confidential clients, such as resource servers, may introspect.
+func (o *oAuth2Server) HandleIntrospectionRequest(w http.ResponseWriter, r *http.Request) {
+	ci, err := o.authenticateClient(r)
+	if err == nil && ci.public {
+		err = errors.ErrUnauthorizedClient
+	}
+	if err != nil {
+		o.writeClientError(w, err)
+		return
+	}
+	token := r.PostFormValue("token")
+	if len(token) == 0 {
+		writeOAuth2JSON(w, http.StatusBadRequest, map[string]string{
+			"error": errors.ErrInvalidRequest.Error(),
+		})
+		return
+	}
+	resp, err := o.introspect(r.Context(), token, r.PostFormValue("token_type_hint"))
+	if err != nil {
+		ErrorLogger.Errorf("error introspecting token: %s", err)
+		writeOAuth2JSON(w, http.StatusInternalServerError, map[string]string{
+			"error": errors.ErrServerError.Error(),
+		})
+		return
+	}
+	writeOAuth2JSON(w, http.StatusOK, resp)
+}
+
+func (o *oAuth2Server) introspect(c context.Context, token, hint string) (resp introspectionResponse, err error) {
+	var ti oauth2.TokenInfo
+	if ti, err = o.lookupToken(c, token, hint); err != nil || ti == nil {
+		return
+	}
+	var created time.Time
+	var expires time.Duration
+	if ti.GetAccess() == token {
+		created, expires = ti.GetAccessCreateAt(), ti.GetAccessExpiresIn()
+	} else {
+		created, expires = ti.GetRefreshCreateAt(), ti.GetRefreshExpiresIn()
+	}
+	exp := created.Add(expires)
+	if expires > 0 && exp.Before(time.Now()) {
+		return
+	}
+	if userId := ti.GetUserID(); len(userId) > 0 {
+		var state userState
+		if state, err = o.d.UserState(c, userId); err != nil || !state.CanLogin() {
+			return
+		}
+	}
+	resp = introspectionResponse{
+		Active:    true,
+		Scope:     ti.GetScope(),
+		ClientId:  ti.GetClientID(),
+		TokenType: "Bearer",
+		Iat:       created.Unix(),
+		Sub:       ti.GetUserID(),
+	}
+	if expires > 0 {
+		resp.Exp = exp.Unix()
+	}
+	return
+}
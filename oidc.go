@@ -0,0 +1,246 @@
+// apcore is a server framework for implementing an ActivityPub application.
+// Copyright (C) 2019 Cory Slep
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package apcore
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"time"
+
+	"gopkg.in/oauth2.v3"
+)
+
+const (
+	oidcDiscoveryPath = "/.well-known/openid-configuration"
+	oidcJWKSPath      = "/oauth/jwks"
+	oidcUserInfoPath  = "/oauth/userinfo"
+	// Size of signing keys created by the guided configuration flow.
+	oidcSigningKeySize = 2048
+)
+
+// oidcProfile holds the OpenID Connect standard claims derived from a user's
+// actor.
+type oidcProfile struct {
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Name              string `json:"name,omitempty"`
+	Picture           string `json:"picture,omitempty"`
+	Profile           string `json:"profile,omitempty"`
+}
+
+// nonceTokenInfo carries the OpenID Connect nonce of the authorization request
+// to the ID token issued alongside the access token.
+type nonceTokenInfo struct {
+	oauth2.TokenInfo
+	nonce string
+}
+
+// oidcProvider issues ID tokens and serves the OpenID Connect discovery, JWKS,
+// and userinfo endpoints on top of the OAuth2 server.
+type oidcProvider struct {
+	issuer  string
+	key     *rsa.PrivateKey
+	kid     string
+	idTTL   time.Duration
+	d       *database
+	dynamic bool
+}
+
+func newOIDCProvider(c *config, scheme string, d *database) (p *oidcProvider, err error) {
+	var b []byte
+	if b, err = ioutil.ReadFile(c.OAuthConfig.OIDCSigningKeyFile); err != nil {
+		return
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		err = fmt.Errorf("no PEM data in OpenID Connect signing key file")
+		return
+	}
+	var k crypto.PrivateKey
+	if k, err = deserializeRSAPrivateKey(block.Bytes); err != nil {
+		return
+	}
+	rk, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		err = fmt.Errorf("OpenID Connect signing key is not an RSA private key")
+		return
+	}
+	var pub []byte
+	if pub, err = x509.MarshalPKIXPublicKey(&rk.PublicKey); err != nil {
+		return
+	}
+	h := sha256.Sum256(pub)
+	p = &oidcProvider{
+		issuer:  fmt.Sprintf("%s://%s", scheme, c.ServerConfig.Host),
+		key:     rk,
+		kid:     base64.RawURLEncoding.EncodeToString(h[:12]),
+		idTTL:   time.Duration(c.OAuthConfig.AccessTokenExpiry) * time.Second,
+		d:       d,
+		dynamic: c.OAuthConfig.DynamicClientRegistration,
+	}
+	return
+}
+
+// sign creates a compact JWS using RS256.
+func (p *oidcProvider) sign(claims map[string]interface{}) (s string, err error) {
+	var header, payload []byte
+	if header, err = json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"kid": p.kid,
+	}); err != nil {
+		return
+	}
+	if payload, err = json.Marshal(claims); err != nil {
+		return
+	}
+	s = base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	h := sha256.Sum256([]byte(s))
+	var sig []byte
+	if sig, err = rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, h[:]); err != nil {
+		return
+	}
+	s += "." + base64.RawURLEncoding.EncodeToString(sig)
+	return
+}
+
+// IDToken creates the ID token for a token granted the openid scope.
+func (p *oidcProvider) IDToken(c context.Context, ti oauth2.TokenInfo) (s string, err error) {
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss": p.issuer,
+		"sub": ti.GetUserID(),
+		"aud": ti.GetClientID(),
+		"iat": now.Unix(),
+		"exp": now.Add(p.idTTL).Unix(),
+	}
+	if nti, ok := ti.(*nonceTokenInfo); ok {
+		claims["nonce"] = nti.nonce
+	}
+	if scopeGrants(ti.GetScope(), ScopeProfile) {
+		var pr oidcProfile
+		if pr, err = p.d.UserProfile(c, ti.GetUserID()); err != nil {
+			return
+		}
+		addProfileClaims(claims, pr)
+	}
+	return p.sign(claims)
+}
+
+func addProfileClaims(claims map[string]interface{}, pr oidcProfile) {
+	for k, v := range map[string]string{
+		"preferred_username": pr.PreferredUsername,
+		"name":               pr.Name,
+		"picture":            pr.Picture,
+		"profile":            pr.Profile,
+	} {
+		if len(v) > 0 {
+			claims[k] = v
+		}
+	}
+}
+
+func (p *oidcProvider) discoveryHandler(sc *scopes) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var names []string
+		for _, s := range sc.All() {
+			names = append(names, s.Name)
+		}
+		d := map[string]interface{}{
+			"issuer":                                p.issuer,
+			"authorization_endpoint":                p.issuer + "/authorize",
+			"token_endpoint":                        p.issuer + "/token",
+			"userinfo_endpoint":                     p.issuer + oidcUserInfoPath,
+			"jwks_uri":                              p.issuer + oidcJWKSPath,
+			"revocation_endpoint":                   p.issuer + "/oauth/revoke",
+			"introspection_endpoint":                p.issuer + "/oauth/introspect",
+			"scopes_supported":                      names,
+			"response_types_supported":              []string{"code"},
+			"grant_types_supported":                 []string{"authorization_code", "refresh_token", "client_credentials"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+			"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+			"code_challenge_methods_supported":      []string{pkceMethodS256, pkceMethodPlain},
+			"claims_supported":                      []string{"iss", "sub", "aud", "iat", "exp", "nonce", "preferred_username", "name", "picture", "profile"},
+		}
+		if p.dynamic {
+			d["registration_endpoint"] = p.issuer + "/oauth/register"
+		}
+		writeOAuth2JSON(w, http.StatusOK, d)
+	}
+}
+
+func (p *oidcProvider) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	writeOAuth2JSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"use": "sig",
+				"alg": "RS256",
+				"kid": p.kid,
+				"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+			},
+		},
+	})
+}
+
+func (p *oidcProvider) userInfoHandler(o *oAuth2Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t, authenticated, err := o.ValidateOAuth2AccessToken(w, r)
+		if err != nil {
+			ErrorLogger.Errorf("error validating token for OpenID Connect userinfo: %s", err)
+			writeOAuth2JSON(w, http.StatusInternalServerError, map[string]string{
+				"error": "server_error",
+			})
+			return
+		} else if !authenticated || len(t.GetUserID()) == 0 {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if !scopeGrants(t.GetScope(), ScopeOpenID) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		claims := map[string]interface{}{
+			"sub": t.GetUserID(),
+		}
+		if scopeGrants(t.GetScope(), ScopeProfile) {
+			pr, err := p.d.UserProfile(r.Context(), t.GetUserID())
+			if err != nil {
+				ErrorLogger.Errorf("error fetching profile for OpenID Connect userinfo: %s", err)
+				writeOAuth2JSON(w, http.StatusInternalServerError, map[string]string{
+					"error": "server_error",
+				})
+				return
+			}
+			addProfileClaims(claims, pr)
+		}
+		writeOAuth2JSON(w, http.StatusOK, claims)
+	}
+}
@@ -18,29 +18,173 @@ package apcore
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"fmt"
+	"strings"
 
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
 
-// Uses a password and salt to hash with the given strength value.
+const (
+	passwordArgon2id = "argon2id"
+	passwordBcrypt   = "bcrypt"
+	// Prefixes of versioned password hashes. Hashes without either are
+	// legacy bcrypt hashes of the password with a separate salt appended.
+	argon2idPrefix     = "$argon2id$"
+	bcryptSHA256Prefix = "$bcrypt-sha256$"
+	argon2KeyLen       = 32
+)
+
+// passwordHasher hashes passwords with the configured algorithm and
+// parameters, and verifies hashes created by earlier configurations.
 //
-// Strength is dependent on the bcrypt library, which has built-in protections
-// against under-strength values.
-func hashPasswordWithSalt(pass string, salt []byte, strength int) (b []byte, err error) {
-	salty := append([]byte(pass), salt...)
-	b, err = bcrypt.GenerateFromPassword(salty, strength)
+// Hashes use the PHC string format, for example:
+//
+//	$argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+//	$bcrypt-sha256$$2a$12$<salt and hash>
+//
+// bcrypt is given the base64 SHA-256 digest of the password, so that
+// passwords longer than 72 bytes are not truncated.
+type passwordHasher struct {
+	algorithm  string
+	bcryptCost int
+	saltSize   int
+	time       uint32
+	memory     uint32
+	threads    uint8
+}
+
+func newPasswordHasher(c *config) (p passwordHasher, err error) {
+	sc := c.ServerConfig
+	p = passwordHasher{
+		algorithm:  sc.PasswordHashAlgorithm,
+		bcryptCost: sc.BCryptStrength,
+		saltSize:   sc.SaltSize,
+		time:       uint32(sc.Argon2Time),
+		memory:     uint32(sc.Argon2MemoryKiB),
+		threads:    uint8(sc.Argon2Threads),
+	}
+	if len(p.algorithm) == 0 {
+		p.algorithm = passwordArgon2id
+	}
+	switch p.algorithm {
+	case passwordArgon2id:
+		if sc.Argon2Time <= 0 || sc.Argon2MemoryKiB <= 0 || sc.Argon2Threads <= 0 || sc.Argon2Threads > 255 {
+			err = fmt.Errorf("argon2id parameters must be positive, with at most 255 threads")
+		}
+	case passwordBcrypt:
+	default:
+		err = fmt.Errorf("unknown password hash algorithm: %q", p.algorithm)
+	}
 	return
 }
 
+// Hash creates a versioned hash of the password.
+func (p passwordHasher) Hash(pass string) (hash []byte, err error) {
+	if p.algorithm == passwordBcrypt {
+		var b []byte
+		if b, err = bcrypt.GenerateFromPassword(prehashPassword(pass), p.bcryptCost); err != nil {
+			return
+		}
+		hash = append([]byte(bcryptSHA256Prefix), b...)
+		return
+	}
+	var salt []byte
+	if salt, err = newSalt(p.saltSize); err != nil {
+		return
+	}
+	k := argon2.IDKey([]byte(pass), salt, p.time, p.memory, p.threads, argon2KeyLen)
+	hash = []byte(fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix,
+		argon2.Version,
+		p.memory,
+		p.time,
+		p.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(k)))
+	return
+}
+
+// Verify determines whether the password matches the hash, and if so whether
+// it should be rehashed because the algorithm or its parameters have changed
+// since. The salt is only used by legacy hashes.
+func (p passwordHasher) Verify(pass string, hash, salt []byte) (valid, rehash bool) {
+	s := string(hash)
+	switch {
+	case strings.HasPrefix(s, argon2idPrefix):
+		var version int
+		var memory, time uint32
+		var threads uint8
+		parts := strings.Split(s, "$")
+		if len(parts) != 6 {
+			return
+		} else if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+			return
+		} else if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+			return
+		}
+		salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+		if err != nil {
+			return
+		}
+		k, err := base64.RawStdEncoding.DecodeString(parts[5])
+		if err != nil {
+			return
+		}
+		valid = subtle.ConstantTimeCompare(k, argon2.IDKey([]byte(pass), salt, time, memory, threads, uint32(len(k)))) == 1
+		rehash = p.algorithm != passwordArgon2id || memory != p.memory || time != p.time || threads != p.threads || len(k) != argon2KeyLen
+	case strings.HasPrefix(s, bcryptSHA256Prefix):
+		b := hash[len(bcryptSHA256Prefix):]
+		valid = bcrypt.CompareHashAndPassword(b, prehashPassword(pass)) == nil
+		cost, err := bcrypt.Cost(b)
+		rehash = p.algorithm != passwordBcrypt || err != nil || cost != p.bcryptCost
+	default:
+		valid = passEquals(pass, salt, hash)
+		rehash = true
+	}
+	return
+}
+
+func prehashPassword(pass string) []byte {
+	h := sha256.Sum256([]byte(pass))
+	return []byte(base64.StdEncoding.EncodeToString(h[:]))
+}
+
 // Uses time constant comparison to determine if a password and salt are equal
-// to the hash.
+// to a legacy hash, which is the bcrypt hash of the password with the salt
+// appended.
 func passEquals(pass string, salt, hash []byte) bool {
 	salty := append([]byte(pass), salt...)
 	err := bcrypt.CompareHashAndPassword(hash, salty)
 	return err == nil
 }
 
+// Hashes an OAuth2 client secret for storage. Secrets are random, so no
+// additional salt is needed.
+func hashClientSecret(secret string, strength int) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(secret), strength)
+	return string(b), err
+}
+
+// Uses time constant comparison to determine if a client secret matches its
+// stored hash. Public clients have neither.
+func clientSecretEquals(hash, secret string) bool {
+	if len(hash) == 0 {
+		return len(secret) == 0
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(secret)) == nil
+}
+
+// Determines whether a stored client secret is already hashed, for migrating
+// rows from earlier versions.
+func isHashedClientSecret(s string) bool {
+	_, err := bcrypt.Cost([]byte(s))
+	return err == nil
+}
+
 // Creates a new salt of the given byte size.
 //
 // The smallest supported salt length is 16 bytes, any shorter request will be
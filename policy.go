@@ -40,6 +40,31 @@ func (p permit) and(o permit) permit {
 	return unknown
 }
 
+// action is a graded moderation outcome applied to federated data that is
+// otherwise permitted.
+type action string
+
+const (
+	// noAction applies no additional moderation.
+	noAction action = "none"
+	// silence accepts activities but hides them from public collections.
+	silence action = "silence"
+	// rejectMedia strips attachments from activities before they are
+	// handled.
+	rejectMedia action = "reject_media"
+	// quarantine stops local public activities from being delivered.
+	quarantine action = "quarantine"
+)
+
+func containsAction(as []action, a action) bool {
+	for _, o := range as {
+		if o == a {
+			return true
+		}
+	}
+	return false
+}
+
 type scanner interface {
 	Scan(...interface{}) error
 }
@@ -49,6 +74,7 @@ type resolution struct {
 	Id           string
 	Order        int
 	Permit       permit
+	Action       action
 	ActivityId   *url.URL
 	TargetUserId string
 	Public       bool
@@ -62,6 +88,7 @@ func (r *resolution) Load(row scanner) (err error) {
 		&r.Id,
 		&r.TargetUserId,
 		&r.Permit,
+		&r.Action,
 		&activityIRI,
 		&r.Order,
 		&r.Public,
@@ -82,6 +109,11 @@ const (
 	instanceDeny  = "instance_deny"
 	actorGrant    = "actor_grant"
 	actorDeny     = "actor_deny"
+	// Instance moderation policies do not permit nor deny, but instead
+	// apply an action to the matching instance's federated data.
+	instanceSilence     = "instance_silence"
+	instanceRejectMedia = "instance_reject_media"
+	instanceQuarantine  = "instance_quarantine"
 )
 
 // policy determines what kind of resolution is appropriate.
@@ -96,7 +128,7 @@ type policy struct {
 	Public           bool
 	Subject          string
 	Kind             string
-	Resolve          func(from []*url.URL, activityType string) (p permit, reason string)
+	Resolve          func(from []*url.URL, activityType string) (p permit, a action, reason string)
 }
 
 func (p *policy) Load(r scanner, isInstance bool) (err error) {
@@ -124,20 +156,23 @@ func (p *policy) Load(r scanner, isInstance bool) (err error) {
 	}
 	switch p.Kind {
 	case alwaysGrant:
-		p.Resolve = func(from []*url.URL, activityType string) (perm permit, reason string) {
+		p.Resolve = func(from []*url.URL, activityType string) (perm permit, a action, reason string) {
 			perm = grant
+			a = noAction
 			reason = "always permit"
 			return
 		}
 	case alwaysDeny:
-		p.Resolve = func(from []*url.URL, activityType string) (perm permit, reason string) {
+		p.Resolve = func(from []*url.URL, activityType string) (perm permit, a action, reason string) {
 			perm = deny
+			a = noAction
 			reason = "always deny"
 			return
 		}
 	case instanceGrant:
-		p.Resolve = func(from []*url.URL, activityType string) (perm permit, reason string) {
+		p.Resolve = func(from []*url.URL, activityType string) (perm permit, a action, reason string) {
 			perm = unknown
+			a = noAction
 			reason = fmt.Sprintf("could not match host %q for instance grant", p.Subject)
 			for _, f := range from {
 				if f.Host == p.Subject {
@@ -149,8 +184,9 @@ func (p *policy) Load(r scanner, isInstance bool) (err error) {
 			return
 		}
 	case instanceDeny:
-		p.Resolve = func(from []*url.URL, activityType string) (perm permit, reason string) {
+		p.Resolve = func(from []*url.URL, activityType string) (perm permit, a action, reason string) {
 			perm = unknown
+			a = noAction
 			reason = fmt.Sprintf("could not match host %q for instance deny", p.Subject)
 			for _, f := range from {
 				if f.Host == p.Subject {
@@ -162,8 +198,9 @@ func (p *policy) Load(r scanner, isInstance bool) (err error) {
 			return
 		}
 	case actorGrant:
-		p.Resolve = func(from []*url.URL, activityType string) (perm permit, reason string) {
+		p.Resolve = func(from []*url.URL, activityType string) (perm permit, a action, reason string) {
 			perm = unknown
+			a = noAction
 			reason = fmt.Sprintf("could not match actor %q for actor grant", p.Subject)
 			for _, f := range from {
 				if f.String() == p.Subject {
@@ -175,8 +212,9 @@ func (p *policy) Load(r scanner, isInstance bool) (err error) {
 			return
 		}
 	case actorDeny:
-		p.Resolve = func(from []*url.URL, activityType string) (perm permit, reason string) {
+		p.Resolve = func(from []*url.URL, activityType string) (perm permit, a action, reason string) {
 			perm = unknown
+			a = noAction
 			reason = fmt.Sprintf("could not match actor %q for actor deny", p.Subject)
 			for _, f := range from {
 				if f.String() == p.Subject {
@@ -187,27 +225,42 @@ func (p *policy) Load(r scanner, isInstance bool) (err error) {
 			}
 			return
 		}
+	case instanceSilence:
+		p.Resolve = p.instanceAction(silence)
+	case instanceRejectMedia:
+		p.Resolve = p.instanceAction(rejectMedia)
+	case instanceQuarantine:
+		p.Resolve = p.instanceAction(quarantine)
 	default:
 		err = fmt.Errorf("unknown kind of policy: %s", p.Kind)
 	}
 	return
 }
 
-type policies []policy
-
-// IsBlocked uses a number of policies to determine and record resolutions.
-func (p policies) IsBlocked(c context.Context, db *database, targetUserId string, from []*url.URL, activityIRI *url.URL, activityType string) (blocked bool, err error) {
-	var r []resolution
-	defer func() {
-		if err == nil {
-			err = db.InsertResolutions(c, r)
+// instanceAction applies the action to any matching host, leaving the permit
+// decision to other policies.
+func (p *policy) instanceAction(act action) func(from []*url.URL, activityType string) (perm permit, a action, reason string) {
+	return func(from []*url.URL, activityType string) (perm permit, a action, reason string) {
+		perm = unknown
+		a = noAction
+		reason = fmt.Sprintf("could not match host %q for instance %s", p.Subject, act)
+		for _, f := range from {
+			if f.Host == p.Subject {
+				a = act
+				reason = fmt.Sprintf("%q matched host %q for instance %s", f, p.Subject, act)
+				return
+			}
 		}
-	}()
-	if len(p) == 0 {
-		err = fmt.Errorf("no policies to evaluate")
 		return
 	}
-	outcome := unknown
+}
+
+type policies []policy
+
+// evaluate applies the policies in order, stopping at the first denial. The
+// actions of all matching policies are collected.
+func (p policies) evaluate(targetUserId string, from []*url.URL, activityIRI *url.URL, activityType string) (r []resolution, outcome permit, applied []action) {
+	outcome = unknown
 	for i, policy := range p {
 		res := resolution{
 			ActivityId:   activityIRI,
@@ -216,16 +269,57 @@ func (p policies) IsBlocked(c context.Context, db *database, targetUserId string
 			PolicyId:     policy.Id,
 			Order:        i,
 		}
-		res.Permit, res.Reason = policy.Resolve(from, activityType)
+		res.Permit, res.Action, res.Reason = policy.Resolve(from, activityType)
 		r = append(r, res)
+		if res.Action != noAction && !containsAction(applied, res.Action) {
+			applied = append(applied, res.Action)
+		}
 		outcome = outcome.and(res.Permit)
-		blocked = outcome == deny
-		if blocked {
+		if outcome == deny {
 			return
 		}
 	}
+	return
+}
+
+// IsBlocked uses a number of policies to determine and record resolutions,
+// returning the moderation actions to apply if the activity is not blocked.
+func (p policies) IsBlocked(c context.Context, db *database, targetUserId string, from []*url.URL, activityIRI *url.URL, activityType string) (blocked bool, applied []action, err error) {
+	var r []resolution
+	defer func() {
+		if err == nil {
+			err = db.InsertResolutions(c, r)
+		}
+	}()
+	if len(p) == 0 {
+		err = fmt.Errorf("no policies to evaluate")
+		return
+	}
+	var outcome permit
+	r, outcome, applied = p.evaluate(targetUserId, from, activityIRI, activityType)
+	blocked = outcome == deny
 	if outcome == unknown {
 		err = fmt.Errorf("unknown resolution after evaluating all policies")
 	}
 	return
 }
+
+// IsFetchBlocked determines whether an authenticated fetch by the actor is
+// denied. Unlike IsBlocked, an unknown outcome permits the fetch and no
+// resolutions are recorded.
+func (p policies) IsFetchBlocked(from *url.URL, targetIRI *url.URL) (blocked bool) {
+	_, outcome, _ := p.evaluate("", []*url.URL{from}, targetIRI, "")
+	return outcome == deny
+}
+
+// IsQuarantined determines whether local public activities must not be
+// delivered to the recipient. Every policy is checked, as a quarantine applies
+// even if another policy denies the recipient first.
+func (p policies) IsQuarantined(to *url.URL) bool {
+	for _, policy := range p {
+		if _, a, _ := policy.Resolve([]*url.URL{to}, ""); a == quarantine {
+			return true
+		}
+	}
+	return false
+}
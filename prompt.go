@@ -17,14 +17,121 @@
 package apcore
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
 	"strconv"
 	"strings"
 
 	"github.com/manifoldco/promptui"
+	"gopkg.in/yaml.v2"
 )
 
-func promptYN(display string) (b bool, err error) {
+// answers are given to prompts by name instead of asking, from the answers
+// file and the answer flags.
+var answers = make(map[string]string)
+
+// inputError is returned when a prompt cannot be answered, or its scripted
+// answer is invalid.
+type inputError string
+
+func (e inputError) Error() string {
+	return string(e)
+}
+
+// answerFlags collects the repeatable -answer name=value flags.
+type answerFlags map[string]string
+
+func (a answerFlags) String() string {
+	return fmt.Sprint(map[string]string(a))
+}
+
+func (a answerFlags) Set(v string) error {
+	kv := strings.SplitN(v, "=", 2)
+	if len(kv) != 2 || len(kv[0]) == 0 {
+		return fmt.Errorf("answer must be name=value: %q", v)
+	}
+	a[kv[0]] = kv[1]
+	return nil
+}
+
+// loadAnswers reads the answers file, a JSON or YAML object mapping prompt
+// names to answers, and then the answer flags, which take precedence. Files
+// ending in .yaml or .yml are read as YAML.
+func loadAnswers(file string, flags answerFlags) (err error) {
+	if len(file) > 0 {
+		var b []byte
+		if b, err = ioutil.ReadFile(file); err != nil {
+			return
+		}
+		var m map[string]interface{}
+		switch strings.ToLower(filepath.Ext(file)) {
+		case ".yaml", ".yml":
+			err = yaml.Unmarshal(b, &m)
+		default:
+			err = json.Unmarshal(b, &m)
+		}
+		if err != nil {
+			err = fmt.Errorf("invalid answers file %s: %s", file, err)
+			return
+		}
+		for k, v := range m {
+			switch t := v.(type) {
+			case string:
+				answers[k] = t
+			case bool:
+				answers[k] = strconv.FormatBool(t)
+			case int:
+				answers[k] = strconv.Itoa(t)
+			case float64:
+				answers[k] = strconv.FormatFloat(t, 'f', -1, 64)
+			default:
+				err = fmt.Errorf("answer to %s in %s is not a string, number, or boolean", k, file)
+				return
+			}
+		}
+	}
+	for k, v := range flags {
+		answers[k] = v
+	}
+	return
+}
+
+// scriptedAnswer answers the named prompt without asking, with the answer given
+// for it or, in -yes mode, its default. Otherwise ok is false, and the prompt
+// must be asked unless in non-interactive mode.
+func scriptedAnswer(name, display, def string, hasDef bool) (s string, ok bool, err error) {
+	if s, ok = answers[name]; ok {
+		return
+	} else if *yesFlag && hasDef {
+		return def, true, nil
+	} else if *nonInteractiveFlag {
+		err = inputError(fmt.Sprintf("no answer to %s in non-interactive mode: %s", name, display))
+	}
+	return
+}
+
+func parseYN(name, s string) (b bool, err error) {
+	switch strings.ToLower(s) {
+	case "y", "yes", "true":
+		b = true
+	case "n", "no", "false":
+	default:
+		err = inputError(fmt.Sprintf("answer to %s must be yes or no: %q", name, s))
+	}
+	return
+}
+
+func promptYN(name, display string) (b bool, err error) {
+	var s string
+	var ok bool
+	if s, ok, err = scriptedAnswer(name, display, "n", true); err != nil {
+		return
+	} else if ok {
+		b, err = parseYN(name, s)
+		return
+	}
 	p := promptui.Prompt{
 		Label: display,
 		Templates: &promptui.PromptTemplates{
@@ -42,7 +149,6 @@ func promptYN(display string) (b bool, err error) {
 		},
 		Default: "n",
 	}
-	var s string
 	s, err = p.Run()
 	s = strings.ToLower(s)
 	if err != nil {
@@ -58,7 +164,22 @@ func promptYN(display string) (b bool, err error) {
 	return
 }
 
-func promptPassword(display string) (s string, err error) {
+// promptConfirm asks a yes-or-no question where no stops the action. When
+// scripted, it is not answered by -yes and must be answered explicitly, so
+// that an action does not silently do nothing.
+func promptConfirm(name, display string) (b bool, err error) {
+	if _, ok := answers[name]; !ok && (*yesFlag || *nonInteractiveFlag) {
+		err = inputError(fmt.Sprintf("no answer to %s, which must be answered explicitly when scripted: %s", name, display))
+		return
+	}
+	return promptYN(name, display)
+}
+
+func promptPassword(name, display string) (s string, err error) {
+	var ok bool
+	if s, ok, err = scriptedAnswer(name, display, "", false); err != nil || ok {
+		return
+	}
 	p := promptui.Prompt{
 		Label: display,
 		Mask:  '*',
@@ -67,33 +188,40 @@ func promptPassword(display string) (s string, err error) {
 	return
 }
 
-func promptDoesXHavePassword(display string) (b bool, err error) {
+func promptDoesXHavePassword(name, display string) (b bool, err error) {
 	return promptYN(
+		name,
 		fmt.Sprintf(
 			"Does %s have a password?",
 			display))
 }
 
-func promptFileExistsContinue(path string) (b bool, err error) {
-	return promptYN(
+func promptFileExistsContinue(name, path string) (b bool, err error) {
+	return promptConfirm(
+		name,
 		fmt.Sprintf(
 			"File exists at: %q. Do you wish to continue?",
 			path))
 }
 
-func promptOverwriteExistingFile(path string) (b bool, err error) {
-	return promptYN(
+func promptOverwriteExistingFile(name, path string) (b bool, err error) {
+	return promptConfirm(
+		name,
 		fmt.Sprintf(
 			"File exists at: %q. Do you wish to overwrite it?",
 			path))
 }
 
-func promptString(display string) (s string, err error) {
-	s, err = promptStringWithDefault(display, "")
+func promptString(name, display string) (s string, err error) {
+	s, err = promptStringWithDefault(name, display, "")
 	return
 }
 
-func promptStringWithDefault(display, def string) (s string, err error) {
+func promptStringWithDefault(name, display, def string) (s string, err error) {
+	var ok bool
+	if s, ok, err = scriptedAnswer(name, display, def, len(def) > 0); err != nil || ok {
+		return
+	}
 	p := promptui.Prompt{
 		Label:     display,
 		Default:   def,
@@ -113,7 +241,19 @@ func promptStringWithDefault(display, def string) (s string, err error) {
 	return
 }
 
-func promptSelection(display string, choices ...string) (s string, err error) {
+func promptSelection(name, display string, choices ...string) (s string, err error) {
+	var ok bool
+	if s, ok, err = scriptedAnswer(name, display, choices[0], true); err != nil {
+		return
+	} else if ok {
+		for _, c := range choices {
+			if s == c {
+				return
+			}
+		}
+		err = inputError(fmt.Sprintf("answer to %s must be one of %s: %q", name, strings.Join(choices, ", "), s))
+		return
+	}
 	p := promptui.Select{
 		Label: display,
 		Items: choices,
@@ -125,7 +265,17 @@ func promptSelection(display string, choices ...string) (s string, err error) {
 	return
 }
 
-func promptIntWithDefault(display string, def int) (v int, err error) {
+func promptIntWithDefault(name, display string, def int) (v int, err error) {
+	var s string
+	var ok bool
+	if s, ok, err = scriptedAnswer(name, display, strconv.Itoa(def), true); err != nil {
+		return
+	} else if ok {
+		if v, err = strconv.Atoi(s); err != nil {
+			err = inputError(fmt.Sprintf("answer to %s must be an integer: %q", name, s))
+		}
+		return
+	}
 	p := promptui.Prompt{
 		Label:     display,
 		Default:   fmt.Sprintf("%d", def),
@@ -145,7 +295,6 @@ func promptIntWithDefault(display string, def int) (v int, err error) {
 			Success:         fmt.Sprintf(`{{ "%s" | bold }} {{ . | faint }}{{ ":" | bold}}`, promptui.IconGood),
 		},
 	}
-	var s string
 	s, err = p.Run()
 	if err != nil {
 		return
@@ -156,7 +305,17 @@ func promptIntWithDefault(display string, def int) (v int, err error) {
 	return
 }
 
-func promptFloat64WithDefault(display string, def int) (v float64, err error) {
+func promptFloat64WithDefault(name, display string, def int) (v float64, err error) {
+	var s string
+	var ok bool
+	if s, ok, err = scriptedAnswer(name, display, strconv.Itoa(def), true); err != nil {
+		return
+	} else if ok {
+		if v, err = strconv.ParseFloat(s, 64); err != nil {
+			err = inputError(fmt.Sprintf("answer to %s must be a number: %q", name, s))
+		}
+		return
+	}
 	p := promptui.Prompt{
 		Label:     display,
 		Default:   fmt.Sprintf("%d", def),
@@ -176,7 +335,6 @@ func promptFloat64WithDefault(display string, def int) (v float64, err error) {
 			Success:         fmt.Sprintf(`{{ "%s" | bold }} {{ . | faint }}{{ ":" | bold}}`, promptui.IconGood),
 		},
 	}
-	var s string
 	s, err = p.Run()
 	if err != nil {
 		return
@@ -0,0 +1,483 @@
+// apcore is a server framework for implementing an ActivityPub application.
+// Copyright (C) 2019 Cory Slep
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package apcore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RegistrationMode determines who may register an account.
+type RegistrationMode string
+
+const (
+	// RegistrationClosed allows no one to register.
+	RegistrationClosed RegistrationMode = "closed"
+	// RegistrationInviteOnly requires a valid invite code to register.
+	RegistrationInviteOnly RegistrationMode = "invite_only"
+	// RegistrationApprovalRequired requires an administrator to approve
+	// accounts registered without a valid invite code.
+	RegistrationApprovalRequired RegistrationMode = "approval_required"
+	// RegistrationOpen allows anyone to register.
+	RegistrationOpen RegistrationMode = "open"
+)
+
+func toRegistrationMode(s string) (m RegistrationMode, err error) {
+	m = RegistrationMode(s)
+	switch m {
+	case RegistrationClosed, RegistrationInviteOnly, RegistrationApprovalRequired, RegistrationOpen:
+	case "":
+		m = RegistrationClosed
+	default:
+		err = fmt.Errorf("unknown registration mode: %q", s)
+	}
+	return
+}
+
+const (
+	// Form keys POSTed to "/register".
+	RegisterFormUsernameKey = "username"
+	RegisterFormEmailKey    = "email"
+	RegisterFormPasswordKey = "password"
+	RegisterFormInviteKey   = "invite"
+	// Form keys POSTed to "/reset-password". Only the email is POSTed to
+	// request a reset, and the token and new password to complete it.
+	PasswordResetFormEmailKey    = "email"
+	PasswordResetFormTokenKey    = "token"
+	PasswordResetFormPasswordKey = "password"
+	// Form key POSTed to "/verify-email" to send a new verification email.
+	VerifyEmailFormEmailKey = "email"
+)
+
+const (
+	minPasswordLength = 8
+	inviteCodeSize    = 16
+	// Purposes of signed account tokens, so that one cannot be used in
+	// place of another.
+	accountTokenVerifyEmail   = "verify_email"
+	accountTokenResetPassword = "reset_password"
+)
+
+var (
+	errInvalidInvite = errors.New("invite code is invalid, expired, or used up")
+	usernameRegexp   = regexp.MustCompile(`^[a-zA-Z0-9_]{1,30}$`)
+)
+
+// accounts handles registration, email verification, and password resets.
+//
+// Verification and reset links contain signed, expiring tokens bound to the
+// user's current email or password hash, so that a reset token cannot be
+// used again once the password has changed.
+type accounts struct {
+	d         *database
+	sl        *sessions
+	m         Mailer
+	mode      RegistrationMode
+	scheme    string
+	host      string
+	key       []byte
+	verifyTTL time.Duration
+	resetTTL  time.Duration
+}
+
+func newAccounts(c *config, a Application, scheme string, d *database, sl *sessions) (ac *accounts, err error) {
+	rc := c.RegistrationConfig
+	if rc.VerificationTokenExpirySeconds <= 0 {
+		err = fmt.Errorf("reg_verification_token_expiry_seconds is <= 0")
+		return
+	} else if rc.ResetTokenExpirySeconds <= 0 {
+		err = fmt.Errorf("reg_reset_token_expiry_seconds is <= 0")
+		return
+	}
+	ac = &accounts{
+		d:         d,
+		sl:        sl,
+		scheme:    scheme,
+		host:      c.ServerConfig.Host,
+		key:       deriveKey(d.tokenKey, "apcore account tokens"),
+		verifyTTL: time.Duration(rc.VerificationTokenExpirySeconds) * time.Second,
+		resetTTL:  time.Duration(rc.ResetTokenExpirySeconds) * time.Second,
+	}
+	if ac.mode, err = toRegistrationMode(rc.Mode); err != nil {
+		return
+	}
+	ac.m, err = newMailer(c, a)
+	return
+}
+
+func tokenBinding(b []byte) string {
+	h := sha256.Sum256(b)
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// sign creates a token for the purpose, which expires after the duration.
+func (ac *accounts) sign(purpose, userId string, binding []byte, ttl time.Duration) string {
+	payload := strings.Join([]string{
+		purpose,
+		userId,
+		strconv.FormatInt(time.Now().Add(ttl).Unix(), 10),
+		tokenBinding(binding),
+	}, "\n")
+	m := hmac.New(sha256.New, ac.key)
+	m.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// verify checks the signature and expiry of a token for the purpose, returning
+// the user and the binding digest to compare against.
+func (ac *accounts) verify(purpose, token string) (userId, binding string, ok bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return
+	}
+	m := hmac.New(sha256.New, ac.key)
+	m.Write(payload)
+	if !hmac.Equal(sig, m.Sum(nil)) {
+		return
+	}
+	fields := strings.Split(string(payload), "\n")
+	if len(fields) != 4 || fields[0] != purpose {
+		return
+	}
+	exp, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || time.Now().After(time.Unix(exp, 0)) {
+		return
+	}
+	return fields[1], fields[3], true
+}
+
+func (ac *accounts) link(path, token string) string {
+	u := url.URL{
+		Scheme:   ac.scheme,
+		Host:     ac.host,
+		Path:     path,
+		RawQuery: url.Values{"token": []string{token}}.Encode(),
+	}
+	return u.String()
+}
+
+func (ac *accounts) SendVerification(c context.Context, userId, email string) error {
+	return ac.m.SendMail(c, Mail{
+		To:      email,
+		Subject: fmt.Sprintf("Verify your email address on %s", ac.host),
+		Body: fmt.Sprintf("Open this link to verify the email address of your account on %s:\n\n%s\n\nThe link expires in %s. If you did not register, you can ignore this email.\n",
+			ac.host,
+			ac.link("/verify-email", ac.sign(accountTokenVerifyEmail, userId, []byte(email), ac.verifyTTL)),
+			ac.verifyTTL),
+	})
+}
+
+func (ac *accounts) sendRegisteredNotice(c context.Context, email string) error {
+	return ac.m.SendMail(c, Mail{
+		To:      email,
+		Subject: fmt.Sprintf("Registration attempt on %s", ac.host),
+		Body: fmt.Sprintf("Someone tried to register an account on %s with your email address, which already has an account. If it was you, you can reset your password at:\n\n%s://%s/reset-password\n\nOtherwise, you can ignore this email.\n",
+			ac.host,
+			ac.scheme,
+			ac.host),
+	})
+}
+
+func (ac *accounts) sendReset(c context.Context, userId string, a userAccount) error {
+	return ac.m.SendMail(c, Mail{
+		To:      a.email,
+		Subject: fmt.Sprintf("Reset your password on %s", ac.host),
+		Body: fmt.Sprintf("Open this link to choose a new password for your account on %s:\n\n%s\n\nThe link expires in %s. If you did not request a reset, you can ignore this email.\n",
+			ac.host,
+			ac.link("/reset-password", ac.sign(accountTokenResetPassword, userId, a.hashpass, ac.resetTTL)),
+			ac.resetTTL),
+	})
+}
+
+// Register creates an account, returning errInvalidInvite if the invite is
+// required or cannot be used. A registered email is not revealed to the
+// registrant; its owner is instead notified by email.
+func (ac *accounts) Register(c context.Context, username, email, pass, invite string) (err error) {
+	var state userState
+	switch ac.mode {
+	case RegistrationOpen:
+		state = userActive
+	case RegistrationApprovalRequired:
+		state = userPendingApproval
+		if len(invite) > 0 {
+			state = userActive
+		}
+	case RegistrationInviteOnly:
+		state = userActive
+		if len(invite) == 0 {
+			err = errInvalidInvite
+			return
+		}
+	default:
+		err = fmt.Errorf("registration is closed")
+		return
+	}
+	var existing string
+	if existing, err = ac.d.UserIDFromEmail(c, email); err != nil {
+		return
+	} else if len(existing) > 0 {
+		err = ac.sendRegisteredNotice(c, email)
+		return
+	}
+	var userId string
+	if userId, err = ac.d.RegisterUser(c, ac.scheme, ac.host, username, email, pass, invite, state); err != nil {
+		return
+	}
+	InfoLogger.Infof("Registered user %s in state %q", userId, state)
+	err = ac.SendVerification(c, userId, email)
+	return
+}
+
+// VerifyEmail marks the email of the user as verified if the token is valid
+// for their current email.
+func (ac *accounts) VerifyEmail(c context.Context, token string) (ok bool, err error) {
+	userId, binding, valid := ac.verify(accountTokenVerifyEmail, token)
+	if !valid {
+		return
+	}
+	var a userAccount
+	if a, err = ac.d.UserAccount(c, userId); err != nil {
+		return
+	} else if !hmac.Equal([]byte(binding), []byte(tokenBinding([]byte(a.email)))) {
+		return
+	}
+	if err = ac.d.SetEmailVerified(c, userId); err != nil {
+		return
+	}
+	ok = true
+	return
+}
+
+// ResendVerification sends a new verification email if the email belongs to
+// an unverified account.
+func (ac *accounts) ResendVerification(c context.Context, email string) (err error) {
+	var userId string
+	if userId, err = ac.d.UserIDFromEmail(c, email); err != nil || len(userId) == 0 {
+		return
+	}
+	var a userAccount
+	if a, err = ac.d.UserAccount(c, userId); err != nil || a.verified {
+		return
+	}
+	err = ac.SendVerification(c, userId, a.email)
+	return
+}
+
+// RequestReset sends a password reset email if the email belongs to an
+// account that can log in.
+func (ac *accounts) RequestReset(c context.Context, email string) (err error) {
+	var userId string
+	if userId, err = ac.d.UserIDFromEmail(c, email); err != nil || len(userId) == 0 {
+		return
+	}
+	var a userAccount
+	if a, err = ac.d.UserAccount(c, userId); err != nil || !a.state.CanLogin() {
+		return
+	}
+	err = ac.sendReset(c, userId, a)
+	return
+}
+
+// ResetPassword sets the new password if the token is valid for the user's
+// current password, returning the user.
+func (ac *accounts) ResetPassword(c context.Context, token, pass string) (userId string, ok bool, err error) {
+	userId, binding, valid := ac.verify(accountTokenResetPassword, token)
+	if !valid {
+		return
+	}
+	var a userAccount
+	if a, err = ac.d.UserAccount(c, userId); err != nil {
+		return
+	} else if !hmac.Equal([]byte(binding), []byte(tokenBinding(a.hashpass))) {
+		return
+	}
+	if err = ac.d.SetPassword(c, userId, pass); err != nil {
+		return
+	}
+	// Whoever knew the old password is logged out.
+	if err = ac.sl.RevokeUser(c, userId); err != nil {
+		return
+	}
+	// Receiving the email proves ownership of the address.
+	if !a.verified {
+		if err = ac.d.SetEmailVerified(c, userId); err != nil {
+			return
+		}
+	}
+	ok = true
+	return
+}
+
+// createInvite creates an invite code usable the given number of times, which
+// never expires if ttl is zero.
+func createInvite(c context.Context, d *database, createdBy string, maxUses int, ttl time.Duration) (code string, err error) {
+	if maxUses <= 0 {
+		err = fmt.Errorf("invite max uses must be positive: %d", maxUses)
+		return
+	}
+	if code, err = randomToken(inviteCodeSize); err != nil {
+		return
+	}
+	var exp time.Time
+	if ttl > 0 {
+		exp = time.Now().Add(ttl)
+	}
+	err = d.InsertInvite(c, code, createdBy, exp, maxUses)
+	return
+}
+
+func validRegistration(username, email, pass string) bool {
+	if !usernameRegexp.MatchString(username) || len(pass) < minPasswordLength {
+		return false
+	}
+	a, err := mail.ParseAddress(email)
+	return err == nil && a.Address == email
+}
+
+func getRegisterFn(mode RegistrationMode, registerWebHandler func(http.ResponseWriter, *http.Request, RegistrationMode)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		registerWebHandler(w, r, mode)
+	}
+}
+
+func postRegisterFn(ac *accounts, badRequestHandler, internalErrorHandler http.Handler) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			badRequestHandler.ServeHTTP(w, r)
+			return
+		}
+		username := r.Form.Get(RegisterFormUsernameKey)
+		email := r.Form.Get(RegisterFormEmailKey)
+		pass := r.Form.Get(RegisterFormPasswordKey)
+		invite := strings.TrimSpace(r.Form.Get(RegisterFormInviteKey))
+		if !validRegistration(username, email, pass) {
+			http.Redirect(w, r, "/register?register_error=invalid", http.StatusFound)
+			return
+		}
+		// Usernames are public, so revealing they are taken is fine.
+		if existing, err := ac.d.UserIdForUsername(r.Context(), username); err != nil {
+			ErrorLogger.Errorf("error checking username in POST register: %s", err)
+			internalErrorHandler.ServeHTTP(w, r)
+			return
+		} else if len(existing) > 0 {
+			http.Redirect(w, r, "/register?register_error=taken", http.StatusFound)
+			return
+		}
+		err := ac.Register(r.Context(), username, email, pass, invite)
+		if err == errInvalidInvite {
+			http.Redirect(w, r, "/register?register_error=invite", http.StatusFound)
+			return
+		} else if err != nil {
+			ErrorLogger.Errorf("error registering user in POST register: %s", err)
+			internalErrorHandler.ServeHTTP(w, r)
+			return
+		}
+		http.Redirect(w, r, "/register?registered=true", http.StatusFound)
+	}
+}
+
+func getVerifyEmailFn(ac *accounts, internalErrorHandler http.Handler) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ok, err := ac.VerifyEmail(r.Context(), r.URL.Query().Get("token"))
+		if err != nil {
+			ErrorLogger.Errorf("error verifying email in GET verify-email: %s", err)
+			internalErrorHandler.ServeHTTP(w, r)
+			return
+		} else if !ok {
+			http.Redirect(w, r, "/login?verify_error=true", http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, "/login?verified=true", http.StatusFound)
+	}
+}
+
+func postVerifyEmailFn(ac *accounts, badRequestHandler, internalErrorHandler http.Handler) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			badRequestHandler.ServeHTTP(w, r)
+			return
+		}
+		if err := ac.ResendVerification(r.Context(), r.Form.Get(VerifyEmailFormEmailKey)); err != nil {
+			ErrorLogger.Errorf("error resending verification in POST verify-email: %s", err)
+			internalErrorHandler.ServeHTTP(w, r)
+			return
+		}
+		http.Redirect(w, r, "/login?verification_sent=true", http.StatusFound)
+	}
+}
+
+func getResetPasswordFn(resetWebHandler func(http.ResponseWriter, *http.Request, string)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resetWebHandler(w, r, r.URL.Query().Get("token"))
+	}
+}
+
+func postResetPasswordFn(ac *accounts, badRequestHandler, internalErrorHandler http.Handler) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			badRequestHandler.ServeHTTP(w, r)
+			return
+		}
+		token := r.Form.Get(PasswordResetFormTokenKey)
+		if len(token) == 0 {
+			if err := ac.RequestReset(r.Context(), r.Form.Get(PasswordResetFormEmailKey)); err != nil {
+				ErrorLogger.Errorf("error requesting reset in POST reset-password: %s", err)
+				internalErrorHandler.ServeHTTP(w, r)
+				return
+			}
+			http.Redirect(w, r, "/reset-password?sent=true", http.StatusFound)
+			return
+		}
+		pass := r.Form.Get(PasswordResetFormPasswordKey)
+		if len(pass) < minPasswordLength {
+			http.Redirect(w, r, "/reset-password?"+url.Values{
+				"token":       []string{token},
+				"reset_error": []string{"invalid_password"},
+			}.Encode(), http.StatusFound)
+			return
+		}
+		_, ok, err := ac.ResetPassword(r.Context(), token, pass)
+		if err != nil {
+			ErrorLogger.Errorf("error resetting password in POST reset-password: %s", err)
+			internalErrorHandler.ServeHTTP(w, r)
+			return
+		} else if !ok {
+			http.Redirect(w, r, "/reset-password?reset_error=invalid_token", http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, "/login?reset=true", http.StatusFound)
+	}
+}
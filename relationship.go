@@ -0,0 +1,103 @@
+// apcore is a server framework for implementing an ActivityPub application.
+// Copyright (C) 2019 Cory Slep
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package apcore
+
+import (
+	"database/sql"
+	"net/url"
+	"time"
+)
+
+// RelationshipKind is a kind of relationship a local user has with another
+// actor or domain.
+type RelationshipKind string
+
+const (
+	// RelationshipBlock rejects the actor's activities and hides its
+	// content.
+	RelationshipBlock RelationshipKind = "block"
+	// RelationshipMute accepts the actor's activities but hides its
+	// content, optionally until an expiry.
+	RelationshipMute RelationshipKind = "mute"
+	// RelationshipDomainBlock blocks all actors on the domain.
+	RelationshipDomainBlock RelationshipKind = "domain_block"
+)
+
+// Relationship is a block, mute, or domain block of a local user.
+type Relationship struct {
+	Id         string
+	CreateTime time.Time
+	UserId     string
+	Kind       RelationshipKind
+	// Subject is an actor IRI, or a host for domain blocks.
+	Subject string
+	// Expires is the zero value if the relationship does not expire.
+	Expires time.Time
+	// ActivityIRI is the Block activity that created the relationship, if
+	// any.
+	ActivityIRI *url.URL
+}
+
+func (r *Relationship) Load(row scanner) (err error) {
+	var expires *time.Time
+	var activityIRI sql.NullString
+	if err = row.Scan(
+		&r.Id,
+		&r.CreateTime,
+		&r.UserId,
+		&r.Kind,
+		&r.Subject,
+		&expires,
+		&activityIRI); err != nil {
+		return
+	}
+	if expires != nil {
+		r.Expires = *expires
+	}
+	if activityIRI.Valid {
+		r.ActivityIRI, err = url.Parse(activityIRI.String)
+	}
+	return
+}
+
+// blockSet holds the actors and domains a user blocks, so that many actors
+// can be checked against a single query of the user's relationships.
+type blockSet struct {
+	actors  map[string]bool
+	domains map[string]bool
+}
+
+func newBlockSet(rs []Relationship) *blockSet {
+	b := &blockSet{
+		actors:  make(map[string]bool, 0),
+		domains: make(map[string]bool, 0),
+	}
+	for _, r := range rs {
+		switch r.Kind {
+		case RelationshipBlock:
+			b.actors[r.Subject] = true
+		case RelationshipDomainBlock:
+			b.domains[r.Subject] = true
+		}
+	}
+	return b
+}
+
+// blocking determines whether the actor or its domain is blocked.
+func (b *blockSet) blocking(actor *url.URL) bool {
+	return b.actors[actor.String()] || b.domains[actor.Hostname()]
+}
@@ -0,0 +1,177 @@
+// apcore is a server framework for implementing an ActivityPub application.
+// Copyright (C) 2019 Cory Slep
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package apcore
+
+import (
+	"crypto/tls"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"gopkg.in/ini.v1"
+)
+
+// certificates serves the TLS certificate loaded from the configured files,
+// which is loaded again when the configuration is reloaded.
+type certificates struct {
+	mu   *sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newCertificates(c *config) (t *certificates, err error) {
+	var cert *tls.Certificate
+	if cert, err = loadCertificate(c); err != nil {
+		return
+	}
+	t = &certificates{
+		mu:   &sync.RWMutex{},
+		cert: cert,
+	}
+	return
+}
+
+func loadCertificate(c *config) (cert *tls.Certificate, err error) {
+	var kp tls.Certificate
+	kp, err = tls.LoadX509KeyPair(c.ServerConfig.CertFile, c.ServerConfig.KeyFile)
+	if err != nil {
+		err = fmt.Errorf("failed to load TLS certificate: %s", err)
+		return
+	}
+	cert = &kp
+	return
+}
+
+// GetCertificate is used as the tls.Config GetCertificate function.
+func (t *certificates) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.cert, nil
+}
+
+// prepareReload loads the certificate of a reloaded configuration, returning a
+// function that begins serving it. Without certificate files, such as when
+// using ACME, there is nothing to reload.
+func (t *certificates) prepareReload(c *config) (apply func(), err error) {
+	if t == nil {
+		return
+	}
+	var cert *tls.Certificate
+	if cert, err = loadCertificate(c); err != nil {
+		return
+	}
+	apply = func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.cert = cert
+	}
+	return
+}
+
+// reload reloads the configuration file and applies the settings that can
+// change while serving: certificate files, outbound rate limits, collection
+// page sizes, database connection pool limits, session timeouts, and the
+// shutdown drain timeout, as well as the application's configuration if it is
+// a ConfigurationReloader.
+//
+// Every component validates its new settings, and then the application is
+// given its configuration, before anything is applied. If any of them fails,
+// the reload is abandoned and the current configuration remains in use.
+// Changes to other settings are reported as requiring a restart.
+func (s *server) reload() (err error) {
+	if s.lc.draining() {
+		err = fmt.Errorf("server is shutting down")
+		return
+	}
+	var c *config
+	var appCfg interface{}
+	if c, appCfg, err = parseConfigFile(s.configFile, s.a, s.debug); err != nil {
+		return
+	}
+	var applies []func()
+	for _, prepare := range []func(*config) (func(), error){
+		s.certs.prepareReload,
+		s.tc.prepareReload,
+		s.db.prepareReload,
+		s.sessions.prepareReload,
+		s.lc.prepareReload,
+	} {
+		var apply func()
+		if apply, err = prepare(c); err != nil {
+			return
+		} else if apply != nil {
+			applies = append(applies, apply)
+		}
+	}
+	if r, ok := s.a.(ConfigurationReloader); ok {
+		if err = r.ReloadConfiguration(appCfg); err != nil {
+			err = fmt.Errorf("application rejected its configuration: %s", err)
+			return
+		}
+		s.appConfig = appCfg
+	} else if !reflect.DeepEqual(s.appConfig, appCfg) {
+		InfoLogger.Infof("Application configuration changed, but the application cannot reload it; restart to apply it")
+	}
+	for _, apply := range applies {
+		apply()
+	}
+	reloaded := reloadableConfig(s.config, c)
+	var restart []string
+	if restart, err = changedConfigKeys(reloaded, c); err != nil {
+		return
+	} else if len(restart) > 0 {
+		InfoLogger.Infof("Restart to apply changes to: %v", restart)
+	}
+	s.config = reloaded
+	InfoLogger.Infof("Configuration reloaded")
+	return
+}
+
+// reloadableConfig copies the current configuration, replacing the settings
+// that can change while serving with those of the reloaded configuration.
+func reloadableConfig(current, reloaded *config) *config {
+	c := *current
+	c.ServerConfig.CertFile = reloaded.ServerConfig.CertFile
+	c.ServerConfig.KeyFile = reloaded.ServerConfig.KeyFile
+	c.ServerConfig.SessionIdleTimeoutSeconds = reloaded.ServerConfig.SessionIdleTimeoutSeconds
+	c.ServerConfig.SessionAbsoluteTimeoutSeconds = reloaded.ServerConfig.SessionAbsoluteTimeoutSeconds
+	c.ServerConfig.ShutdownDrainTimeoutSeconds = reloaded.ServerConfig.ShutdownDrainTimeoutSeconds
+	c.ActivityPubConfig.OutboundRateLimitQPS = reloaded.ActivityPubConfig.OutboundRateLimitQPS
+	c.ActivityPubConfig.OutboundRateLimitBurst = reloaded.ActivityPubConfig.OutboundRateLimitBurst
+	c.DatabaseConfig.DefaultCollectionPageSize = reloaded.DatabaseConfig.DefaultCollectionPageSize
+	c.DatabaseConfig.ConnMaxLifetimeSeconds = reloaded.DatabaseConfig.ConnMaxLifetimeSeconds
+	c.DatabaseConfig.MaxOpenConns = reloaded.DatabaseConfig.MaxOpenConns
+	c.DatabaseConfig.MaxIdleConns = reloaded.DatabaseConfig.MaxIdleConns
+	return &c
+}
+
+// changedConfigKeys lists the keys whose values differ between configurations.
+func changedConfigKeys(a, b *config) (keys []string, err error) {
+	fa, fb := ini.Empty(), ini.Empty()
+	if err = ini.ReflectFrom(fa, a); err != nil {
+		return
+	} else if err = ini.ReflectFrom(fb, b); err != nil {
+		return
+	}
+	for _, sec := range fb.Sections() {
+		for _, k := range sec.Keys() {
+			if fa.Section(sec.Name()).Key(k.Name()).String() != k.String() {
+				keys = append(keys, k.Name())
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,221 @@
+// apcore is a server framework for implementing an ActivityPub application.
+// Copyright (C) 2019 Cory Slep
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package apcore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/go-fed/activity/pub"
+	"github.com/go-fed/activity/streams/vocab"
+)
+
+// ReportStatus is the state of a report in the moderation queue.
+type ReportStatus string
+
+const (
+	ReportOpen      ReportStatus = "open"
+	ReportResolved  ReportStatus = "resolved"
+	ReportDismissed ReportStatus = "dismissed"
+)
+
+// Report is a moderation report about an actor and its content. It is either
+// received in a federated Flag activity or created by a local user.
+type Report struct {
+	Id         string
+	CreateTime time.Time
+	// FlagIRI is the Flag activity of the report, if any.
+	FlagIRI *url.URL
+	// ReporterIRI is the actor filing the report. For remote reports it is
+	// often an instance actor rather than the person reporting.
+	ReporterIRI *url.URL
+	// ReporterUserId is set only for reports made by local users.
+	ReporterUserId string
+	ReportedIRI    *url.URL
+	Objects        []*url.URL
+	Content        string
+	// Forward is whether the report was forwarded to the reported actor's
+	// instance.
+	Forward        bool
+	Status         ReportStatus
+	AssigneeUserId string
+	Notes          string
+}
+
+func (r *Report) Load(row scanner) (err error) {
+	var flagIRI, reporterUserId, assigneeUserId sql.NullString
+	var reporterIRI, reportedIRI string
+	var objects []byte
+	if err = row.Scan(
+		&r.Id,
+		&r.CreateTime,
+		&flagIRI,
+		&reporterIRI,
+		&reporterUserId,
+		&reportedIRI,
+		&objects,
+		&r.Content,
+		&r.Forward,
+		&r.Status,
+		&assigneeUserId,
+		&r.Notes); err != nil {
+		return
+	}
+	if flagIRI.Valid {
+		if r.FlagIRI, err = url.Parse(flagIRI.String); err != nil {
+			return
+		}
+	}
+	if r.ReporterIRI, err = url.Parse(reporterIRI); err != nil {
+		return
+	}
+	if r.ReportedIRI, err = url.Parse(reportedIRI); err != nil {
+		return
+	}
+	r.ReporterUserId = reporterUserId.String
+	r.AssigneeUserId = assigneeUserId.String
+	var objs []string
+	if err = json.Unmarshal(objects, &objs); err != nil {
+		return
+	}
+	for _, o := range objs {
+		var u *url.URL
+		if u, err = url.Parse(o); err != nil {
+			return
+		}
+		r.Objects = append(r.Objects, u)
+	}
+	return
+}
+
+func (r Report) objectsJSON() (b []byte, err error) {
+	objs := make([]string, 0, len(r.Objects))
+	for _, o := range r.Objects {
+		objs = append(objs, o.String())
+	}
+	return json.Marshal(objs)
+}
+
+// ReportResolution is an administrator's decision on a report.
+type ReportResolution struct {
+	Status         ReportStatus
+	AssigneeUserId string
+	Notes          string
+	// PolicyKind optionally creates an instance policy against the
+	// reported actor. Instance kinds (such as "instance_deny" or
+	// "instance_silence") apply to the reported actor's host, while actor
+	// kinds (such as "actor_deny") apply to the reported actor itself.
+	PolicyKind string
+}
+
+// newReportFromFlag extracts a report from a Flag activity. The reported actor
+// is the first object, as is conventional in the Fediverse.
+func newReportFromFlag(flag vocab.ActivityStreamsFlag) (r Report, err error) {
+	if r.FlagIRI, err = pub.GetId(flag); err != nil {
+		return
+	}
+	ap := flag.GetActivityStreamsActor()
+	if ap == nil || ap.Len() == 0 {
+		err = fmt.Errorf("flag has no actor")
+		return
+	}
+	if r.ReporterIRI, err = pub.ToId(ap.At(0)); err != nil {
+		return
+	}
+	op := flag.GetActivityStreamsObject()
+	if op == nil || op.Len() == 0 {
+		err = fmt.Errorf("flag has no object")
+		return
+	}
+	for iter := op.Begin(); iter != op.End(); iter = iter.Next() {
+		var id *url.URL
+		if id, err = pub.ToId(iter); err != nil {
+			return
+		}
+		r.Objects = append(r.Objects, id)
+	}
+	r.ReportedIRI = r.Objects[0]
+	if cp := flag.GetActivityStreamsContent(); cp != nil {
+		for iter := cp.Begin(); iter != cp.End(); iter = iter.Next() {
+			if iter.IsXMLSchemaString() {
+				r.Content = iter.GetXMLSchemaString()
+				break
+			}
+		}
+	}
+	r.Status = ReportOpen
+	return
+}
+
+// reportPolicy creates the policy requested in the resolution of the report,
+// ordering it after the existing instance policies.
+func reportPolicy(c context.Context, db *database, r Report, kind string) (p policy, err error) {
+	p = policy{
+		IsInstancePolicy: true,
+		Public:           true,
+		Kind:             kind,
+		Description:      fmt.Sprintf("Created resolving report %s", r.Id),
+	}
+	switch kind {
+	case instanceGrant, instanceDeny, instanceSilence, instanceRejectMedia, instanceQuarantine:
+		p.Subject = r.ReportedIRI.Host
+	case actorGrant, actorDeny:
+		p.Subject = r.ReportedIRI.String()
+	default:
+		err = fmt.Errorf("cannot create policy of kind %q for report", kind)
+		return
+	}
+	var ip policies
+	if ip, err = db.InstancePolicies(c); err != nil {
+		return
+	}
+	for _, existing := range ip {
+		if existing.Order >= p.Order {
+			p.Order = existing.Order + 1
+		}
+	}
+	return
+}
+
+// applyReportResolution applies an administrator's resolution to a report.
+func applyReportResolution(c context.Context, db *database, id string, res ReportResolution) (err error) {
+	switch res.Status {
+	case ReportOpen, ReportResolved, ReportDismissed:
+	default:
+		err = fmt.Errorf("unknown report status: %q", res.Status)
+		return
+	}
+	var r Report
+	if r, err = db.ReportById(c, id); err != nil {
+		return
+	}
+	if len(res.PolicyKind) > 0 {
+		var p policy
+		if p, err = reportPolicy(c, db, r, res.PolicyKind); err != nil {
+			return
+		}
+		if err = db.InsertPolicy(c, p); err != nil {
+			return
+		}
+	}
+	err = db.UpdateReport(c, id, res.Status, res.AssigneeUserId, res.Notes)
+	return
+}
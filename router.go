@@ -17,8 +17,10 @@
 package apcore
 
 import (
+	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/go-fed/activity/pub"
 	"github.com/go-fed/activity/streams/vocab"
@@ -31,33 +33,42 @@ type Router struct {
 	router            *mux.Router
 	db                *apdb
 	oauth             *oAuth2Server
+	sl                *sessions
 	actor             pub.Actor
 	clock             pub.Clock
 	host              string
 	scheme            string
 	errorHandler      http.Handler
 	badRequestHandler http.Handler
+	tc                *transportController
+	authorizedFetch   bool
 }
 
 func newRouter(router *mux.Router,
 	db *apdb,
 	oauth *oAuth2Server,
+	sl *sessions,
 	actor pub.Actor,
 	clock pub.Clock,
 	host string,
 	scheme string,
 	errorHandler http.Handler,
-	badRequestHandler http.Handler) *Router {
+	badRequestHandler http.Handler,
+	tc *transportController,
+	authorizedFetch bool) *Router {
 	return &Router{
 		router:            router,
 		db:                db,
 		oauth:             oauth,
+		sl:                sl,
 		actor:             actor,
 		clock:             clock,
 		host:              host,
 		scheme:            scheme,
 		errorHandler:      errorHandler,
 		badRequestHandler: badRequestHandler,
+		tc:                tc,
+		authorizedFetch:   authorizedFetch,
 	}
 }
 
@@ -66,6 +77,7 @@ func (r *Router) wrap(route *mux.Route) *Route {
 		route:             route,
 		db:                r.db,
 		oauth:             r.oauth,
+		sl:                r.sl,
 		actor:             r.actor,
 		clock:             r.clock,
 		host:              r.host,
@@ -73,6 +85,9 @@ func (r *Router) wrap(route *mux.Route) *Route {
 		errorHandler:      r.errorHandler,
 		badRequestHandler: r.badRequestHandler,
 		notFoundHandler:   r.router.NotFoundHandler,
+		tc:                r.tc,
+		authorizedFetch:   r.authorizedFetch,
+		csrf:              true,
 	}
 }
 
@@ -108,16 +123,24 @@ func (r *Router) HandleAccessTokenRequest(path string) *Route {
 	return r.wrap(r.router.NewRoute()).HandleAccessTokenRequest(path)
 }
 
+func (r *Router) RequireScopes(scopes ...string) *Route {
+	return r.wrap(r.router.NewRoute()).RequireScopes(scopes...)
+}
+
 func (r *Router) Get(name string) *Route {
 	return r.wrap(r.router.Get(name))
 }
 
+// WebOnlyHandle registers a web route. State-changing requests to it must
+// include the CSRF token of the session, see CSRFToken.
 func (r *Router) WebOnlyHandle(path string, handler http.Handler) *Route {
-	return r.wrap(r.router.Handle(path, handler))
+	return r.wrap(r.router.NewRoute()).WebOnlyHandler(path, handler)
 }
 
+// WebOnlyHandleFunc registers a web route. State-changing requests to it must
+// include the CSRF token of the session, see CSRFToken.
 func (r *Router) WebOnlyHandleFunc(path string, f func(http.ResponseWriter, *http.Request)) *Route {
-	return r.wrap(r.router.HandleFunc(path, f))
+	return r.wrap(r.router.NewRoute()).WebOnlyHandlerFunc(path, f)
 }
 
 func (r *Router) Handle(path string, handler http.Handler) *Route {
@@ -183,6 +206,141 @@ type Route struct {
 	errorHandler      http.Handler
 	badRequestHandler http.Handler
 	notFoundHandler   http.Handler
+	tc                *transportController
+	authorizedFetch   bool
+	requiredScopes    []string
+	sl                *sessions
+	csrf              bool
+}
+
+// RequireScopes restricts the route to requests bearing an OAuth2 access token
+// granted all of the scopes. It must be called before the handler is set.
+func (r *Route) RequireScopes(scopes ...string) *Route {
+	r.requiredScopes = append(r.requiredScopes, scopes...)
+	return r
+}
+
+// enforceScopes wraps the route's handler to check the required scopes,
+// responding per RFC 6750 Section 3.1 when they are not granted.
+func (r *Route) enforceScopes() {
+	if len(r.requiredScopes) == 0 {
+		return
+	}
+	required := append([]string{}, r.requiredScopes...)
+	next := r.route.GetHandler()
+	r.route = r.route.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t, authenticated, err := r.oauth.ValidateOAuth2AccessToken(w, req)
+		if err != nil {
+			ErrorLogger.Errorf("Error validating OAuth2 token for required scopes: %s", err)
+			r.errorHandler.ServeHTTP(w, req)
+			return
+		} else if !authenticated {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		} else if !scopeGrants(t.GetScope(), required...) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer error=\"insufficient_scope\", scope=%q", strings.Join(required, " ")))
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// protectCSRF wraps the route's handler to require the CSRF token of the
+// session on state-changing requests.
+func (r *Route) protectCSRF() {
+	if !r.csrf {
+		return
+	}
+	r.route = r.route.Handler(csrfProtect(r.sl, r.errorHandler, r.route.GetHandler()))
+}
+
+// withoutCSRF exempts the route from CSRF protection, for endpoints fetched by
+// other servers that neither use nor need a session. It must be called before
+// the handler is set.
+func (r *Route) withoutCSRF() *Route {
+	r.csrf = false
+	return r
+}
+
+// withoutAuthorizedFetch exempts the route from requiring HTTP Signatures on
+// ActivityStreams GET requests, so that peers can fetch actors and their keys.
+func (r *Route) withoutAuthorizedFetch() *Route {
+	r.authorizedFetch = false
+	return r
+}
+
+// checkAuthorizedFetch verifies the HTTP Signature of an ActivityStreams GET
+// request when authorized fetch is enabled, and applies the instance and user
+// policies to the signing actor. The verified actor is placed in the context.
+//
+// Requests already authenticated with an OAuth2 token are not checked.
+func (r *Route) checkAuthorizedFetch(c *ctx, req *http.Request) (permit bool, err error) {
+	permit = true
+	if !r.authorizedFetch || !isActivityStreamsGet(req) {
+		return
+	} else if _, err = c.UserAuthUUID(); err == nil {
+		return
+	}
+	err = nil
+	var authenticated bool
+	var actorIRI *url.URL
+	authenticated, actorIRI, err = verifyHttpSignaturesForFetch(c.Context, req, r.host, r.tc)
+	if err != nil || !authenticated {
+		if err != nil {
+			InfoLogger.Infof("Denying unverified fetch of %s: %s", req.URL, err)
+		}
+		err = nil
+		permit = false
+		return
+	}
+	var p policies
+	if p, err = r.db.InstancePolicies(c.Context); err != nil {
+		return
+	}
+	if username, ok := Vars(req)["user"]; ok {
+		var userId string
+		if userId, err = r.db.UserIdForUsername(c.Context, username); err != nil {
+			return
+		} else if len(userId) == 0 {
+			// No such user, so there is nothing to fetch.
+			permit = false
+			return
+		}
+		var up policies
+		if up, err = r.db.UserPolicies(c.Context, userId); err != nil {
+			return
+		}
+		p = append(p, up...)
+	}
+	var target *url.URL
+	if target, err = c.CompleteRequestURL(); err != nil {
+		return
+	}
+	if p.IsFetchBlocked(actorIRI, target) {
+		permit = false
+		return
+	}
+	c.withSignedActorIRI(actorIRI)
+	return
+}
+
+// canReceive determines whether the state of the user owning the inbox
+// permits delivery.
+func (r *Route) canReceive(c ctx) (canReceive bool, err error) {
+	var userId string
+	if userId, err = c.UserPathUUID(); err != nil {
+		return
+	} else if len(userId) == 0 {
+		return
+	}
+	var state userState
+	if state, err = r.db.UserState(c.Context, userId); err != nil {
+		return
+	}
+	canReceive = state.CanReceive()
+	return
 }
 
 func (r *Route) actorPostInbox(path, scheme string) *Route {
@@ -194,6 +352,14 @@ func (r *Route) actorPostInbox(path, scheme string) *Route {
 				r.errorHandler.ServeHTTP(w, req)
 				return
 			}
+			if canReceive, err := r.canReceive(c); err != nil {
+				ErrorLogger.Errorf("Error determining user state for ActorPostInbox: %s", err)
+				r.errorHandler.ServeHTTP(w, req)
+				return
+			} else if !canReceive {
+				r.notFoundHandler.ServeHTTP(w, req)
+				return
+			}
 			isApRequest, err := r.actor.PostInbox(c.Context, w, req)
 			if err != nil {
 				ErrorLogger.Errorf("Error in ActorPostInbox: %s", err)
@@ -240,6 +406,14 @@ func (r *Route) actorGetInbox(path, scheme string, web func(w http.ResponseWrite
 				r.errorHandler.ServeHTTP(w, req)
 				return
 			}
+			if permit, err := r.checkAuthorizedFetch(&c, req); err != nil {
+				ErrorLogger.Errorf("Error checking authorized fetch for ActorGetInbox: %s", err)
+				r.errorHandler.ServeHTTP(w, req)
+				return
+			} else if !permit {
+				r.notFoundHandler.ServeHTTP(w, req)
+				return
+			}
 			isApRequest, err := r.actor.GetInbox(c.Context, w, req)
 			if err != nil {
 				ErrorLogger.Errorf("Error in ActorGetInbox: %s", err)
@@ -277,6 +451,14 @@ func (r *Route) actorGetOutbox(path, scheme string, web func(w http.ResponseWrit
 				r.errorHandler.ServeHTTP(w, req)
 				return
 			}
+			if permit, err := r.checkAuthorizedFetch(&c, req); err != nil {
+				ErrorLogger.Errorf("Error checking authorized fetch for ActorGetOutbox: %s", err)
+				r.errorHandler.ServeHTTP(w, req)
+				return
+			} else if !permit {
+				r.notFoundHandler.ServeHTTP(w, req)
+				return
+			}
 			isApRequest, err := r.actor.GetOutbox(c.Context, w, req)
 			if err != nil {
 				ErrorLogger.Errorf("Error in ActorGetOutbox: %s", err)
@@ -315,8 +497,13 @@ func (r *Route) ActivityPubOnlyHandleFunc(path string, authFn AuthorizeFunc) *Ro
 				r.errorHandler.ServeHTTP(w, req)
 				return
 			}
-			permit := true
-			if authFn != nil {
+			permit, err := r.checkAuthorizedFetch(&c, req)
+			if err != nil {
+				ErrorLogger.Errorf("Error in ActivityPubOnlyHandleFunc checkAuthorizedFetch: %s", err)
+				r.errorHandler.ServeHTTP(w, req)
+				return
+			}
+			if permit && authFn != nil {
 				permit, err = authFn(c, w, req, r.db)
 				if err != nil {
 					ErrorLogger.Errorf("Error in ActivityPubOnlyHandleFunc authFn: %s", err)
@@ -340,6 +527,7 @@ func (r *Route) ActivityPubOnlyHandleFunc(path string, authFn AuthorizeFunc) *Ro
 			}
 			return
 		})
+	r.enforceScopes()
 	return r
 }
 
@@ -353,8 +541,13 @@ func (r *Route) ActivityPubAndWebHandleFunc(path string, authFn AuthorizeFunc, f
 				r.errorHandler.ServeHTTP(w, req)
 				return
 			}
-			permit := true
-			if authFn != nil {
+			permit, err := r.checkAuthorizedFetch(&c, req)
+			if err != nil {
+				ErrorLogger.Errorf("Error in ActivityPubAndWebHandleFunc checkAuthorizedFetch: %s", err)
+				r.errorHandler.ServeHTTP(w, req)
+				return
+			}
+			if permit && authFn != nil {
 				permit, err = authFn(c, w, req, r.db)
 				if err != nil {
 					ErrorLogger.Errorf("Error in ActivityPubAndWebHandleFunc authFn: %s", err)
@@ -378,6 +571,7 @@ func (r *Route) ActivityPubAndWebHandleFunc(path string, authFn AuthorizeFunc, f
 			}
 			return
 		})
+	r.enforceScopes()
 	return r
 }
 
@@ -393,21 +587,27 @@ func (r *Route) HandleAccessTokenRequest(path string) *Route {
 
 func (r *Route) WebOnlyHandler(path string, handler http.Handler) *Route {
 	r.route = r.route.Path(path).Handler(handler)
+	r.protectCSRF()
+	r.enforceScopes()
 	return r
 }
 
 func (r *Route) WebOnlyHandlerFunc(path string, f func(http.ResponseWriter, *http.Request)) *Route {
 	r.route = r.route.Path(path).HandlerFunc(f)
+	r.protectCSRF()
+	r.enforceScopes()
 	return r
 }
 
 func (r *Route) Handler(handler http.Handler) *Route {
 	r.route = r.route.Handler(handler)
+	r.enforceScopes()
 	return r
 }
 
 func (r *Route) HandlerFunc(f func(http.ResponseWriter, *http.Request)) *Route {
 	r.route = r.route.HandlerFunc(f)
+	r.enforceScopes()
 	return r
 }
 
@@ -0,0 +1,162 @@
+// apcore is a server framework for implementing an ActivityPub application.
+// Copyright (C) 2019 Cory Slep
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package apcore
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Built-in OAuth2 scopes.
+const (
+	// ScopeReadInbox permits viewing the private messages of the user's
+	// inbox.
+	ScopeReadInbox = "read:inbox"
+	// ScopeReadOutbox permits viewing the private messages of the user's
+	// outbox.
+	ScopeReadOutbox = "read:outbox"
+	// ScopeWriteOutbox permits posting to the user's outbox when C2S is
+	// enabled.
+	ScopeWriteOutbox = "write:outbox"
+	// ScopeAdmin permits administrative actions, and can only be granted by
+	// administrators.
+	ScopeAdmin = "admin"
+	// ScopeOpenID requests an OpenID Connect ID token identifying the user.
+	ScopeOpenID = "openid"
+	// ScopeProfile permits reading the user's name, username, and icon
+	// through OpenID Connect.
+	ScopeProfile = "profile"
+)
+
+// Scope is an OAuth2 scope that clients can request and users can grant.
+type Scope struct {
+	// Name is the scope as it appears in OAuth2 requests, and cannot
+	// contain spaces.
+	Name string
+	// Description is shown to users when they are asked to consent.
+	Description string
+	// WithoutUser permits granting the scope to a client acting on its
+	// own behalf through the client credentials grant. Built-in scopes act
+	// for a user and are never granted without one.
+	WithoutUser bool
+}
+
+var builtinScopes = []Scope{
+	{
+		Name:        ScopeReadInbox,
+		Description: "Read your private inbox",
+	},
+	{
+		Name:        ScopeReadOutbox,
+		Description: "Read your private outbox",
+	},
+	{
+		Name:        ScopeWriteOutbox,
+		Description: "Post on your behalf",
+	},
+	{
+		Name:        ScopeAdmin,
+		Description: "Administer this server",
+	},
+	{
+		Name:        ScopeOpenID,
+		Description: "Sign you in with your account",
+	},
+	{
+		Name:        ScopeProfile,
+		Description: "Read your name, username, and avatar",
+	},
+}
+
+// scopes is the registry of the built-in and application scopes.
+type scopes struct {
+	ordered []Scope
+	byName  map[string]Scope
+}
+
+func newScopes(app []Scope) (s *scopes, err error) {
+	s = &scopes{
+		byName: make(map[string]Scope, len(builtinScopes)+len(app)),
+	}
+	for _, sc := range append(append([]Scope{}, builtinScopes...), app...) {
+		if len(sc.Name) == 0 || strings.ContainsAny(sc.Name, " \t\n\"\\") {
+			err = fmt.Errorf("invalid scope name: %q", sc.Name)
+			return
+		} else if _, ok := s.byName[sc.Name]; ok {
+			err = fmt.Errorf("scope registered more than once: %s", sc.Name)
+			return
+		}
+		s.ordered = append(s.ordered, sc)
+		s.byName[sc.Name] = sc
+	}
+	return
+}
+
+// All returns every registered scope in registration order.
+func (s *scopes) All() []Scope {
+	return append([]Scope{}, s.ordered...)
+}
+
+// Parse converts a space-delimited scope string into registered scopes,
+// erroring on unknown ones.
+func (s *scopes) Parse(scope string) (sc []Scope, err error) {
+	for _, name := range strings.Fields(scope) {
+		if v, ok := s.byName[name]; !ok {
+			err = fmt.Errorf("unknown scope: %s", name)
+			return
+		} else {
+			sc = append(sc, v)
+		}
+	}
+	return
+}
+
+// UserBound determines whether the space-delimited scope string contains a
+// scope that can only be granted for a user. Unknown scopes are user-bound.
+func (s *scopes) UserBound(scope string) bool {
+	for _, name := range strings.Fields(scope) {
+		if v, ok := s.byName[name]; !ok || !v.WithoutUser {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate errors if any of the names is not a registered scope.
+func (s *scopes) Validate(names []string) (err error) {
+	_, err = s.Parse(strings.Join(names, " "))
+	return
+}
+
+// scopeGrants determines whether a granted, space-delimited scope string
+// contains all of the required scopes.
+func scopeGrants(granted string, required ...string) bool {
+	have := strings.Fields(granted)
+	for _, r := range required {
+		found := false
+		for _, h := range have {
+			if h == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
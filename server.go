@@ -24,34 +24,43 @@ import (
 	"time"
 
 	"github.com/go-fed/activity/pub"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 type server struct {
-	certFile    string
-	keyFile     string
+	configFile  string
+	appConfig   interface{}
+	certs       *certificates
 	a           Application
 	oa          *oAuth2Server
 	actor       pub.Actor
 	handler     *handler
 	db          *database
+	p           *paths
+	tc          *transportController
 	sessions    *sessions
+	deleter     *userDeleter
+	purger      *tokenPurger
+	lc          *lifecycle
 	config      *config
 	httpServer  *http.Server
 	httpsServer *http.Server
-	debug       bool // TODO: http only, no https
+	debug       bool
+	// plain serves HTTP without TLS or the redirect server, in debug and
+	// reverse proxy modes
+	plain bool
 }
 
 func newServer(configFileName string, a Application, debug bool, scheme string) (s *server, err error) {
 	// Load the configuration
 	var c *config
-	c, err = loadConfigFile(configFileName, a, debug)
+	var appCfg interface{}
+	c, appCfg, err = parseConfigFile(configFileName, a, debug)
 	if err != nil {
 		return
 	}
-
-	// Enforce server level configuration
-	if c.ServerConfig.RSAKeySize < minKeySize {
-		err = fmt.Errorf("RSA private key size is configured to be < %d, which is forbidden: %d", minKeySize, c.ServerConfig.RSAKeySize)
+	err = a.SetConfiguration(appCfg)
+	if err != nil {
 		return
 	}
 
@@ -64,14 +73,28 @@ func newServer(configFileName string, a Application, debug bool, scheme string)
 
 	// Prepare sessions
 	var ses *sessions
-	ses, err = newSessions(c)
+	ses, err = newSessions(c, db, debug)
+	if err != nil {
+		return
+	}
+
+	// Prepare login throttling
+	var lg *loginGuard
+	lg, err = newLoginGuard(c, db)
+	if err != nil {
+		return
+	}
+
+	// Prepare registration and account emails
+	var ac *accounts
+	ac, err = newAccounts(c, a, scheme, db, ses)
 	if err != nil {
 		return
 	}
 
 	// Prepare OAuth2 server
 	var oa *oAuth2Server
-	oa, err = newOAuth2Server(c, a, db, ses)
+	oa, err = newOAuth2Server(c, scheme, a, db, ses, lg)
 	if err != nil {
 		return
 	}
@@ -92,8 +115,14 @@ func newServer(configFileName string, a Application, debug bool, scheme string)
 	var apdb *apdb
 	apdb = newApdb(db, a)
 
+	var lc *lifecycle
+	lc, err = newLifecycle(c)
+	if err != nil {
+		return
+	}
+
 	var tc *transportController
-	tc, err = newTransportController(c, a, clock, httpClient, db)
+	tc, err = newTransportController(c, a, clock, httpClient, db, lc)
 	if err != nil {
 		return
 	}
@@ -104,44 +133,104 @@ func newServer(configFileName string, a Application, debug bool, scheme string)
 		return
 	}
 
+	var deleter *userDeleter
+	deleter, err = newUserDeleter(c, a, apdb, p, tc, clock)
+	if err != nil {
+		return
+	}
+
+	var purger *tokenPurger
+	purger, err = newTokenPurger(c, db, ses)
+	if err != nil {
+		return
+	}
+
 	// Build application routes
 	var h *handler
-	h, err = newHandler(scheme, c, a, actor, apdb, oa, ses, clock, debug)
+	h, err = newHandler(scheme, c, a, actor, apdb, oa, ses, lg, ac, clock, tc, debug)
+	if err != nil {
+		return
+	}
+
+	var fh *forwardedHeaders
+	fh, err = newForwardedHeaders(c, debug)
 	if err != nil {
 		return
 	}
 
 	// Prepare HTTPS server. No option to run the server as HTTP in prod,
-	// because we're living in the future.
+	// unless a reverse proxy terminates TLS, because we're living in the
+	// future.
 	httpsServer := &http.Server{
-		Addr:         ":" + scheme,
-		Handler:      h.Handler(),
+		Addr:         c.ServerConfig.ListenAddress,
+		Handler:      fh.Handler(h.Handler()),
 		ReadTimeout:  time.Duration(c.ServerConfig.HttpsReadTimeoutSeconds) * time.Second,
 		WriteTimeout: time.Duration(c.ServerConfig.HttpsWriteTimeoutSeconds) * time.Second,
 		TLSConfig:    createTlsConfig(),
 		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler), 0),
 	}
-	// Prepare redirection server. HTTP is only allowed to redirect.
-	httpServer := createRedirectServer(c)
+	// Prepare redirection server. HTTP is only allowed to redirect, and to
+	// answer ACME HTTP-01 challenges.
+	var httpServer *http.Server
+	var certs *certificates
+	plain := debug || c.ServerConfig.ReverseProxy
+	if plain {
+		httpsServer.TLSConfig = nil
+		httpsServer.TLSNextProto = nil
+	}
+	if debug {
+		// Developers get plain HTTP on localhost instead.
+		httpsServer.Addr = c.ServerConfig.DebugAddress
+	} else if c.ServerConfig.ReverseProxy {
+		if len(httpsServer.Addr) == 0 {
+			httpsServer.Addr = defaultReverseProxyAddress
+		}
+		InfoLogger.Infof("Serving plain HTTP behind a reverse proxy")
+	} else {
+		if len(httpsServer.Addr) == 0 {
+			httpsServer.Addr = ":https"
+		}
+		httpServer = createRedirectServer(c)
+		if c.ServerConfig.ACMEEnabled {
+			var m *autocert.Manager
+			if m, err = newACMEManager(c); err != nil {
+				return
+			}
+			httpsServer.TLSConfig = acmeTLSConfig(m)
+			httpServer.Handler = m.HTTPHandler(httpServer.Handler)
+			InfoLogger.Infof("Obtaining certificates for %s with ACME", c.ServerConfig.Host)
+		} else {
+			// Served from memory, so that reloading the
+			// configuration can replace the certificate.
+			if certs, err = newCertificates(c); err != nil {
+				return
+			}
+			httpsServer.TLSConfig.GetCertificate = certs.GetCertificate
+		}
+	}
 
 	// Create the apcore server
 	s = &server{
-		certFile:    c.ServerConfig.CertFile,
-		keyFile:     c.ServerConfig.KeyFile,
+		configFile:  configFileName,
+		appConfig:   appCfg,
+		certs:       certs,
 		a:           a,
 		oa:          oa,
 		actor:       actor,
 		handler:     h,
 		db:          db,
+		p:           p,
+		tc:          tc,
 		sessions:    ses,
+		deleter:     deleter,
+		purger:      purger,
+		lc:          lc,
 		config:      c,
 		httpServer:  httpServer,
 		httpsServer: httpsServer,
 		debug:       debug,
+		plain:       plain,
 	}
-
-	// Post-creation hooks
-	httpsServer.RegisterOnShutdown(s.onStop)
 	return
 }
 
@@ -164,8 +253,12 @@ func createTlsConfig() *tls.Config {
 }
 
 func createRedirectServer(c *config) *http.Server {
+	addr := c.ServerConfig.RedirectListenAddress
+	if len(addr) == 0 {
+		addr = ":http"
+	}
 	return &http.Server{
-		Addr:         ":http",
+		Addr:         addr,
 		ReadTimeout:  time.Duration(c.ServerConfig.RedirectReadTimeoutSeconds) * time.Second,
 		WriteTimeout: time.Duration(c.ServerConfig.RedirectWriteTimeoutSeconds) * time.Second,
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
@@ -175,29 +268,72 @@ func createRedirectServer(c *config) *http.Server {
 	}
 }
 
+// start runs the server until it is stopped. Each component is registered with
+// the lifecycle as it starts, so shutdown stops them in the reverse order.
 func (s *server) start() error {
+	defer s.lc.shutdown()
 	err := s.db.Open()
 	if err != nil {
 		return err
 	}
+	s.lc.register("database", func(c context.Context) error {
+		return s.db.Close()
+	})
+	nTokens, nClients, err := s.db.MigrateOAuth2Secrets(context.Background())
+	if err != nil {
+		return err
+	} else if nTokens > 0 || nClients > 0 {
+		InfoLogger.Infof("Hashed %d plaintext OAuth2 tokens and %d client secrets", nTokens, nClients)
+	}
 	InfoLogger.Infof("Starting application")
 	err = s.a.Start()
 	if err != nil {
 		return err
 	}
+	s.lc.register("application", func(c context.Context) error {
+		return s.a.Stop()
+	})
+	// Deliveries are waited on once nothing else can start new ones.
+	s.lc.register("in-flight deliveries", s.lc.wait)
+	s.tc.retryPending(s.p)
+	s.deleter.start()
+	s.lc.register("user deletion", func(c context.Context) error {
+		s.deleter.stop()
+		return nil
+	})
+	s.purger.start()
+	s.lc.register("expired token and session purging", func(c context.Context) error {
+		s.purger.stop()
+		return nil
+	})
+	if s.lc.draining() {
+		// Stopped while starting up.
+		return nil
+	}
+	if s.plain {
+		s.lc.register("http server", shutdownServer(s.httpsServer))
+		InfoLogger.Infof("Launching http server on %s", s.httpsServer.Addr)
+		err = listenAndServe(s.httpsServer, false)
+		if err != http.ErrServerClosed {
+			ErrorLogger.Errorf("Error shutting down http server: %s", err)
+		} else {
+			InfoLogger.Infof("HTTP server shutdown")
+		}
+		return nil
+	}
+	s.lc.register("http redirect server", shutdownServer(s.httpServer))
 	go func() {
-		InfoLogger.Infof("Starting http redirection server")
-		err := s.httpServer.ListenAndServe()
+		InfoLogger.Infof("Starting http redirection server on %s", s.httpServer.Addr)
+		err := listenAndServe(s.httpServer, false)
 		if err != http.ErrServerClosed {
 			ErrorLogger.Errorf("Error shutting down http redirect server: %s", err)
 		} else {
 			InfoLogger.Infof("Http redirect server shutdown")
 		}
 	}()
-	InfoLogger.Infof("Launching https server")
-	err = s.httpsServer.ListenAndServeTLS(
-		s.certFile,
-		s.keyFile)
+	s.lc.register("https server", shutdownServer(s.httpsServer))
+	InfoLogger.Infof("Launching https server on %s", s.httpsServer.Addr)
+	err = listenAndServe(s.httpsServer, true)
 	if err != http.ErrServerClosed {
 		ErrorLogger.Errorf("Error shutting down https server: %s", err)
 	} else {
@@ -206,20 +342,19 @@ func (s *server) start() error {
 	return nil
 }
 
+// stop gracefully shuts down the server, returning once it is stopped.
 func (s *server) stop() {
-	InfoLogger.Infof("Shutdown HTTPS server")
-	s.httpsServer.Shutdown(context.Background())
+	s.lc.shutdown()
 }
 
-func (s *server) onStop() {
-	InfoLogger.Infof("Shutdown HTTP server")
-	s.httpServer.Shutdown(context.Background())
-	InfoLogger.Infof("Stop application")
-	if err := s.a.Stop(); err != nil {
-		ErrorLogger.Errorf("Error shutting down application: %s", err)
-	}
-	InfoLogger.Infof("Close database")
-	if err := s.db.Close(); err != nil {
-		ErrorLogger.Errorf("Error closing database: %s", err)
+// shutdownServer gracefully shuts down an HTTP server, closing any connections
+// still active once the drain timeout elapses.
+func shutdownServer(h *http.Server) func(c context.Context) error {
+	return func(c context.Context) error {
+		err := h.Shutdown(c)
+		if err != nil {
+			h.Close()
+		}
+		return err
 	}
 }
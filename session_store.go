@@ -0,0 +1,180 @@
+// apcore is a server framework for implementing an ActivityPub application.
+// Copyright (C) 2019 Cory Slep
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package apcore
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// UserSession describes a session in which a user is logged in.
+type UserSession struct {
+	Id         string
+	CreateTime time.Time
+	LastSeen   time.Time
+	UserAgent  string
+	IP         string
+}
+
+func (u *UserSession) Load(row scanner) error {
+	return row.Scan(&u.Id, &u.CreateTime, &u.LastSeen, &u.UserAgent, &u.IP)
+}
+
+// sessionRecord is a session as kept in a sessionStore. The id is the keyed
+// hash of the token in the cookie.
+type sessionRecord struct {
+	id        string
+	userId    string
+	data      []byte
+	created   time.Time
+	lastSeen  time.Time
+	userAgent string
+	ip        string
+}
+
+// sessionStore keeps the data of sessions server side.
+type sessionStore interface {
+	GetSession(c context.Context, id string) (r sessionRecord, ok bool, err error)
+	// InsertSession creates a new session.
+	InsertSession(c context.Context, r sessionRecord) error
+	// UpdateSession updates the session, keeping its creation time. It
+	// returns false if the session no longer exists, such as when it was
+	// revoked, instead of creating it again.
+	UpdateSession(c context.Context, r sessionRecord) (bool, error)
+	TouchSession(c context.Context, id string, t time.Time) error
+	DeleteSession(c context.Context, id string) error
+	UserSessions(c context.Context, userId string) ([]UserSession, error)
+	DeleteUserSession(c context.Context, userId, id string) error
+	DeleteUserSessions(c context.Context, userId string) error
+	// PurgeExpiredSessions removes sessions last seen before idleBefore
+	// or created before createdBefore.
+	PurgeExpiredSessions(c context.Context, idleBefore, createdBefore time.Time) (int64, error)
+}
+
+var _ sessionStore = &database{}
+var _ sessionStore = &memorySessionStore{}
+
+// memorySessionStore keeps sessions in memory, so they are lost on restart.
+type memorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]sessionRecord
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{
+		sessions: make(map[string]sessionRecord),
+	}
+}
+
+func (m *memorySessionStore) GetSession(c context.Context, id string) (r sessionRecord, ok bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok = m.sessions[id]
+	return
+}
+
+func (m *memorySessionStore) InsertSession(c context.Context, r sessionRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r.created = r.lastSeen
+	m.sessions[r.id] = r
+	return nil
+}
+
+func (m *memorySessionStore) UpdateSession(c context.Context, r sessionRecord) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old, ok := m.sessions[r.id]
+	if !ok {
+		return false, nil
+	}
+	r.created = old.created
+	m.sessions[r.id] = r
+	return true, nil
+}
+
+func (m *memorySessionStore) TouchSession(c context.Context, id string, t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r, ok := m.sessions[id]; ok {
+		r.lastSeen = t
+		m.sessions[id] = r
+	}
+	return nil
+}
+
+func (m *memorySessionStore) DeleteSession(c context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *memorySessionStore) UserSessions(c context.Context, userId string) (us []UserSession, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range m.sessions {
+		if r.userId != userId {
+			continue
+		}
+		us = append(us, UserSession{
+			Id:         r.id,
+			CreateTime: r.created,
+			LastSeen:   r.lastSeen,
+			UserAgent:  r.userAgent,
+			IP:         r.ip,
+		})
+	}
+	sort.Slice(us, func(i, j int) bool {
+		return us[i].LastSeen.After(us[j].LastSeen)
+	})
+	return
+}
+
+func (m *memorySessionStore) DeleteUserSession(c context.Context, userId, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r, ok := m.sessions[id]; ok && r.userId == userId {
+		delete(m.sessions, id)
+	}
+	return nil
+}
+
+func (m *memorySessionStore) DeleteUserSessions(c context.Context, userId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, r := range m.sessions {
+		if r.userId == userId {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (m *memorySessionStore) PurgeExpiredSessions(c context.Context, idleBefore, createdBefore time.Time) (n int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, r := range m.sessions {
+		if r.lastSeen.Before(idleBefore) || r.created.Before(createdBefore) {
+			delete(m.sessions, id)
+			n++
+		}
+	}
+	return
+}
@@ -17,82 +17,318 @@
 package apcore
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"net/url"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/gorilla/securecookie"
 	gs "github.com/gorilla/sessions"
 )
 
+const (
+	sessionStoreDatabase = "database"
+	sessionStoreMemory   = "memory"
+	// Size in bytes of the random token kept in the session cookie.
+	sessionTokenSize = 32
+	// Sessions are only marked as seen this often, to avoid writing to
+	// the store on every request.
+	sessionTouchInterval = time.Minute
+)
+
+type sessionContextKey struct{}
+
+// sessions keeps session data server side, so that sessions can be listed and
+// revoked. The cookie only holds a random token, which is stored as a keyed
+// hash.
 type sessions struct {
-	name    string
-	cookies *gs.CookieStore
+	name     string
+	key      []byte
+	codecs   []securecookie.Codec
+	options  *gs.Options
+	store    sessionStore
+	mu       *sync.RWMutex
+	idle     time.Duration
+	absolute time.Duration
 }
 
-func newSessions(c *config) (s *sessions, err error) {
-	var authKey, encKey []byte
+func newSessions(c *config, d *database, debug bool) (s *sessions, err error) {
+	sc := c.ServerConfig
 	var keys [][]byte
-	authKey, err = ioutil.ReadFile(c.ServerConfig.CookieAuthKeyFile)
-	if err != nil {
+	if keys, err = readCookieKeys(sc.CookieAuthKeyFile, sc.CookieEncryptionKeyFile); err != nil {
 		return
 	}
-	if len(c.ServerConfig.CookieEncryptionKeyFile) > 0 {
+	if len(sc.CookieEncryptionKeyFile) > 0 {
 		InfoLogger.Info("Cookie encryption key file detected")
-		encKey, err = ioutil.ReadFile(c.ServerConfig.CookieEncryptionKeyFile)
-		if err != nil {
-			return
-		}
-		keys = [][]byte{authKey, encKey}
 	} else {
 		InfoLogger.Info("No cookie encryption key file detected")
-		keys = [][]byte{authKey}
 	}
-	if len(c.ServerConfig.CookieSessionName) <= 0 {
+	// Previous keys only decode existing cookies, as the first key pair is
+	// used to encode.
+	for _, prev := range strings.Split(sc.CookiePreviousKeyFiles, ",") {
+		prev = strings.TrimSpace(prev)
+		if len(prev) == 0 {
+			continue
+		}
+		authFile, encFile := prev, ""
+		if i := strings.Index(prev, ":"); i >= 0 {
+			authFile, encFile = prev[:i], prev[i+1:]
+		}
+		var prevKeys [][]byte
+		if prevKeys, err = readCookieKeys(authFile, encFile); err != nil {
+			return
+		}
+		keys = append(keys, prevKeys...)
+	}
+	var sameSite http.SameSite
+	if sameSite, err = toSameSite(sc.CookieSameSite); err != nil {
+		return
+	}
+	if len(sc.CookieSessionName) <= 0 {
 		err = fmt.Errorf("no cookie session name provided")
 		return
+	} else if sc.SessionIdleTimeoutSeconds <= 0 {
+		err = fmt.Errorf("sr_session_idle_timeout_seconds is <= 0")
+		return
+	} else if sc.SessionAbsoluteTimeoutSeconds <= 0 {
+		err = fmt.Errorf("sr_session_absolute_timeout_seconds is <= 0")
+		return
+	} else if len(d.tokenKey) == 0 {
+		err = fmt.Errorf("no token hashing key is configured for sessions")
+		return
 	}
 	s = &sessions{
-		name:    c.ServerConfig.CookieSessionName,
-		cookies: gs.NewCookieStore(keys...),
+		name:     sc.CookieSessionName,
+		key:      deriveKey(d.tokenKey, "apcore sessions"),
+		codecs:   securecookie.CodecsFromPairs(keys...),
+		mu:       &sync.RWMutex{},
+		idle:     time.Duration(sc.SessionIdleTimeoutSeconds) * time.Second,
+		absolute: time.Duration(sc.SessionAbsoluteTimeoutSeconds) * time.Second,
+		options: &gs.Options{
+			Path:     "/",
+			Domain:   sc.Host,
+			MaxAge:   sc.CookieMaxAge,
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: sameSite,
+		},
+	}
+	// Browsers reject cookies for localhost with a Domain, and plain HTTP
+	// cannot set Secure cookies.
+	if debug {
+		s.options.Domain = ""
+		s.options.Secure = false
+		if s.options.SameSite == http.SameSiteNoneMode {
+			s.options.SameSite = http.SameSiteLaxMode
+		}
+	}
+	for _, cd := range s.codecs {
+		if sck, ok := cd.(*securecookie.SecureCookie); ok {
+			sck.MaxAge(s.options.MaxAge)
+		}
+	}
+	switch sc.SessionStore {
+	case sessionStoreDatabase:
+		s.store = d
+	case sessionStoreMemory:
+		s.store = newMemorySessionStore()
+	default:
+		err = fmt.Errorf("unknown session store: %q", sc.SessionStore)
+	}
+	return
+}
+
+func toSameSite(s string) (m http.SameSite, err error) {
+	switch s {
+	case "lax", "":
+		m = http.SameSiteLaxMode
+	case "strict":
+		m = http.SameSiteStrictMode
+	case "none":
+		m = http.SameSiteNoneMode
+	default:
+		err = fmt.Errorf("unknown cookie SameSite mode: %q", s)
+	}
+	return
+}
+
+// readCookieKeys reads an authentication and optional encryption key pair.
+func readCookieKeys(authFile, encFile string) (keys [][]byte, err error) {
+	var authKey, encKey []byte
+	if authKey, err = ioutil.ReadFile(authFile); err != nil {
+		return
 	}
-	opt := &gs.Options{
-		Path:     "/",
-		Domain:   c.ServerConfig.Host,
-		MaxAge:   c.ServerConfig.CookieMaxAge,
-		Secure:   true,
-		HttpOnly: true,
+	if len(encFile) > 0 {
+		if encKey, err = ioutil.ReadFile(encFile); err != nil {
+			return
+		}
 	}
-	s.cookies.Options = opt
-	s.cookies.MaxAge(opt.MaxAge)
+	keys = [][]byte{authKey, encKey}
 	return
 }
 
+// Get fetches the session of the request, which is new if the cookie is
+// missing, cannot be decoded, or refers to a revoked or expired session. The
+// session is shared by later calls for the same request.
 func (s *sessions) Get(r *http.Request) (ses *session, err error) {
-	var gs *gs.Session
-	gs, err = s.cookies.Get(r, s.name)
+	if v, ok := r.Context().Value(sessionContextKey{}).(*session); ok {
+		ses = v
+		return
+	}
 	ses = &session{
-		gs: gs,
+		sl:     s,
+		values: make(map[interface{}]interface{}),
+	}
+	*r = *r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, ses))
+	ck, cerr := r.Cookie(s.name)
+	if cerr != nil {
+		return
+	}
+	var token string
+	if securecookie.DecodeMulti(s.name, ck.Value, &token, s.codecs...) != nil {
+		return
+	}
+	id := hashToken(s.key, token)
+	var rec sessionRecord
+	var ok bool
+	if rec, ok, err = s.store.GetSession(r.Context(), id); err != nil || !ok {
+		return
+	}
+	now := time.Now()
+	idle, absolute := s.timeouts()
+	if now.Sub(rec.lastSeen) > idle || now.Sub(rec.created) > absolute {
+		err = s.store.DeleteSession(r.Context(), id)
+		return
+	}
+	if err = gob.NewDecoder(bytes.NewReader(rec.data)).Decode(&ses.values); err != nil {
+		return
+	}
+	ses.token = token
+	ses.id = id
+	if now.Sub(rec.lastSeen) > sessionTouchInterval {
+		err = s.store.TouchSession(r.Context(), id, now)
+	}
+	return
+}
+
+// csrfCookieName is the cookie holding the CSRF token of visitors without a
+// stored session.
+func (s *sessions) csrfCookieName() string {
+	return s.name + "_csrf"
+}
+
+// csrfCookieToken returns the CSRF token of the signed cookie, if present and
+// valid.
+func (s *sessions) csrfCookieToken(r *http.Request) (token string, ok bool) {
+	ck, err := r.Cookie(s.csrfCookieName())
+	if err != nil {
+		return
+	}
+	ok = securecookie.DecodeMulti(s.csrfCookieName(), ck.Value, &token, s.codecs...) == nil && len(token) > 0
+	return
+}
+
+// setCSRFCookie sets a new CSRF token in a signed cookie, which lasts as long
+// as the browser session.
+func (s *sessions) setCSRFCookie(w http.ResponseWriter) (token string, err error) {
+	if token, err = randomToken(csrfTokenSize); err != nil {
+		return
+	}
+	var v string
+	if v, err = securecookie.EncodeMulti(s.csrfCookieName(), token, s.codecs...); err != nil {
+		return
+	}
+	opts := *s.options
+	opts.MaxAge = 0
+	http.SetCookie(w, gs.NewCookie(s.csrfCookieName(), v, &opts))
+	return
+}
+
+// UserSessions lists the sessions in which the user is logged in.
+func (s *sessions) UserSessions(c context.Context, userId string) ([]UserSession, error) {
+	return s.store.UserSessions(c, userId)
+}
+
+// Revoke logs out a single session of the user.
+func (s *sessions) Revoke(c context.Context, userId, id string) error {
+	return s.store.DeleteUserSession(c, userId, id)
+}
+
+// RevokeUser logs the user out of every session, such as when their password
+// changes.
+func (s *sessions) RevokeUser(c context.Context, userId string) error {
+	return s.store.DeleteUserSessions(c, userId)
+}
+
+// PurgeExpired removes sessions past their idle or absolute timeout,
+// returning how many were removed.
+func (s *sessions) PurgeExpired(c context.Context) (int64, error) {
+	now := time.Now()
+	idle, absolute := s.timeouts()
+	return s.store.PurgeExpiredSessions(c, now.Add(-idle), now.Add(-absolute))
+}
+
+func (s *sessions) timeouts() (idle, absolute time.Duration) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.idle, s.absolute
+}
+
+// prepareReload validates the session timeouts of a reloaded configuration,
+// returning a function that applies them.
+func (s *sessions) prepareReload(c *config) (apply func(), err error) {
+	sc := c.ServerConfig
+	if sc.SessionIdleTimeoutSeconds <= 0 {
+		err = fmt.Errorf("sr_session_idle_timeout_seconds is <= 0")
+		return
+	} else if sc.SessionAbsoluteTimeoutSeconds <= 0 {
+		err = fmt.Errorf("sr_session_absolute_timeout_seconds is <= 0")
+		return
+	}
+	apply = func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.idle = time.Duration(sc.SessionIdleTimeoutSeconds) * time.Second
+		s.absolute = time.Duration(sc.SessionAbsoluteTimeoutSeconds) * time.Second
 	}
 	return
 }
 
 type session struct {
-	gs *gs.Session
+	sl     *sessions
+	values map[interface{}]interface{}
+	// token is kept in the cookie, and id is its keyed hash. Both are
+	// empty until a new session is first saved.
+	token string
+	id    string
+	// renew replaces the token when saved, such as after logging in.
+	renew bool
 }
 
 const (
-	userIDSessionKey           = "userid"
-	oAuthRedirectFormValuesKey = "oauth_redir"
+	userIDSessionKey    = "userid"
+	authorizeRequestKey = "oauth_authz"
+	mfaUserIDKey        = "mfa_userid"
+	mfaTimeKey          = "mfa_time"
+	csrfTokenKey        = "csrf_token"
 )
 
+// SetUserID logs in the user. The session and CSRF tokens are replaced, so
+// tokens planted before logging in cannot be used afterwards.
 func (s *session) SetUserID(uuid string) {
-	s.gs.Values[userIDSessionKey] = uuid
+	s.values[userIDSessionKey] = uuid
+	delete(s.values, csrfTokenKey)
+	s.renew = true
 	return
 }
 
 func (s *session) UserID() (uuid string, err error) {
-	if v, ok := s.gs.Values[userIDSessionKey]; !ok {
+	if v, ok := s.values[userIDSessionKey]; !ok {
 		err = fmt.Errorf("no user id in session")
 		return
 	} else if uuid, ok = v.(string); !ok {
@@ -102,24 +338,132 @@ func (s *session) UserID() (uuid string, err error) {
 	return
 }
 
-func (s *session) SetOAuthRedirectFormValues(f url.Values) {
-	s.gs.Values[oAuthRedirectFormValuesKey] = f
+// SetMFAPending marks the user as having entered their password, but not yet
+// their second factor.
+func (s *session) SetMFAPending(uuid string) {
+	s.values[mfaUserIDKey] = uuid
+	s.values[mfaTimeKey] = time.Now().Unix()
+}
+
+// MFAPending fetches the user who has yet to enter their second factor, if they
+// have not taken too long to do so.
+func (s *session) MFAPending() (uuid string, ok bool) {
+	var t int64
+	if t, ok = s.values[mfaTimeKey].(int64); !ok {
+		return
+	} else if time.Since(time.Unix(t, 0)) > mfaPendingTimeout {
+		ok = false
+		return
+	}
+	uuid, ok = s.values[mfaUserIDKey].(string)
+	return
+}
+
+func (s *session) DeleteMFAPending() {
+	delete(s.values, mfaUserIDKey)
+	delete(s.values, mfaTimeKey)
+}
+
+// stored determines whether the session has been saved, as opposed to being
+// new to this request.
+func (s *session) stored() bool {
+	return len(s.id) > 0
+}
+
+func (s *session) CSRFToken() (token string, ok bool) {
+	token, ok = s.values[csrfTokenKey].(string)
+	return
+}
+
+// NewCSRFToken replaces the CSRF token of the session, which must then be
+// saved.
+func (s *session) NewCSRFToken() (token string, err error) {
+	if token, err = randomToken(csrfTokenSize); err != nil {
+		return
+	}
+	s.values[csrfTokenKey] = token
+	return
+}
+
+func (s *session) SetAuthorizeRequest(a authorizeRequest) {
+	s.values[authorizeRequestKey] = a
 	return
 }
 
-func (s *session) OAuthRedirectFormValues() (v url.Values, ok bool) {
+func (s *session) AuthorizeRequest() (a authorizeRequest, ok bool) {
 	var i interface{}
-	if i, ok = s.gs.Values[oAuthRedirectFormValuesKey]; !ok {
+	if i, ok = s.values[authorizeRequestKey]; !ok {
 		return
 	}
-	v, ok = i.(url.Values)
+	a, ok = i.(authorizeRequest)
 	return
 }
 
-func (s *session) DeleteOAuthRedirectFormValues() {
-	delete(s.gs.Values, oAuthRedirectFormValuesKey)
+func (s *session) DeleteAuthorizeRequest() {
+	delete(s.values, authorizeRequestKey)
 }
 
-func (s *session) Save(r *http.Request, w http.ResponseWriter) error {
-	return s.gs.Save(r, w)
+func (s *session) Save(r *http.Request, w http.ResponseWriter) (err error) {
+	c := r.Context()
+	if s.renew && len(s.id) > 0 {
+		if err = s.sl.store.DeleteSession(c, s.id); err != nil {
+			return
+		}
+		s.token, s.id = "", ""
+	}
+	s.renew = false
+	isNew := len(s.token) == 0
+	if isNew {
+		if s.token, err = randomToken(sessionTokenSize); err != nil {
+			return
+		}
+		s.id = hashToken(s.sl.key, s.token)
+	}
+	var b bytes.Buffer
+	if err = gob.NewEncoder(&b).Encode(s.values); err != nil {
+		return
+	}
+	userId, _ := s.UserID()
+	rec := sessionRecord{
+		id:        s.id,
+		userId:    userId,
+		data:      b.Bytes(),
+		lastSeen:  time.Now(),
+		userAgent: r.UserAgent(),
+		ip:        remoteIP(r),
+	}
+	if isNew {
+		err = s.sl.store.InsertSession(c, rec)
+	} else {
+		var ok bool
+		if ok, err = s.sl.store.UpdateSession(c, rec); err == nil && !ok {
+			// Revoked while this request was served, so the
+			// revocation is kept instead of saving it again.
+			return s.Destroy(r, w)
+		}
+	}
+	if err != nil {
+		return
+	}
+	var v string
+	if v, err = securecookie.EncodeMulti(s.sl.name, s.token, s.sl.codecs...); err != nil {
+		return
+	}
+	http.SetCookie(w, gs.NewCookie(s.sl.name, v, s.sl.options))
+	return
+}
+
+// Destroy logs out and removes the session.
+func (s *session) Destroy(r *http.Request, w http.ResponseWriter) (err error) {
+	if len(s.id) > 0 {
+		if err = s.sl.store.DeleteSession(r.Context(), s.id); err != nil {
+			return
+		}
+	}
+	s.values = make(map[interface{}]interface{})
+	s.token, s.id = "", ""
+	opts := *s.sl.options
+	opts.MaxAge = -1
+	http.SetCookie(w, gs.NewCookie(s.sl.name, "", &opts))
+	return
 }
@@ -33,6 +33,7 @@ type sqlGenerator interface {
 	//   hash ([]byte)
 	//   salt ([]byte)
 	HashPassForUserID() string
+	RehashUserPassword() string
 	UserIdForEmail() string
 	UserIdForBoxPath() string
 	UserIdForUsername() string
@@ -40,6 +41,37 @@ type sqlGenerator interface {
 	InsertUserPrivileges() string
 	UserPreferences() string
 	InsertUserPreferences() string
+	UserState() string
+	UserProfile() string
+	UserIsAdmin() string
+	UserMFA() string
+	SetTOTPSecret() string
+	TOTPSecret() string
+	PendingTOTPSecret() string
+	SetTOTPStep() string
+	EnableMFA() string
+	DeleteMFA() string
+	InsertRecoveryCode() string
+	DeleteRecoveryCodes() string
+	UseRecoveryCode() string
+	InsertLoginAttempt() string
+	UserAccount() string
+	SetEmailVerified() string
+	SetUserPassword() string
+	InsertInvite() string
+	UseInvite() string
+	AccountLoginFailures() string
+	IPLoginFailures() string
+	SetUserLockedUntil() string
+	UserLockedUntil() string
+	SetUserState() string
+	UsersInState() string
+	UsersPendingKeyPurge() string
+	RemoveActorPublicKey() string
+	TombstoneUser() string
+	DeleteUserInbox() string
+	DeleteUserPKeys() string
+	DeleteUserTokens() string
 	UpdateUserPolicy() string
 	UpdateInstancePolicy() string
 	InsertUserPolicy() string
@@ -53,9 +85,21 @@ type sqlGenerator interface {
 	GetUserPKey() string
 	FollowersByUserUUID() string
 
+	InsertRelationship() string
+	DeleteRelationship() string
+	DeleteRelationshipByActivity() string
+	UserRelationships() string
+	HasRelationship() string
+
+	InsertReport() string
+	ReportsByStatus() string
+	ReportById() string
+	UpdateReport() string
+
 	InsertAttempt() string
 	MarkSuccessfulAttempt() string
 	MarkRetryFailureAttempt() string
+	PendingAttempts() string
 
 	CreateTokenInfo() string
 	RemoveTokenByCode() string
@@ -64,7 +108,30 @@ type sqlGenerator interface {
 	GetTokenByCode() string
 	GetTokenByAccess() string
 	GetTokenByRefresh() string
+	SetTokenCodeParameters() string
+	TokenCodeParameters() string
 	GetClientById() string
+	InsertClient() string
+	Clients() string
+	RevokeClient() string
+	RemoveTokensByClient() string
+	PlaintextTokens() string
+	SetTokenHashes() string
+	ClientSecrets() string
+	SetClientSecret() string
+	UserGrants() string
+	RemoveUserGrant() string
+	RemoveUserClientGrants() string
+	PurgeExpiredTokens() string
+	GetSession() string
+	InsertSession() string
+	UpdateSession() string
+	TouchSession() string
+	DeleteSession() string
+	UserSessions() string
+	DeleteUserSession() string
+	DeleteUserSessions() string
+	PurgeExpiredSessions() string
 
 	InboxContains() string
 	GetInbox() string
@@ -20,6 +20,8 @@ import (
 	"bytes"
 	"context"
 	"crypto"
+	"crypto/rsa"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -52,8 +54,6 @@ func containsRequiredHttpHeaders(method string, headers []string) error {
 	return nil
 }
 
-// TODO: re-launch existing failed deliveries at startup and control rate-limiting.
-
 type transportController struct {
 	a           Application
 	clock       pub.Clock
@@ -62,8 +62,10 @@ type transportController struct {
 	digestAlg   httpsig.DigestAlgorithm
 	getHeaders  []string
 	postHeaders []string
-	l           *rate.Limiter // TODO: Use this
+	mu          *sync.RWMutex
+	l           *rate.Limiter
 	db          *database
+	lc          *lifecycle
 }
 
 func newTransportController(
@@ -71,7 +73,8 @@ func newTransportController(
 	a Application,
 	clock pub.Clock,
 	client *http.Client,
-	db *database) (tc *transportController, err error) {
+	db *database,
+	lc *lifecycle) (tc *transportController, err error) {
 	if c.ActivityPubConfig.OutboundRateLimitQPS <= 0 {
 		err = fmt.Errorf("outbound rate limit qps is <= 0")
 		return
@@ -106,8 +109,10 @@ func newTransportController(
 		digestAlg:   httpsig.DigestAlgorithm(c.ActivityPubConfig.HttpSignaturesConfig.DigestAlgorithm),
 		getHeaders:  c.ActivityPubConfig.HttpSignaturesConfig.GetHeaders,
 		postHeaders: c.ActivityPubConfig.HttpSignaturesConfig.PostHeaders,
+		mu:          &sync.RWMutex{},
 		l:           rate.NewLimiter(rate.Limit(c.ActivityPubConfig.OutboundRateLimitQPS), c.ActivityPubConfig.OutboundRateLimitBurst),
 		db:          db,
+		lc:          lc,
 	}, err
 }
 
@@ -138,21 +143,138 @@ func (tc *transportController) Get(
 		tc)
 }
 
-func (tc *transportController) wait(c context.Context) {
-	tc.l.Wait(c)
+// ForUser returns a transport that signs requests with the user's key.
+func (tc *transportController) ForUser(c context.Context, p *paths, userUUID string) (t *transport, err error) {
+	var privKey *rsa.PrivateKey
+	var kUUID string
+	kUUID, privKey, err = tc.db.GetUserPKey(c, userUUID)
+	if err != nil {
+		return
+	}
+	var pubKeyURL *url.URL
+	pubKeyURL, err = p.PublicKeyPath(userUUID, kUUID)
+	if err != nil {
+		return
+	}
+	return tc.Get(privKey, pubKeyURL.String())
+}
+
+// DereferenceUnsigned fetches the IRI without an HTTP Signature, for use when
+// no local user is making the request.
+func (tc *transportController) DereferenceUnsigned(c context.Context, iri *url.URL) (b []byte, err error) {
+	var req *http.Request
+	req, err = http.NewRequest(http.MethodGet, iri.String(), nil)
+	if err != nil {
+		return
+	}
+	req = req.WithContext(c)
+	if err = tc.wait(c); err != nil {
+		return
+	}
+	req.Header.Add("Accept", activityStreamsContentType)
+	req.Header.Add("Accept-Charset", "utf-8")
+	req.Header.Add("Date", fmt.Sprintf("%s GMT", tc.clock.Now().UTC().Format("Mon, 02 Jan 2006 15:04:05")))
+	req.Header.Add("User-Agent", userAgent(tc.a.Software()))
+	var resp *http.Response
+	resp, err = tc.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("url IRI dereference failed with status (%d): %s", resp.StatusCode, resp.Status)
+		return
+	}
+	b, err = ioutil.ReadAll(resp.Body)
+	return
+}
+
+// retryPending attempts the deliveries left pending by a previous shutdown, in
+// the background.
+func (tc *transportController) retryPending(p *paths) {
+	tc.lc.spawn(func() {
+		c, cancel := tc.lc.bind(context.Background())
+		defer cancel()
+		as, err := tc.db.PendingAttempts(c)
+		if err != nil {
+			ErrorLogger.Errorf("Error fetching pending delivery attempts: %s", err)
+			return
+		} else if len(as) > 0 {
+			InfoLogger.Infof("Retrying %d pending delivery attempts", len(as))
+		}
+		for _, a := range as {
+			if tc.lc.draining() {
+				return
+			}
+			uc := &ctx{c}
+			uc.withUserPathUUID(a.FromUUID)
+			var t *transport
+			if t, err = tc.ForUser(uc.Context, p, a.FromUUID); err != nil {
+				// Such as when the user has since been deleted.
+				ErrorLogger.Errorf("Error retrying delivery attempt %s: %s", a.Id, err)
+				if err = tc.markFailure(context.Background(), a.Id); err != nil {
+					ErrorLogger.Errorf("Error marking delivery attempt %s as failure: %s", a.Id, err)
+				}
+				continue
+			}
+			if err = t.attempt(uc.Context, a.Id, a.Payload, a.To); err != nil {
+				ErrorLogger.Errorf("Error retrying delivery attempt %s to %s: %s", a.Id, a.To, err)
+			}
+		}
+	})
+}
+
+// quarantinePolicies loads the instance policies that may quarantine the
+// recipients of the payload. Only public payloads are quarantined, so none are
+// loaded otherwise.
+func (tc *transportController) quarantinePolicies(c context.Context, b []byte) (p policies, err error) {
+	var public bool
+	if public, err = isPublicPayload(b); err != nil || !public {
+		return
+	}
+	p, err = tc.db.InstancePolicies(c)
+	return
+}
+
+// wait blocks until the outbound rate limit permits another request, or
+// returns an error if c is done first.
+func (tc *transportController) wait(c context.Context) error {
+	tc.mu.RLock()
+	l := tc.l
+	tc.mu.RUnlock()
+	return l.Wait(c)
+}
+
+// prepareReload validates the outbound rate limits of a reloaded
+// configuration, returning a function that applies them.
+func (tc *transportController) prepareReload(c *config) (apply func(), err error) {
+	ac := c.ActivityPubConfig
+	if ac.OutboundRateLimitQPS <= 0 {
+		err = fmt.Errorf("outbound rate limit qps is <= 0")
+		return
+	} else if ac.OutboundRateLimitBurst <= 0 {
+		err = fmt.Errorf("outbound rate limit burst is <= 0")
+		return
+	}
+	apply = func() {
+		tc.mu.Lock()
+		defer tc.mu.Unlock()
+		tc.l = rate.NewLimiter(rate.Limit(ac.OutboundRateLimitQPS), ac.OutboundRateLimitBurst)
+	}
+	return
 }
 
-func (tc *transportController) insertAttempt(c context.Context, payload []byte, to *url.URL, fromUUID string) (id int64, err error) {
+func (tc *transportController) insertAttempt(c context.Context, payload []byte, to *url.URL, fromUUID string) (id string, err error) {
 	id, err = tc.db.InsertAttempt(c, payload, to, fromUUID)
 	return
 }
 
-func (tc *transportController) markSuccess(c context.Context, id int64) (err error) {
+func (tc *transportController) markSuccess(c context.Context, id string) (err error) {
 	err = tc.db.MarkSuccessfulAttempt(c, id)
 	return
 }
 
-func (tc *transportController) markFailure(c context.Context, id int64) (err error) {
+func (tc *transportController) markFailure(c context.Context, id string) (err error) {
 	err = tc.db.MarkRetryFailureAttempt(c, id)
 	return
 }
@@ -168,6 +290,12 @@ type transport struct {
 	privKey                   crypto.PrivateKey
 	pubKeyId                  string
 	tc                        *transportController
+	// The blocks of the user delivering are loaded on first use. While
+	// recipients are resolved, the inboxes of blocked actors are recorded
+	// so that they are not delivered to.
+	blocksMu       *sync.Mutex
+	blocks         *blockSet
+	blockedInboxes map[string]bool
 }
 
 func newTransport(a Application,
@@ -188,16 +316,74 @@ func newTransport(a Application,
 		privKey:      privKey,
 		pubKeyId:     pubKeyId,
 		tc:           tc,
+		blocksMu:     &sync.Mutex{},
 	}, nil
 }
 
+// loadBlocks returns the blocks of the user on whose behalf the transport is
+// used. Without a user, nothing is blocked.
+func (t *transport) loadBlocks(c context.Context) (b *blockSet, err error) {
+	if t.blocks != nil {
+		return t.blocks, nil
+	}
+	var rs []Relationship
+	if userUUID, uErr := (&ctx{c}).UserPathUUID(); uErr == nil {
+		if rs, err = t.tc.db.Relationships(c, userUUID); err != nil {
+			return
+		}
+	}
+	t.blocks = newBlockSet(rs)
+	t.blockedInboxes = make(map[string]bool, 0)
+	return t.blocks, nil
+}
+
+// recordBlockedInbox remembers the inbox of a dereferenced actor that the
+// user blocks.
+func (t *transport) recordBlockedInbox(c context.Context, iri *url.URL, b []byte) (err error) {
+	t.blocksMu.Lock()
+	defer t.blocksMu.Unlock()
+	var bs *blockSet
+	if bs, err = t.loadBlocks(c); err != nil || !bs.blocking(iri) {
+		return
+	}
+	var m map[string]interface{}
+	if err = json.Unmarshal(b, &m); err != nil {
+		return
+	}
+	if inbox, ok := m["inbox"].(string); ok {
+		t.blockedInboxes[inbox] = true
+	}
+	return
+}
+
+// unblockedRecipients removes the inboxes of blocked actors and domains.
+func (t *transport) unblockedRecipients(c context.Context, recipients []*url.URL) (r []*url.URL, err error) {
+	t.blocksMu.Lock()
+	defer t.blocksMu.Unlock()
+	var bs *blockSet
+	if bs, err = t.loadBlocks(c); err != nil {
+		return
+	}
+	for _, to := range recipients {
+		if bs.domains[to.Hostname()] || t.blockedInboxes[to.String()] {
+			InfoLogger.Infof("Not delivering to blocked recipient: %s", to)
+			continue
+		}
+		r = append(r, to)
+	}
+	return
+}
+
 func (t *transport) Dereference(c context.Context, iri *url.URL) (b []byte, err error) {
 	var req *http.Request
 	req, err = http.NewRequest(http.MethodGet, iri.String(), nil)
 	if err != nil {
 		return
 	}
-	req.WithContext(c)
+	req = req.WithContext(c)
+	if err = t.tc.wait(c); err != nil {
+		return
+	}
 	req.Header.Add("Accept", activityStreamsContentType)
 	req.Header.Add("Accept-Charset", "utf-8")
 	req.Header.Add("Date", t.date())
@@ -218,22 +404,62 @@ func (t *transport) Dereference(c context.Context, iri *url.URL) (b []byte, err
 	if err = t.handleDereferenceResponse(resp); err != nil {
 		return
 	}
-	b, err = ioutil.ReadAll(resp.Body)
+	if b, err = ioutil.ReadAll(resp.Body); err != nil {
+		return
+	}
+	err = t.recordBlockedInbox(c, iri, b)
 	return
 }
 
 func (t *transport) Deliver(c context.Context, b []byte, to *url.URL) (err error) {
+	var qp policies
+	if qp, err = t.tc.quarantinePolicies(c, b); err != nil {
+		err = fmt.Errorf("failed to determine if recipient is quarantined: %s", err)
+		return
+	}
+	var r []*url.URL
+	if r, err = t.unblockedRecipients(c, []*url.URL{to}); err != nil {
+		err = fmt.Errorf("failed to determine if recipient is blocked: %s", err)
+		return
+	} else if len(r) == 0 {
+		return
+	}
+	return t.deliver(c, b, to, qp)
+}
+
+// deliver delivers the payload unless the quarantine policies apply to the
+// recipient.
+func (t *transport) deliver(c context.Context, b []byte, to *url.URL, qp policies) (err error) {
+	c, cancel := t.tc.lc.bind(c)
+	defer cancel()
 	var fromUUID string
 	fromUUID, err = (&ctx{c}).UserPathUUID()
 	if err != nil {
 		err = fmt.Errorf("failed to determine user to deliver on behalf of: %s", err)
 		return
 	}
-	var attemptId int64
+	if qp.IsQuarantined(to) {
+		InfoLogger.Infof("Not delivering public activity to quarantined recipient: %s", to)
+		return
+	}
+	var attemptId string
 	if attemptId, err = t.tc.insertAttempt(c, b, to, fromUUID); err != nil {
 		err = fmt.Errorf("failed to create delivery attempt: %s", err)
 		return
 	}
+	return t.attempt(c, attemptId, b, to)
+}
+
+// attempt makes the recorded delivery attempt, marking whether it succeeded.
+// It is left pending if shutdown prevents it from finishing.
+func (t *transport) attempt(c context.Context, attemptId string, b []byte, to *url.URL) (err error) {
+	if t.tc.lc.draining() {
+		InfoLogger.Infof("Shutting down, leaving delivery attempt %s to %s pending", attemptId, to)
+		return
+	} else if err = t.tc.wait(c); err != nil {
+		InfoLogger.Infof("Leaving delivery attempt %s to %s pending: %s", attemptId, to, err)
+		return
+	}
 
 	byteCopy := make([]byte, len(b))
 	copy(byteCopy, b)
@@ -243,7 +469,7 @@ func (t *transport) Deliver(c context.Context, b []byte, to *url.URL) (err error
 	if err != nil {
 		return
 	}
-	req.WithContext(c)
+	req = req.WithContext(c)
 	req.Header.Add("Content-Type", activityStreamsContentType)
 	req.Header.Add("Accept-Charset", "utf-8")
 	req.Header.Add("Date", t.date())
@@ -254,37 +480,66 @@ func (t *transport) Deliver(c context.Context, b []byte, to *url.URL) (err error
 	if err != nil {
 		return
 	}
+	// The outcome is recorded even if shutdown cancelled c.
+	mc := context.Background()
 	var resp *http.Response
 	resp, err = t.client.Do(req)
 	if err != nil {
+		if c.Err() != nil && t.tc.lc.draining() {
+			InfoLogger.Infof("Shutting down, leaving cancelled delivery attempt %s to %s pending", attemptId, to)
+			return
+		}
+		if err2 := t.tc.markFailure(mc, attemptId); err2 != nil {
+			err = fmt.Errorf("failed delivery and failed to mark as failure (%s): [%s, %s]", attemptId, err, err2)
+		}
 		return
 	}
 	defer resp.Body.Close()
 
 	if err = t.handleDeliverResponse(resp); err != nil {
-		err2 := t.tc.markFailure(c, attemptId)
+		err2 := t.tc.markFailure(mc, attemptId)
 		if err2 != nil {
-			err = fmt.Errorf("failed delivery and failed to mark as failure (%d): [%s, %s]", attemptId, err, err2)
+			err = fmt.Errorf("failed delivery and failed to mark as failure (%s): [%s, %s]", attemptId, err, err2)
 		}
 		return
 	}
-	if err = t.tc.markSuccess(c, attemptId); err != nil {
-		err = fmt.Errorf("failed to mark delivery as successful (%d): %s", attemptId, err)
+	if err = t.tc.markSuccess(mc, attemptId); err != nil {
+		err = fmt.Errorf("failed to mark delivery as successful (%s): %s", attemptId, err)
 		return
 	}
 	return
 }
 
 func (t *transport) BatchDeliver(c context.Context, b []byte, recipients []*url.URL) (err error) {
-	var wg *sync.WaitGroup
+	// The policies are loaded once for every recipient.
+	var qp policies
+	if qp, err = t.tc.quarantinePolicies(c, b); err != nil {
+		err = fmt.Errorf("failed to determine if recipients are quarantined: %s", err)
+		return
+	}
+	if recipients, err = t.unblockedRecipients(c, recipients); err != nil {
+		err = fmt.Errorf("failed to determine if recipients are blocked: %s", err)
+		return
+	}
+	wg := &sync.WaitGroup{}
 	for i, r := range recipients {
-		wg.Add(1)
-		go func(i int, r *url.URL) {
-			err := t.Deliver(c, b, r)
+		i, r := i, r
+		deliver := func() {
+			err := t.deliver(c, b, r, qp)
 			if err != nil {
-				ErrorLogger.Errorf("BatchDeliver (%d of %d): %s", i, len(recipients), err)
+				ErrorLogger.Errorf("BatchDeliver (%d of %d): %s", i+1, len(recipients), err)
 			}
-		}(i, r)
+		}
+		wg.Add(1)
+		if !t.tc.lc.spawn(func() {
+			defer wg.Done()
+			deliver()
+		}) {
+			// Shutting down, so Deliver only records the attempt
+			// as pending.
+			deliver()
+			wg.Done()
+		}
 	}
 	wg.Wait()
 	return
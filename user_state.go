@@ -0,0 +1,272 @@
+// apcore is a server framework for implementing an ActivityPub application.
+// Copyright (C) 2019 Cory Slep
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package apcore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/go-fed/activity/pub"
+	"github.com/go-fed/activity/streams"
+	"github.com/go-fed/activity/streams/vocab"
+)
+
+// userState is the moderation and lifecycle state of a local user.
+type userState string
+
+const (
+	// userActive users have no restrictions.
+	userActive userState = "active"
+	// userSilenced users may log in and federate, but their activities
+	// are hidden from their public outbox.
+	userSilenced userState = "silenced"
+	// userSuspended users cannot log in, use OAuth2 tokens, or receive
+	// federated activities, and their actor is not served.
+	userSuspended userState = "suspended"
+	// userPendingDeletion users are suspended until their Delete has been
+	// federated and their actor replaced with a Tombstone.
+	userPendingDeletion userState = "pending_deletion"
+	// userDeleted users have a Tombstone in place of their actor.
+	userDeleted userState = "deleted"
+	// userPendingApproval users have registered, but cannot log in and
+	// their actor is not served until an administrator makes them active.
+	userPendingApproval userState = "pending_approval"
+)
+
+func toUserState(s string) (u userState, err error) {
+	u = userState(s)
+	switch u {
+	case userActive, userSilenced, userSuspended, userPendingDeletion, userDeleted, userPendingApproval:
+	default:
+		err = fmt.Errorf("unknown user state: %q", s)
+	}
+	return
+}
+
+// CanLogin determines whether the user may log in or use OAuth2 tokens.
+func (u userState) CanLogin() bool {
+	return u == userActive || u == userSilenced
+}
+
+// CanReceive determines whether federated activities may be delivered to the
+// user's inbox.
+func (u userState) CanReceive() bool {
+	return u == userActive || u == userSilenced
+}
+
+// ServesActor determines whether the user's actor may be served. Deleted
+// users are served, as their actor has been replaced by a Tombstone.
+func (u userState) ServesActor() bool {
+	return u == userActive || u == userSilenced || u == userDeleted
+}
+
+// userDeleter periodically replaces the actors of users pending deletion with
+// Tombstones, then federates their Delete to their followers. Their keys are
+// purged once every delivery of the Delete has finished.
+type userDeleter struct {
+	db         *apdb
+	p          *paths
+	tc         *transportController
+	federating bool
+	clock      pub.Clock
+	period     time.Duration
+	stopCh     chan struct{}
+	doneCh     chan struct{}
+}
+
+func newUserDeleter(c *config, a Application, db *apdb, p *paths, tc *transportController, clock pub.Clock) (u *userDeleter, err error) {
+	if c.ActivityPubConfig.UserDeletionPeriodSeconds <= 0 {
+		err = fmt.Errorf("user deletion period is <= 0")
+		return
+	}
+	u = &userDeleter{
+		db:         db,
+		p:          p,
+		tc:         tc,
+		federating: a.S2SEnabled(),
+		clock:      clock,
+		period:     time.Duration(c.ActivityPubConfig.UserDeletionPeriodSeconds) * time.Second,
+		stopCh:     make(chan struct{}),
+		doneCh:     make(chan struct{}),
+	}
+	return
+}
+
+func (u *userDeleter) start() {
+	go func() {
+		defer close(u.doneCh)
+		t := time.NewTicker(u.period)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				u.deletePending(context.Background())
+			case <-u.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (u *userDeleter) stop() {
+	close(u.stopCh)
+	<-u.doneCh
+}
+
+func (u *userDeleter) deletePending(c context.Context) {
+	us, err := u.db.UsersPendingDeletion(c)
+	if err != nil {
+		ErrorLogger.Errorf("Error fetching users pending deletion: %s", err)
+		return
+	}
+	for _, td := range us {
+		if err = u.deleteUser(c, td); err != nil {
+			ErrorLogger.Errorf("Error deleting user %s: %s", td.UserId, err)
+			continue
+		}
+		InfoLogger.Infof("Deleted user %s: %s", td.UserId, td.ActorIRI)
+	}
+	// Keys are purged in a later pass, once no delivery of the Delete is
+	// left pending.
+	ids, err := u.db.UsersPendingKeyPurge(c)
+	if err != nil {
+		ErrorLogger.Errorf("Error fetching deleted users with keys: %s", err)
+		return
+	}
+	for _, id := range ids {
+		if err = u.db.PurgeUserKeys(c, id); err != nil {
+			ErrorLogger.Errorf("Error purging keys of deleted user %s: %s", id, err)
+			continue
+		}
+		InfoLogger.Infof("Purged keys of deleted user %s", id)
+	}
+}
+
+func (u *userDeleter) deleteUser(c context.Context, td userToDelete) (err error) {
+	var t vocab.Type
+	if t, err = u.db.Get(c, td.ActorIRI); err != nil {
+		return
+	}
+	// The Delete is addressed while the actor still exists, but only
+	// delivered once the Tombstone is in place. The Tombstone keeps the
+	// actor's publicKey so the Delete can be verified, until the keys are
+	// purged after its deliveries finish. It is delivered directly, as the
+	// C2S side effects of a Delete would replace the actor before the
+	// Tombstone is written.
+	ctx := &ctx{c}
+	ctx.withUserPathUUID(td.UserId)
+	var tp *transport
+	var del []byte
+	var inboxes []*url.URL
+	if u.federating {
+		if tp, err = u.tc.ForUser(ctx.Context, u.p, td.UserId); err != nil {
+			return
+		}
+		if del, err = u.deleteActivity(ctx.Context, td); err != nil {
+			return
+		}
+		if inboxes, err = u.followerInboxes(ctx.Context, tp, td.UserId); err != nil {
+			return
+		}
+	}
+	tomb := streams.NewActivityStreamsTombstone()
+	id := streams.NewJSONLDIdProperty()
+	id.Set(td.ActorIRI)
+	tomb.SetJSONLDId(id)
+	ft := streams.NewActivityStreamsFormerTypeProperty()
+	ft.AppendXMLSchemaString(t.GetTypeName())
+	tomb.SetActivityStreamsFormerType(ft)
+	deleted := streams.NewActivityStreamsDeletedProperty()
+	deleted.Set(u.clock.Now())
+	tomb.SetActivityStreamsDeleted(deleted)
+	if err = u.db.TombstoneUser(c, td.UserId, tomb, t); err != nil || tp == nil {
+		return
+	}
+	err = tp.BatchDeliver(ctx.Context, del, inboxes)
+	return
+}
+
+// deleteActivity serializes the Delete of the user's actor, addressed to its
+// followers.
+func (u *userDeleter) deleteActivity(c context.Context, td userToDelete) (b []byte, err error) {
+	del := streams.NewActivityStreamsDelete()
+	var iri *url.URL
+	if iri, err = u.db.NewId(c, del); err != nil {
+		return
+	}
+	id := streams.NewJSONLDIdProperty()
+	id.Set(iri)
+	del.SetJSONLDId(id)
+	actor := streams.NewActivityStreamsActorProperty()
+	actor.AppendIRI(td.ActorIRI)
+	del.SetActivityStreamsActor(actor)
+	obj := streams.NewActivityStreamsObjectProperty()
+	obj.AppendIRI(td.ActorIRI)
+	del.SetActivityStreamsObject(obj)
+	to := streams.NewActivityStreamsToProperty()
+	to.AppendIRI(td.FollowersIRI)
+	del.SetActivityStreamsTo(to)
+	var m map[string]interface{}
+	if m, err = streams.Serialize(del); err != nil {
+		return
+	}
+	b, err = json.Marshal(m)
+	return
+}
+
+// followerInboxes dereferences the user's followers to find their inboxes.
+// Followers that cannot be dereferenced are skipped.
+func (u *userDeleter) followerInboxes(c context.Context, tp *transport, userId string) (inboxes []*url.URL, err error) {
+	var fc vocab.ActivityStreamsCollection
+	if fc, err = u.db.FollowersByUserUUID(c, userId); err != nil {
+		return
+	}
+	items := fc.GetActivityStreamsItems()
+	if items == nil {
+		return
+	}
+	seen := make(map[string]bool, 0)
+	for iter := items.Begin(); iter != items.End(); iter = iter.Next() {
+		var id *url.URL
+		if id, err = pub.ToId(iter); err != nil {
+			return
+		}
+		b, dErr := tp.Dereference(c, id)
+		if dErr != nil {
+			ErrorLogger.Errorf("Failed to dereference follower %s of deleted user %s: %s", id, userId, dErr)
+			continue
+		}
+		var m map[string]interface{}
+		if err = json.Unmarshal(b, &m); err != nil {
+			return
+		}
+		inbox, ok := m["inbox"].(string)
+		if !ok || seen[inbox] {
+			continue
+		}
+		seen[inbox] = true
+		var iu *url.URL
+		if iu, err = url.Parse(inbox); err != nil {
+			return
+		}
+		inboxes = append(inboxes, iu)
+	}
+	return
+}